@@ -0,0 +1,151 @@
+// Package main implements the metrics collector agent. It polls the Go runtime
+// statistics of the agent and, on Linux, host statistics from procfs and reports
+// them to the metric server.
+//
+// Usage:
+//
+//	agent [-server URL] [-poll-interval D] [-report-interval D] [-label k=v]...
+//	      [-concurrency N] [-batch-size N] [-gzip] [-format F] [-client-id ID] [-proc DIR] [-host=false]
+//
+// Every flag can also be set with an AGENT_ environment variable, e.g.
+// AGENT_SERVER or AGENT_LABELS=env=prod,dc=eu.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/agent"
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatalf("[agent] %v", err)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	server := fs.String("server", env("SERVER", "http://localhost:8080"), "Metric server URL")
+	pollInterval := fs.Duration("poll-interval", envDuration("POLL_INTERVAL", 2*time.Second), "How often metrics are collected")
+	reportInterval := fs.Duration("report-interval", envDuration("REPORT_INTERVAL", 10*time.Second), "How often metrics are reported")
+	concurrency := fs.Int("concurrency", envInt("CONCURRENCY", 1), "Number of concurrent report requests")
+	batchSize := fs.Int("batch-size", envInt("BATCH_SIZE", 500), "Maximum number of metrics per request")
+	useGzip := fs.Bool("gzip", env("GZIP", "") == "true", "Compress reports with gzip")
+	format := fs.String("format", env("FORMAT", "json"), "Report payload format: json, protobuf or msgpack")
+	clientID := fs.String("client-id", env("CLIENT_ID", ""), "Client ID sent with reports")
+	procRoot := fs.String("proc", env("PROC", "/proc"), "procfs mount point")
+	host := fs.Bool("host", env("HOST", strconv.FormatBool(runtime.GOOS == "linux")) == "true", "Collect host statistics from procfs")
+	logLevel := fs.String("log-level", env("LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+
+	labels := make(map[string]string)
+	if v := env("LABELS", ""); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			if err := addLabel(labels, pair); err != nil {
+				return err
+			}
+		}
+	}
+	fs.Func("label", "Label k=v added to every metric (repeatable)", func(v string) error {
+		return addLabel(labels, v)
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pollInterval <= 0 || *reportInterval <= 0 {
+		return errors.New("intervals must be positive")
+	}
+
+	lg, err := logger.New(config.Log{Level: *logLevel, Format: "text"})
+	if err != nil {
+		return err
+	}
+
+	formats := map[string]client.Format{
+		"json":     client.FormatJSON,
+		"protobuf": client.FormatProtobuf,
+		"msgpack":  client.FormatMsgpack,
+	}
+	f, ok := formats[*format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	opts := []client.Option{client.WithFormat(f)}
+	if *useGzip {
+		opts = append(opts, client.WithGzip())
+	}
+	if *clientID != "" {
+		opts = append(opts, client.WithClientID(*clientID))
+	}
+	c, err := client.New(*server, opts...)
+	if err != nil {
+		return err
+	}
+
+	collectors := []agent.Collector{agent.NewRuntimeCollector()}
+	if *host {
+		collectors = append(collectors, agent.NewProcCollector(*procRoot))
+	}
+
+	a := agent.New(agent.Config{
+		PollInterval:   *pollInterval,
+		ReportInterval: *reportInterval,
+		Labels:         labels,
+		Concurrency:    *concurrency,
+		BatchSize:      *batchSize,
+	}, c, collectors, lg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	lg.Info("agent started", slog.String("server", *server),
+		slog.Duration("poll_interval", *pollInterval), slog.Duration("report_interval", *reportInterval))
+
+	return a.Run(ctx)
+}
+
+func addLabel(labels map[string]string, pair string) error {
+	k, v, ok := strings.Cut(pair, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid label %q: expected name=value", pair)
+	}
+	labels[k] = v
+	return nil
+}
+
+func env(key, def string) string {
+	if v := os.Getenv("AGENT_" + key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(env(key, "")); err == nil {
+		return d
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(env(key, "")); err == nil {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// Supported push input formats.
+const (
+	formatAuto   = "auto"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// parseArgs parses metrics given as name=value arguments, all of the given
+// type and labels.
+func parseArgs(args []string, mtype string, labels map[string]string) ([]client.Metric, error) {
+	metrics := make([]client.Metric, 0, len(args))
+	for _, arg := range args {
+		name, raw, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid metric %q: expected name=value", arg)
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %q: %w", name, err)
+		}
+		metrics = append(metrics, client.Metric{Name: name, MType: mtype, Value: value, Labels: labels})
+	}
+	return metrics, nil
+}
+
+// parseInput reads metrics in the given format. The auto format picks JSON for
+// input starting with '[', NDJSON for input starting with '{' and CSV otherwise.
+func parseInput(r io.Reader, format string) ([]client.Metric, error) {
+	br := bufio.NewReader(r)
+
+	if format == formatAuto {
+		format = detectFormat(br)
+	}
+
+	switch format {
+	case formatJSON:
+		var metrics []client.Metric
+		if err := json.NewDecoder(br).Decode(&metrics); err != nil {
+			return nil, fmt.Errorf("invalid JSON input: %w", err)
+		}
+		return metrics, nil
+	case formatNDJSON:
+		return parseNDJSON(br)
+	case formatCSV:
+		return parseCSV(br)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func detectFormat(br *bufio.Reader) string {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return formatCSV
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+		case '[':
+			return formatJSON
+		case '{':
+			return formatNDJSON
+		default:
+			return formatCSV
+		}
+	}
+}
+
+func parseNDJSON(r io.Reader) ([]client.Metric, error) {
+	var metrics []client.Metric
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var m client.Metric
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("invalid NDJSON input on line %d: %w", line, err)
+		}
+		metrics = append(metrics, m)
+	}
+
+	return metrics, scanner.Err()
+}
+
+// parseCSV reads records of name,value[,type[,labels]] where labels are given as
+// k=v pairs separated by ';'. A first record whose value is not a number is
+// taken as a header and skipped.
+func parseCSV(r io.Reader) ([]client.Metric, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var metrics []client.Metric
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return metrics, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV input: %w", err)
+		}
+		if len(rec) < 2 || len(rec) > 4 {
+			return nil, fmt.Errorf("invalid CSV input on line %d: expected name,value[,type[,labels]]", line)
+		}
+
+		value, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid CSV input on line %d: %w", line, err)
+		}
+
+		m := client.Metric{Name: rec[0], Value: value}
+		if len(rec) > 2 {
+			m.MType = rec[2]
+		}
+		if len(rec) > 3 && rec[3] != "" {
+			if m.Labels, err = parseLabels(strings.Split(rec[3], ";")); err != nil {
+				return nil, fmt.Errorf("invalid CSV input on line %d: %w", line, err)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+}
+
+// parseLabels parses k=v pairs.
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: expected name=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+func TestParseInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		format   string
+		expected []client.Metric
+		wantErr  bool
+	}{
+		{
+			name:   "json array",
+			input:  ` [{"name":"cpu","type":"gauge","value":0.5,"labels":{"host":"a"}}]`,
+			format: formatAuto,
+			expected: []client.Metric{
+				{Name: "cpu", MType: "gauge", Value: 0.5, Labels: map[string]string{"host": "a"}},
+			},
+		},
+		{
+			name:   "ndjson",
+			input:  "{\"name\":\"cpu\",\"value\":1}\n\n{\"name\":\"mem\",\"value\":2}\n",
+			format: formatAuto,
+			expected: []client.Metric{
+				{Name: "cpu", Value: 1},
+				{Name: "mem", Value: 2},
+			},
+		},
+		{
+			name:   "csv with header, type and labels",
+			input:  "name,value,type,labels\ncpu,0.5,gauge,host=a;dc=eu\nrequests,3\n",
+			format: formatAuto,
+			expected: []client.Metric{
+				{Name: "cpu", MType: "gauge", Value: 0.5, Labels: map[string]string{"host": "a", "dc": "eu"}},
+				{Name: "requests", Value: 3},
+			},
+		},
+		{name: "csv invalid value", input: "cpu,1\nmem,x\n", format: formatCSV, wantErr: true},
+		{name: "invalid json", input: `[{"name":`, format: formatJSON, wantErr: true},
+		{name: "unknown format", input: "", format: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := parseInput(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, metrics)
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	metrics, err := parseArgs([]string{"cpu=0.5", "mem=1e3"}, "gauge", map[string]string{"host": "a"})
+	require.NoError(t, err)
+	require.Equal(t, []client.Metric{
+		{Name: "cpu", MType: "gauge", Value: 0.5, Labels: map[string]string{"host": "a"}},
+		{Name: "mem", MType: "gauge", Value: 1000, Labels: map[string]string{"host": "a"}},
+	}, metrics)
+
+	_, err = parseArgs([]string{"cpu"}, "gauge", nil)
+	require.Error(t, err)
+	_, err = parseArgs([]string{"cpu=high"}, "gauge", nil)
+	require.Error(t, err)
+}
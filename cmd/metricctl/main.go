@@ -0,0 +1,320 @@
+// Package main implements metricctl, a command line client for the metric server.
+//
+// Usage:
+//
+//	metricctl [-server URL] [-gzip] [-client-id ID] [-tenant-id ID] COMMAND [flags] [args]
+//
+// Commands:
+//
+//	push [-type T] [-label k=v]... [-format auto|json|ndjson|csv] [-file F] [name=value...]
+//	get [-prefix P] [-json] [NAME...]
+//	list
+//	query [-time T] EXPR
+//	tail [-match SELECTOR]... [NAME...]
+//	flush
+//	snapshot -out FILE [-prefix P] [-start T] [-end T]
+//	health
+//
+// Without name=value arguments or -file, push reads metrics from stdin.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "metricctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("metricctl", flag.ContinueOnError)
+	server := fs.String("server", envOr("METRICCTL_SERVER", "http://localhost:8080"), "Metric server URL")
+	useGzip := fs.Bool("gzip", false, "Compress pushed payloads with gzip")
+	clientID := fs.String("client-id", "", "Client ID sent with pushes")
+	tenantID := fs.String("tenant-id", "", "Tenant ID sent with pushes")
+	token := fs.String("token", envOr("METRICCTL_TOKEN", ""), "Admin token of the server, for flush and snapshot")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: metricctl [flags] push|get|list|query|tail|flush|snapshot|health [args]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command")
+	}
+
+	var opts []client.Option
+	if *useGzip {
+		opts = append(opts, client.WithGzip())
+	}
+	if *clientID != "" {
+		opts = append(opts, client.WithClientID(*clientID))
+	}
+	if *tenantID != "" {
+		opts = append(opts, client.WithTenantID(*tenantID))
+	}
+	if *token != "" {
+		opts = append(opts, client.WithToken(*token))
+	}
+
+	c, err := client.New(*server, opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "push":
+		return push(ctx, c, cmdArgs)
+	case "get":
+		return get(ctx, c, cmdArgs)
+	case "list":
+		return list(ctx, c)
+	case "query":
+		return query(ctx, c, cmdArgs)
+	case "tail":
+		return tail(ctx, c, cmdArgs)
+	case "flush":
+		n, err := c.Flush(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("flushed %d metrics\n", n)
+		return nil
+	case "snapshot":
+		return snapshot(ctx, c, cmdArgs)
+	case "health":
+		if err := c.Health(ctx); err != nil {
+			return err
+		}
+		fmt.Println("ok")
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func push(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	mtype := fs.String("type", "gauge", "Type of the metrics given as arguments")
+	var labels []string
+	fs.Func("label", "Label k=v of the metrics given as arguments (repeatable)", func(v string) error {
+		labels = append(labels, v)
+		return nil
+	})
+	format := fs.String("format", formatAuto, "Input format: auto, json, ndjson or csv")
+	file := fs.String("file", "", "Read metrics from this file instead of stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		metrics []client.Metric
+		err     error
+	)
+
+	switch {
+	case fs.NArg() > 0:
+		var l map[string]string
+		if l, err = parseLabels(labels); err != nil {
+			return err
+		}
+		metrics, err = parseArgs(fs.Args(), *mtype, l)
+	case *file != "":
+		var f *os.File
+		if f, err = os.Open(*file); err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		if *format == formatAuto {
+			*format = formatOf(*file)
+		}
+		metrics, err = parseInput(f, *format)
+	default:
+		metrics, err = parseInput(os.Stdin, *format)
+	}
+	if err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		return errors.New("no metrics to push")
+	}
+
+	if err = c.Push(ctx, metrics); err != nil {
+		return err
+	}
+	fmt.Printf("pushed %d metrics\n", len(metrics))
+	return nil
+}
+
+// formatOf guesses the input format from a file extension.
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".csv":
+		return formatCSV
+	default:
+		return formatAuto
+	}
+}
+
+func get(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "Only show series whose key starts with this prefix")
+	asJSON := fs.Bool("json", false, "Print JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	samples, err := c.Values(ctx, *prefix, fs.Args()...)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(samples)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SERIES\tVALUE\tUPDATED")
+	for _, s := range samples {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, formatValue(s.Value), s.Timestamp.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func list(ctx context.Context, c *client.Client) error {
+	names, err := c.Names(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func query(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	var ts time.Time
+	fs.Func("time", "Evaluation time as RFC3339 (default: now)", timeFlag(&ts))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: query [-time T] EXPR")
+	}
+
+	res, err := c.Query(ctx, fs.Arg(0), ts)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func tail(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	var selectors []string
+	fs.Func("match", "Series selector, e.g. cpu{host=\"a\"} (repeatable)", func(v string) error {
+		selectors = append(selectors, v)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	for _, name := range fs.Args() {
+		selectors = append(selectors, fmt.Sprintf("{__name__=%q}", name))
+	}
+
+	err := c.Stream(ctx, selectors, func(u client.Update) error {
+		fmt.Printf("%s %s %s\n", u.Timestamp.Format(time.RFC3339Nano), u.Key, formatValue(u.Value))
+		return nil
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func snapshot(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	out := fs.String("out", "", "Snapshot file to write")
+	prefix := fs.String("prefix", "", "Only include series whose key starts with this prefix")
+	var start, end time.Time
+	fs.Func("start", "Only include data at or after this RFC3339 time", timeFlag(&start))
+	fs.Func("end", "Only include data at or before this RFC3339 time", timeFlag(&end))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("missing -out")
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+
+	if err = c.Snapshot(ctx, f, *prefix, start, end); err != nil {
+		_ = f.Close()
+		_ = os.Remove(*out)
+		return err
+	}
+	return f.Close()
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// timeFlag parses an RFC3339 flag value into t.
+func timeFlag(t *time.Time) func(string) error {
+	return func(value string) error {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		*t = parsed
+		return nil
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/snapshot"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+// runCommand runs the subcommand named by args[0].
+func runCommand(ctx context.Context, cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "snapshot":
+		return runSnapshot(ctx, cfg, args[1:])
+	case "migrate":
+		return runMigrate(ctx, cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// connect creates the logger and connects to PostgreSQL without applying migrations.
+func connect(ctx context.Context, cfg *config.Config) (*slog.Logger, *storage.PostgresStorage, error) {
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := storage.NewPostgresStorage(ctx, cfg.PgDSN, log.With(slog.String("component", "postgres")))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return log, db, nil
+}
+
+// runMigrate applies, rolls back or lists the embedded schema migrations.
+func runMigrate(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	_, db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Printf("OK    up   %s\n", m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		m, err := db.MigrateDown(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("OK    down %s\n", m.Name)
+		return nil
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "APPLIED AT\tMIGRATION")
+		for _, m := range status {
+			appliedAt := "pending"
+			if m.Applied {
+				appliedAt = m.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", appliedAt, m.Name)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
+// runSnapshot exports or restores a snapshot of the PostgreSQL store directly,
+// without a running server. Values still held in a running server's memory are
+// only included by the GET /admin/snapshot endpoint.
+func runSnapshot(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: snapshot export|restore [flags]")
+	}
+
+	fs := flag.NewFlagSet("snapshot "+args[0], flag.ContinueOnError)
+	var f snapshot.Filter
+	fs.StringVar(&f.Prefix, "prefix", "", "Only include series whose key starts with this prefix")
+	fs.Func("start", "Only include data at or after this RFC3339 time", timeFlag(&f.Start))
+	fs.Func("end", "Only include data at or before this RFC3339 time", timeFlag(&f.End))
+	out := fs.String("out", "", "Snapshot file to write (export)")
+	in := fs.String("in", "", "Snapshot file to read (restore)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	log, db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	svc := snapshot.New(nil, db, log.With(slog.String("component", "snapshot")))
+
+	switch args[0] {
+	case "export":
+		if *out == "" {
+			return errors.New("missing -out")
+		}
+		return exportSnapshot(ctx, svc, *out, f)
+	case "restore":
+		if *in == "" {
+			return errors.New("missing -in")
+		}
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		_, err = svc.Restore(ctx, file, f)
+		return err
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+}
+
+// exportSnapshot writes the snapshot to a temporary file renamed into place
+// once complete, so that a failed export never leaves a partial file behind.
+func exportSnapshot(ctx context.Context, svc *snapshot.Service, path string, f snapshot.Filter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = svc.Export(ctx, tmp, f); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// timeFlag parses an RFC3339 flag value into t.
+func timeFlag(t *time.Time) func(string) error {
+	return func(value string) error {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		*t = parsed
+		return nil
+	}
+}
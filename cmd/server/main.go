@@ -1,8 +1,16 @@
 // Package main is the entry point of the application.
+//
+// Without arguments it runs the metric server. Subcommands given after the
+// flags run maintenance tasks with the same configuration:
+//
+//	snapshot export -out FILE [-prefix P] [-start T] [-end T]
+//	snapshot restore -in FILE [-prefix P] [-start T] [-end T]
+//	migrate up|down|status
 package main
 
 import (
 	"context"
+	"flag"
 	"log"
 
 	"github.com/sanchey92/metric-server/internal/app"
@@ -17,6 +25,13 @@ func main() {
 
 	ctx := context.Background()
 
+	if args := flag.Args(); len(args) > 0 {
+		if err = runCommand(ctx, cfg, args); err != nil {
+			log.Fatalf("[main] %s: %v", args[0], err)
+		}
+		return
+	}
+
 	application, err := app.New(ctx, cfg)
 	if err != nil {
 		log.Fatalf("[main] failed to initialize app: %v", err)
@@ -0,0 +1,334 @@
+// Package admin applies administrative changes to stored series: deleting the
+// series selected by metric name, key prefix or label matchers, resetting them
+// to zero and renaming metrics. Every change covers the latest values, raw
+// samples and rollups: it is applied to PostgreSQL in a single transaction and
+// then to memory, while flushes are held off, so that a failed change leaves
+// both stores as they were and no flush writes back what it removed.
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+)
+
+var (
+	// ErrInvalidSelector is returned for selectors not naming exactly one of
+	// a metric name, a prefix or matchers, or with matchers failing to parse.
+	ErrInvalidSelector = errors.New("invalid series selector")
+	// ErrInvalidName is returned when renaming to a name series cannot have.
+	ErrInvalidName = errors.New("invalid metric name")
+	// ErrConflict is returned when renaming to series that already exist.
+	ErrConflict = errors.New("series already exist")
+	// ErrUnavailable is returned by every change of a Service created with
+	// WithUnavailable.
+	ErrUnavailable = errors.New("series administration is only available on a single instance")
+)
+
+// MemStorage defines an interface for changing the in-memory series.
+type MemStorage interface {
+	Latest() []models.Sample
+	DeleteSeries(keys []string) int
+	ResetSeries(keys []string, at time.Time) int
+	RenameSeries(renames map[string]string) int
+}
+
+// Database defines an interface for changing the persisted series, each call
+// being applied in a single transaction.
+type Database interface {
+	SeriesKeys(ctx context.Context, prefix string) ([]string, error)
+	DeleteSeries(ctx context.Context, keys []string) (models.ExpireStats, error)
+	ResetSeries(ctx context.Context, keys []string, at time.Time) error
+	RenameSeries(ctx context.Context, renames map[string]string) error
+}
+
+// Flusher defines an interface for holding off flushes during a change, which
+// is given the history carried over from failed flushes and returns the
+// history to carry over instead.
+type Flusher interface {
+	Exclusive(fn func(carry []models.Sample) ([]models.Sample, error)) error
+}
+
+// Selector selects series by exactly one of: the metric name, a series key
+// prefix or PromQL series selectors, a series matching any of them.
+type Selector struct {
+	Name   string   `json:"name,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Match  []string `json:"match,omitempty"`
+}
+
+// DeleteResult reports the deleted series and the persisted rows removed with them.
+type DeleteResult struct {
+	Series []string           `json:"series"`
+	Rows   models.ExpireStats `json:"rows"`
+}
+
+// Service applies administrative changes to the series of both stores.
+type Service struct {
+	mem         MemStorage
+	db          Database
+	flusher     Flusher
+	onDelete    []func(keys []string)
+	unavailable bool
+}
+
+// Option configures optional Service behaviour.
+type Option func(*Service)
+
+// WithDeleteHook registers a function called with the keys of the series that
+// no longer exist after a deletion or a rename, e.g. to release their
+// cardinality budget.
+func WithDeleteHook(fn func(keys []string)) Option {
+	return func(s *Service) {
+		s.onDelete = append(s.onDelete, fn)
+	}
+}
+
+// WithUnavailable refuses every change with ErrUnavailable, for instances
+// not holding all the series in memory, such as the nodes of a cluster or
+// instances electing a leader, where a change would only apply to some of them.
+func WithUnavailable() Option {
+	return func(s *Service) {
+		s.unavailable = true
+	}
+}
+
+// New creates a Service changing the series of mem and db, holding off the flushes of flusher.
+func New(mem MemStorage, db Database, flusher Flusher, opts ...Option) *Service {
+	s := &Service{mem: mem, db: db, flusher: flusher}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Delete deletes the selected series from memory and PostgreSQL, including
+// their history and rollups.
+func (s *Service) Delete(ctx context.Context, sel Selector) (DeleteResult, error) {
+	res := DeleteResult{Series: []string{}}
+	if s.unavailable {
+		return res, ErrUnavailable
+	}
+
+	keys, err := s.selectKeys(ctx, sel)
+	if err != nil || len(keys) == 0 {
+		return res, err
+	}
+
+	deleted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deleted[key] = true
+	}
+
+	err = s.flusher.Exclusive(func(carry []models.Sample) ([]models.Sample, error) {
+		if res.Rows, err = s.db.DeleteSeries(ctx, keys); err != nil {
+			return nil, err
+		}
+		s.mem.DeleteSeries(keys)
+
+		return slices.DeleteFunc(carry, func(sample models.Sample) bool { return deleted[sample.Key] }), nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	s.deleted(keys)
+	res.Series = keys
+	return res, nil
+}
+
+// Reset sets the selected series to zero, as of now, in memory and PostgreSQL,
+// recording the reset in their history. It returns the keys of the series reset.
+func (s *Service) Reset(ctx context.Context, sel Selector) ([]string, error) {
+	if s.unavailable {
+		return []string{}, ErrUnavailable
+	}
+
+	keys, err := s.selectKeys(ctx, sel)
+	if err != nil || len(keys) == 0 {
+		return []string{}, err
+	}
+
+	at := time.Now().UTC()
+	err = s.flusher.Exclusive(func(carry []models.Sample) ([]models.Sample, error) {
+		if err := s.db.ResetSeries(ctx, keys, at); err != nil {
+			return nil, err
+		}
+		s.mem.ResetSeries(keys, at)
+
+		return carry, nil
+	})
+	if err != nil {
+		return []string{}, err
+	}
+
+	return keys, nil
+}
+
+// Rename renames every series of the metric from to the metric to, keeping
+// their labels, in memory and PostgreSQL. It refuses with ErrConflict if any
+// of the renamed series already exists, and returns the new key of every
+// renamed series by its old key. The new name must be one clients may write,
+// see models.ValidName.
+func (s *Service) Rename(ctx context.Context, from, to string) (map[string]string, error) {
+	if s.unavailable {
+		return nil, ErrUnavailable
+	}
+	if from == "" || !models.ValidName(to) {
+		return nil, ErrInvalidName
+	}
+
+	// Series are selected while flushes are held off, so that none is written
+	// to PostgreSQL between the conflict check and the rename.
+	var (
+		keys    []string
+		renames = make(map[string]string)
+	)
+	err := s.flusher.Exclusive(func(carry []models.Sample) ([]models.Sample, error) {
+		var err error
+		if keys, err = s.selectKeys(ctx, Selector{Name: from}); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 || from == to {
+			return carry, nil
+		}
+
+		existing, err := s.selectKeys(ctx, Selector{Name: to})
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			renames[key] = to + key[len(from):]
+			if _, found := slices.BinarySearch(existing, renames[key]); found {
+				return nil, fmt.Errorf("%w: %s", ErrConflict, renames[key])
+			}
+		}
+
+		if err := s.db.RenameSeries(ctx, renames); err != nil {
+			return nil, err
+		}
+		s.mem.RenameSeries(renames)
+
+		for i, sample := range carry {
+			if key, ok := renames[sample.Key]; ok {
+				carry[i].Key = key
+			}
+		}
+		return carry, nil
+	})
+	if err != nil || len(renames) == 0 {
+		return renames, err
+	}
+
+	s.deleted(keys)
+	return renames, nil
+}
+
+func (s *Service) deleted(keys []string) {
+	for _, fn := range s.onDelete {
+		fn(keys)
+	}
+}
+
+// selectKeys returns the sorted keys of the series in memory or PostgreSQL
+// matching the selector.
+func (s *Service) selectKeys(ctx context.Context, sel Selector) ([]string, error) {
+	match, prefix, err := sel.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	persisted, err := s.db.SeriesKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if !seen[key] && match(key) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, sample := range s.mem.Latest() {
+		add(sample.Key)
+	}
+	for _, key := range persisted {
+		add(key)
+	}
+
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// compile returns the predicate of the selector over series keys, together
+// with a prefix of all the keys it matches.
+func (sel Selector) compile() (func(key string) bool, string, error) {
+	set := 0
+	for _, ok := range []bool{sel.Name != "", sel.Prefix != "", len(sel.Match) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, "", fmt.Errorf("%w: exactly one of name, prefix or match is required", ErrInvalidSelector)
+	}
+
+	switch {
+	case sel.Name != "":
+		return func(key string) bool { return seriesName(key) == sel.Name }, sel.Name, nil
+	case sel.Prefix != "":
+		return func(key string) bool { return strings.HasPrefix(key, sel.Prefix) }, sel.Prefix, nil
+	}
+
+	filters := make([][]*promql.Matcher, 0, len(sel.Match))
+	for _, m := range sel.Match {
+		matchers, err := promql.ParseSelector(m)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrInvalidSelector, err)
+		}
+		filters = append(filters, matchers)
+	}
+
+	return func(key string) bool {
+		name, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return false
+		}
+		for _, matchers := range filters {
+			if matchAll(matchers, name, labels) {
+				return true
+			}
+		}
+		return false
+	}, "", nil
+}
+
+func matchAll(matchers []*promql.Matcher, name string, labels map[string]string) bool {
+	for _, m := range matchers {
+		v := labels[m.Name]
+		if m.Name == "__name__" {
+			v = name
+		}
+		if !m.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesName returns the metric name part of a series key.
+func seriesName(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
@@ -0,0 +1,355 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/flusher"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+// fakeDB is a persisted store keeping the latest value and the raw samples of every series.
+type fakeDB struct {
+	mu      sync.Mutex
+	latest  map[string]models.Sample
+	samples []models.Sample
+	err     error
+	// onSeriesKeys, if set, is called on every series selection.
+	onSeriesKeys func()
+}
+
+func newFakeDB(latest ...models.Sample) *fakeDB {
+	db := &fakeDB{latest: make(map[string]models.Sample)}
+	for _, s := range latest {
+		db.latest[s.Key] = s
+		db.samples = append(db.samples, s)
+	}
+	return db
+}
+
+func (db *fakeDB) SeriesKeys(_ context.Context, prefix string) ([]string, error) {
+	if db.onSeriesKeys != nil {
+		db.onSeriesKeys()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var keys []string
+	for key := range db.latest {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (db *fakeDB) DeleteSeries(_ context.Context, keys []string) (models.ExpireStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.err != nil {
+		return models.ExpireStats{}, db.err
+	}
+
+	var stats models.ExpireStats
+	for _, key := range keys {
+		if _, ok := db.latest[key]; ok {
+			delete(db.latest, key)
+			stats.Series++
+		}
+	}
+	db.samples = slices.DeleteFunc(db.samples, func(s models.Sample) bool {
+		if slices.Contains(keys, s.Key) {
+			stats.Samples++
+			return true
+		}
+		return false
+	})
+	return stats, nil
+}
+
+func (db *fakeDB) ResetSeries(_ context.Context, keys []string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := db.latest[key]; ok {
+			db.latest[key] = models.Sample{Key: key, Timestamp: at}
+			db.samples = append(db.samples, db.latest[key])
+		}
+	}
+	return db.err
+}
+
+func (db *fakeDB) RenameSeries(_ context.Context, renames map[string]string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for from, to := range renames {
+		if s, ok := db.latest[from]; ok {
+			delete(db.latest, from)
+			s.Key = to
+			db.latest[to] = s
+		}
+	}
+	for i, s := range db.samples {
+		if to, ok := renames[s.Key]; ok {
+			db.samples[i].Key = to
+		}
+	}
+	return db.err
+}
+
+func (db *fakeDB) Save(_ context.Context, current, history []models.Sample, _ []models.IdempotencyKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.err != nil {
+		return db.err
+	}
+	for _, s := range current {
+		db.latest[s.Key] = s
+	}
+	db.samples = append(db.samples, history...)
+	return nil
+}
+
+func (db *fakeDB) keys() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keys := make([]string, 0, len(db.latest))
+	for key := range db.latest {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func newFlusher(mem *storage.MemStorage, db *fakeDB) *flusher.Flusher {
+	return flusher.New(time.Hour, mem, db, flusher.WithLogger(slog.New(slog.DiscardHandler)))
+}
+
+func keysOf(samples []models.Sample) []string {
+	keys := make([]string, len(samples))
+	for i, s := range samples {
+		keys[i] = s.Key
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestService_Delete(t *testing.T) {
+	ts := time.Unix(1_700_000_000, 0).UTC()
+
+	tests := []struct {
+		name     string
+		selector Selector
+		expected []string
+		err      error
+	}{
+		{
+			name:     "by name",
+			selector: Selector{Name: "cpu"},
+			expected: []string{`cpu{host="a"}`, `cpu{host="b"}`},
+		},
+		{
+			name:     "by prefix",
+			selector: Selector{Prefix: "cpu"},
+			expected: []string{"cpu_temp", `cpu{host="a"}`, `cpu{host="b"}`},
+		},
+		{
+			name:     "by matchers",
+			selector: Selector{Match: []string{`{host="b"}`, "cpu_temp"}},
+			expected: []string{"cpu_temp", `cpu{host="b"}`},
+		},
+		{
+			name:     "persisted only",
+			selector: Selector{Name: "legacy"},
+			expected: []string{"legacy"},
+		},
+		{
+			name:     "nothing selected",
+			selector: Selector{Name: "missing"},
+			expected: []string{},
+		},
+		{
+			name:     "no criteria",
+			selector: Selector{},
+			err:      ErrInvalidSelector,
+		},
+		{
+			name:     "several criteria",
+			selector: Selector{Name: "cpu", Prefix: "cpu"},
+			err:      ErrInvalidSelector,
+		},
+		{
+			name:     "invalid matcher",
+			selector: Selector{Match: []string{"cpu{"}},
+			err:      ErrInvalidSelector,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := storage.NewMemStorage(4)
+			mem.SetBatch([]models.Metric{
+				{Name: "cpu", Value: 1, Labels: map[string]string{"host": "a"}},
+				{Name: "cpu", Value: 2, Labels: map[string]string{"host": "b"}},
+				{Name: "cpu_temp", Value: 40},
+			})
+			db := newFakeDB(models.Sample{Key: `cpu{host="a"}`, Value: 1, Timestamp: ts},
+				models.Sample{Key: "legacy", Value: 5, Timestamp: ts})
+
+			var forgotten []string
+			s := New(mem, db, newFlusher(mem, db),
+				WithDeleteHook(func(keys []string) { forgotten = append(forgotten, keys...) }))
+
+			res, err := s.Delete(context.Background(), tt.selector)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, res.Series)
+
+			for _, key := range tt.expected {
+				require.NotContains(t, keysOf(mem.Latest()), key)
+				require.NotContains(t, db.keys(), key)
+			}
+			if len(tt.expected) > 0 {
+				require.Equal(t, tt.expected, forgotten)
+			}
+		})
+	}
+}
+
+func TestService_DeleteFailure(t *testing.T) {
+	mem := storage.NewMemStorage(4)
+	mem.SetBatch([]models.Metric{{Name: "cpu", Value: 1}})
+	db := newFakeDB()
+	db.err = errors.New("db down")
+
+	_, err := New(mem, db, newFlusher(mem, db)).Delete(context.Background(), Selector{Name: "cpu"})
+	require.Error(t, err)
+	require.Equal(t, 1, mem.Len(), "memory is left alone when the database change fails")
+}
+
+func TestService_Unavailable(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewMemStorage(4)
+	mem.SetBatch([]models.Metric{{Name: "cpu", Value: 1}})
+	db := newFakeDB()
+	s := New(mem, db, newFlusher(mem, db), WithUnavailable())
+
+	_, err := s.Delete(ctx, Selector{Name: "cpu"})
+	require.ErrorIs(t, err, ErrUnavailable)
+	_, err = s.Reset(ctx, Selector{Name: "cpu"})
+	require.ErrorIs(t, err, ErrUnavailable)
+	_, err = s.Rename(ctx, "cpu", "cpu_usage")
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.Equal(t, []string{"cpu"}, keysOf(mem.Latest()))
+}
+
+func TestService_Reset(t *testing.T) {
+	ts := time.Unix(1_700_000_000, 0).UTC()
+	mem := storage.NewMemStorage(4)
+	mem.SetBatch([]models.Metric{{Name: "requests", Value: 10, Timestamp: ts.UnixMilli()}})
+	db := newFakeDB(models.Sample{Key: "requests", Value: 8, Timestamp: ts.Add(-time.Minute)})
+
+	keys, err := New(mem, db, newFlusher(mem, db)).Reset(context.Background(), Selector{Name: "requests"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"requests"}, keys)
+
+	latest := mem.Latest()
+	require.Len(t, latest, 1)
+	require.Zero(t, latest[0].Value)
+	require.True(t, latest[0].Timestamp.After(ts))
+	require.Zero(t, db.latest["requests"].Value)
+}
+
+func TestService_Rename(t *testing.T) {
+	ctx := context.Background()
+	ts := time.Unix(1_700_000_000, 0).UTC()
+
+	mem := storage.NewMemStorage(4)
+	db := newFakeDB(models.Sample{Key: `load{host="a"}`, Value: 1, Timestamp: ts})
+	f := newFlusher(mem, db)
+	s := New(mem, db, f)
+
+	// A sample of a failed flush, carried over to the next one.
+	mem.SetBatch([]models.Metric{
+		{Name: "load", Value: 2, Labels: map[string]string{"host": "b"}, Timestamp: ts.UnixMilli()},
+	})
+	db.err = errors.New("db down")
+	_, err := f.Flush(ctx)
+	require.Error(t, err)
+	db.err = nil
+
+	for _, to := range []string{"", `load{x="y"}`, "_self_x"} {
+		_, err = s.Rename(ctx, "load", to)
+		require.ErrorIs(t, err, ErrInvalidName, to)
+	}
+
+	renamed, err := s.Rename(ctx, "load", "system_load")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		`load{host="a"}`: `system_load{host="a"}`,
+		`load{host="b"}`: `system_load{host="b"}`,
+	}, renamed)
+
+	_, err = f.Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{`system_load{host="a"}`, `system_load{host="b"}`}, db.keys())
+	for _, sample := range db.samples {
+		require.True(t, strings.HasPrefix(sample.Key, "system_load"), sample.Key)
+	}
+
+	// Renaming onto existing series is refused.
+	mem.SetBatch([]models.Metric{{Name: "load", Value: 3, Labels: map[string]string{"host": "a"}}})
+	_, err = s.Rename(ctx, "load", "system_load")
+	require.ErrorIs(t, err, ErrConflict)
+	require.Equal(t, []string{`load{host="a"}`, `system_load{host="b"}`}, keysOf(mem.Latest()))
+}
+
+// exclusiveFlusher tracks whether a change holds off flushes.
+type exclusiveFlusher struct {
+	Flusher
+	held bool
+}
+
+func (f *exclusiveFlusher) Exclusive(fn func(carry []models.Sample) ([]models.Sample, error)) error {
+	return f.Flusher.Exclusive(func(carry []models.Sample) ([]models.Sample, error) {
+		f.held = true
+		defer func() { f.held = false }()
+		return fn(carry)
+	})
+}
+
+func TestService_RenameSelectsWhileFlushesHeldOff(t *testing.T) {
+	mem := storage.NewMemStorage(4)
+	mem.SetBatch([]models.Metric{{Name: "load", Value: 1}})
+	db := newFakeDB()
+	f := &exclusiveFlusher{Flusher: newFlusher(mem, db)}
+
+	selections := 0
+	db.onSeriesKeys = func() {
+		require.True(t, f.held, "series selected while flushes may run")
+		selections++
+	}
+
+	renamed, err := New(mem, db, f).Rename(context.Background(), "load", "system_load")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"load": "system_load"}, renamed)
+	require.Equal(t, 2, selections)
+}
@@ -0,0 +1,178 @@
+// Package agent implements a metrics collector that polls Go runtime and host
+// statistics and reports them to the metric server's ingestion endpoint.
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// shutdownTimeout bounds the final report sent when the agent stops.
+const shutdownTimeout = 5 * time.Second
+
+// Collector defines an interface for a source of metrics polled by the agent.
+type Collector interface {
+	Collect() ([]models.Metric, error)
+}
+
+// Pusher defines an interface for sending a batch of metrics to the server.
+type Pusher interface {
+	Push(ctx context.Context, metrics []models.Metric) error
+}
+
+// Config holds the agent settings.
+type Config struct {
+	// PollInterval is how often the collectors are polled.
+	PollInterval time.Duration
+	// ReportInterval is how often the latest values are sent.
+	ReportInterval time.Duration
+	// Labels are added to every metric that does not already set them.
+	Labels map[string]string
+	// Concurrency is the number of batches sent in parallel.
+	Concurrency int
+	// BatchSize is the maximum number of metrics per request.
+	BatchSize int
+}
+
+// Agent polls its collectors and reports the latest value of every series.
+type Agent struct {
+	cfg        Config
+	pusher     Pusher
+	collectors []Collector
+	log        *slog.Logger
+
+	mu     sync.Mutex
+	latest map[string]models.Metric
+}
+
+// job is a batch handed to a sender.
+type job struct {
+	ctx     context.Context
+	metrics []models.Metric
+}
+
+// New creates a new Agent reporting the metrics of the given collectors through pusher.
+func New(cfg Config, pusher Pusher, collectors []Collector, log *slog.Logger) *Agent {
+	cfg.Concurrency = max(cfg.Concurrency, 1)
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+
+	return &Agent{
+		cfg:        cfg,
+		pusher:     pusher,
+		collectors: collectors,
+		log:        log.With(slog.String("component", "agent")),
+		latest:     make(map[string]models.Metric),
+	}
+}
+
+// Run polls and reports on the configured intervals until ctx is canceled,
+// then sends a final report and waits for the senders to finish.
+func (a *Agent) Run(ctx context.Context) error {
+	jobs := make(chan job)
+
+	var wg sync.WaitGroup
+	for range a.cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				a.send(j)
+			}
+		}()
+	}
+
+	pollTicker := time.NewTicker(a.cfg.PollInterval)
+	defer pollTicker.Stop()
+	reportTicker := time.NewTicker(a.cfg.ReportInterval)
+	defer reportTicker.Stop()
+
+	a.poll()
+
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+			a.poll()
+			a.report(final, jobs)
+			close(jobs)
+			wg.Wait()
+			cancel()
+			return nil
+		case <-pollTicker.C:
+			a.poll()
+		case <-reportTicker.C:
+			a.report(ctx, jobs)
+		}
+	}
+}
+
+// poll collects the metrics of every collector, adding the configured labels.
+func (a *Agent) poll() {
+	var collected []models.Metric
+	for _, c := range a.collectors {
+		metrics, err := c.Collect()
+		if err != nil {
+			a.log.Warn("failed to collect metrics", logger.Err(err))
+			continue
+		}
+		collected = append(collected, metrics...)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, m := range collected {
+		m.Labels = a.withLabels(m.Labels)
+		a.latest[m.Key()] = m
+	}
+}
+
+// withLabels returns labels extended with the configured labels it does not set.
+func (a *Agent) withLabels(labels map[string]string) map[string]string {
+	if len(a.cfg.Labels) == 0 {
+		return labels
+	}
+
+	out := make(map[string]string, len(labels)+len(a.cfg.Labels))
+	for k, v := range a.cfg.Labels {
+		out[k] = v
+	}
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+// report hands the latest values to the senders in batches.
+func (a *Agent) report(ctx context.Context, jobs chan<- job) {
+	a.mu.Lock()
+	metrics := make([]models.Metric, 0, len(a.latest))
+	for _, m := range a.latest {
+		metrics = append(metrics, m)
+	}
+	a.mu.Unlock()
+
+	for start := 0; start < len(metrics); start += a.cfg.BatchSize {
+		batch := metrics[start:min(start+a.cfg.BatchSize, len(metrics))]
+		select {
+		case jobs <- job{ctx: ctx, metrics: batch}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) send(j job) {
+	if err := a.pusher.Push(j.ctx, j.metrics); err != nil {
+		a.log.Warn("failed to report metrics", slog.Int("count", len(j.metrics)), logger.Err(err))
+		return
+	}
+	a.log.Debug("reported metrics", slog.Int("count", len(j.metrics)))
+}
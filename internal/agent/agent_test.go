@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/http-server/handler"
+	"github.com/sanchey92/metric-server/internal/http-server/router"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// pollCounter reports how many times it was polled.
+type pollCounter struct {
+	n atomic.Int64
+}
+
+func (c *pollCounter) Collect() ([]models.Metric, error) {
+	n := c.n.Add(1)
+	return []models.Metric{
+		{Name: "polls", MType: client.TypeCounter, Value: float64(n)},
+		{Name: "up", MType: client.TypeGauge, Value: 1, Labels: map[string]string{"env": "test"}},
+	}, nil
+}
+
+func TestAgent_Run(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mem := storage.NewMemStorage(4)
+	srv := httptest.NewServer(router.New(log, handler.New(mem)))
+	defer srv.Close()
+
+	c, err := client.New(srv.URL, client.WithGzip())
+	require.NoError(t, err)
+
+	collector := &pollCounter{}
+	a := New(Config{
+		PollInterval:   5 * time.Millisecond,
+		ReportInterval: 20 * time.Millisecond,
+		Labels:         map[string]string{"host": "a", "env": "prod"},
+		Concurrency:    2,
+		BatchSize:      1,
+	}, c, []Collector{collector}, log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return mem.Snapshot()[`up{env="test",host="a"}`] == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	// The final report sends the last poll.
+	require.Equal(t, float64(collector.n.Load()), mem.Snapshot()[`polls{env="prod",host="a"}`])
+}
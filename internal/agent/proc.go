@@ -0,0 +1,294 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// userHZ is the kernel clock tick rate used by /proc/stat on Linux.
+const userHZ = 100
+
+// sectorSize is the unit of the sector counts in /proc/diskstats.
+const sectorSize = 512
+
+// cpuModes names the columns of the cpu lines of /proc/stat.
+var cpuModes = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal"}
+
+// ProcCollector collects Linux host statistics from procfs: CPU times and
+// utilization, memory, load average, disk and network I/O.
+type ProcCollector struct {
+	root string
+
+	// prevCPU holds the CPU times of the previous poll, to compute utilization.
+	prevCPU map[string][]uint64
+}
+
+// NewProcCollector creates a ProcCollector reading procfs mounted at root, usually "/proc".
+func NewProcCollector(root string) *ProcCollector {
+	return &ProcCollector{root: root}
+}
+
+// Collect reads the current host statistics. Utilization is only reported from
+// the second call on, as it is computed over the time between two calls.
+func (c *ProcCollector) Collect() ([]models.Metric, error) {
+	var metrics []models.Metric
+
+	for _, read := range []func([]models.Metric) ([]models.Metric, error){
+		c.cpu, c.memory, c.load, c.disks, c.network,
+	} {
+		var err error
+		if metrics, err = read(metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	return metrics, nil
+}
+
+func (c *ProcCollector) read(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(c.root, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// cpu reads the cpu lines of /proc/stat.
+func (c *ProcCollector) cpu(metrics []models.Metric) ([]models.Metric, error) {
+	data, err := c.read("stat")
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string][]uint64)
+	for _, fields := range lines(data) {
+		if len(fields) < len(cpuModes)+1 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		cpu := fields[0]
+		if cpu == "cpu" {
+			cpu = "total"
+		}
+
+		times, err := parseUints(fields[1 : len(cpuModes)+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid stat line of %s: %w", fields[0], err)
+		}
+		current[cpu] = times
+
+		for i, mode := range cpuModes {
+			metrics = append(metrics, counter("host_cpu_seconds_total", float64(times[i])/userHZ, "cpu", cpu, "mode", mode))
+		}
+
+		if prev, ok := c.prevCPU[cpu]; ok {
+			if ratio, ok := utilization(prev, times); ok {
+				metrics = append(metrics, gauge("host_cpu_utilization_ratio", ratio, "cpu", cpu))
+			}
+		}
+	}
+	c.prevCPU = current
+
+	return metrics, nil
+}
+
+// utilization returns the busy share of the CPU time elapsed between two readings.
+func utilization(prev, cur []uint64) (float64, bool) {
+	var total, idle uint64
+	for i := range cur {
+		if cur[i] < prev[i] {
+			return 0, false
+		}
+		d := cur[i] - prev[i]
+		total += d
+		if cpuModes[i] == "idle" || cpuModes[i] == "iowait" {
+			idle += d
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(total-idle) / float64(total), true
+}
+
+// memoryFields maps /proc/meminfo fields to metric names.
+var memoryFields = map[string]string{
+	"MemTotal":     "host_memory_total_bytes",
+	"MemFree":      "host_memory_free_bytes",
+	"MemAvailable": "host_memory_available_bytes",
+	"Buffers":      "host_memory_buffers_bytes",
+	"Cached":       "host_memory_cached_bytes",
+	"SwapTotal":    "host_swap_total_bytes",
+	"SwapFree":     "host_swap_free_bytes",
+}
+
+// memory reads /proc/meminfo.
+func (c *ProcCollector) memory(metrics []models.Metric) ([]models.Metric, error) {
+	data, err := c.read("meminfo")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range lines(data) {
+		if len(fields) < 2 {
+			continue
+		}
+		name, ok := memoryFields[strings.TrimSuffix(fields[0], ":")]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid meminfo line of %s: %w", fields[0], err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		metrics = append(metrics, gauge(name, value))
+	}
+
+	return metrics, nil
+}
+
+// load reads /proc/loadavg.
+func (c *ProcCollector) load(metrics []models.Metric) ([]models.Metric, error) {
+	data, err := c.read("loadavg")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid loadavg %q", data)
+	}
+	for i, name := range []string{"host_load1", "host_load5", "host_load15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loadavg: %w", err)
+		}
+		metrics = append(metrics, gauge(name, value))
+	}
+
+	return metrics, nil
+}
+
+// disks reads /proc/diskstats, skipping loop and RAM devices.
+func (c *ProcCollector) disks(metrics []models.Metric) ([]models.Metric, error) {
+	data, err := c.read("diskstats")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range lines(data) {
+		if len(fields) < 10 {
+			continue
+		}
+		device := fields[2]
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			continue
+		}
+
+		// reads completed, reads merged, sectors read, ms reading,
+		// writes completed, writes merged, sectors written.
+		v, err := parseUints(fields[3:10])
+		if err != nil {
+			return nil, fmt.Errorf("invalid diskstats line of %s: %w", device, err)
+		}
+		metrics = append(metrics,
+			counter("host_disk_reads_completed_total", float64(v[0]), "device", device),
+			counter("host_disk_read_bytes_total", float64(v[2]*sectorSize), "device", device),
+			counter("host_disk_writes_completed_total", float64(v[4]), "device", device),
+			counter("host_disk_written_bytes_total", float64(v[6]*sectorSize), "device", device),
+		)
+	}
+
+	return metrics, nil
+}
+
+// network reads /proc/net/dev.
+func (c *ProcCollector) network(metrics []models.Metric) ([]models.Metric, error) {
+	data, err := c.read(filepath.Join("net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		iface, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		device := strings.TrimSpace(iface)
+		fields := strings.Fields(rest)
+		if len(fields) < 11 {
+			continue
+		}
+
+		// Receive bytes, packets, errs, then transmit bytes, packets, errs from column 8.
+		v, err := parseUints([]string{fields[0], fields[1], fields[2], fields[8], fields[9], fields[10]})
+		if err != nil {
+			return nil, fmt.Errorf("invalid net/dev line of %s: %w", device, err)
+		}
+		metrics = append(metrics,
+			counter("host_network_receive_bytes_total", float64(v[0]), "device", device),
+			counter("host_network_receive_packets_total", float64(v[1]), "device", device),
+			counter("host_network_receive_errors_total", float64(v[2]), "device", device),
+			counter("host_network_transmit_bytes_total", float64(v[3]), "device", device),
+			counter("host_network_transmit_packets_total", float64(v[4]), "device", device),
+			counter("host_network_transmit_errors_total", float64(v[5]), "device", device),
+		)
+	}
+
+	return metrics, nil
+}
+
+// lines splits a procfs file into the fields of its non-empty lines.
+func lines(data []byte) [][]string {
+	var out [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			out = append(out, fields)
+		}
+	}
+	return out
+}
+
+func parseUints(fields []string) ([]uint64, error) {
+	out := make([]uint64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func gauge(name string, value float64, labels ...string) models.Metric {
+	return metric(name, client.TypeGauge, value, labels)
+}
+
+func counter(name string, value float64, labels ...string) models.Metric {
+	return metric(name, client.TypeCounter, value, labels)
+}
+
+// metric builds a metric from alternating label names and values.
+func metric(name, mtype string, value float64, labels []string) models.Metric {
+	m := models.Metric{Name: name, MType: mtype, Value: value}
+	if len(labels) > 0 {
+		m.Labels = make(map[string]string, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			m.Labels[labels[i]] = labels[i+1]
+		}
+	}
+	return m
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+const (
+	statBefore = `cpu  100 0 100 700 100 0 0 0 0 0
+cpu0 100 0 100 700 100 0 0 0 0 0
+intr 12345
+`
+	statAfter = `cpu  160 0 140 790 110 0 0 0 0 0
+cpu0 160 0 140 790 110 0 0 0 0 0
+intr 12400
+`
+	meminfo = `MemTotal:        2048 kB
+MemFree:          512 kB
+MemAvailable:    1024 kB
+Buffers:          128 kB
+Cached:           256 kB
+SwapTotal:          0 kB
+SwapFree:           0 kB
+Dirty:             12 kB
+`
+	loadavg   = "0.50 0.25 0.10 1/123 4567\n"
+	diskstats = `   7       0 loop0 10 0 20 0 0 0 0 0 0 0 0
+   8       0 sda 100 5 2000 30 50 2 400 10 0 40 40
+`
+	netdev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0:    5000      50    1    0    0     0          0         0     3000      30    2    0    0     0       0          0
+`
+)
+
+func writeProc(t *testing.T, root, stat string) {
+	t.Helper()
+
+	files := map[string]string{
+		"stat":      stat,
+		"meminfo":   meminfo,
+		"loadavg":   loadavg,
+		"diskstats": diskstats,
+		"net/dev":   netdev,
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+func TestProcCollector_Collect(t *testing.T) {
+	root := t.TempDir()
+	writeProc(t, root, statBefore)
+	c := NewProcCollector(root)
+
+	first, err := c.Collect()
+	require.NoError(t, err)
+	values := byKey(first)
+	require.NotContains(t, values, `host_cpu_utilization_ratio{cpu="total"}`)
+
+	writeProc(t, root, statAfter)
+	second, err := c.Collect()
+	require.NoError(t, err)
+	values = byKey(second)
+
+	expected := map[string]float64{
+		`host_cpu_seconds_total{cpu="total",mode="user"}`: 1.6,
+		`host_cpu_seconds_total{cpu="cpu0",mode="idle"}`:  7.9,
+		// 200 ticks elapsed, 100 of them idle or iowait.
+		`host_cpu_utilization_ratio{cpu="total"}`:           0.5,
+		`host_cpu_utilization_ratio{cpu="cpu0"}`:            0.5,
+		`host_memory_total_bytes`:                           2048 * 1024,
+		`host_memory_available_bytes`:                       1024 * 1024,
+		`host_swap_free_bytes`:                              0,
+		`host_load1`:                                        0.5,
+		`host_load15`:                                       0.1,
+		`host_disk_reads_completed_total{device="sda"}`:     100,
+		`host_disk_read_bytes_total{device="sda"}`:          2000 * 512,
+		`host_disk_written_bytes_total{device="sda"}`:       400 * 512,
+		`host_network_receive_bytes_total{device="eth0"}`:   5000,
+		`host_network_transmit_errors_total{device="eth0"}`: 2,
+		`host_network_transmit_packets_total{device="lo"}`:  10,
+	}
+	for key, value := range expected {
+		require.Contains(t, values, key)
+		require.InDelta(t, value, values[key], 1e-9, key)
+	}
+	require.NotContains(t, values, `host_disk_reads_completed_total{device="loop0"}`)
+	require.NotContains(t, values, `host_memory_dirty_bytes`)
+}
+
+func TestProcCollector_MissingFiles(t *testing.T) {
+	_, err := NewProcCollector(t.TempDir()).Collect()
+	require.Error(t, err)
+}
+
+func TestRuntimeCollector_Collect(t *testing.T) {
+	metrics, err := NewRuntimeCollector().Collect()
+	require.NoError(t, err)
+
+	values := byKey(metrics)
+	require.Greater(t, values["go_goroutines"], 0.0)
+	require.Contains(t, values, "go_memstats_heap_alloc_bytes")
+	require.Contains(t, values, "go_gc_heap_allocs_bytes")
+	for _, m := range metrics {
+		require.Regexp(t, `^[a-zA-Z_][a-zA-Z0-9_]*$`, m.Name)
+	}
+}
+
+func byKey(metrics []models.Metric) map[string]float64 {
+	out := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		out[m.Key()] = m.Value
+	}
+	return out
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// RuntimeCollector collects Go runtime statistics of the agent process from
+// runtime.MemStats and the scalar metrics of runtime/metrics.
+type RuntimeCollector struct {
+	samples []metrics.Sample
+	kinds   []string
+}
+
+// NewRuntimeCollector creates a RuntimeCollector for every scalar metric
+// supported by the running Go version.
+func NewRuntimeCollector() *RuntimeCollector {
+	c := &RuntimeCollector{}
+	for _, d := range metrics.All() {
+		if d.Kind != metrics.KindUint64 && d.Kind != metrics.KindFloat64 {
+			continue
+		}
+		kind := client.TypeGauge
+		if d.Cumulative {
+			kind = client.TypeCounter
+		}
+		c.samples = append(c.samples, metrics.Sample{Name: d.Name})
+		c.kinds = append(c.kinds, kind)
+	}
+	return c
+}
+
+// Collect reads the current runtime statistics.
+func (c *RuntimeCollector) Collect() ([]models.Metric, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	out := []models.Metric{
+		gauge("go_goroutines", float64(runtime.NumGoroutine())),
+		gauge("go_memstats_alloc_bytes", float64(ms.Alloc)),
+		counter("go_memstats_alloc_bytes_total", float64(ms.TotalAlloc)),
+		gauge("go_memstats_sys_bytes", float64(ms.Sys)),
+		counter("go_memstats_lookups_total", float64(ms.Lookups)),
+		counter("go_memstats_mallocs_total", float64(ms.Mallocs)),
+		counter("go_memstats_frees_total", float64(ms.Frees)),
+		gauge("go_memstats_heap_alloc_bytes", float64(ms.HeapAlloc)),
+		gauge("go_memstats_heap_sys_bytes", float64(ms.HeapSys)),
+		gauge("go_memstats_heap_idle_bytes", float64(ms.HeapIdle)),
+		gauge("go_memstats_heap_inuse_bytes", float64(ms.HeapInuse)),
+		gauge("go_memstats_heap_released_bytes", float64(ms.HeapReleased)),
+		gauge("go_memstats_heap_objects", float64(ms.HeapObjects)),
+		gauge("go_memstats_stack_inuse_bytes", float64(ms.StackInuse)),
+		gauge("go_memstats_stack_sys_bytes", float64(ms.StackSys)),
+		gauge("go_memstats_mspan_inuse_bytes", float64(ms.MSpanInuse)),
+		gauge("go_memstats_mcache_inuse_bytes", float64(ms.MCacheInuse)),
+		gauge("go_memstats_gc_sys_bytes", float64(ms.GCSys)),
+		gauge("go_memstats_other_sys_bytes", float64(ms.OtherSys)),
+		gauge("go_memstats_next_gc_bytes", float64(ms.NextGC)),
+		gauge("go_memstats_last_gc_time_seconds", float64(ms.LastGC)/1e9),
+		counter("go_memstats_gc_pause_seconds_total", float64(ms.PauseTotalNs)/1e9),
+		counter("go_memstats_gc_total", float64(ms.NumGC)),
+		counter("go_memstats_forced_gc_total", float64(ms.NumForcedGC)),
+		gauge("go_memstats_gc_cpu_fraction", ms.GCCPUFraction),
+	}
+
+	metrics.Read(c.samples)
+	for i, s := range c.samples {
+		var value float64
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			value = float64(s.Value.Uint64())
+		case metrics.KindFloat64:
+			value = s.Value.Float64()
+		default:
+			continue
+		}
+		out = append(out, models.Metric{Name: runtimeMetricName(s.Name), MType: c.kinds[i], Value: value})
+	}
+
+	return out, nil
+}
+
+// runtimeMetricName turns a runtime/metrics name such as "/gc/heap/allocs:bytes"
+// into a metric name such as "go_gc_heap_allocs_bytes".
+func runtimeMetricName(name string) string {
+	var b strings.Builder
+	b.WriteString("go")
+	underscore := false
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			if underscore {
+				b.WriteByte('_')
+				underscore = false
+			}
+			b.WriteRune(r)
+		default:
+			underscore = true
+		}
+	}
+	return b.String()
+}
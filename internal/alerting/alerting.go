@@ -0,0 +1,274 @@
+// Package alerting evaluates alerting rules against current metric values and
+// notifies webhooks when alerts start or stop firing. Every series returned by
+// a rule's PromQL expression is an alert: it is pending while the series keeps
+// being returned for less than the rule's "for" duration, then firing, and it
+// is resolved as soon as the series disappears from the result.
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+)
+
+// nameLabel is the label holding the alerting rule name.
+const nameLabel = "alertname"
+
+// Querier defines an interface for evaluating instant queries.
+type Querier interface {
+	Instant(ctx context.Context, query string, ts time.Time) (promql.Value, error)
+}
+
+// Notifier defines an interface for delivering alert state changes.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert)
+}
+
+// State is the state of an alert.
+type State string
+
+// Alert states.
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// Alert is one series returned by an alerting rule.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	State       State             `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// rule is a compiled alerting rule with its active alerts by label key.
+type rule struct {
+	cfg         config.AlertRule
+	annotations map[string]*template.Template
+	active      map[string]*Alert
+}
+
+// templateData is the data available to annotation templates.
+type templateData struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Manager evaluates alerting rules periodically and keeps track of their alerts.
+type Manager struct {
+	interval time.Duration
+	querier  Querier
+	notifier Notifier
+	active   func() bool
+	log      *slog.Logger
+
+	mu    sync.RWMutex
+	rules []*rule
+}
+
+// Option configures optional Manager behavior.
+type Option func(*Manager)
+
+// WithActive only evaluates the rules while active reports true, such as on
+// the leader of several instances sharing the database, which alone holds the
+// series of all of them.
+func WithActive(active func() bool) Option {
+	return func(m *Manager) {
+		m.active = active
+	}
+}
+
+// NewManager validates the rules and creates a Manager evaluating them every interval.
+// Annotations are Go templates with the alert's .Labels and .Value.
+func NewManager(
+	interval time.Duration, rules []config.AlertRule, querier Querier, notifier Notifier, log *slog.Logger,
+	opts ...Option,
+) (*Manager, error) {
+	m := &Manager{interval: interval, querier: querier, notifier: notifier, log: log}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	for _, cfg := range rules {
+		if cfg.Alert == "" {
+			return nil, fmt.Errorf("alerting rule without name")
+		}
+		if _, err := promql.Parse(cfg.Expr); err != nil {
+			return nil, fmt.Errorf("alerting rule %q: %w", cfg.Alert, err)
+		}
+
+		r := &rule{cfg: cfg, annotations: make(map[string]*template.Template), active: make(map[string]*Alert)}
+		for name, text := range cfg.Annotations {
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("alerting rule %q: annotation %q: %w", cfg.Alert, name, err)
+			}
+			r.annotations[name] = tmpl
+		}
+
+		m.rules = append(m.rules, r)
+	}
+
+	return m, nil
+}
+
+// Run evaluates the rules on every tick until the context is canceled.
+func (m *Manager) Run(ctx context.Context) error {
+	if len(m.rules) == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			m.Eval(ctx, time.Now().UTC())
+		}
+	}
+}
+
+// Eval evaluates every rule at the given time and notifies about alerts that
+// started firing or were resolved. A rule whose query fails keeps its alerts
+// unchanged. While inactive, the alerts are dropped without notification, the
+// active instance being the one to evaluate and notify them.
+func (m *Manager) Eval(ctx context.Context, now time.Time) {
+	var changed []Alert
+
+	m.mu.Lock()
+	if m.active != nil && !m.active() {
+		for _, r := range m.rules {
+			clear(r.active)
+		}
+		m.mu.Unlock()
+		return
+	}
+	for _, r := range m.rules {
+		v, err := m.querier.Instant(ctx, r.cfg.Expr, now)
+		if err != nil {
+			m.log.Warn("alerting rule evaluation failed", slog.String("rule", r.cfg.Alert), logger.Err(err))
+			continue
+		}
+
+		vec, ok := v.(promql.Vector)
+		if !ok {
+			m.log.Warn("alerting rule must return an instant vector",
+				slog.String("rule", r.cfg.Alert), slog.String("type", string(v.Type())))
+			continue
+		}
+
+		changed = append(changed, r.eval(vec, now)...)
+	}
+	m.mu.Unlock()
+
+	if len(changed) > 0 && m.notifier != nil {
+		m.notifier.Notify(ctx, changed)
+	}
+}
+
+// eval updates the rule's alerts from the query result and returns copies of
+// the alerts that changed to firing or resolved.
+func (r *rule) eval(vec promql.Vector, now time.Time) []Alert {
+	var changed []Alert
+	seen := make(map[string]bool, len(vec))
+
+	for _, s := range vec {
+		labels := make(map[string]string, len(s.Metric)+len(r.cfg.Labels)+1)
+		for k, v := range s.Metric {
+			if k != "__name__" {
+				labels[k] = v
+			}
+		}
+		for k, v := range r.cfg.Labels {
+			labels[k] = v
+		}
+		labels[nameLabel] = r.cfg.Alert
+
+		key := models.SeriesKey("", labels)
+		seen[key] = true
+
+		a, ok := r.active[key]
+		if !ok {
+			a = &Alert{Labels: labels, State: StatePending, ActiveAt: now}
+			r.active[key] = a
+		}
+		a.Value = s.Point.V
+		a.Annotations = r.expand(labels, a.Value)
+
+		if a.State == StatePending && now.Sub(a.ActiveAt) >= r.cfg.For {
+			firedAt := now
+			a.State, a.FiredAt = StateFiring, &firedAt
+			changed = append(changed, *a)
+		}
+	}
+
+	for key, a := range r.active {
+		if seen[key] {
+			continue
+		}
+
+		delete(r.active, key)
+		if a.State == StateFiring {
+			resolvedAt := now
+			a.State, a.ResolvedAt = StateResolved, &resolvedAt
+			changed = append(changed, *a)
+		}
+	}
+
+	return changed
+}
+
+// expand renders the annotation templates, falling back to the raw text on error.
+func (r *rule) expand(labels map[string]string, value float64) map[string]string {
+	annotations := make(map[string]string, len(r.annotations))
+	data := templateData{Labels: labels, Value: value}
+
+	for name, tmpl := range r.annotations {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			annotations[name] = r.cfg.Annotations[name]
+			continue
+		}
+		annotations[name] = b.String()
+	}
+
+	return annotations
+}
+
+// Alerts returns the pending and firing alerts ordered by rule and labels.
+func (m *Manager) Alerts() []Alert {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	alerts := []Alert{}
+	for _, r := range m.rules {
+		keys := make([]string, 0, len(r.active))
+		for key := range r.active {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			alerts = append(alerts, *r.active[key])
+		}
+	}
+
+	return alerts
+}
@@ -0,0 +1,168 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/promql"
+)
+
+// fakeQuerier returns the configured vector for every query.
+type fakeQuerier struct {
+	result promql.Vector
+}
+
+func (f *fakeQuerier) Instant(context.Context, string, time.Time) (promql.Value, error) {
+	return f.result, nil
+}
+
+// recorder collects notified alerts.
+type recorder struct {
+	alerts []Alert
+}
+
+func (r *recorder) Notify(_ context.Context, alerts []Alert) {
+	r.alerts = append(r.alerts, alerts...)
+}
+
+func sample(instance string, v float64) promql.Sample {
+	return promql.Sample{Metric: promql.Labels{"__name__": "cpu", "instance": instance}, Point: promql.Point{V: v}}
+}
+
+func TestManager_Eval(t *testing.T) {
+	q := &fakeQuerier{}
+	n := &recorder{}
+
+	m, err := NewManager(time.Minute, []config.AlertRule{{
+		Alert:       "HighCPU",
+		Expr:        "cpu > 0.9",
+		For:         2 * time.Minute,
+		Labels:      map[string]string{"severity": "page"},
+		Annotations: map[string]string{"summary": "{{ .Labels.instance }} at {{ .Value }}"},
+	}}, q, n, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	start := time.Unix(1_700_000_000, 0).UTC()
+	ctx := context.Background()
+
+	// The alert becomes pending first.
+	q.result = promql.Vector{sample("a", 0.95)}
+	m.Eval(ctx, start)
+	alerts := m.Alerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, StatePending, alerts[0].State)
+	require.Equal(t, map[string]string{"alertname": "HighCPU", "instance": "a", "severity": "page"}, alerts[0].Labels)
+	require.Equal(t, "a at 0.95", alerts[0].Annotations["summary"])
+	require.Empty(t, n.alerts)
+
+	// It fires once it has been active for the "for" duration.
+	q.result = promql.Vector{sample("a", 0.97)}
+	m.Eval(ctx, start.Add(2*time.Minute))
+	require.Equal(t, StateFiring, m.Alerts()[0].State)
+	require.Len(t, n.alerts, 1)
+	require.Equal(t, StateFiring, n.alerts[0].State)
+	require.Equal(t, 0.97, n.alerts[0].Value)
+
+	// Staying active does not notify again.
+	m.Eval(ctx, start.Add(3*time.Minute))
+	require.Len(t, n.alerts, 1)
+
+	// A pending alert that disappears is dropped silently, a firing one is resolved.
+	q.result = promql.Vector{sample("b", 0.99)}
+	m.Eval(ctx, start.Add(4*time.Minute))
+	require.Len(t, n.alerts, 2)
+	require.Equal(t, StateResolved, n.alerts[1].State)
+	require.NotNil(t, n.alerts[1].ResolvedAt)
+
+	q.result = nil
+	m.Eval(ctx, start.Add(5*time.Minute))
+	require.Len(t, n.alerts, 2)
+	require.Empty(t, m.Alerts())
+}
+
+func TestManager_EvalInactive(t *testing.T) {
+	q := &fakeQuerier{result: promql.Vector{sample("a", 0.95)}}
+	n := &recorder{}
+
+	var active atomic.Bool
+	m, err := NewManager(time.Minute, []config.AlertRule{{Alert: "HighCPU", Expr: "cpu > 0.9"}}, q, n,
+		slog.New(slog.DiscardHandler), WithActive(active.Load))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	start := time.Unix(1_700_000_000, 0).UTC()
+
+	m.Eval(ctx, start)
+	require.Empty(t, m.Alerts(), "inactive instances do not evaluate rules")
+
+	active.Store(true)
+	m.Eval(ctx, start.Add(time.Minute))
+	require.Len(t, n.alerts, 1)
+	require.Len(t, m.Alerts(), 1)
+
+	// Alerts are left to the instance taking over.
+	active.Store(false)
+	m.Eval(ctx, start.Add(2*time.Minute))
+	require.Empty(t, m.Alerts())
+	require.Len(t, n.alerts, 1)
+}
+
+func TestNewManager_InvalidRule(t *testing.T) {
+	_, err := NewManager(time.Minute, []config.AlertRule{{Alert: "Broken", Expr: "sum("}}, &fakeQuerier{}, nil, slog.Default())
+	require.Error(t, err)
+
+	_, err = NewManager(time.Minute, []config.AlertRule{{Expr: "cpu"}}, &fakeQuerier{}, nil, slog.Default())
+	require.Error(t, err)
+}
+
+func TestWebhook_Send(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		expectedCalls int32
+		wantErr       bool
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, expectedCalls: 1},
+		{name: "retried after server error", statuses: []int{http.StatusBadGateway, http.StatusNoContent}, expectedCalls: 2},
+		{name: "gives up after max retries", statuses: []int{500, 500, 500}, expectedCalls: 3, wantErr: true},
+		{name: "client error not retried", statuses: []int{http.StatusBadRequest}, expectedCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var p Payload
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+				require.Equal(t, "firing", p.Status)
+
+				i := calls.Add(1) - 1
+				w.WriteHeader(tt.statuses[min(int(i), len(tt.statuses)-1)])
+			}))
+			defer srv.Close()
+
+			d := NewDispatcher([]config.Webhook{{URL: srv.URL, MaxRetries: 2, Backoff: time.Millisecond}}, nil, slog.Default())
+
+			body, err := json.Marshal(Payload{Status: "firing"})
+			require.NoError(t, err)
+
+			err = d.webhooks[0].send(context.Background(), body)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedCalls, calls.Load())
+		})
+	}
+}
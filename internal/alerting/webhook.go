@@ -0,0 +1,180 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Webhook delivery defaults applied to unset configuration values.
+const (
+	DefaultWebhookTimeout = 10 * time.Second
+	DefaultMaxRetries     = 3
+	DefaultBackoff        = time.Second
+)
+
+// queueSize bounds the number of notifications waiting for delivery.
+const queueSize = 64
+
+// errPermanent marks a delivery failure that retrying cannot fix.
+var errPermanent = errors.New("permanent failure")
+
+// Payload is the JSON body posted to webhooks. Status is "firing" if any of the
+// alerts is firing and "resolved" otherwise.
+type Payload struct {
+	Status string  `json:"status"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// webhook is a configured notification endpoint.
+type webhook struct {
+	url        string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Dispatcher delivers notifications to webhooks in the background so that slow
+// or failing endpoints never delay rule evaluation.
+type Dispatcher struct {
+	webhooks []webhook
+	queue    chan []Alert
+	log      *slog.Logger
+
+	results *telemetry.CounterVec
+}
+
+// NewDispatcher creates a Dispatcher for the given webhooks. A zero timeout,
+// retry count or backoff takes the package default; negative MaxRetries disables retries.
+func NewDispatcher(cfgs []config.Webhook, reg *telemetry.Registry, log *slog.Logger) *Dispatcher {
+	d := &Dispatcher{
+		queue: make(chan []Alert, queueSize),
+		log:   log,
+		results: reg.CounterVec("metric_server_alert_notifications_total",
+			"Total number of alert notifications by delivery result.", "result"),
+	}
+
+	for _, cfg := range cfgs {
+		w := webhook{
+			url:        cfg.URL,
+			client:     &http.Client{Timeout: cfg.Timeout},
+			maxRetries: cfg.MaxRetries,
+			backoff:    cfg.Backoff,
+		}
+		if w.client.Timeout <= 0 {
+			w.client.Timeout = DefaultWebhookTimeout
+		}
+		if w.maxRetries == 0 {
+			w.maxRetries = DefaultMaxRetries
+		}
+		if w.backoff <= 0 {
+			w.backoff = DefaultBackoff
+		}
+		d.webhooks = append(d.webhooks, w)
+	}
+
+	return d
+}
+
+// Notify implements Notifier by queueing the alerts for delivery. When the
+// queue is full the notification is dropped.
+func (d *Dispatcher) Notify(_ context.Context, alerts []Alert) {
+	if len(d.webhooks) == 0 {
+		return
+	}
+
+	select {
+	case d.queue <- alerts:
+	default:
+		d.results.With("dropped").Inc()
+		d.log.Warn("alert notification queue full, dropping notification", slog.Int("alerts", len(alerts)))
+	}
+}
+
+// Run delivers queued notifications until the context is canceled.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case alerts := <-d.queue:
+			d.deliver(ctx, alerts)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, alerts []Alert) {
+	payload := Payload{Status: string(StateResolved), Alerts: alerts}
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			payload.Status = string(StateFiring)
+			break
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.log.Error("failed to encode alert notification", logger.Err(err))
+		return
+	}
+
+	for _, w := range d.webhooks {
+		if err = w.send(ctx, body); err != nil {
+			d.results.With("failed").Inc()
+			d.log.Error("alert notification failed", slog.String("url", w.url), logger.Err(err))
+			continue
+		}
+		d.results.With("sent").Inc()
+	}
+}
+
+// send posts the body, retrying transient failures with exponential backoff.
+func (w webhook) send(ctx context.Context, body []byte) error {
+	backoff := w.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := w.post(ctx, body)
+		if err == nil || errors.Is(err, errPermanent) || attempt >= w.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: webhook returned %s", errPermanent, resp.Status)
+	}
+
+	return fmt.Errorf("webhook returned %s", resp.Status)
+}
@@ -4,48 +4,311 @@ package app
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/sanchey92/metric-server/internal/admin"
+	"github.com/sanchey92/metric-server/internal/alerting"
+	"github.com/sanchey92/metric-server/internal/cluster"
 	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/dedup"
+	"github.com/sanchey92/metric-server/internal/election"
 	"github.com/sanchey92/metric-server/internal/flusher"
+	"github.com/sanchey92/metric-server/internal/forward"
+	"github.com/sanchey92/metric-server/internal/http-server/handler"
+	"github.com/sanchey92/metric-server/internal/http-server/router"
 	"github.com/sanchey92/metric-server/internal/http-server/server"
+	"github.com/sanchey92/metric-server/internal/limits"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/recording"
+	"github.com/sanchey92/metric-server/internal/relabel"
+	"github.com/sanchey92/metric-server/internal/replication"
+	"github.com/sanchey92/metric-server/internal/retention"
+	"github.com/sanchey92/metric-server/internal/rollup"
+	"github.com/sanchey92/metric-server/internal/snapshot"
 	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/internal/stream"
+	"github.com/sanchey92/metric-server/internal/telemetry"
 )
 
 // App is the main application struct that orchestrates the HTTP server,
 // metrics flusher, and database storage components.
 // It manages their lifecycle and handles graceful shutdown.
 type App struct {
-	server  *server.Server
-	flusher *flusher.Flusher
-	db      *storage.PostgresStorage
-	errCh   chan error
+	server     *server.Server
+	flusher    *flusher.Flusher
+	feeder     *telemetry.Feeder
+	rollup     *rollup.Job
+	retention  *retention.Job
+	alerts     *alerting.Manager
+	dispatcher *alerting.Dispatcher
+	forwarder  *forward.Manager
+	hub        *stream.Hub
+	primary    *replication.Primary
+	replica    *replication.Replica
+	elector    *election.Elector
+	db         *storage.PostgresStorage
+	log        *slog.Logger
+	errCh      chan error
+	// flushed is closed once the flusher has returned after its final flush.
+	flushed chan struct{}
 }
 
 // New creates and initializes a new App instance.
-// It sets up the memory storage, database connection, HTTP server, and metrics flusher.
+// It sets up the memory storage, database connection, HTTP server, metrics flusher
+// and the logger and self-instrumentation registry shared by all of them.
 func New(ctx context.Context, cfg *config.Config) (*App, error) {
-	memStorage := storage.NewMemStorage()
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(log)
+
+	reg := telemetry.NewRegistry()
+
+	policy, err := retention.NewPolicy(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+
+	memStorage := storage.NewMemStorage(cfg.Memory.Shards, storage.WithOutOfOrderWindow(policy.OutOfOrderWindow))
+	memStorage.Instrument(reg)
+
+	var dbOpts []storage.PostgresOption
+	if cfg.Migrations.AutoApply {
+		dbOpts = append(dbOpts, storage.WithMigrations())
+	}
+
+	db, err := storage.NewPostgresStorage(ctx, cfg.PgDSN, log.With(slog.String("component", "postgres")), dbOpts...)
+	if err != nil {
+		return nil, err
+	}
+	db.Instrument(reg)
+
+	// Keys persisted before a restart keep retries of requests applied by then safe.
+	dedupCache := dedup.New(cfg.Idempotency, reg)
+	keys, err := db.IdempotencyKeys(ctx, dedupCache.MaxKeys())
+	if err != nil {
+		return nil, err
+	}
+	dedupCache.Load(keys)
+
+	// With leader election, only the leader writes to PostgreSQL; background
+	// jobs writing to it and alerting, which needs the series of all instances,
+	// are gated on leadership and flushes go through the elector.
+	var (
+		elector *election.Elector
+		sink    flusher.PostgresStorage = db
+		leader                          = func() bool { return true }
+	)
+	if cfg.Election.Enabled {
+		elector, err = election.New(cfg.Election, election.Postgres(db), memStorage, dedupCache, reg,
+			log.With(slog.String("component", "election")), election.WithToken(cfg.Admin.Token))
+		if err != nil {
+			return nil, err
+		}
+		sink, leader = elector, elector.Leader
+	}
+
+	handlerOpts := []handler.Option{
+		handler.WithTelemetry(reg),
+		handler.WithMaxFuture(maxFuture(cfg)),
+		handler.WithDeduplicator(dedupCache),
+	}
+	routerOpts := []router.Option{router.WithTelemetry(telemetryPath(cfg), reg.Handler())}
+
+	var (
+		rollupJob   *rollup.Job
+		resolutions []rollup.Resolution
+	)
+	if cfg.Rollup.Enabled {
+		if resolutions, err = rollup.Resolutions(cfg.Rollup.Resolutions); err != nil {
+			return nil, err
+		}
+		rollupJob = rollup.NewJob(db, resolutions, log.With(slog.String("component", "rollup")),
+			rollup.WithActive(leader))
+	}
+	handlerOpts = append(handlerOpts, handler.WithHistory(rollup.NewReader(db, resolutions)))
+
+	retentionInterval := cfg.Retention.Interval
+	if retentionInterval <= 0 {
+		retentionInterval = 10 * time.Minute
+	}
+	// The limiter tracks the series written to memory by any means, not only
+	// those admitted from clients.
+	limiter := limits.New(cfg.Cardinality, reg)
+	memStorage.AddListener(limiter.Track)
+	retentionJob := retention.NewJob(retentionInterval, cfg.Retention.DryRun, policy, memStorage, db,
+		log.With(slog.String("component", "retention")),
+		retention.WithExpireHook(limiter.Forget),
+		retention.WithHistoryActive(leader),
+	)
+
+	// In a cluster, queries and current values read the series of all nodes.
+	var latest handler.ValueReader = memStorage
+	if len(cfg.Cluster.Nodes) > 0 {
+		var nodes *cluster.Cluster
+		nodes, err = cluster.New(cfg.Cluster, memStorage, reg, log.With(slog.String("component", "cluster")),
+			cluster.WithToken(cfg.Admin.Token))
+		if err != nil {
+			return nil, err
+		}
+		latest = nodes
+		handlerOpts = append(handlerOpts, handler.WithCluster(nodes))
+		routerOpts = append(routerOpts, router.WithCluster(cluster.ValuesPath, nodes))
+	}
+	queryEngine := promql.NewEngine(promql.NewStorage(db, latest))
 
-	db, err := storage.NewPostgresStorage(ctx, cfg.PgDSN)
+	alertInterval := cfg.Alerting.Interval
+	if alertInterval <= 0 {
+		alertInterval = 30 * time.Second
+	}
+	alertLog := log.With(slog.String("component", "alerting"))
+	dispatcher := alerting.NewDispatcher(cfg.Alerting.Webhooks, reg, alertLog)
+	alerts, err := alerting.NewManager(alertInterval, cfg.Rules.Alerts,
+		promql.NewEngine(promql.NewStorage(nil, memStorage)), dispatcher, alertLog, alerting.WithActive(leader))
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := relabel.New(cfg.Relabel, reg)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := server.New(cfg, memStorage)
+	forwarder, err := forward.New(cfg.Forwarding, reg, log.With(slog.String("component", "forward")))
 	if err != nil {
 		return nil, err
 	}
 
-	f := flusher.New(cfg.FlushInterval, memStorage, db)
+	recorder, err := recording.New(cfg.Rules.Records, queryEngine, memStorage, reg,
+		log.With(slog.String("component", "recording")))
+	if err != nil {
+		return nil, err
+	}
+
+	flusherOpts := []flusher.Option{
+		flusher.WithTelemetry(reg),
+		flusher.WithIdempotencyKeys(dedupCache),
+		flusher.WithBeforeFlush(func(ctx context.Context) {
+			// Followers only hold part of the series, rules are evaluated on the leader.
+			if leader() {
+				recorder.Eval(ctx, time.Now().UTC())
+			}
+		}),
+		flusher.WithLogger(log.With(slog.String("component", "flusher"))),
+	}
+
+	// With a replication role, the instance streams its changes so that
+	// replicas can follow it, a replica once promoted; without one, the store
+	// builds no changes to stream. A replica only writes and flushes once promoted.
+	var (
+		primary *replication.Primary
+		replica *replication.Replica
+	)
+	replLog := log.With(slog.String("component", "replication"))
+	switch cfg.Replication.Role {
+	case "":
+	case replication.RolePrimary, replication.RoleReplica:
+		primary = replication.NewPrimary(cfg.Replication, memStorage, reg, replLog)
+		memStorage.AddMutationListener(primary.Publish)
+		if cfg.Replication.Role == replication.RolePrimary {
+			break
+		}
+
+		replica, err = replication.NewReplica(cfg.Replication, memStorage, reg, replLog,
+			replication.WithToken(cfg.Admin.Token))
+		if err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, handler.WithReplica(replica))
+		flusherOpts = append(flusherOpts, flusher.WithActive(func() bool { return !replica.ReadOnly() }))
+	default:
+		return nil, fmt.Errorf("unknown replication role %q", cfg.Replication.Role)
+	}
+
+	f := flusher.New(cfg.FlushInterval, memStorage, sink, flusherOpts...)
+
+	// Series administration changes the memory of the instance it is sent to,
+	// so it is refused where other instances hold series too.
+	adminOpts := []admin.Option{admin.WithDeleteHook(limiter.Forget)}
+	if len(cfg.Cluster.Nodes) > 0 || elector != nil {
+		adminOpts = append(adminOpts, admin.WithUnavailable())
+	}
+
+	hub := stream.NewHub(cfg.Stream.BufferSize, reg)
+	memStorage.AddListener(hub.Publish)
+
+	handlerOpts = append(handlerOpts,
+		handler.WithPipeline(pipeline),
+		handler.WithForwarder(forwarder),
+		handler.WithRetention(retentionJob),
+		handler.WithLimiter(limiter),
+		handler.WithQueryEngine(queryEngine),
+		handler.WithAlerts(alerts),
+		handler.WithStream(hub, cfg.Stream.Heartbeat),
+		handler.WithStreamOrigins(cfg.Stream.AllowedOrigins...),
+		handler.WithSnapshots(snapshot.New(memStorage, db, log.With(slog.String("component", "snapshot")))),
+		handler.WithHealthCheck(db),
+		handler.WithValues(latest),
+		handler.WithFlusher(f),
+		handler.WithSeriesAdmin(admin.New(memStorage, db, f, adminOpts...)),
+	)
+
+	h := handler.New(memStorage, handlerOpts...)
+	routerOpts = append(routerOpts,
+		router.WithAdminToken(cfg.Admin.Token),
+		router.WithSeriesAdmin(h),
+		router.WithHistory(h.HandleHistory),
+		router.WithRetentionReport(h.HandleRetentionReport),
+		router.WithSnapshots(h.HandleSnapshot, h.HandleRestore),
+		router.WithCardinality(h.HandleCardinality),
+		router.WithQueryAPI(h),
+		router.WithAlerts(h.HandleAlerts),
+		router.WithStream(h.HandleStream),
+		router.WithOps(h),
+	)
+	if primary != nil {
+		routerOpts = append(routerOpts, router.WithReplication(h.HandlePromote, replication.StreamPath, primary))
+	}
+	if elector != nil {
+		routerOpts = append(routerOpts, router.WithElection(election.MergePath, elector))
+	}
+
+	s, err := server.New(cfg, log, h, routerOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var feeder *telemetry.Feeder
+	if cfg.Telemetry.SelfIngest {
+		interval := cfg.Telemetry.SelfIngestInterval
+		if interval <= 0 {
+			interval = cfg.FlushInterval
+		}
+		feeder = telemetry.NewFeeder(interval, reg, memStorage)
+	}
 
 	return &App{
-		server:  s,
-		flusher: f,
-		db:      db,
-		errCh:   make(chan error, 2),
+		server:     s,
+		flusher:    f,
+		feeder:     feeder,
+		rollup:     rollupJob,
+		retention:  retentionJob,
+		alerts:     alerts,
+		dispatcher: dispatcher,
+		forwarder:  forwarder,
+		hub:        hub,
+		primary:    primary,
+		replica:    replica,
+		elector:    elector,
+		db:         db,
+		log:        log,
+		errCh:      make(chan error, 10),
+		flushed:    make(chan struct{}),
 	}, nil
 }
 
@@ -56,25 +319,88 @@ func (a *App) Run(ctx context.Context) error {
 	defer stop()
 
 	go func() {
-		fmt.Println("Starting HTTPServer on port :8080")
+		a.log.Info("starting HTTP server", slog.String("addr", a.server.Addr()))
 		if err := a.server.Run(); err != nil {
 			a.errCh <- fmt.Errorf("server error: %w", err)
 		}
 	}()
 
 	go func() {
-		fmt.Println("Starting metrics flusher")
+		defer close(a.flushed)
+		a.log.Info("starting metrics flusher")
 		if err := a.flusher.Run(ctx); err != nil {
 			a.errCh <- fmt.Errorf("flusher error: %w", err)
 		}
 	}()
 
+	if a.elector != nil {
+		go func() {
+			a.log.Info("starting leader election")
+			if err := a.elector.Run(ctx); err != nil {
+				a.errCh <- fmt.Errorf("election error: %w", err)
+			}
+		}()
+	}
+
+	if a.feeder != nil {
+		go func() {
+			a.log.Info("starting self-instrumentation feeder")
+			if err := a.feeder.Run(ctx); err != nil {
+				a.errCh <- fmt.Errorf("feeder error: %w", err)
+			}
+		}()
+	}
+
+	if a.rollup != nil {
+		go func() {
+			a.log.Info("starting rollup job")
+			if err := a.rollup.Run(ctx); err != nil {
+				a.errCh <- fmt.Errorf("rollup error: %w", err)
+			}
+		}()
+	}
+
+	go func() {
+		a.log.Info("starting retention job")
+		if err := a.retention.Run(ctx); err != nil {
+			a.errCh <- fmt.Errorf("retention error: %w", err)
+		}
+	}()
+
+	go func() {
+		a.log.Info("starting alerting rule evaluation")
+		if err := a.alerts.Run(ctx); err != nil {
+			a.errCh <- fmt.Errorf("alerting error: %w", err)
+		}
+	}()
+
+	go func() {
+		if err := a.dispatcher.Run(ctx); err != nil {
+			a.errCh <- fmt.Errorf("alert dispatcher error: %w", err)
+		}
+	}()
+
+	go func() {
+		if err := a.forwarder.Run(ctx); err != nil {
+			a.errCh <- fmt.Errorf("forwarder error: %w", err)
+		}
+	}()
+
+	if a.replica != nil {
+		go func() {
+			a.log.Info("starting replication from primary")
+			if err := a.replica.Run(ctx); err != nil {
+				a.errCh <- fmt.Errorf("replication error: %w", err)
+			}
+		}()
+	}
+
 	select {
 	case err := <-a.errCh:
-		fmt.Printf("application error: %v", err)
+		a.log.Error("application error", logger.Err(err))
 		return err
 	case <-ctx.Done():
-		fmt.Println("application shutdown initiated")
+		a.log.Info("application shutdown initiated")
 	}
 
 	return a.shutdown()
@@ -87,14 +413,51 @@ func (a *App) shutdown() error {
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
+	// Streams never go idle on their own, end them so the server can drain.
+	a.hub.Close()
+	if a.primary != nil {
+		a.primary.Close()
+	}
+
 	if err := a.server.Shutdown(shutdownCtx); err != nil {
 		return err
 	}
 
+	// Leadership is handed over only once the final flush is persisted.
+	select {
+	case <-a.flushed:
+	case <-shutdownCtx.Done():
+	}
+	if a.elector != nil {
+		if err := a.elector.Resign(shutdownCtx); err != nil {
+			a.log.Error("failed to resign leadership", logger.Err(err))
+		}
+	}
+
 	if err := a.db.Close(); err != nil {
 		return err
 	}
 
-	fmt.Printf("Application shutdown complete")
+	a.log.Info("application shutdown complete")
 	return nil
 }
+
+// maxFuture returns how far ahead of the server clock metrics may be timestamped, zero meaning no limit.
+func maxFuture(cfg *config.Config) time.Duration {
+	switch {
+	case cfg.Timestamps.MaxFuture < 0:
+		return 0
+	case cfg.Timestamps.MaxFuture == 0:
+		return 5 * time.Minute
+	default:
+		return cfg.Timestamps.MaxFuture
+	}
+}
+
+// telemetryPath returns the configured self-instrumentation endpoint path.
+func telemetryPath(cfg *config.Config) string {
+	if cfg.Telemetry.Path == "" {
+		return "/internal/metrics"
+	}
+	return cfg.Telemetry.Path
+}
@@ -0,0 +1,328 @@
+// Package cluster spreads series over several metric server nodes. Series are
+// assigned to nodes by consistent hashing of their keys: ingested metrics are
+// sent on to the nodes owning them, and the current values of all nodes are
+// gathered for reads. Membership is static, every node listing all nodes in
+// its configuration.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/http-server/middleware"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// HeaderForwardedBy marks ingestion requests sent on by another node. Their
+// metrics are stored where they arrive, so that nodes with diverging
+// configurations cannot bounce metrics between each other. It is only honored
+// on requests authenticated by the cluster token.
+const HeaderForwardedBy = "X-Forwarded-By-Node"
+
+// ValuesPath is the internal endpoint serving the current values held by a node.
+const ValuesPath = "/internal/cluster/values"
+
+// Cluster defaults applied to unset configuration values.
+const (
+	DefaultVirtualNodes = 128
+	DefaultTimeout      = 5 * time.Second
+)
+
+// MemStorage defines an interface for reading the current values held by this node.
+type MemStorage interface {
+	Latest() []models.Sample
+}
+
+// PeerError is returned when a node answers a request with an error status.
+type PeerError struct {
+	Node       string
+	StatusCode int
+	Message    string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("node %s returned %d: %s", e.Node, e.StatusCode, e.Message)
+}
+
+// HTTPStatus returns the status code the node answered with.
+func (e *PeerError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// Cluster routes series to the nodes owning them.
+type Cluster struct {
+	self  string
+	token string
+	nodes []string
+	ring  *Ring
+	mem   MemStorage
+	http  *http.Client
+	log   *slog.Logger
+
+	forwarded *telemetry.CounterVec
+	failures  *telemetry.CounterVec
+}
+
+// Option configures optional Cluster behaviour.
+type Option func(*Cluster)
+
+// WithToken sets the bearer token authenticating requests between nodes.
+// Without one, requests marked as sent on by another node are treated as
+// coming from clients.
+func WithToken(token string) Option {
+	return func(c *Cluster) {
+		c.token = token
+	}
+}
+
+// New creates the Cluster of this node, reading local values from mem.
+func New(
+	cfg config.Cluster, mem MemStorage, reg *telemetry.Registry, log *slog.Logger, opts ...Option,
+) (*Cluster, error) {
+	nodes := make([]string, len(cfg.Nodes))
+	for i, node := range cfg.Nodes {
+		nodes[i] = strings.TrimSuffix(node, "/")
+	}
+	self := strings.TrimSuffix(cfg.Self, "/")
+	if !slices.Contains(nodes, self) {
+		return nil, fmt.Errorf("cluster node %q is not listed in the cluster nodes", cfg.Self)
+	}
+
+	vnodes := cfg.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	c := &Cluster{
+		self:  self,
+		nodes: nodes,
+		ring:  NewRing(nodes, vnodes),
+		mem:   mem,
+		http:  &http.Client{Timeout: timeout},
+		log:   log,
+		forwarded: reg.CounterVec("metric_server_cluster_forwarded_metrics_total",
+			"Total number of ingested metrics sent on to the nodes owning them.", "node"),
+		failures: reg.CounterVec("metric_server_cluster_request_failures_total",
+			"Total number of failed requests to other cluster nodes.", "node", "op"),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Self returns the URL of this node.
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+// Owner returns the URL of the node owning the series key.
+func (c *Cluster) Owner(key string) string {
+	return c.ring.Owner(key)
+}
+
+// Split separates the metrics owned by this node from those owned by other
+// nodes, grouped by node. Metrics of a request sent on by another node,
+// recognized by the request header together with the cluster token, are all
+// kept. The input slice is reused for the local metrics.
+func (c *Cluster) Split(header http.Header, metrics []models.Metric) ([]models.Metric, map[string][]models.Metric) {
+	if header.Get(HeaderForwardedBy) != "" && middleware.HasBearerToken(header, c.token) {
+		return metrics, nil
+	}
+
+	local := metrics[:0]
+	var remote map[string][]models.Metric
+	for _, m := range metrics {
+		owner := c.ring.Owner(m.Key())
+		if owner == c.self {
+			local = append(local, m)
+			continue
+		}
+		if remote == nil {
+			remote = make(map[string][]models.Metric)
+		}
+		remote[owner] = append(remote[owner], m)
+	}
+	return local, remote
+}
+
+// Send pushes metrics to the nodes owning them, in parallel, passing on the
+// client and tenant of the original request. When a node cannot be reached
+// or fails, the returned error has no status; otherwise a node refusing the
+// metrics is reported as a *PeerError.
+func (c *Cluster) Send(ctx context.Context, header http.Header, remote map[string][]models.Metric) error {
+	var (
+		mu          sync.Mutex
+		unavailable []error
+		refused     []error
+		wg          sync.WaitGroup
+	)
+
+	for node, metrics := range remote {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := c.push(ctx, node, header, metrics)
+			if err == nil {
+				c.forwarded.With(node).Add(float64(len(metrics)))
+				return
+			}
+			c.failures.With(node, "push").Inc()
+
+			mu.Lock()
+			defer mu.Unlock()
+			var peerErr *PeerError
+			if errors.As(err, &peerErr) && peerErr.StatusCode < http.StatusInternalServerError {
+				refused = append(refused, err)
+			} else {
+				unavailable = append(unavailable, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(unavailable) > 0 {
+		return errors.Join(unavailable...)
+	}
+	return errors.Join(refused...)
+}
+
+func (c *Cluster) push(ctx context.Context, node string, header http.Header, metrics []models.Metric) error {
+	var body bytes.Buffer
+	if err := (codec.Protobuf{}).Encode(&body, metrics); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, node+"/update", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", codec.ContentTypeProtobuf)
+	req.Header.Set(HeaderForwardedBy, c.self)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	for _, name := range []string{middleware.HeaderRequestID, middleware.HeaderClientID, middleware.HeaderTenantID} {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send metrics to node %s: %w", node, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &PeerError{Node: node, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Latest returns the current values of all nodes. Nodes that cannot be
+// reached are skipped, so reads degrade to the series of the available nodes.
+// A series found on several nodes, as after a change of membership, has its
+// most recent value returned.
+func (c *Cluster) Latest() []models.Sample {
+	ctx, cancel := context.WithTimeout(context.Background(), c.http.Timeout)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		samples = c.mem.Latest()
+		wg      sync.WaitGroup
+	)
+	for _, node := range c.nodes {
+		if node == c.self {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			peer, err := c.values(ctx, node)
+			if err != nil {
+				c.failures.With(node, "values").Inc()
+				c.log.Warn("failed to read values of cluster node", slog.String("node", node), logger.Err(err))
+				return
+			}
+
+			mu.Lock()
+			samples = append(samples, peer...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return latestByKey(samples)
+}
+
+func (c *Cluster) values(ctx context.Context, node string) ([]models.Sample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+ValuesPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &PeerError{Node: node, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	return codec.UnmarshalSamples(body)
+}
+
+// latestByKey keeps the most recent sample of every series.
+func latestByKey(samples []models.Sample) []models.Sample {
+	index := make(map[string]int, len(samples))
+	res := samples[:0]
+	for _, s := range samples {
+		if i, ok := index[s.Key]; ok {
+			if s.Timestamp.After(res[i].Timestamp) {
+				res[i] = s
+			}
+			continue
+		}
+		index[s.Key] = len(res)
+		res = append(res, s)
+	}
+	return res
+}
+
+// ServeHTTP serves the current values held by this node as a protobuf Samples
+// message, for the Latest calls of other nodes.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", codec.ContentTypeProtobuf)
+	if err := (codec.Protobuf{}).Encode(w, c.mem.Latest()); err != nil {
+		logger.FromContext(r.Context()).Error("failed to write cluster values", logger.Err(err))
+	}
+}
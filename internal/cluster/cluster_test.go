@@ -0,0 +1,206 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/http-server/handler"
+	"github.com/sanchey92/metric-server/internal/http-server/router"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	ring := NewRing(nodes, DefaultVirtualNodes)
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := range 30000 {
+		key := fmt.Sprintf(`http_requests_total{host="host-%d"}`, i)
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, node := range nodes {
+		require.InDelta(t, 10000, counts[node], 2000, "series of %s", node)
+	}
+
+	// A new node only takes over keys, the others keep their owner.
+	grown := NewRing(append(nodes, "http://d"), DefaultVirtualNodes)
+	moved := 0
+	for key, owner := range owners {
+		if o := grown.Owner(key); o != owner {
+			require.Equal(t, "http://d", o)
+			moved++
+		}
+	}
+	require.InDelta(t, 7500, moved, 1500)
+
+	require.Empty(t, NewRing(nil, DefaultVirtualNodes).Owner("cpu"))
+}
+
+// node is an in-process cluster node serving the real router.
+type node struct {
+	url     string
+	mem     *storage.MemStorage
+	cluster *Cluster
+}
+
+// token authenticates requests between nodes.
+const token = "secret"
+
+// startCluster runs n nodes, plus the given URLs of nodes that are down.
+func startCluster(t *testing.T, n int, down ...string) []*node {
+	t.Helper()
+
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	log := slog.New(slog.DiscardHandler)
+
+	nodes := make([]*node, n)
+	for i, srv := range servers {
+		mem := storage.NewMemStorage(4)
+		c, err := New(config.Cluster{Self: urls[i], Nodes: append(urls, down...), Timeout: time.Second}, mem, nil, log,
+			WithToken(token))
+		require.NoError(t, err)
+
+		h := handler.New(mem,
+			handler.WithCluster(c),
+			handler.WithValues(c),
+			handler.WithQueryEngine(promql.NewEngine(promql.NewStorage(nil, c))),
+		)
+		srv.Config.Handler = router.New(log, h, router.WithAdminToken(token),
+			router.WithOps(h), router.WithQueryAPI(h), router.WithCluster(ValuesPath, c))
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		nodes[i] = &node{url: urls[i], mem: mem, cluster: c}
+	}
+	return nodes
+}
+
+func TestCluster_InProcess(t *testing.T) {
+	nodes := startCluster(t, 3)
+	ctx := context.Background()
+
+	metrics := make([]models.Metric, 100)
+	sum := 0
+	for i := range metrics {
+		metrics[i] = models.Metric{
+			Name: "load", MType: "gauge", Value: float64(i), Labels: map[string]string{"host": strconv.Itoa(i)},
+		}
+		sum += i
+	}
+
+	ingress, err := client.New(nodes[0].url)
+	require.NoError(t, err)
+	require.NoError(t, ingress.Push(ctx, metrics))
+
+	// Every series is stored once, on its owner.
+	total := 0
+	for _, n := range nodes {
+		local := n.mem.Latest()
+		require.NotEmpty(t, local, "node %s owns no series", n.url)
+		for _, s := range local {
+			require.Equal(t, n.url, n.cluster.Owner(s.Key))
+		}
+		total += len(local)
+	}
+	require.Equal(t, len(metrics), total)
+
+	// Reads on any node see the series of all nodes.
+	for _, n := range nodes {
+		c, err := client.New(n.url)
+		require.NoError(t, err)
+
+		values, err := c.Values(ctx, "", "load")
+		require.NoError(t, err)
+		require.Len(t, values, len(metrics))
+
+		res, err := c.Query(ctx, "sum(load)", time.Time{})
+		require.NoError(t, err)
+		require.Contains(t, string(res.Result), `"`+strconv.Itoa(sum)+`"`)
+	}
+}
+
+func TestCluster_NodeDown(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	nodes := startCluster(t, 1, down.URL)
+	ctx := context.Background()
+
+	metrics := make([]models.Metric, 20)
+	for i := range metrics {
+		metrics[i] = models.Metric{Name: "load", Value: 1, Labels: map[string]string{"host": strconv.Itoa(i)}}
+	}
+
+	c, err := client.New(nodes[0].url)
+	require.NoError(t, err)
+
+	var apiErr *client.APIError
+	require.ErrorAs(t, c.Push(ctx, metrics), &apiErr)
+	require.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+
+	// Nothing is stored, not even the series owned by the available node, so
+	// that the client can retry the whole request.
+	require.Empty(t, nodes[0].mem.Latest())
+	values, err := c.Values(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, values)
+
+	owned, _ := nodes[0].cluster.Split(http.Header{}, slices.Clone(metrics))
+	local := len(owned)
+	require.Positive(t, local)
+	require.Less(t, local, len(metrics))
+
+	// Requests sent on by another node are stored where they arrive.
+	header := http.Header{HeaderForwardedBy: {down.URL}, "Authorization": {"Bearer " + token}}
+	kept, remote := nodes[0].cluster.Split(header, slices.Clone(metrics))
+	require.Len(t, kept, len(metrics))
+	require.Empty(t, remote)
+
+	// Without the token, the header is ignored.
+	header.Set("Authorization", "Bearer wrong")
+	kept, remote = nodes[0].cluster.Split(header, slices.Clone(metrics))
+	require.Len(t, kept, local)
+	require.NotEmpty(t, remote)
+}
+
+func TestNew_SelfNotListed(t *testing.T) {
+	_, err := New(config.Cluster{Self: "http://a", Nodes: []string{"http://b"}}, nil, nil, slog.Default())
+	require.Error(t, err)
+
+	c, err := New(config.Cluster{Self: "http://a/", Nodes: []string{"http://a", "http://b"}}, nil, nil, slog.Default())
+	require.NoError(t, err)
+	require.Equal(t, "http://a", c.Self())
+}
+
+func TestLatestByKey(t *testing.T) {
+	now := time.Now()
+	got := latestByKey([]models.Sample{
+		{Key: "a", Value: 1, Timestamp: now},
+		{Key: "b", Value: 2, Timestamp: now},
+		{Key: "a", Value: 3, Timestamp: now.Add(time.Second)},
+		{Key: "b", Value: 4, Timestamp: now.Add(-time.Second)},
+	})
+	require.Equal(t, []models.Sample{
+		{Key: "a", Value: 3, Timestamp: now.Add(time.Second)},
+		{Key: "b", Value: 2, Timestamp: now},
+	}, got)
+}
@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Ring assigns keys to nodes by consistent hashing. Every node is placed at
+// several points of a hash ring; a key belongs to the node at the first point
+// following its hash. Adding or removing a node only moves the keys of the
+// ring segments it gains or loses.
+type Ring struct {
+	points []uint64
+	owners []string
+}
+
+// NewRing places every node at vnodes points of the ring.
+func NewRing(nodes []string, vnodes int) *Ring {
+	type point struct {
+		hash  uint64
+		owner string
+	}
+
+	points := make([]point, 0, len(nodes)*vnodes)
+	for _, node := range nodes {
+		for i := range vnodes {
+			points = append(points, point{hash: hash(node + "#" + strconv.Itoa(i)), owner: node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].owner < points[j].owner
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	r := &Ring{points: make([]uint64, len(points)), owners: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// Owner returns the node owning key, or an empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// hash is 64-bit FNV-1a followed by the splitmix64 finalizer, which spreads
+// similar keys, such as series differing in one label, over the whole ring.
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(s))
+
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,147 @@
+// Package codec provides the payload formats of the HTTP API. Ingested batches
+// are decoded from JSON, protobuf (see proto/metrics.proto) or MessagePack
+// according to the request Content-Type, and read responses are encoded in the
+// format preferred by the Accept header.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Content types of the supported formats.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+// ErrUnsupported is returned by Encode for values the format cannot represent.
+var ErrUnsupported = errors.New("value not supported by the format")
+
+// Codec is a payload format.
+type Codec interface {
+	// ContentType returns the canonical content type of the format.
+	ContentType() string
+	// DecodeBatch reads an ingestion batch.
+	DecodeBatch(r io.Reader) (Batch, error)
+	// Encode writes v, returning ErrUnsupported if the format cannot represent it.
+	Encode(w io.Writer, v any) error
+}
+
+// Batch is the body of an ingestion request: metrics with an optional ID used
+// as the idempotency key when the request has no Idempotency-Key header. In
+// JSON and MessagePack it is either a bare array of metrics or an object
+// {"id": "...", "metrics": [...]}.
+type Batch struct {
+	ID      string
+	Metrics []models.Metric
+}
+
+// batchObject is the object form of a Batch.
+type batchObject struct {
+	ID      string          `json:"id"`
+	Metrics []models.Metric `json:"metrics"`
+}
+
+// UnmarshalJSON decodes either form of a batch.
+func (b *Batch) UnmarshalJSON(data []byte) error {
+	for _, c := range data {
+		if c == '[' {
+			return json.Unmarshal(data, &b.Metrics)
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			break
+		}
+	}
+
+	var v batchObject
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	b.ID, b.Metrics = v.ID, v.Metrics
+	return nil
+}
+
+var (
+	jsonCodec     Codec = JSON{}
+	protobufCodec Codec = Protobuf{}
+	msgpackCodec  Codec = Msgpack{}
+)
+
+// byMediaType maps the accepted media types, including common aliases, to their codec.
+var byMediaType = map[string]Codec{
+	ContentTypeJSON:                   jsonCodec,
+	ContentTypeProtobuf:               protobufCodec,
+	"application/protobuf":            protobufCodec,
+	"application/vnd.google.protobuf": protobufCodec,
+	ContentTypeMsgpack:                msgpackCodec,
+	"application/x-msgpack":           msgpackCodec,
+	"application/vnd.msgpack":         msgpackCodec,
+}
+
+// ForContentType returns the codec of a request Content-Type. Unknown or
+// missing types are treated as JSON, which was the only format before binary
+// formats were added and is still sent by clients without a Content-Type.
+func ForContentType(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return jsonCodec
+	}
+	if c, ok := byMediaType[mediaType]; ok {
+		return c
+	}
+	return jsonCodec
+}
+
+// Negotiate returns the codec preferred by an Accept header, honoring quality
+// values. JSON is returned when the header is empty or names no known format.
+func Negotiate(accept string) Codec {
+	best, bestQ := jsonCodec, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		c, ok := byMediaType[mediaType]
+		if !ok && (mediaType == "*/*" || mediaType == "application/*") {
+			c, ok = jsonCodec, true
+		}
+		if ok && q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// JSON is the encoding/json format.
+type JSON struct{}
+
+// ContentType implements Codec.
+func (JSON) ContentType() string { return ContentTypeJSON }
+
+// DecodeBatch implements Codec.
+func (JSON) DecodeBatch(r io.Reader) (Batch, error) {
+	var b Batch
+	err := json.NewDecoder(r).Decode(&b)
+	return b, err
+}
+
+// Encode implements Codec.
+func (JSON) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,274 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+func batch(n int) Batch {
+	b := Batch{ID: "batch-1", Metrics: make([]models.Metric, n)}
+	for i := range b.Metrics {
+		b.Metrics[i] = models.Metric{
+			Name:      fmt.Sprintf("http_requests_total_%d", i%50),
+			MType:     "counter",
+			Value:     float64(i) * 1.5,
+			Labels:    map[string]string{"host": fmt.Sprintf("host-%d", i%10), "method": "GET", "code": "200"},
+			Timestamp: 1718000000000 + int64(i),
+		}
+	}
+	return b
+}
+
+func TestCodecs_Batch(t *testing.T) {
+	b := batch(3)
+	b.Metrics = append(b.Metrics, models.Metric{Name: "empty"})
+
+	for _, c := range []Codec{JSON{}, Protobuf{}, Msgpack{}} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, c.Encode(&buf, b))
+
+			got, err := c.DecodeBatch(&buf)
+			require.NoError(t, err)
+			require.Equal(t, b, got)
+
+			buf.Reset()
+			require.NoError(t, c.Encode(&buf, b.Metrics))
+			got, err = c.DecodeBatch(&buf)
+			require.NoError(t, err)
+			require.Equal(t, Batch{Metrics: b.Metrics}, got)
+
+			_, err = c.DecodeBatch(bytes.NewReader([]byte{0xff, 0xff, 0xff}))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCodecs_Samples(t *testing.T) {
+	samples := []models.Sample{
+		{Key: `cpu{host="a"}`, Value: 0.5, Timestamp: time.UnixMilli(1718000000123).UTC()},
+		{Key: "mem", Value: 42, Timestamp: time.UnixMilli(1718000000000).UTC()},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Protobuf{}.Encode(&buf, samples))
+	got, err := UnmarshalSamples(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, samples, got)
+
+	require.ErrorIs(t, Protobuf{}.Encode(&buf, map[string]int{}), ErrUnsupported)
+}
+
+// batchDescriptor builds the Batch message of proto/metrics.proto, so the
+// hand-written encoding can be checked against the protobuf runtime.
+func batchDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string,
+		label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(num),
+			Type: typ.Enum(), Label: label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("metrics.proto"),
+		Package: proto.String("metricserver.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Metric"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, str, "", optional),
+					field("type", 2, str, "", optional),
+					field("value", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, "", optional),
+					field("labels", 4, msg, ".metricserver.v1.Metric.LabelsEntry", repeated),
+					field("timestamp", 5, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", optional),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{{
+					Name: proto.String("LabelsEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, str, "", optional),
+						field("value", 2, str, "", optional),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}},
+			},
+			{
+				Name: proto.String("Batch"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, str, "", optional),
+					field("metrics", 2, msg, ".metricserver.v1.Metric", repeated),
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	require.NoError(t, err)
+	return fd.Messages().ByName("Batch")
+}
+
+func TestProtobuf_Compatibility(t *testing.T) {
+	desc := batchDescriptor(t)
+	b := batch(2)
+
+	// Encoded by the protobuf runtime, decoded by the codec.
+	m := dynamicpb.NewMessage(desc)
+	fillBatch(m, b)
+	data, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	got, err := UnmarshalBatch(data)
+	require.NoError(t, err)
+	require.Equal(t, b, got)
+
+	// Encoded by the codec, decoded by the protobuf runtime.
+	decoded := dynamicpb.NewMessage(desc)
+	require.NoError(t, proto.Unmarshal(MarshalBatch(b), decoded))
+	require.True(t, proto.Equal(m, decoded))
+}
+
+// fillBatch sets the fields of a dynamic Batch message from b.
+func fillBatch(m *dynamicpb.Message, b Batch) {
+	desc := m.Descriptor()
+	m.Set(desc.Fields().ByName("id"), protoreflect.ValueOfString(b.ID))
+
+	list := m.Mutable(desc.Fields().ByName("metrics")).List()
+	for _, metric := range b.Metrics {
+		item := list.NewElement().Message()
+		fields := item.Descriptor().Fields()
+		item.Set(fields.ByName("name"), protoreflect.ValueOfString(metric.Name))
+		item.Set(fields.ByName("type"), protoreflect.ValueOfString(metric.MType))
+		item.Set(fields.ByName("value"), protoreflect.ValueOfFloat64(metric.Value))
+		item.Set(fields.ByName("timestamp"), protoreflect.ValueOfInt64(metric.Timestamp))
+		labels := item.Mutable(fields.ByName("labels")).Map()
+		for k, v := range metric.Labels {
+			labels.Set(protoreflect.ValueOfString(k).MapKey(), protoreflect.ValueOfString(v))
+		}
+		list.Append(protoreflect.ValueOfMessage(item))
+	}
+}
+
+func TestProtobuf_SkipsUnknownFields(t *testing.T) {
+	data := protowire.AppendTag(nil, 15, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	data = append(data, MarshalBatch(Batch{Metrics: []models.Metric{{Name: "cpu", Value: 1}}})...)
+
+	got, err := UnmarshalBatch(data)
+	require.NoError(t, err)
+	require.Equal(t, Batch{Metrics: []models.Metric{{Name: "cpu", Value: 1}}}, got)
+
+	_, err = UnmarshalBatch(data[:len(data)-3])
+	require.Error(t, err)
+}
+
+func TestMsgpack_IntegerValues(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Msgpack{}.Encode(&buf, []map[string]any{{"name": "cpu", "value": 42}}))
+
+	got, err := Msgpack{}.DecodeBatch(&buf)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metric{{Name: "cpu", Value: 42}}, got.Metrics)
+}
+
+func TestForContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{contentType: "", expected: ContentTypeJSON},
+		{contentType: "application/json; charset=utf-8", expected: ContentTypeJSON},
+		{contentType: "text/plain", expected: ContentTypeJSON},
+		{contentType: "application/x-protobuf", expected: ContentTypeProtobuf},
+		{contentType: "application/protobuf", expected: ContentTypeProtobuf},
+		{contentType: "application/msgpack", expected: ContentTypeMsgpack},
+		{contentType: "application/x-msgpack", expected: ContentTypeMsgpack},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			require.Equal(t, tt.expected, ForContentType(tt.contentType).ContentType())
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: ContentTypeJSON},
+		{accept: "*/*", expected: ContentTypeJSON},
+		{accept: "text/html", expected: ContentTypeJSON},
+		{accept: "application/x-protobuf", expected: ContentTypeProtobuf},
+		{accept: "application/msgpack, application/json;q=0.9", expected: ContentTypeMsgpack},
+		{accept: "application/json;q=0.5, application/x-protobuf", expected: ContentTypeProtobuf},
+		{accept: "application/x-protobuf;q=0.1, */*;q=0.8", expected: ContentTypeJSON},
+		{accept: "application/msgpack;q=bad", expected: ContentTypeJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			require.Equal(t, tt.expected, Negotiate(tt.accept).ContentType())
+		})
+	}
+}
+
+// BenchmarkDecodeBatch compares the ingestion formats against the plain
+// encoding/json decoding of a metric array used before binary formats.
+func BenchmarkDecodeBatch(b *testing.B) {
+	metrics := batch(1000).Metrics
+
+	jsonData, err := json.Marshal(metrics)
+	require.NoError(b, err)
+
+	b.Run("encoding/json", func(b *testing.B) {
+		b.SetBytes(int64(len(jsonData)))
+		b.ReportAllocs()
+		for b.Loop() {
+			var out []models.Metric
+			if err := json.NewDecoder(bytes.NewReader(jsonData)).Decode(&out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	for _, c := range []Codec{JSON{}, Protobuf{}, Msgpack{}} {
+		var buf bytes.Buffer
+		require.NoError(b, c.Encode(&buf, metrics))
+		data := buf.Bytes()
+
+		b.Run(c.ContentType(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := c.DecodeBatch(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Msgpack is the MessagePack format. Values have the same shape and field
+// names as in JSON.
+type Msgpack struct{}
+
+// ContentType implements Codec.
+func (Msgpack) ContentType() string { return ContentTypeMsgpack }
+
+// DecodeBatch implements Codec.
+func (Msgpack) DecodeBatch(r io.Reader) (Batch, error) {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+
+	var b Batch
+	err := dec.Decode(&b)
+	return b, err
+}
+
+// Encode implements Codec.
+func (Msgpack) Encode(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// DecodeMsgpack decodes either form of a batch.
+func (b *Batch) DecodeMsgpack(dec *msgpack.Decoder) error {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+
+	if msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32 {
+		return dec.Decode(&b.Metrics)
+	}
+
+	var v batchObject
+	if err = dec.Decode(&v); err != nil {
+		return err
+	}
+	b.ID, b.Metrics = v.ID, v.Metrics
+	return nil
+}
+
+// EncodeMsgpack encodes a batch in its object form.
+func (b Batch) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.Encode(batchObject{ID: b.ID, Metrics: b.Metrics})
+}
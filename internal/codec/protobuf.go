@@ -0,0 +1,292 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Field numbers of proto/metrics.proto.
+const (
+	batchID      protowire.Number = 1
+	batchMetrics protowire.Number = 2
+
+	metricName      protowire.Number = 1
+	metricType      protowire.Number = 2
+	metricValue     protowire.Number = 3
+	metricLabels    protowire.Number = 4
+	metricTimestamp protowire.Number = 5
+
+	entryKey   protowire.Number = 1
+	entryValue protowire.Number = 2
+
+	samplesSamples protowire.Number = 1
+
+	sampleKey       protowire.Number = 1
+	sampleValue     protowire.Number = 2
+	sampleTimestamp protowire.Number = 3
+)
+
+// Protobuf is the protobuf format of proto/metrics.proto. Batches are decoded
+// from and encoded as Batch messages, sample lists as Samples messages.
+type Protobuf struct{}
+
+// ContentType implements Codec.
+func (Protobuf) ContentType() string { return ContentTypeProtobuf }
+
+// DecodeBatch implements Codec.
+func (Protobuf) DecodeBatch(r io.Reader) (Batch, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Batch{}, err
+	}
+	return UnmarshalBatch(data)
+}
+
+// Encode implements Codec for Batch, []models.Metric and []models.Sample values.
+func (Protobuf) Encode(w io.Writer, v any) error {
+	var buf []byte
+	switch v := v.(type) {
+	case Batch:
+		buf = MarshalBatch(v)
+	case []models.Metric:
+		buf = MarshalBatch(Batch{Metrics: v})
+	case []models.Sample:
+		buf = marshalSamples(v)
+	default:
+		return ErrUnsupported
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// MarshalBatch encodes b as a Batch message.
+func MarshalBatch(b Batch) []byte {
+	var buf []byte
+	if b.ID != "" {
+		buf = protowire.AppendTag(buf, batchID, protowire.BytesType)
+		buf = protowire.AppendString(buf, b.ID)
+	}
+
+	var msg []byte
+	for _, m := range b.Metrics {
+		msg = appendMetric(msg[:0], m)
+		buf = protowire.AppendTag(buf, batchMetrics, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+	return buf
+}
+
+func appendMetric(buf []byte, m models.Metric) []byte {
+	if m.Name != "" {
+		buf = protowire.AppendTag(buf, metricName, protowire.BytesType)
+		buf = protowire.AppendString(buf, m.Name)
+	}
+	if m.MType != "" {
+		buf = protowire.AppendTag(buf, metricType, protowire.BytesType)
+		buf = protowire.AppendString(buf, m.MType)
+	}
+	if m.Value != 0 {
+		buf = appendDouble(buf, metricValue, m.Value)
+	}
+
+	// Labels are written in name order, so equal metrics encode identically.
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		size := protowire.SizeTag(entryKey) + protowire.SizeBytes(len(name)) +
+			protowire.SizeTag(entryValue) + protowire.SizeBytes(len(m.Labels[name]))
+		buf = protowire.AppendTag(buf, metricLabels, protowire.BytesType)
+		buf = protowire.AppendVarint(buf, uint64(size))
+		buf = protowire.AppendTag(buf, entryKey, protowire.BytesType)
+		buf = protowire.AppendString(buf, name)
+		buf = protowire.AppendTag(buf, entryValue, protowire.BytesType)
+		buf = protowire.AppendString(buf, m.Labels[name])
+	}
+
+	if m.Timestamp != 0 {
+		buf = protowire.AppendTag(buf, metricTimestamp, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(m.Timestamp))
+	}
+	return buf
+}
+
+func marshalSamples(samples []models.Sample) []byte {
+	var buf, msg []byte
+	for _, s := range samples {
+		msg = msg[:0]
+		if s.Key != "" {
+			msg = protowire.AppendTag(msg, sampleKey, protowire.BytesType)
+			msg = protowire.AppendString(msg, s.Key)
+		}
+		if s.Value != 0 {
+			msg = appendDouble(msg, sampleValue, s.Value)
+		}
+		if !s.Timestamp.IsZero() {
+			msg = protowire.AppendTag(msg, sampleTimestamp, protowire.VarintType)
+			msg = protowire.AppendVarint(msg, uint64(s.Timestamp.UnixMilli()))
+		}
+		buf = protowire.AppendTag(buf, samplesSamples, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, msg)
+	}
+	return buf
+}
+
+func appendDouble(buf []byte, num protowire.Number, v float64) []byte {
+	buf = protowire.AppendTag(buf, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(buf, math.Float64bits(v))
+}
+
+// UnmarshalBatch decodes a Batch message. Unknown fields are skipped.
+func UnmarshalBatch(data []byte) (Batch, error) {
+	var b Batch
+	err := walk(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == batchID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			b.ID = v
+			return n, nil
+		case num == batchMetrics && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := unmarshalMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			b.Metrics = append(b.Metrics, m)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, data), nil
+	})
+	return b, err
+}
+
+func unmarshalMetric(data []byte) (models.Metric, error) {
+	var m models.Metric
+	err := walk(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == metricName && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			m.Name = v
+			return n, nil
+		case num == metricType && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			m.MType = v
+			return n, nil
+		case num == metricValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			m.Value = math.Float64frombits(v)
+			return n, nil
+		case num == metricLabels && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return n, nil
+			}
+			name, value, err := unmarshalEntry(v)
+			if err != nil {
+				return 0, err
+			}
+			if m.Labels == nil {
+				m.Labels = make(map[string]string)
+			}
+			m.Labels[name] = value
+			return n, nil
+		case num == metricTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			m.Timestamp = int64(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, data), nil
+	})
+	return m, err
+}
+
+func unmarshalEntry(data []byte) (key, value string, err error) {
+	err = walk(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch {
+		case num == entryKey && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			key = v
+			return n, nil
+		case num == entryValue && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			value = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, data), nil
+	})
+	return key, value, err
+}
+
+// UnmarshalSamples decodes a Samples message. Unknown fields are skipped.
+func UnmarshalSamples(data []byte) ([]models.Sample, error) {
+	var samples []models.Sample
+	err := walk(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		if num != samplesSamples || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, data), nil
+		}
+
+		v, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return n, nil
+		}
+		var s models.Sample
+		err := walk(v, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+			switch {
+			case num == sampleKey && typ == protowire.BytesType:
+				v, n := protowire.ConsumeString(data)
+				s.Key = v
+				return n, nil
+			case num == sampleValue && typ == protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(data)
+				s.Value = math.Float64frombits(v)
+				return n, nil
+			case num == sampleTimestamp && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(data)
+				s.Timestamp = time.UnixMilli(int64(v)).UTC()
+				return n, nil
+			}
+			return protowire.ConsumeFieldValue(num, typ, data), nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		samples = append(samples, s)
+		return n, nil
+	})
+	return samples, err
+}
+
+// walk calls field for every field of a message with the data following its
+// tag; field returns the length of the value it consumed, negative on error.
+func walk(data []byte, field func(num protowire.Number, typ protowire.Type, data []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf tag: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		n, err := field(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	return nil
+}
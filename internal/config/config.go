@@ -7,6 +7,7 @@ package config
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
@@ -20,7 +21,26 @@ import (
 type Config struct {
 	HTTPServer    HTTPServer    `yaml:"http-server"`
 	PgDSN         string        `yaml:"pg-dsn"`
+	Migrations    Migrations    `yaml:"migrations"`
 	FlushInterval time.Duration `yaml:"flush-interval"`
+	Telemetry     Telemetry     `yaml:"telemetry"`
+	Log           Log           `yaml:"log"`
+	Rollup        Rollup        `yaml:"rollup"`
+	Retention     Retention     `yaml:"retention"`
+	Memory        Memory        `yaml:"memory"`
+	Timestamps    Timestamps    `yaml:"timestamps"`
+	Idempotency   Idempotency   `yaml:"idempotency"`
+	Cardinality   Cardinality   `yaml:"cardinality"`
+	Relabel       Relabel       `yaml:"relabel"`
+	Stream        Stream        `yaml:"stream"`
+	Alerting      Alerting      `yaml:"alerting"`
+	Forwarding    []Destination `yaml:"forwarding"`
+	Cluster       Cluster       `yaml:"cluster"`
+	Replication   Replication   `yaml:"replication"`
+	Election      Election      `yaml:"election"`
+	Admin         Admin         `yaml:"admin"`
+	RulesFile     string        `yaml:"rules-file"`
+	Rules         Rules         `yaml:"-"`
 }
 
 // HTTPServer contains configuration parameters for the HTTP server.
@@ -31,6 +51,270 @@ type HTTPServer struct {
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
 }
 
+// Migrations controls the schema migrations embedded in the binary. When
+// AutoApply is set, pending migrations are applied on startup; an advisory lock
+// keeps instances starting together from applying them concurrently.
+type Migrations struct {
+	AutoApply bool `yaml:"auto-apply"`
+}
+
+// Telemetry contains configuration parameters for the server's self-instrumentation.
+// Path is the endpoint exposing metrics in the Prometheus text format. When SelfIngest
+// is set, the values are also written into the metric store every SelfIngestInterval.
+type Telemetry struct {
+	Path               string        `yaml:"path"`
+	SelfIngest         bool          `yaml:"self-ingest"`
+	SelfIngestInterval time.Duration `yaml:"self-ingest-interval"`
+}
+
+// Log contains configuration parameters for the application logger.
+// Level is one of debug, info, warn or error, audit records being logged
+// regardless; Format is either json or text.
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Rollup contains configuration parameters for downsampling of historical data.
+// Each resolution is built from the next finer one (the first from raw samples).
+type Rollup struct {
+	Enabled     bool               `yaml:"enabled"`
+	Resolutions []RollupResolution `yaml:"resolutions"`
+}
+
+// RollupResolution configures one rollup level: the bucket size (Step) and how
+// often the most recent buckets are recomputed (Interval, defaults to Step).
+type RollupResolution struct {
+	Step     time.Duration `yaml:"step"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Retention contains configuration parameters for data expiry. The first rule
+// matching a metric name wins; names matching no rule use Default. When DryRun is
+// set, the periodic job only reports what it would delete.
+type Retention struct {
+	Interval time.Duration   `yaml:"interval"`
+	DryRun   bool            `yaml:"dry-run"`
+	Default  RetentionTTL    `yaml:"default"`
+	Rules    []RetentionRule `yaml:"rules"`
+}
+
+// RetentionTTL defines how long a series is kept in memory without updates and
+// how long its history is kept in PostgreSQL. Zero means forever.
+// OutOfOrderWindow is how far behind the latest time of a series a timestamped
+// sample may arrive and still be written to history; zero only accepts samples
+// in order.
+type RetentionTTL struct {
+	MemoryTTL        time.Duration `yaml:"memory-ttl"`
+	HistoryTTL       time.Duration `yaml:"history-ttl"`
+	OutOfOrderWindow time.Duration `yaml:"out-of-order-window"`
+}
+
+// RetentionRule overrides the retention TTLs for metric names matching either
+// a glob pattern (Match) or a regular expression (Regex).
+type RetentionRule struct {
+	Match        string `yaml:"match"`
+	Regex        string `yaml:"regex"`
+	RetentionTTL `yaml:",inline"`
+}
+
+// Memory contains configuration parameters for the in-memory metric store.
+// Shards is the number of independently locked partitions (32 if unset).
+type Memory struct {
+	Shards int `yaml:"shards"`
+}
+
+// Timestamps contains configuration parameters for client-supplied metric
+// timestamps. Metrics timestamped more than MaxFuture ahead of the server clock
+// are rejected (5m if unset, no limit if negative).
+type Timestamps struct {
+	MaxFuture time.Duration `yaml:"max-future"`
+}
+
+// Idempotency contains configuration parameters for ingestion request
+// deduplication. Request keys are remembered for TTL (1h if unset), keeping at
+// most MaxKeys of them (100000 if unset) and evicting the oldest first.
+type Idempotency struct {
+	TTL     time.Duration `yaml:"ttl"`
+	MaxKeys int           `yaml:"max-keys"`
+}
+
+// Cardinality contains the series count limits protecting the in-memory store.
+// A zero limit disables the corresponding check. Separators delimit the name
+// prefix used in cardinality reports (defaults to "._:").
+type Cardinality struct {
+	MaxSeries          int           `yaml:"max-series"`
+	MaxSeriesPerClient int           `yaml:"max-series-per-client"`
+	MaxSeriesPerTenant int           `yaml:"max-series-per-tenant"`
+	PrefixLimits       []PrefixLimit `yaml:"prefix-limits"`
+	Separators         string        `yaml:"separators"`
+}
+
+// PrefixLimit caps the number of series whose names start with Prefix.
+type PrefixLimit struct {
+	Prefix    string `yaml:"prefix"`
+	MaxSeries int    `yaml:"max-series"`
+}
+
+// Relabel configures the processing applied to ingested metrics before they are
+// stored. Names must match one of the Allow regexes (if any) and none of the
+// Deny regexes; the Rules are then applied in order.
+type Relabel struct {
+	Allow []string      `yaml:"allow"`
+	Deny  []string      `yaml:"deny"`
+	Rules []RelabelRule `yaml:"rules"`
+}
+
+// RelabelRule is a Prometheus-style relabeling step over the labels of a metric,
+// its name being the __name__ label. Action is one of keep, drop, replace
+// (the default), labeldrop, labelmap and hashmod. Separator defaults to ";",
+// Regex to "(.*)" and Replacement to "$1".
+type RelabelRule struct {
+	SourceLabels []string `yaml:"source-labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target-label"`
+	Replacement  *string  `yaml:"replacement"`
+	Modulus      uint64   `yaml:"modulus"`
+	Action       string   `yaml:"action"`
+}
+
+// Stream contains configuration parameters for the live update stream.
+// BufferSize is the number of distinct series a subscriber may have pending
+// before it is disconnected as a slow consumer (1024 if unset); Heartbeat is
+// the interval of keep-alive messages on idle connections (15s if unset).
+// WebSocket connections from browsers are accepted from the origin of the
+// server and from AllowedOrigins only.
+type Stream struct {
+	BufferSize     int           `yaml:"buffer-size"`
+	Heartbeat      time.Duration `yaml:"heartbeat"`
+	AllowedOrigins []string      `yaml:"allowed-origins"`
+}
+
+// Alerting contains configuration parameters for the alerting rule engine.
+// Interval is how often the alerting rules are evaluated (defaults to 30s).
+type Alerting struct {
+	Interval time.Duration `yaml:"interval"`
+	Webhooks []Webhook     `yaml:"webhooks"`
+}
+
+// Webhook is an HTTP endpoint receiving alert notifications as JSON. Failed
+// deliveries are retried up to MaxRetries times (3 if unset, none if negative),
+// waiting Backoff (1s if unset) before the first retry and doubling it for each
+// further one. Timeout bounds every attempt (10s if unset).
+type Webhook struct {
+	URL        string        `yaml:"url"`
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxRetries int           `yaml:"max-retries"`
+	Backoff    time.Duration `yaml:"backoff"`
+}
+
+// Destination is a downstream system ingested metrics are forwarded to. Type is
+// one of metric-server, remote-write (Prometheus remote write), influx (line
+// protocol over HTTP) and graphite (plaintext protocol over TCP, URL being
+// host:port). Headers are added to HTTP requests, e.g. for authentication.
+//
+// Metrics are filtered and relabeled by Relabel, then queued, at most QueueSize
+// of them (10000 if unset) and further ones being dropped. Batches of up to
+// BatchSize metrics (500 if unset) are sent once full or every FlushInterval
+// (1s if unset). Failed batches are retried like webhook notifications, up to
+// MaxRetries times (3 if unset, none if negative) starting with Backoff (1s if
+// unset) and with every attempt bounded by Timeout (10s if unset).
+type Destination struct {
+	Name          string            `yaml:"name"`
+	Type          string            `yaml:"type"`
+	URL           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers"`
+	QueueSize     int               `yaml:"queue-size"`
+	BatchSize     int               `yaml:"batch-size"`
+	FlushInterval time.Duration     `yaml:"flush-interval"`
+	Timeout       time.Duration     `yaml:"timeout"`
+	MaxRetries    int               `yaml:"max-retries"`
+	Backoff       time.Duration     `yaml:"backoff"`
+	Relabel       Relabel           `yaml:"relabel"`
+}
+
+// Cluster configures a clustered deployment, enabled when Nodes is set. Nodes
+// lists the base URLs of all nodes, Self being the one of this node. Series
+// are assigned to nodes by consistent hashing of their keys, every node being
+// placed VirtualNodes times on the hash ring (128 if unset). Timeout bounds
+// requests to other nodes (5s if unset), which are authenticated by the admin
+// token shared by all nodes.
+type Cluster struct {
+	Self         string        `yaml:"self"`
+	Nodes        []string      `yaml:"nodes"`
+	VirtualNodes int           `yaml:"virtual-nodes"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// Replication configures primary/replica replication of the in-memory store,
+// enabled by Role, either primary or replica. A primary streams its changes to
+// the replicas following it, authenticated by the admin token; without a role,
+// the instance neither streams nor follows. A replica follows the
+// primary at the base URL Primary: it catches up from a snapshot and then
+// applies every change of the primary, serves reads but refuses writes, and
+// neither flushes nor ingests until promoted. Changes are buffered, up to
+// BufferSize batches per replica (1024 if unset), before a replica falling
+// behind is disconnected to catch up again. Heartbeat is the interval of
+// keep-alive messages (5s if unset); a replica reconnects after three missed ones.
+type Replication struct {
+	Role       string        `yaml:"role"`
+	Primary    string        `yaml:"primary"`
+	BufferSize int           `yaml:"buffer-size"`
+	Heartbeat  time.Duration `yaml:"heartbeat"`
+}
+
+// Election configures leader election among instances sharing the database,
+// enabled by Enabled. Only the leader flushes to PostgreSQL, evaluates
+// recording and alerting rules and runs rollups and history retention; the
+// others send what they would flush to the leader, authenticated by the admin
+// token, which merges it into its memory. Self is the
+// base URL other instances reach this one at. LockID is the key of the
+// PostgreSQL advisory lock electing the leader, shared by all instances (a
+// fixed default if unset). Interval is how often followers try to take over
+// and the leader checks it still holds the lock (5s if unset); Timeout bounds
+// requests to the leader (10s if unset).
+type Election struct {
+	Enabled  bool          `yaml:"enabled"`
+	Self     string        `yaml:"self"`
+	LockID   int64         `yaml:"lock-id"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Admin configures access to the administrative endpoints under /admin, such
+// as flushes, snapshots and series administration. Requests must carry Token
+// as a bearer token in their Authorization header; without a Token, the
+// endpoints refuse every request.
+type Admin struct {
+	Token string `yaml:"token"`
+}
+
+// Rules is the content of the rules file referenced by Config.RulesFile.
+type Rules struct {
+	Alerts  []AlertRule     `yaml:"alerts"`
+	Records []RecordingRule `yaml:"records"`
+}
+
+// AlertRule fires an alert for every series returned by the PromQL expression
+// Expr once it has been returned continuously for at least For. Labels are
+// added to the alert labels; Annotations carry descriptive text.
+type AlertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         time.Duration     `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// RecordingRule stores the result of the PromQL expression Expr as series of
+// the metric Record on every flush cycle, with Labels added to each series.
+type RecordingRule struct {
+	Record string            `yaml:"record"`
+	Expr   string            `yaml:"expr"`
+	Labels map[string]string `yaml:"labels"`
+}
+
 // LoadConfig loads and parses the application configuration.
 // It performs the following steps:
 //  1. Parses command-line flags for config and .env file locations
@@ -38,6 +322,7 @@ type HTTPServer struct {
 //  3. Reads the configuration file (defaults to ./config/config.yaml)
 //  4. Expands environment variables in the config file
 //  5. Unmarshals the YAML content into the Config struct
+//  6. Loads the rules file, if configured, resolved relative to the config file
 //
 // Returns:
 //   - *Config: Loaded configuration object
@@ -51,7 +336,7 @@ func LoadConfig() (*Config, error) {
 	flag.Parse()
 
 	if err := godotenv.Load(*envPathFlag); err != nil {
-		fmt.Printf(".env file not found: %s\n", *envPathFlag)
+		slog.Warn(".env file not found", slog.String("path", *envPathFlag))
 	}
 
 	configPath := *configPathFlag
@@ -72,5 +357,31 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
 
+	if cfg.RulesFile != "" {
+		rulesPath := cfg.RulesFile
+		if !filepath.IsAbs(rulesPath) {
+			rulesPath = filepath.Join(filepath.Dir(configPath), rulesPath)
+		}
+		if cfg.Rules, err = LoadRules(rulesPath); err != nil {
+			return nil, err
+		}
+	}
+
 	return &cfg, nil
 }
+
+// LoadRules reads and parses a rules file.
+func LoadRules(path string) (Rules, error) {
+	var rules Rules
+
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return rules, fmt.Errorf("error loading rules: %w", err)
+	}
+
+	if err = yaml.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("error parsing rules: %w", err)
+	}
+
+	return rules, nil
+}
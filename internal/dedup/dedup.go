@@ -0,0 +1,189 @@
+// Package dedup provides request deduplication for idempotent ingestion. A
+// Cache remembers the keys of recently applied ingestion requests for a TTL,
+// so that a client retrying a request it got no answer for is acknowledged
+// without the metrics being applied twice.
+package dedup
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Defaults used when the configuration leaves a setting unset.
+const (
+	DefaultTTL     = time.Hour
+	DefaultMaxKeys = 100_000
+)
+
+// entry is a remembered key; a zero status means the request is still being applied.
+type entry struct {
+	key     string
+	status  int
+	expires time.Time
+}
+
+// Cache is a bounded set of request keys, each remembered for the TTL. Once
+// it holds the maximum number of keys the oldest are evicted first. Keys of
+// completed requests are queued until persisted, see Pending and Load.
+type Cache struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // oldest first
+	pending []models.IdempotencyKey
+
+	duplicates *telemetry.Counter
+}
+
+// New creates a Cache with the given settings, registering its metrics in reg.
+func New(cfg config.Idempotency, reg *telemetry.Registry) *Cache {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = DefaultMaxKeys
+	}
+
+	c := &Cache{
+		ttl:     cfg.TTL,
+		maxKeys: cfg.MaxKeys,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		duplicates: reg.Counter("metric_server_ingest_duplicate_requests_total",
+			"Total number of ingestion requests acknowledged without being applied again."),
+	}
+
+	reg.GaugeFunc("metric_server_idempotency_keys", "Number of remembered ingestion request keys.",
+		func() float64 { return float64(c.Len()) })
+
+	return c
+}
+
+// Begin reserves key for a request about to be applied. If the key is already
+// known it reports seen along with the status the request was answered with,
+// which is zero while that request is still being applied.
+func (c *Cache) Begin(key string) (status int, seen bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.expire(now)
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		if now.Before(e.expires) {
+			c.duplicates.Inc()
+			return e.status, true
+		}
+		c.remove(el)
+	}
+
+	c.add(&entry{key: key, expires: now.Add(c.ttl)})
+	return 0, false
+}
+
+// Complete records the status a request reserved with Begin was answered
+// with and queues its key for persistence. Keys of requests that failed with a
+// server error, or were never answered (status 0, as after a panic), are
+// released instead, as retrying them may succeed.
+func (c *Cache) Complete(key string, status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if status == 0 || status >= http.StatusInternalServerError {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		return
+	}
+
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.status = status
+		expires = e.expires
+	}
+
+	c.pending = append(c.pending, models.IdempotencyKey{Key: key, Status: status, Expires: expires})
+}
+
+// Pending returns and clears the keys completed since the previous call.
+func (c *Cache) Pending() []models.IdempotencyKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := c.pending
+	c.pending = nil
+	return keys
+}
+
+// Load remembers keys restored from persistent storage, skipping expired ones.
+// Keys should be ordered by expiry, oldest first.
+func (c *Cache) Load(keys []models.IdempotencyKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for _, k := range keys {
+		if !now.Before(k.Expires) {
+			continue
+		}
+		if el, ok := c.entries[k.Key]; ok {
+			c.remove(el)
+		}
+		c.add(&entry{key: k.Key, status: k.Status, expires: k.Expires})
+	}
+}
+
+// Merge remembers keys of requests applied by another instance and queues
+// them for persistence, as if the requests had been completed here.
+func (c *Cache) Merge(keys []models.IdempotencyKey) {
+	c.Load(keys)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, keys...)
+}
+
+// Len returns the number of remembered keys.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// MaxKeys returns the maximum number of remembered keys.
+func (c *Cache) MaxKeys() int {
+	return c.maxKeys
+}
+
+// add appends e as the newest key, evicting the oldest beyond the bound.
+func (c *Cache) add(e *entry) {
+	c.entries[e.key] = c.order.PushBack(e)
+	for c.order.Len() > c.maxKeys {
+		c.remove(c.order.Front())
+	}
+}
+
+// expire removes the expired keys from the oldest end.
+func (c *Cache) expire(now time.Time) {
+	for el := c.order.Front(); el != nil && !now.Before(el.Value.(*entry).expires); el = c.order.Front() {
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).key)
+	c.order.Remove(el)
+}
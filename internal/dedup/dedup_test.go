@@ -0,0 +1,110 @@
+package dedup
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+func newCache(cfg config.Idempotency) (*Cache, *time.Time) {
+	c := New(cfg, nil)
+	now := time.Date(2025, 6, 3, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCache_BeginComplete(t *testing.T) {
+	c, now := newCache(config.Idempotency{TTL: time.Minute})
+
+	status, seen := c.Begin("a")
+	require.False(t, seen)
+	require.Zero(t, status)
+
+	// A retry while the first request is being applied.
+	status, seen = c.Begin("a")
+	require.True(t, seen)
+	require.Zero(t, status)
+
+	c.Complete("a", http.StatusOK)
+	status, seen = c.Begin("a")
+	require.True(t, seen)
+	require.Equal(t, http.StatusOK, status)
+
+	_, seen = c.Begin("b")
+	require.False(t, seen)
+	c.Complete("b", http.StatusServiceUnavailable)
+	_, seen = c.Begin("b")
+	require.False(t, seen, "key of a failed request is applied again")
+
+	_, seen = c.Begin("c")
+	require.False(t, seen)
+	c.Complete("c", 0)
+	_, seen = c.Begin("c")
+	require.False(t, seen, "key of a request never answered is applied again")
+	pending := c.Pending()
+	require.Len(t, pending, 1, "only answered keys are persisted")
+	require.Equal(t, "a", pending[0].Key)
+
+	*now = now.Add(time.Minute)
+	_, seen = c.Begin("a")
+	require.False(t, seen, "expired key is applied again")
+	require.Equal(t, 1, c.Len())
+}
+
+func TestCache_MaxKeys(t *testing.T) {
+	c, _ := newCache(config.Idempotency{MaxKeys: 2})
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, seen := c.Begin(key)
+		require.False(t, seen)
+	}
+	require.Equal(t, 2, c.Len())
+
+	_, seen := c.Begin("c")
+	require.True(t, seen)
+	_, seen = c.Begin("a")
+	require.False(t, seen, "oldest key is evicted")
+}
+
+func TestCache_PendingAndLoad(t *testing.T) {
+	c, now := newCache(config.Idempotency{TTL: time.Hour})
+
+	c.Begin("a")
+	c.Complete("a", http.StatusOK)
+	c.Begin("b")
+	c.Complete("b", http.StatusTooManyRequests)
+
+	pending := c.Pending()
+	require.Equal(t, []models.IdempotencyKey{
+		{Key: "a", Status: http.StatusOK, Expires: now.Add(time.Hour)},
+		{Key: "b", Status: http.StatusTooManyRequests, Expires: now.Add(time.Hour)},
+	}, pending)
+	require.Empty(t, c.Pending())
+
+	restored, _ := newCache(config.Idempotency{TTL: time.Hour})
+	restored.Load(append([]models.IdempotencyKey{{Key: "old", Status: http.StatusOK, Expires: *now}}, pending...))
+	require.Equal(t, 2, restored.Len())
+
+	status, seen := restored.Begin("b")
+	require.True(t, seen)
+	require.Equal(t, http.StatusTooManyRequests, status)
+	_, seen = restored.Begin("old")
+	require.False(t, seen)
+}
+
+func TestCache_Merge(t *testing.T) {
+	c, now := newCache(config.Idempotency{TTL: time.Hour})
+	keys := []models.IdempotencyKey{{Key: "a", Status: http.StatusOK, Expires: now.Add(time.Minute)}}
+
+	c.Merge(keys)
+	require.Equal(t, keys, c.Pending())
+
+	status, seen := c.Begin("a")
+	require.True(t, seen)
+	require.Equal(t, http.StatusOK, status)
+}
@@ -0,0 +1,250 @@
+// Package election elects the leader among instances sharing a database, so
+// that a single instance writes to PostgreSQL. The leader holds a PostgreSQL
+// advisory lock for as long as its session lives and records the URL it is
+// reached at. It flushes to PostgreSQL and runs the background jobs; followers
+// send what they would flush to the leader instead, which merges it into its
+// memory and persists it with its own data. On shutdown the leader releases
+// the lock after its final flush, handing over to the next follower trying to
+// take it.
+package election
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// MergePath is the internal endpoint of the leader receiving the flushes of followers.
+const MergePath = "/internal/election/merge"
+
+// Election defaults applied to unset configuration values.
+const (
+	// DefaultLockID is the advisory lock key, "metrics" in ASCII.
+	DefaultLockID   int64 = 0x6d657472696373
+	DefaultInterval       = 5 * time.Second
+	DefaultTimeout        = 10 * time.Second
+)
+
+// Lock is the held leader lock. Save persists the flushes of the leader in
+// the session holding the lock, failing with storage.ErrLockLost once it is
+// not held anymore. Close drops a lock that is lost, closing its session so
+// that the lock is released even if the session lingers.
+type Lock interface {
+	Check(ctx context.Context) error
+	Save(ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey) error
+	Release(ctx context.Context) error
+	Close(ctx context.Context)
+}
+
+// Store defines the interface for the persistent storage shared by the
+// instances, electing the leader.
+type Store interface {
+	TryLeaderLock(ctx context.Context, id int64, url string) (Lock, error)
+	Leader(ctx context.Context, id int64) (string, error)
+}
+
+// MemStorage defines the interface for the in-memory store of the leader
+// the flushes of followers are merged into.
+type MemStorage interface {
+	Apply(mutations []storage.Mutation)
+}
+
+// KeyStore defines the interface for the idempotency keys of the leader the
+// keys flushed by followers are merged into.
+type KeyStore interface {
+	Merge(keys []models.IdempotencyKey)
+}
+
+// Elector campaigns for leadership and routes flushes to the leader.
+type Elector struct {
+	store    Store
+	mem      MemStorage
+	keys     KeyStore
+	lockID   int64
+	self     string
+	token    string
+	interval time.Duration
+	http     *http.Client
+	log      *slog.Logger
+
+	// mu serializes campaigns and resignation and guards lock.
+	mu     sync.Mutex
+	lock   Lock
+	leader atomic.Bool
+
+	isLeader  *telemetry.Gauge
+	elections *telemetry.Counter
+	merged    *telemetry.Counter
+}
+
+// Option configures optional Elector behaviour.
+type Option func(*Elector)
+
+// WithToken sets the bearer token authenticating the flushes sent to the leader.
+func WithToken(token string) Option {
+	return func(e *Elector) {
+		e.token = token
+	}
+}
+
+// New creates the Elector of this instance, merging the flushes of followers
+// into mem and keys while leader.
+func New(
+	cfg config.Election, store Store, mem MemStorage, keys KeyStore, reg *telemetry.Registry, log *slog.Logger,
+	opts ...Option,
+) (*Elector, error) {
+	if cfg.Self == "" {
+		return nil, errors.New("election self URL is required")
+	}
+
+	lockID := cfg.LockID
+	if lockID == 0 {
+		lockID = DefaultLockID
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	e := &Elector{
+		store:    store,
+		mem:      mem,
+		keys:     keys,
+		lockID:   lockID,
+		self:     strings.TrimSuffix(cfg.Self, "/"),
+		interval: interval,
+		http:     &http.Client{Timeout: timeout},
+		log:      log,
+		isLeader: reg.Gauge("metric_server_election_leader",
+			"Whether this instance is the leader."),
+		elections: reg.Counter("metric_server_election_elected_total",
+			"Total number of times this instance was elected leader."),
+		merged: reg.Counter("metric_server_election_merged_samples_total",
+			"Total number of samples flushed by followers and merged into the memory of the leader."),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e, nil
+}
+
+// Leader reports whether this instance is the leader.
+func (e *Elector) Leader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns for leadership every interval until the context is canceled:
+// a follower tries to take the lock and the leader checks it still holds it.
+// Leadership is kept after Run returns, until Resign.
+func (e *Elector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.campaign(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) campaign(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lock != nil {
+		err := e.lock.Check(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		e.lose(ctx, err)
+		return
+	}
+
+	lock, err := e.store.TryLeaderLock(ctx, e.lockID, e.self)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.log.Error("leader election failed", logger.Err(err))
+		}
+		return
+	}
+	if lock != nil {
+		e.log.Info("elected leader", slog.String("self", e.self))
+		e.elections.Inc()
+		e.setLock(lock)
+	}
+}
+
+// lose steps down after the lock was lost; e.mu must be held.
+func (e *Elector) lose(ctx context.Context, err error) {
+	e.log.Warn("lost leadership", logger.Err(err))
+	e.lock.Close(ctx)
+	e.setLock(nil)
+}
+
+// setLock records the held lock, nil when a follower; e.mu must be held.
+func (e *Elector) setLock(lock Lock) {
+	e.lock = lock
+	e.leader.Store(lock != nil)
+	if lock != nil {
+		e.isLeader.Set(1)
+	} else {
+		e.isLeader.Set(0)
+	}
+}
+
+// Resign releases leadership, if held, so that a follower takes over. It is
+// called on shutdown once the final flush is done.
+func (e *Elector) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lock == nil {
+		return nil
+	}
+
+	lock := e.lock
+	e.setLock(nil)
+	if err := lock.Release(ctx); err != nil {
+		return err
+	}
+	e.log.Info("resigned leadership")
+	return nil
+}
+
+// postgresStore adapts the PostgreSQL storage to Store.
+type postgresStore struct {
+	*storage.PostgresStorage
+}
+
+// Postgres returns the Store of the PostgreSQL storage db.
+func Postgres(db *storage.PostgresStorage) Store {
+	return postgresStore{db}
+}
+
+func (s postgresStore) TryLeaderLock(ctx context.Context, id int64, url string) (Lock, error) {
+	lock, err := s.PostgresStorage.TryLeaderLock(ctx, id, url)
+	if lock == nil {
+		return nil, err
+	}
+	return lock, nil
+}
@@ -0,0 +1,240 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/dedup"
+	"github.com/sanchey92/metric-server/internal/http-server/middleware"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+// fakeStore is a database shared by the instances of a test.
+type fakeStore struct {
+	mu     sync.Mutex
+	holder *fakeLock
+	leader string
+	saved  [][]models.Sample
+}
+
+type fakeLock struct {
+	store  *fakeStore
+	err    error
+	closed bool
+}
+
+func (s *fakeStore) TryLeaderLock(_ context.Context, _ int64, url string) (Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.holder != nil {
+		return nil, nil
+	}
+	s.holder = &fakeLock{store: s}
+	s.leader = url
+	return s.holder, nil
+}
+
+func (s *fakeStore) Leader(context.Context, int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader, nil
+}
+
+func (l *fakeLock) Check(context.Context) error {
+	return l.err
+}
+
+// Save records the flush if the lock is still held by its session.
+func (l *fakeLock) Save(_ context.Context, current, _ []models.Sample, _ []models.IdempotencyKey) error {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	if l.store.holder != l {
+		return storage.ErrLockLost
+	}
+	l.store.saved = append(l.store.saved, current)
+	return nil
+}
+
+func (l *fakeLock) Release(context.Context) error {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	l.store.holder, l.store.leader = nil, ""
+	return nil
+}
+
+// Close releases the lock as the database does once the session is closed,
+// keeping the leader record.
+func (l *fakeLock) Close(context.Context) {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	l.closed = true
+	if l.store.holder == l {
+		l.store.holder = nil
+	}
+}
+
+// token authenticates the flushes sent to the leader.
+const token = "secret"
+
+// instance is an elector serving its merge endpoint.
+type instance struct {
+	elector *Elector
+	mem     *storage.MemStorage
+	keys    *dedup.Cache
+}
+
+func start(t *testing.T, store *fakeStore) *instance {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(nil)
+	mem := storage.NewMemStorage(4)
+	keys := dedup.New(config.Idempotency{}, nil)
+
+	e, err := New(config.Election{Self: "http://" + srv.Listener.Addr().String()}, store, mem, keys, nil,
+		slog.New(slog.DiscardHandler), WithToken(token))
+	require.NoError(t, err)
+
+	srv.Config.Handler = middleware.BearerToken(token)(e)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return &instance{elector: e, mem: mem, keys: keys}
+}
+
+func TestElector_Campaign(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStore{}
+	a, b := start(t, store), start(t, store)
+
+	a.elector.campaign(ctx)
+	b.elector.campaign(ctx)
+	require.True(t, a.elector.Leader())
+	require.False(t, b.elector.Leader())
+	require.Equal(t, a.elector.self, store.leader)
+
+	// A clean handover: the follower takes over once the leader resigns.
+	require.NoError(t, a.elector.Resign(ctx))
+	require.False(t, a.elector.Leader())
+	b.elector.campaign(ctx)
+	require.True(t, b.elector.Leader())
+
+	// A leader whose session is lost steps down and closes it, so that the
+	// lock can be taken again.
+	lost := store.holder
+	lost.err = errors.New("connection reset")
+	b.elector.campaign(ctx)
+	require.False(t, b.elector.Leader())
+	require.True(t, lost.closed)
+
+	a.elector.campaign(ctx)
+	require.True(t, a.elector.Leader())
+	require.Equal(t, a.elector.self, store.leader)
+}
+
+func TestElector_Save(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStore{}
+	leader, follower := start(t, store), start(t, store)
+
+	// Without a leader, flushes of followers fail and are carried over.
+	require.ErrorIs(t, follower.elector.Save(ctx, nil, nil, nil), errNoLeader)
+
+	leader.elector.campaign(ctx)
+
+	current := []models.Sample{{Key: "cpu", Value: 1, Timestamp: time.Now()}}
+	require.NoError(t, leader.elector.Save(ctx, current, nil, nil))
+	require.Len(t, store.saved, 1)
+
+	// The follower's flush is merged into the memory of the leader.
+	at := time.Now().Add(-time.Minute).Truncate(time.Millisecond).UTC()
+	follower.mem.SetBatch([]models.Metric{
+		{Name: "load", Value: 2, Timestamp: at.UnixMilli()},
+		{Name: "requests", Value: 3},
+	})
+	key := models.IdempotencyKey{Key: "k", Status: http.StatusOK, Expires: time.Now().Add(time.Hour).UTC()}
+
+	fc, fh := follower.mem.Pending()
+	require.NoError(t, follower.elector.Save(ctx, fc, fh, []models.IdempotencyKey{key}))
+	require.Len(t, store.saved, 1, "followers do not write to the store")
+
+	// Flushes are only accepted with the token.
+	follower.elector.token = "wrong"
+	require.ErrorContains(t, follower.elector.Save(ctx, fc, fh, nil), "401")
+	follower.elector.token = token
+
+	_, history := leader.mem.Pending()
+	require.ElementsMatch(t, []string{"load", "requests"}, keysOf(leader.mem.Latest()))
+	require.Len(t, history, 2)
+	for _, s := range history {
+		if s.Key == "load" {
+			require.True(t, at.Equal(s.Timestamp))
+		} else {
+			require.True(t, s.Timestamp.IsZero(), "series written without timestamp")
+		}
+	}
+
+	keys := leader.keys.Pending()
+	require.Len(t, keys, 1)
+	require.Equal(t, key.Key, keys[0].Key)
+	_, seen := leader.keys.Begin(key.Key)
+	require.True(t, seen)
+}
+
+func TestElector_SaveLostLock(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStore{}
+	a, b := start(t, store), start(t, store)
+
+	a.elector.campaign(ctx)
+	require.True(t, a.elector.Leader())
+
+	// The database releases the lock of a behind the back of its elector,
+	// and b takes it before a checks it again.
+	store.mu.Lock()
+	lost := store.holder
+	store.holder = nil
+	store.mu.Unlock()
+	b.elector.campaign(ctx)
+	require.True(t, b.elector.Leader())
+
+	// a steps down without writing and sends its flush to b instead.
+	current := []models.Sample{{Key: "cpu", Value: 1, Timestamp: time.Now().Truncate(time.Millisecond)}}
+	require.NoError(t, a.elector.Save(ctx, current, nil, nil))
+	require.False(t, a.elector.Leader())
+	require.True(t, lost.closed)
+	require.Empty(t, store.saved)
+	require.Equal(t, []string{"cpu"}, keysOf(b.mem.Latest()))
+	require.NotNil(t, store.holder)
+	require.Equal(t, b.elector.self, store.leader)
+}
+
+func TestElector_MergeRefusedByFollower(t *testing.T) {
+	store := &fakeStore{}
+	follower := start(t, store)
+
+	rec := httptest.NewRecorder()
+	follower.elector.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, MergePath, nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	_, err := New(config.Election{}, store, nil, nil, nil, slog.Default())
+	require.Error(t, err)
+}
+
+func keysOf(samples []models.Sample) []string {
+	keys := make([]string, len(samples))
+	for i, s := range samples {
+		keys[i] = s.Key
+	}
+	return keys
+}
@@ -0,0 +1,155 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+// errNoLeader is returned by flushes of followers while no leader is known.
+var errNoLeader = errors.New("no leader elected")
+
+// flush is what a follower would have saved, sent to the leader as MessagePack.
+type flush struct {
+	Current []models.Sample         `json:"current"`
+	History []models.Sample         `json:"history,omitempty"`
+	Keys    []models.IdempotencyKey `json:"keys,omitempty"`
+}
+
+// Save persists a flush: the leader saves it to the store, followers send it
+// to the leader. It is meant to be used by the flusher in place of the store;
+// a flush failing for lack of a leader is carried over to the next one.
+func (e *Elector) Save(ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey) error {
+	if saved, err := e.saveAsLeader(ctx, current, history, keys); saved {
+		return err
+	}
+
+	leader, err := e.store.Leader(ctx, e.lockID)
+	if err != nil {
+		return err
+	}
+	// A leader record of this instance is left over from a lost leadership.
+	if leader == "" || leader == e.self {
+		return errNoLeader
+	}
+
+	var body bytes.Buffer
+	enc := msgpack.NewEncoder(&body)
+	enc.SetCustomStructTag("json")
+	if err = enc.Encode(flush{Current: current, History: history, Keys: keys}); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leader+MergePath, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", codec.ContentTypeMsgpack)
+	req.Header.Set("Authorization", "Bearer "+e.token)
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send flush to leader %s: %w", leader, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("leader %s returned %d: %s", leader, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// saveAsLeader saves a flush through the leader lock, if held, and reports
+// whether it did. Leadership is checked on the session holding the lock rather
+// than trusted from the last campaign: a leader that lost the lock steps down
+// without writing, and the flush is sent to the new leader instead.
+func (e *Elector) saveAsLeader(
+	ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey,
+) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lock == nil {
+		return false, nil
+	}
+
+	err := e.lock.Save(ctx, current, history, keys)
+	if err == nil || ctx.Err() != nil {
+		return true, err
+	}
+	if !errors.Is(err, storage.ErrLockLost) {
+		// A failed save may be due to the session holding the lock.
+		if checkErr := e.lock.Check(ctx); checkErr == nil {
+			return true, err
+		}
+	}
+
+	e.lose(ctx, err)
+	return false, nil
+}
+
+// ServeHTTP merges the flush of a follower into the memory and idempotency
+// keys of the leader, which persists them with its next flush. Instances that
+// are not the leader answer 503, so that the follower retries.
+func (e *Elector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.Leader() {
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	dec := msgpack.NewDecoder(r.Body)
+	dec.SetCustomStructTag("json")
+
+	var f flush
+	if err := dec.Decode(&f); err != nil {
+		logger.FromContext(r.Context()).Warn("invalid flush from follower", logger.Err(err))
+		http.Error(w, "invalid flush", http.StatusBadRequest)
+		return
+	}
+
+	mutations := merge(f.Current, f.History)
+	e.mem.Apply(mutations)
+	if len(f.Keys) > 0 {
+		e.keys.Merge(f.Keys)
+	}
+	e.merged.Add(float64(len(mutations)))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// merge converts a flush into the writes recreating it in memory. History
+// samples without a timestamp stand for the current value of series written
+// without one, which the leader records at the time of its own flush.
+func merge(current, history []models.Sample) []storage.Mutation {
+	unstamped := make(map[string]bool)
+	mutations := make([]storage.Mutation, 0, len(current)+len(history))
+
+	for _, s := range history {
+		if s.Timestamp.IsZero() {
+			unstamped[s.Key] = true
+			continue
+		}
+		mutations = append(mutations, storage.Mutation{Op: storage.OpWrite, Sample: s, Stamped: true, History: true})
+	}
+
+	for _, s := range current {
+		mutations = append(mutations, storage.Mutation{
+			Op: storage.OpWrite, Sample: s, Stamped: !unstamped[s.Key], Current: true,
+		})
+	}
+
+	return mutations
+}
@@ -6,19 +6,39 @@ package flusher
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"sync"
 	"time"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
 )
 
-// MemStorage defines the interface for in-memory metric storage that
-// can provide snapshots of current metrics.
+// finalFlushTimeout bounds the flush performed on shutdown.
+const finalFlushTimeout = 30 * time.Second
+
+// maxCarry bounds the number of timestamped history samples kept across failed flushes.
+const maxCarry = 1_000_000
+
+// MemStorage defines the interface for in-memory metric storage that can
+// provide the current metrics and the samples to append to history.
 type MemStorage interface {
-	Snapshot() map[string]float64
+	Pending() (current, history []models.Sample)
 }
 
 // PostgresStorage defines the interface for persistent metric storage
-// that can save batches of metrics.
+// that can save batches of metrics. History samples with a zero timestamp
+// are recorded at the time of the save. The idempotency keys of the requests
+// that wrote the batch are saved with it.
 type PostgresStorage interface {
-	Save(ctx context.Context, data map[string]float64) error
+	Save(ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey) error
+}
+
+// KeyStore defines the interface for the idempotency keys of applied
+// ingestion requests awaiting persistence.
+type KeyStore interface {
+	Pending() []models.IdempotencyKey
 }
 
 // Flusher implements periodic synchronization of metrics from memory to database.
@@ -27,14 +47,98 @@ type Flusher struct {
 	interval   time.Duration
 	memStorage MemStorage
 	db         PostgresStorage
+	keys       KeyStore
+	log        *slog.Logger
+	metrics    flusherMetrics
+	before     []func(ctx context.Context)
+	active     func() bool
+
+	// mu serializes periodic and on-demand flushes and guards carry and carryKeys.
+	mu sync.Mutex
+	// carry holds the timestamped history samples of failed flushes, which
+	// are no longer held in memory.
+	carry []models.Sample
+	// carryKeys holds the idempotency keys of failed flushes.
+	carryKeys []models.IdempotencyKey
+}
+
+// flusherMetrics groups the self-instrumentation of the flush cycle.
+type flusherMetrics struct {
+	duration    *telemetry.Histogram
+	batchSize   *telemetry.Gauge
+	failures    *telemetry.Counter
+	lastSuccess *telemetry.Gauge
+}
+
+// Option configures optional Flusher dependencies.
+type Option func(*Flusher)
+
+// WithTelemetry registers the flusher's self-instrumentation in the given registry.
+func WithTelemetry(reg *telemetry.Registry) Option {
+	return func(f *Flusher) {
+		f.metrics = newFlusherMetrics(reg)
+	}
+}
+
+// WithLogger sets the logger used to report flush results.
+func WithLogger(log *slog.Logger) Option {
+	return func(f *Flusher) {
+		f.log = log
+	}
+}
+
+// WithBeforeFlush registers a function called at the start of every flush,
+// before the in-memory snapshot is taken, so that values it writes to memory
+// are persisted by the same flush.
+func WithBeforeFlush(fn func(ctx context.Context)) Option {
+	return func(f *Flusher) {
+		f.before = append(f.before, fn)
+	}
+}
+
+// WithIdempotencyKeys persists the idempotency keys of applied ingestion
+// requests together with the metrics they wrote.
+func WithIdempotencyKeys(keys KeyStore) Option {
+	return func(f *Flusher) {
+		f.keys = keys
+	}
+}
+
+// WithActive only flushes while active reports true, such as on a replica
+// once it is promoted.
+func WithActive(active func() bool) Option {
+	return func(f *Flusher) {
+		f.active = active
+	}
 }
 
 // New creates a new Flusher instance with the specified configuration.
-func New(interval time.Duration, storage MemStorage, db PostgresStorage) *Flusher {
-	return &Flusher{
+func New(interval time.Duration, storage MemStorage, db PostgresStorage, opts ...Option) *Flusher {
+	f := &Flusher{
 		interval:   interval,
 		memStorage: storage,
 		db:         db,
+		log:        slog.Default(),
+		metrics:    newFlusherMetrics(nil),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+func newFlusherMetrics(reg *telemetry.Registry) flusherMetrics {
+	return flusherMetrics{
+		duration: reg.Histogram("metric_server_flush_duration_seconds",
+			"Duration of flushes to persistent storage.", nil),
+		batchSize: reg.Gauge("metric_server_flush_batch_size",
+			"Number of metrics in the most recent flush."),
+		failures: reg.Counter("metric_server_flush_failures_total",
+			"Total number of failed flushes."),
+		lastSuccess: reg.Gauge("metric_server_flush_last_success_timestamp_seconds",
+			"Unix time of the last successful flush."),
 	}
 }
 
@@ -63,28 +167,106 @@ func (f *Flusher) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return f.flush(ctx)
+			// The final flush outlives the canceled context, as nothing is persisted otherwise.
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+			_, err := f.Flush(flushCtx)
+			cancel()
+			return err
 		case <-ticker.C:
-			if err := f.flush(ctx); err != nil {
-				fmt.Println("failed to save metrics: %w\n", err)
+			if _, err := f.Flush(ctx); err != nil {
+				f.log.Error("periodic flush failed", logger.Err(err))
 			}
 		}
 	}
 }
 
-// flush performs the actual synchronization of metrics from memory to database.
-// It's called both periodically and during shutdown.
-func (f *Flusher) flush(ctx context.Context) error {
-	snapshot := f.memStorage.Snapshot()
+// Flush performs the actual synchronization of metrics from memory to database
+// and returns the number of series persisted. It's called periodically, during
+// shutdown and on demand; concurrent calls run one after the other.
+func (f *Flusher) Flush(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active != nil && !f.active() {
+		return 0, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		f.metrics.duration.Observe(time.Since(start).Seconds())
+	}()
+
+	for _, fn := range f.before {
+		fn(ctx)
+	}
+
+	// Keys are taken before the snapshot, so the metrics of every request
+	// whose key is saved are part of the same batch.
+	var keys []models.IdempotencyKey
+	if f.keys != nil {
+		keys = f.keys.Pending()
+	}
+	if len(f.carryKeys) > 0 {
+		keys = append(f.carryKeys, keys...)
+		f.carryKeys = nil
+	}
+
+	current, history := f.memStorage.Pending()
+	f.metrics.batchSize.Set(float64(len(current)))
+
+	if len(f.carry) > 0 {
+		history = append(f.carry, history...)
+		f.carry = nil
+	}
 
-	if len(snapshot) == 0 {
-		return nil
+	if len(current) == 0 && len(history) == 0 && len(keys) == 0 {
+		return 0, nil
 	}
 
-	if err := f.db.Save(ctx, snapshot); err != nil {
-		return fmt.Errorf("failed to save metrics: %w", err)
+	if err := f.db.Save(ctx, current, history, keys); err != nil {
+		f.metrics.failures.Inc()
+		f.keep(history, keys)
+		return 0, fmt.Errorf("failed to save metrics: %w", err)
 	}
 
-	fmt.Printf("Successfully flushed %d metrics\n", len(snapshot))
+	f.metrics.lastSuccess.Set(float64(time.Now().Unix()))
+	f.log.Info("flushed metrics", slog.Int("count", len(current)), slog.Int("samples", len(history)))
+	return len(current), nil
+}
+
+// Exclusive runs fn while no flush is in progress, for changes to memory and
+// the database that must not interleave with one. fn is passed the history
+// carried over from failed flushes and returns the history to carry over
+// instead.
+func (f *Flusher) Exclusive(fn func(carry []models.Sample) ([]models.Sample, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	carry, err := fn(f.carry)
+	if err != nil {
+		return err
+	}
+	f.carry = carry
 	return nil
 }
+
+// keep carries the timestamped samples and the idempotency keys of a failed
+// flush over to the next one, dropping the oldest beyond maxCarry. Samples
+// without a timestamp are rebuilt from memory by the next flush.
+func (f *Flusher) keep(history []models.Sample, keys []models.IdempotencyKey) {
+	f.carryKeys = keys
+	if excess := len(f.carryKeys) - maxCarry; excess > 0 {
+		f.carryKeys = f.carryKeys[excess:]
+	}
+
+	for _, s := range history {
+		if !s.Timestamp.IsZero() {
+			f.carry = append(f.carry, s)
+		}
+	}
+
+	if excess := len(f.carry) - maxCarry; excess > 0 {
+		f.log.Warn("dropping history samples of failed flushes", slog.Int("count", excess))
+		f.carry = f.carry[excess:]
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/sanchey92/metric-server/internal/flusher/mocks"
+	"github.com/sanchey92/metric-server/internal/models"
 )
 
 func TestFlusher_Run(t *testing.T) {
@@ -26,12 +27,9 @@ func TestFlusher_Run(t *testing.T) {
 			contextTimeout: 250 * time.Millisecond,
 			expectedError:  nil,
 			setupMocks: func(mockMem *mocks.MockMemStorage, mockDB *mocks.MockPostgresStorage) {
-				metrics := map[string]float64{
-					"cpu":    43.5,
-					"memory": 75.0,
-				}
-				mockMem.EXPECT().Snapshot().Return(metrics).MinTimes(1)
-				mockDB.EXPECT().Save(gomock.Any(), metrics).MinTimes(1)
+				current := []models.Sample{{Key: "cpu", Value: 43.5}, {Key: "memory", Value: 75.0}}
+				mockMem.EXPECT().Pending().Return(current, current).MinTimes(1)
+				mockDB.EXPECT().Save(gomock.Any(), current, current, gomock.Nil()).MinTimes(1)
 			},
 		},
 		{
@@ -40,7 +38,7 @@ func TestFlusher_Run(t *testing.T) {
 			contextTimeout: 250 * time.Millisecond,
 			expectedError:  nil,
 			setupMocks: func(mockMem *mocks.MockMemStorage, _ *mocks.MockPostgresStorage) {
-				mockMem.EXPECT().Snapshot().Return(map[string]float64{}).MinTimes(1)
+				mockMem.EXPECT().Pending().Return(nil, nil).MinTimes(1)
 			},
 		},
 		{
@@ -49,11 +47,11 @@ func TestFlusher_Run(t *testing.T) {
 			contextTimeout: 250 * time.Millisecond,
 			expectedError:  errors.New("failed to save metrics: database connection error"),
 			setupMocks: func(mockMem *mocks.MockMemStorage, mockDB *mocks.MockPostgresStorage) {
-				metrics := map[string]float64{"cpu": 42.5}
-				mockMem.EXPECT().Snapshot().Return(metrics).MinTimes(1)
+				current := []models.Sample{{Key: "cpu", Value: 42.5}}
+				mockMem.EXPECT().Pending().Return(current, current).MinTimes(1)
 				dbErr := errors.New("database connection error")
-				mockDB.EXPECT().Save(gomock.Any(), metrics).Return(dbErr).MinTimes(1)
-				mockDB.EXPECT().Save(gomock.Any(), metrics).Return(dbErr).MaxTimes(1)
+				mockDB.EXPECT().Save(gomock.Any(), current, current, gomock.Nil()).Return(dbErr).MinTimes(1)
+				mockDB.EXPECT().Save(gomock.Any(), current, current, gomock.Nil()).Return(dbErr).MaxTimes(1)
 			},
 		},
 		{
@@ -62,9 +60,9 @@ func TestFlusher_Run(t *testing.T) {
 			contextTimeout: 50 * time.Millisecond,
 			expectedError:  nil,
 			setupMocks: func(mockMem *mocks.MockMemStorage, mockDB *mocks.MockPostgresStorage) {
-				metrics := map[string]float64{"cpu": 42.5}
-				mockMem.EXPECT().Snapshot().Return(metrics).Times(1)
-				mockDB.EXPECT().Save(gomock.Any(), metrics).Return(nil).Times(1)
+				current := []models.Sample{{Key: "cpu", Value: 42.5}}
+				mockMem.EXPECT().Pending().Return(current, current).Times(1)
+				mockDB.EXPECT().Save(gomock.Any(), current, current, gomock.Nil()).Return(nil).Times(1)
 			},
 		},
 	}
@@ -95,3 +93,160 @@ func TestFlusher_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestFlusher_BeforeFlush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMem := mocks.NewMockMemStorage(ctrl)
+	mockDB := mocks.NewMockPostgresStorage(ctrl)
+
+	var called bool
+	recorded := []models.Sample{{Key: "cpu", Value: 1}, {Key: "cpu:ratio", Value: 0.5}}
+
+	mockMem.EXPECT().Pending().DoAndReturn(func() ([]models.Sample, []models.Sample) {
+		require.True(t, called, "hook must run before the snapshot is taken")
+		return recorded, recorded
+	}).Times(1)
+	mockDB.EXPECT().Save(gomock.Any(), recorded, recorded, gomock.Nil()).Return(nil).Times(1)
+
+	f := New(time.Hour, mockMem, mockDB, WithBeforeFlush(func(context.Context) { called = true }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.NoError(t, f.Run(ctx))
+}
+
+func TestFlusher_Active(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMem := mocks.NewMockMemStorage(ctrl)
+	mockDB := mocks.NewMockPostgresStorage(ctrl)
+
+	current := []models.Sample{{Key: "cpu", Value: 1}}
+	mockMem.EXPECT().Pending().Return(current, current).Times(1)
+	mockDB.EXPECT().Save(gomock.Any(), current, current, gomock.Nil()).Return(nil).Times(1)
+
+	var active, hooked bool
+	f := New(time.Hour, mockMem, mockDB,
+		WithActive(func() bool { return active }),
+		WithBeforeFlush(func(context.Context) { hooked = true }),
+	)
+
+	n, err := f.Flush(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.False(t, hooked, "inactive flusher must not run hooks")
+
+	active = true
+	n, err = f.Flush(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.True(t, hooked)
+}
+
+func TestFlusher_CarriesTimestampedSamplesOverFailures(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMem := mocks.NewMockMemStorage(ctrl)
+	mockDB := mocks.NewMockPostgresStorage(ctrl)
+
+	ts := time.Unix(1700000000, 0).UTC()
+	current := []models.Sample{{Key: "cpu", Value: 2, Timestamp: ts.Add(time.Second)}, {Key: "mem", Value: 5}}
+	first := []models.Sample{{Key: "cpu", Value: 1, Timestamp: ts}, {Key: "mem", Value: 5}}
+	second := []models.Sample{{Key: "cpu", Value: 2, Timestamp: ts.Add(time.Second)}, {Key: "mem", Value: 5}}
+
+	gomock.InOrder(
+		mockMem.EXPECT().Pending().Return(current, first),
+		mockDB.EXPECT().Save(gomock.Any(), current, first, gomock.Nil()).Return(errors.New("database connection error")),
+		mockMem.EXPECT().Pending().Return(current, second),
+		// The timestamped sample of the failed flush is kept; the untimestamped one is rebuilt from memory.
+		mockDB.EXPECT().Save(gomock.Any(), current, append([]models.Sample{first[0]}, second...), gomock.Nil()).Return(nil),
+	)
+
+	f := New(time.Hour, mockMem, mockDB)
+
+	_, err := f.Flush(context.Background())
+	require.Error(t, err)
+
+	n, err := f.Flush(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+}
+
+func TestFlusher_Exclusive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMem := mocks.NewMockMemStorage(ctrl)
+	mockDB := mocks.NewMockPostgresStorage(ctrl)
+
+	ts := time.Unix(1700000000, 0).UTC()
+	history := []models.Sample{{Key: "cpu", Value: 1, Timestamp: ts}, {Key: "mem", Value: 5, Timestamp: ts}}
+	dbErr := errors.New("database connection error")
+
+	gomock.InOrder(
+		mockMem.EXPECT().Pending().Return(nil, history),
+		mockDB.EXPECT().Save(gomock.Any(), gomock.Nil(), history, gomock.Nil()).Return(dbErr),
+		mockMem.EXPECT().Pending().Return(nil, nil),
+		// Only the history kept by the exclusive change is carried over.
+		mockDB.EXPECT().Save(gomock.Any(), gomock.Nil(), history[1:], gomock.Nil()).Return(nil),
+	)
+
+	f := New(time.Hour, mockMem, mockDB)
+
+	_, err := f.Flush(context.Background())
+	require.Error(t, err)
+
+	require.Error(t, f.Exclusive(func([]models.Sample) ([]models.Sample, error) {
+		return nil, errors.New("failed change")
+	}))
+	require.NoError(t, f.Exclusive(func(carry []models.Sample) ([]models.Sample, error) {
+		require.Equal(t, history, carry)
+		return carry[1:], nil
+	}))
+
+	_, err = f.Flush(context.Background())
+	require.NoError(t, err)
+}
+
+func TestFlusher_IdempotencyKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockMem := mocks.NewMockMemStorage(ctrl)
+	mockDB := mocks.NewMockPostgresStorage(ctrl)
+	mockKeys := mocks.NewMockKeyStore(ctrl)
+
+	current := []models.Sample{{Key: "cpu", Value: 1}}
+	expires := time.Unix(1700000000, 0).UTC()
+	first := []models.IdempotencyKey{{Key: "a", Status: 200, Expires: expires}}
+	second := []models.IdempotencyKey{{Key: "b", Status: 200, Expires: expires}}
+
+	gomock.InOrder(
+		// Keys are taken before the snapshot of the metrics they wrote.
+		mockKeys.EXPECT().Pending().Return(first),
+		mockMem.EXPECT().Pending().Return(current, current),
+		mockDB.EXPECT().Save(gomock.Any(), current, current, first).Return(errors.New("database connection error")),
+		mockKeys.EXPECT().Pending().Return(second),
+		mockMem.EXPECT().Pending().Return(current, current),
+		mockDB.EXPECT().Save(gomock.Any(), current, current, append(first, second...)).Return(nil),
+		// Keys alone are saved too.
+		mockKeys.EXPECT().Pending().Return(second),
+		mockMem.EXPECT().Pending().Return(nil, nil),
+		mockDB.EXPECT().Save(gomock.Any(), gomock.Nil(), gomock.Nil(), second).Return(nil),
+	)
+
+	f := New(time.Hour, mockMem, mockDB, WithIdempotencyKeys(mockKeys))
+
+	_, err := f.Flush(context.Background())
+	require.Error(t, err)
+
+	for range 2 {
+		_, err = f.Flush(context.Background())
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,318 @@
+// Package forward tees ingested metrics to downstream systems, such as another
+// metric server during a migration. Every destination has its own filtering,
+// bounded queue, batching and retries, so a slow or failing destination never
+// delays ingestion, the other destinations or the PostgreSQL flusher.
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/relabel"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Supported destination types.
+const (
+	TypeMetricServer = "metric-server"
+	TypeRemoteWrite  = "remote-write"
+	TypeInflux       = "influx"
+	TypeGraphite     = "graphite"
+)
+
+// Destination defaults applied to unset configuration values.
+const (
+	DefaultQueueSize     = 10000
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = time.Second
+	DefaultTimeout       = 10 * time.Second
+	DefaultMaxRetries    = 3
+	DefaultBackoff       = time.Second
+)
+
+// Reasons metrics are dropped for, used as the reason label of the drop counter.
+const (
+	reasonQueueFull = "queue_full"
+	reasonFailed    = "send_failed"
+)
+
+// errPermanent marks a send failure that retrying cannot fix.
+var errPermanent = errors.New("permanent failure")
+
+// batch is a group of metrics sent to a destination in one request. The ID
+// stays the same across retries.
+type batch struct {
+	id      string
+	metrics []models.Metric
+}
+
+// sink delivers batches to a downstream system.
+type sink interface {
+	send(ctx context.Context, b batch) error
+	close() error
+}
+
+// Manager forwards metrics to the configured destinations.
+type Manager struct {
+	destinations []*destination
+}
+
+// New creates a Manager for the given destinations, registering its counters
+// in reg. It fails if a destination has an unknown type or invalid relabeling.
+func New(cfgs []config.Destination, reg *telemetry.Registry, log *slog.Logger) (*Manager, error) {
+	m := &Manager{}
+
+	sent := reg.CounterVec("metric_server_forward_metrics_total",
+		"Total number of metrics delivered to forwarding destinations.", "destination")
+	dropped := reg.CounterVec("metric_server_forward_dropped_total",
+		"Total number of metrics dropped by forwarding destinations.", "destination", "reason")
+	failures := reg.CounterVec("metric_server_forward_failures_total",
+		"Total number of failed attempts to send a batch to a forwarding destination.", "destination")
+
+	for i, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", cfg.Type, i)
+		}
+
+		d, err := newDestination(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarding destination %q: %w", name, err)
+		}
+		d.name = name
+		d.log = log.With(slog.String("destination", name))
+		d.sent = sent.With(name)
+		d.queueFull = dropped.With(name, reasonQueueFull)
+		d.failed = dropped.With(name, reasonFailed)
+		d.failures = failures.With(name)
+		m.destinations = append(m.destinations, d)
+	}
+
+	return m, nil
+}
+
+// Forward queues metrics for every destination without blocking. Metrics
+// without a timestamp are stamped with the current time, as they may be sent
+// later. Metrics exceeding the queue of a destination are dropped.
+func (m *Manager) Forward(metrics []models.Metric) {
+	if len(m.destinations) == 0 || len(metrics) == 0 {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	for _, d := range m.destinations {
+		// The pipeline reuses its input slice, so every destination gets a copy.
+		queued := make([]models.Metric, len(metrics))
+		copy(queued, metrics)
+		for i := range queued {
+			if queued[i].Timestamp == 0 {
+				queued[i].Timestamp = now
+			}
+		}
+		d.enqueue(d.pipeline.Process(queued))
+	}
+}
+
+// Run sends queued metrics until the context is canceled, then makes a last
+// attempt to send what is left, bounded by the destination timeout.
+func (m *Manager) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, d := range m.destinations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.run(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// destination is a configured downstream system with its queue.
+type destination struct {
+	name          string
+	sink          sink
+	pipeline      *relabel.Pipeline
+	queueSize     int
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+	maxRetries    int
+	backoff       time.Duration
+	log           *slog.Logger
+
+	mu    sync.Mutex
+	queue []models.Metric
+	ready chan struct{}
+
+	sent      *telemetry.Counter
+	queueFull *telemetry.Counter
+	failed    *telemetry.Counter
+	failures  *telemetry.Counter
+}
+
+func newDestination(cfg config.Destination) (*destination, error) {
+	d := &destination{
+		queueSize:     cfg.QueueSize,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		timeout:       cfg.Timeout,
+		maxRetries:    cfg.MaxRetries,
+		backoff:       cfg.Backoff,
+		ready:         make(chan struct{}, 1),
+	}
+	if d.queueSize <= 0 {
+		d.queueSize = DefaultQueueSize
+	}
+	if d.batchSize <= 0 {
+		d.batchSize = DefaultBatchSize
+	}
+	if d.flushInterval <= 0 {
+		d.flushInterval = DefaultFlushInterval
+	}
+	if d.timeout <= 0 {
+		d.timeout = DefaultTimeout
+	}
+	if d.maxRetries == 0 {
+		d.maxRetries = DefaultMaxRetries
+	}
+	if d.backoff <= 0 {
+		d.backoff = DefaultBackoff
+	}
+
+	var err error
+	// Destination pipelines are not instrumented, their counters would clash
+	// with those of the ingestion pipeline.
+	if d.pipeline, err = relabel.New(cfg.Relabel, nil); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case TypeMetricServer:
+		d.sink, err = newMetricServerSink(cfg.URL, cfg.Headers, d.timeout)
+	case TypeRemoteWrite:
+		d.sink, err = newRemoteWriteSink(cfg.URL, cfg.Headers, d.timeout)
+	case TypeInflux:
+		d.sink, err = newInfluxSink(cfg.URL, cfg.Headers, d.timeout)
+	case TypeGraphite:
+		d.sink, err = newGraphiteSink(cfg.URL, d.timeout)
+	default:
+		err = fmt.Errorf("unknown type %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// enqueue adds metrics to the queue, dropping those that do not fit, and
+// wakes the sender once a full batch is waiting.
+func (d *destination) enqueue(metrics []models.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	free := d.queueSize - len(d.queue)
+	if free < len(metrics) {
+		d.queueFull.Add(float64(len(metrics) - max(free, 0)))
+		metrics = metrics[:max(free, 0)]
+	}
+	d.queue = append(d.queue, metrics...)
+	full := len(d.queue) >= d.batchSize
+	d.mu.Unlock()
+
+	if full {
+		select {
+		case d.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next removes up to a batch of metrics from the queue.
+func (d *destination) next() []models.Metric {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := min(len(d.queue), d.batchSize)
+	if n == 0 {
+		return nil
+	}
+	metrics := make([]models.Metric, n)
+	copy(metrics, d.queue)
+	d.queue = append(d.queue[:0], d.queue[n:]...)
+	return metrics
+}
+
+func (d *destination) run(ctx context.Context) {
+	ticker := time.NewTicker(d.flushInterval)
+	defer ticker.Stop()
+	defer func() {
+		if err := d.sink.close(); err != nil {
+			d.log.Warn("failed to close forwarding destination", logger.Err(err))
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.timeout)
+			d.flush(drainCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		case <-d.ready:
+		}
+		d.flush(ctx)
+	}
+}
+
+// flush sends the queue in batches until it is empty or the context is canceled.
+func (d *destination) flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		metrics := d.next()
+		if len(metrics) == 0 {
+			return
+		}
+
+		if err := d.send(ctx, batch{id: rand.Text(), metrics: metrics}); err != nil {
+			d.failed.Add(float64(len(metrics)))
+			d.log.Error("failed to forward metrics", slog.Int("metrics", len(metrics)), logger.Err(err))
+			continue
+		}
+		d.sent.Add(float64(len(metrics)))
+	}
+}
+
+// send delivers a batch, retrying transient failures with exponential backoff.
+func (d *destination) send(ctx context.Context, b batch) error {
+	backoff := d.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := d.sink.send(ctx, b)
+		if err == nil {
+			return nil
+		}
+		d.failures.Inc()
+		if errors.Is(err, errPermanent) || attempt >= d.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
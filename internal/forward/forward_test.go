@@ -0,0 +1,309 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+var metrics = []models.Metric{
+	{
+		Name: "cpu usage", MType: "gauge", Value: 0.5,
+		Labels: map[string]string{"host": "a,b", "dc": "eu"}, Timestamp: 1718000000123,
+	},
+	{Name: "requests", MType: "counter", Value: 42, Timestamp: 1718000001000},
+}
+
+// receiver records the requests of an HTTP destination.
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// graphiteServer accepts one connection and returns the lines received until it is closed.
+func graphiteServer(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	lines := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var got []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			got = append(got, scanner.Text())
+		}
+		lines <- got
+	}()
+
+	return ln.Addr().String(), lines
+}
+
+// run forwards metrics to the destinations and stops the manager once they are sent.
+func run(t *testing.T, cfgs []config.Destination, metrics []models.Metric) *Manager {
+	t.Helper()
+
+	m, err := New(cfgs, nil, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, m.Run(ctx))
+	}()
+
+	m.Forward(metrics)
+	cancel()
+	<-done
+
+	return m
+}
+
+func TestManager_Destinations(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	graphiteAddr, graphiteLines := graphiteServer(t)
+
+	run(t, []config.Destination{
+		{Type: TypeMetricServer, URL: srv.URL + "/ms", Headers: map[string]string{"Authorization": "Bearer token"}},
+		{Type: TypeRemoteWrite, URL: srv.URL + "/rw"},
+		{Type: TypeInflux, URL: srv.URL + "/influx"},
+		{Type: TypeGraphite, URL: graphiteAddr},
+	}, metrics)
+
+	require.Equal(t, []string{
+		"cpu_usage;dc=eu;host=a,b 0.5 1718000000",
+		"requests 42 1718000001",
+	}, <-graphiteLines)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	require.Len(t, rc.requests, 3)
+	for i, r := range rc.requests {
+		body := rc.bodies[i]
+		switch r.URL.Path {
+		case "/ms/update":
+			require.Equal(t, codec.ContentTypeProtobuf, r.Header.Get("Content-Type"))
+			require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			require.NotEmpty(t, r.Header.Get(client.HeaderIdempotencyKey))
+			got, err := codec.UnmarshalBatch(body)
+			require.NoError(t, err)
+			require.Equal(t, metrics, got.Metrics)
+		case "/rw":
+			require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+			require.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+			data, err := snappy.Decode(nil, body)
+			require.NoError(t, err)
+			require.Equal(t, []writeSeries{
+				{labels: []string{"__name__", "cpu usage", "dc", "eu", "host", "a,b"}, value: 0.5, timestamp: 1718000000123},
+				{labels: []string{"__name__", "requests"}, value: 42, timestamp: 1718000001000},
+			}, unmarshalWriteRequest(t, data))
+		case "/influx":
+			require.Equal(t, "cpu\\ usage,dc=eu,host=a\\,b value=0.5 1718000000123000000\n"+
+				"requests value=42 1718000001000000000\n", string(body))
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	}
+}
+
+// writeSeries is a decoded remote write time series with a single sample.
+type writeSeries struct {
+	labels    []string
+	value     float64
+	timestamp int64
+}
+
+// unmarshalWriteRequest decodes the subset of a WriteRequest written by marshalWriteRequest.
+func unmarshalWriteRequest(t *testing.T, data []byte) []writeSeries {
+	t.Helper()
+
+	fields := func(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+			n = fn(num, typ, b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+		}
+	}
+
+	var res []writeSeries
+	fields(data, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		series, n := protowire.ConsumeBytes(b)
+		var s writeSeries
+		fields(series, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			fields(msg, func(field protowire.Number, _ protowire.Type, b []byte) int {
+				switch {
+				case num == 1:
+					v, n := protowire.ConsumeString(b)
+					s.labels = append(s.labels, v)
+					return n
+				case field == 1:
+					v, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(v)
+					return n
+				default:
+					v, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(v)
+					return n
+				}
+			})
+			return n
+		})
+		res = append(res, s)
+		return n
+	})
+	return res
+}
+
+func TestManager_Forward(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	before := time.Now().UnixMilli()
+	m := run(t, []config.Destination{{
+		Type:      TypeMetricServer,
+		URL:       srv.URL,
+		BatchSize: 2,
+		Relabel:   config.Relabel{Deny: []string{"debug_.*"}},
+	}}, []models.Metric{
+		{Name: "a", Value: 1},
+		{Name: "debug_b", Value: 2},
+		{Name: "c", Value: 3, Labels: map[string]string{"host": "x"}},
+		{Name: "d", Value: 4},
+	})
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	require.Len(t, rc.bodies, 2)
+
+	var got []models.Metric
+	for _, body := range rc.bodies {
+		b, err := codec.UnmarshalBatch(body)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(b.Metrics), 2)
+		got = append(got, b.Metrics...)
+	}
+	require.Len(t, got, 3)
+	for i, name := range []string{"a", "c", "d"} {
+		require.Equal(t, name, got[i].Name)
+		require.GreaterOrEqual(t, got[i].Timestamp, before)
+	}
+	require.Equal(t, float64(3), m.destinations[0].sent.Value())
+}
+
+func TestDestination_Enqueue(t *testing.T) {
+	m, err := New([]config.Destination{{Type: TypeInflux, URL: "http://localhost", QueueSize: 3}}, nil,
+		slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	d := m.destinations[0]
+
+	m.Forward(metrics)
+	m.Forward(metrics)
+	m.Forward(metrics)
+
+	require.Len(t, d.queue, 3)
+	require.Equal(t, float64(3), d.queueFull.Value())
+	require.Equal(t, metrics[0].Name, d.queue[2].Name)
+}
+
+func TestDestination_Send(t *testing.T) {
+	tests := []struct {
+		name             string
+		typ              string
+		statuses         []int
+		expectedAttempts int
+		expectedErr      bool
+	}{
+		{name: "success", typ: TypeInflux, statuses: []int{204}, expectedAttempts: 1},
+		{name: "transient failure", typ: TypeRemoteWrite, statuses: []int{503, 429, 200}, expectedAttempts: 3},
+		{name: "retries exhausted", typ: TypeInflux, statuses: []int{502, 502, 502}, expectedAttempts: 3, expectedErr: true},
+		{name: "permanent failure", typ: TypeRemoteWrite, statuses: []int{400}, expectedAttempts: 1, expectedErr: true},
+		{name: "metric server in progress", typ: TypeMetricServer, statuses: []int{409, 200}, expectedAttempts: 2},
+		{name: "metric server limit", typ: TypeMetricServer, statuses: []int{429}, expectedAttempts: 1, expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				attempts int
+				keys     = make(map[string]bool)
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				keys[r.Header.Get(client.HeaderIdempotencyKey)] = true
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer srv.Close()
+
+			d, err := newDestination(config.Destination{Type: tt.typ, URL: srv.URL, MaxRetries: 2, Backoff: time.Millisecond})
+			require.NoError(t, err)
+			d.failures = new(telemetry.Counter)
+
+			err = d.send(context.Background(), batch{id: "batch-1", metrics: metrics})
+			require.Equal(t, tt.expectedErr, err != nil)
+			require.Equal(t, tt.expectedAttempts, attempts)
+			require.Len(t, keys, 1)
+		})
+	}
+}
+
+func TestGraphiteSink_Reconnect(t *testing.T) {
+	addr, lines := graphiteServer(t)
+	s, err := newGraphiteSink(addr, time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, s.send(context.Background(), batch{metrics: metrics[:1]}))
+	require.NoError(t, s.conn.Close())
+	require.Error(t, s.send(context.Background(), batch{metrics: metrics[1:]}))
+	require.Nil(t, s.conn)
+	require.Len(t, <-lines, 1)
+
+	_, err = newGraphiteSink("localhost", time.Second)
+	require.Error(t, err)
+}
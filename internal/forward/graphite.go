@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// graphiteSink writes batches in the Graphite plaintext protocol over a TCP
+// connection kept open between batches and reopened after a failure. Labels
+// are sent as Graphite tags.
+type graphiteSink struct {
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func newGraphiteSink(addr string, timeout time.Duration) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return &graphiteSink{addr: addr, timeout: timeout}, nil
+}
+
+func (s *graphiteSink) send(ctx context.Context, b batch) error {
+	if s.conn == nil {
+		dialer := net.Dialer{Timeout: s.timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return fmt.Errorf("failed to connect to graphite: %w", err)
+		}
+		s.conn = conn
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return s.reset(err)
+	}
+	if _, err := s.conn.Write(marshalGraphite(b.metrics)); err != nil {
+		return s.reset(err)
+	}
+	return nil
+}
+
+// reset closes a connection that failed, so that the next attempt reconnects.
+func (s *graphiteSink) reset(err error) error {
+	_ = s.conn.Close()
+	s.conn = nil
+	return fmt.Errorf("failed to write to graphite: %w", err)
+}
+
+func (s *graphiteSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// graphiteEscaper replaces the characters Graphite does not allow in names and tags.
+var graphiteEscaper = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_")
+
+// marshalGraphite encodes metrics as "name;tag=value value timestamp" lines
+// with timestamps in seconds. Values that are not finite and labels with empty
+// values are skipped.
+func marshalGraphite(metrics []models.Metric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+
+		buf.WriteString(graphiteEscaper.Replace(m.Name))
+		for _, k := range sortedKeys(m.Labels) {
+			if m.Labels[k] == "" {
+				continue
+			}
+			buf.WriteByte(';')
+			buf.WriteString(graphiteEscaper.Replace(k))
+			buf.WriteByte('=')
+			buf.WriteString(graphiteEscaper.Replace(m.Labels[k]))
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.Timestamp/1000, 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
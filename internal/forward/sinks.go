@@ -0,0 +1,242 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// headerTransport adds configured headers to every request.
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	return t.next.RoundTrip(req)
+}
+
+func newHTTPClient(headers map[string]string, timeout time.Duration) *http.Client {
+	header := make(http.Header, len(headers))
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: headerTransport{header: header, next: http.DefaultTransport},
+	}
+}
+
+// metricServerSink pushes batches to another metric server in the protobuf
+// format. The batch ID is sent as idempotency key, so a retried batch that
+// was applied already is not applied twice.
+type metricServerSink struct {
+	client *client.Client
+}
+
+func newMetricServerSink(url string, headers map[string]string, timeout time.Duration) (*metricServerSink, error) {
+	c, err := client.New(url,
+		client.WithHTTPClient(newHTTPClient(headers, timeout)),
+		client.WithFormat(client.FormatProtobuf),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &metricServerSink{client: c}, nil
+}
+
+func (s *metricServerSink) send(ctx context.Context, b batch) error {
+	err := s.client.PushWithKey(ctx, b.id, b.metrics)
+
+	// A batch partially refused by cardinality limits would be refused again,
+	// while 409 means that an earlier attempt is still being applied.
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 &&
+		apiErr.StatusCode != http.StatusRequestTimeout && apiErr.StatusCode != http.StatusConflict {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return err
+}
+
+func (s *metricServerSink) close() error { return nil }
+
+// httpSink posts encoded batches to an HTTP endpoint.
+type httpSink struct {
+	url     string
+	client  *http.Client
+	header  http.Header
+	encode  func([]models.Metric) []byte
+	service string
+}
+
+func (s *httpSink) send(ctx context.Context, b batch) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(s.encode(b.metrics)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send metrics: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s returned %s", errPermanent, s.service, resp.Status)
+	}
+
+	return fmt.Errorf("%s returned %s", s.service, resp.Status)
+}
+
+func (s *httpSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func newHTTPSink(url, service string, headers map[string]string, timeout time.Duration) (*httpSink, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid URL %q: scheme must be http or https", url)
+	}
+	return &httpSink{
+		url:     url,
+		client:  newHTTPClient(headers, timeout),
+		header:  make(http.Header),
+		service: service,
+	}, nil
+}
+
+// newRemoteWriteSink sends batches as Prometheus remote write requests.
+func newRemoteWriteSink(url string, headers map[string]string, timeout time.Duration) (*httpSink, error) {
+	s, err := newHTTPSink(url, "remote write endpoint", headers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.header.Set("Content-Type", "application/x-protobuf")
+	s.header.Set("Content-Encoding", "snappy")
+	s.header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	s.encode = func(metrics []models.Metric) []byte {
+		return snappy.Encode(nil, marshalWriteRequest(metrics))
+	}
+	return s, nil
+}
+
+// marshalWriteRequest encodes metrics as a remote write WriteRequest, one
+// time series with a single sample per metric:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func marshalWriteRequest(metrics []models.Metric) []byte {
+	var out, series, msg []byte
+	for _, m := range metrics {
+		series = series[:0]
+
+		// Labels must be sorted by name, __name__ sorting before the others.
+		msg = appendLabel(msg[:0], "__name__", m.Name)
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, msg)
+		for _, k := range sortedKeys(m.Labels) {
+			msg = appendLabel(msg[:0], k, m.Labels[k])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, msg)
+		}
+
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(m.Value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(m.Timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, msg)
+
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, series)
+	}
+	return out
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// newInfluxSink sends batches in the InfluxDB line protocol, with nanosecond
+// timestamps, to a write endpoint such as http://influx:8086/api/v2/write?org=o&bucket=b.
+func newInfluxSink(url string, headers map[string]string, timeout time.Duration) (*httpSink, error) {
+	s, err := newHTTPSink(url, "InfluxDB", headers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.header.Set("Content-Type", "text/plain; charset=utf-8")
+	s.encode = marshalLineProtocol
+	return s, nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// marshalLineProtocol encodes metrics as lines with the labels as tags and a
+// single value field. Values that are not finite cannot be represented and are
+// skipped, as are labels with empty values.
+func marshalLineProtocol(metrics []models.Metric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+
+		buf.WriteString(measurementEscaper.Replace(m.Name))
+		for _, k := range sortedKeys(m.Labels) {
+			if m.Labels[k] == "" {
+				continue
+			}
+			buf.WriteByte(',')
+			buf.WriteString(tagEscaper.Replace(k))
+			buf.WriteByte('=')
+			buf.WriteString(tagEscaper.Replace(m.Labels[k]))
+		}
+		buf.WriteString(" value=")
+		buf.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(m.Timestamp*int64(time.Millisecond), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/admin"
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// SeriesAdmin defines an interface for deleting, resetting and renaming stored series.
+type SeriesAdmin interface {
+	Delete(ctx context.Context, sel admin.Selector) (admin.DeleteResult, error)
+	Reset(ctx context.Context, sel admin.Selector) ([]string, error)
+	Rename(ctx context.Context, from, to string) (map[string]string, error)
+}
+
+// WithSeriesAdmin enables the series administration endpoints.
+func WithSeriesAdmin(a SeriesAdmin) Option {
+	return func(h *Handler) {
+		h.admin = a
+	}
+}
+
+// resetResponse is the JSON representation of a series reset.
+type resetResponse struct {
+	Series []string `json:"series"`
+}
+
+// renameRequest is the JSON body of a series rename.
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// renameResponse is the JSON representation of a series rename.
+type renameResponse struct {
+	Renamed map[string]string `json:"renamed"`
+}
+
+// HandleDeleteSeries deletes the series selected by the JSON body, an
+// admin.Selector, from memory and PostgreSQL together with their history.
+func (h *Handler) HandleDeleteSeries(w http.ResponseWriter, r *http.Request) {
+	var sel admin.Selector
+	if !h.adminRequest(w, r, &sel) {
+		return
+	}
+
+	res, err := h.admin.Delete(r.Context(), sel)
+	audit(r, "delete", err, slog.Any("selector", sel), slog.Int("series", len(res.Series)),
+		slog.Int64("samples", res.Rows.Samples), slog.Int64("rollups", res.Rows.Rollups))
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, res)
+}
+
+// HandleResetSeries sets the series selected by the JSON body, an
+// admin.Selector, to zero in memory and PostgreSQL.
+func (h *Handler) HandleResetSeries(w http.ResponseWriter, r *http.Request) {
+	var sel admin.Selector
+	if !h.adminRequest(w, r, &sel) {
+		return
+	}
+
+	keys, err := h.admin.Reset(r.Context(), sel)
+	audit(r, "reset", err, slog.Any("selector", sel), slog.Int("series", len(keys)))
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, resetResponse{Series: keys})
+}
+
+// HandleRenameSeries renames the metric "from" of the JSON body to "to",
+// keeping the labels of its series, in memory and PostgreSQL. It answers 409
+// if any of the renamed series already exists.
+func (h *Handler) HandleRenameSeries(w http.ResponseWriter, r *http.Request) {
+	var req renameRequest
+	if !h.adminRequest(w, r, &req) {
+		return
+	}
+
+	renamed, err := h.admin.Rename(r.Context(), req.From, req.To)
+	audit(r, "rename", err, slog.String("from", req.From), slog.String("to", req.To),
+		slog.Int("series", len(renamed)))
+	if err != nil {
+		adminError(w, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, renameResponse{Renamed: renamed})
+}
+
+// adminRequest decodes the JSON body of a series administration request into
+// v, answering the request itself and returning false if it cannot proceed.
+func (h *Handler) adminRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if h.admin == nil {
+		http.Error(w, "series administration is not enabled", http.StatusNotFound)
+		return false
+	}
+	if h.readOnly(w) {
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// adminError answers a failed series administration request.
+func adminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, admin.ErrInvalidSelector), errors.Is(err, admin.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, admin.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, admin.ErrUnavailable):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, "operation failed", http.StatusInternalServerError)
+	}
+}
+
+// audit records a series administration operation and its outcome in the
+// request log, which identifies the request and the client, at the audit
+// level, which the log level does not filter out.
+func audit(r *http.Request, op string, err error, attrs ...slog.Attr) {
+	attrs = append([]slog.Attr{slog.String("op", op), slog.Bool("ok", err == nil)}, attrs...)
+	if err != nil {
+		attrs = append(attrs, logger.Err(err))
+	}
+
+	logger.FromContext(r.Context()).LogAttrs(r.Context(), logger.LevelAudit, "audit: series administration", attrs...)
+}
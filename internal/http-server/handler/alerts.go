@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/alerting"
+)
+
+// AlertLister defines an interface for listing active alerts.
+type AlertLister interface {
+	Alerts() []alerting.Alert
+}
+
+// WithAlerts enables the active alerts endpoint backed by the given lister.
+func WithAlerts(alerts AlertLister) Option {
+	return func(h *Handler) {
+		h.alerts = alerts
+	}
+}
+
+// alertsData is the data of the alerts response.
+type alertsData struct {
+	Alerts []alerting.Alert `json:"alerts"`
+}
+
+// HandleAlerts lists the pending and firing alerts in the Prometheus HTTP API format.
+func (h *Handler) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	if h.alerts == nil {
+		writeAPIError(w, r, http.StatusNotFound, errorBadData, "alerting is not enabled")
+		return
+	}
+
+	writeAPIData(w, r, alertsData{Alerts: h.alerts.Alerts()})
+}
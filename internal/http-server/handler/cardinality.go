@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/sanchey92/metric-server/internal/limits"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// maxReportedRejections bounds the number of rejections listed in a 429 response.
+const maxReportedRejections = 100
+
+// Limiter defines an interface for enforcing series cardinality limits.
+type Limiter interface {
+	Admit(client, tenant string, metrics []models.Metric) ([]models.Metric, []limits.Rejection)
+	TopPrefixes(n int) []limits.PrefixCount
+	Len() int
+}
+
+// WithLimiter enables cardinality limits on ingestion and the cardinality report endpoint.
+func WithLimiter(limiter Limiter) Option {
+	return func(h *Handler) {
+		h.limiter = limiter
+	}
+}
+
+// limitResponse is the body of a 429 response listing the refused series.
+type limitResponse struct {
+	Error      string             `json:"error"`
+	Accepted   int                `json:"accepted"`
+	Rejected   int                `json:"rejected"`
+	Rejections []limits.Rejection `json:"rejections"`
+}
+
+// writeLimitExceeded reports series refused by the limiter. Accepted metrics
+// of the same request have been stored; only the listed series were dropped.
+func writeLimitExceeded(w http.ResponseWriter, r *http.Request, accepted int, rejected []limits.Rejection) {
+	listed := rejected
+	if len(listed) > maxReportedRejections {
+		listed = listed[:maxReportedRejections]
+	}
+
+	writeJSON(w, r, http.StatusTooManyRequests, limitResponse{
+		Error:      "series limit exceeded",
+		Accepted:   accepted,
+		Rejected:   len(rejected),
+		Rejections: listed,
+	})
+}
+
+// cardinalityResponse is the JSON representation of the cardinality report.
+type cardinalityResponse struct {
+	TotalSeries int                  `json:"total_series"`
+	TopPrefixes []limits.PrefixCount `json:"top_prefixes"`
+}
+
+// HandleCardinality reports the total number of ingested series and the metric
+// name prefixes with the most series. The "limit" query parameter sets the
+// number of prefixes returned (default 10).
+func (h *Handler) HandleCardinality(w http.ResponseWriter, r *http.Request) {
+	if h.limiter == nil {
+		http.Error(w, "cardinality limits are not enabled", http.StatusNotFound)
+		return
+	}
+
+	n := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+
+	writeJSON(w, r, http.StatusOK, cardinalityResponse{
+		TotalSeries: h.limiter.Len(),
+		TopPrefixes: h.limiter.TopPrefixes(n),
+	})
+}
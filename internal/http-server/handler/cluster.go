@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Cluster defines an interface for routing ingested metrics to the cluster
+// nodes owning their series. Split returns the metrics owned by this node and
+// the others grouped by owner; Send pushes the latter to their owners.
+type Cluster interface {
+	Split(header http.Header, metrics []models.Metric) ([]models.Metric, map[string][]models.Metric)
+	Send(ctx context.Context, header http.Header, remote map[string][]models.Metric) error
+}
+
+// WithCluster stores ingested metrics on the cluster nodes owning them.
+func WithCluster(c Cluster) Option {
+	return func(h *Handler) {
+		h.cluster = c
+	}
+}
+
+// sendToOwners pushes metrics owned by other nodes and returns the error of
+// those that were not accepted.
+func (h *Handler) sendToOwners(r *http.Request, remote map[string][]models.Metric) error {
+	err := h.cluster.Send(r.Context(), r.Header, remote)
+	if err != nil {
+		logger.FromContext(r.Context()).Warn("failed to send metrics to cluster nodes", logger.Err(err))
+	}
+	return err
+}
+
+// refusedStatus returns the status of a node refusing metrics, e.g. due to its
+// cardinality limits, and false when a node was unavailable instead.
+func refusedStatus(err error) (int, bool) {
+	var statusErr interface{ HTTPStatus() int }
+	if errors.As(err, &statusErr) && statusErr.HTTPStatus() < http.StatusInternalServerError {
+		return statusErr.HTTPStatus(), true
+	}
+	return 0, false
+}
@@ -4,44 +4,290 @@
 package handler
 
 import (
-	"encoding/json"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/http-server/middleware"
+	"github.com/sanchey92/metric-server/internal/limits"
+	"github.com/sanchey92/metric-server/internal/logger"
 	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
 )
 
 // MemStorage defines an interface for storing metrics in memory.
 // It provides methods for setting and retrieving metric values.
 type MemStorage interface {
-	Set(name string, value float64)
+	SetBatch(metrics []models.Metric)
+}
+
+// Pipeline defines an interface for filtering and relabeling metrics before they are stored.
+type Pipeline interface {
+	Process(metrics []models.Metric) []models.Metric
+}
+
+// Forwarder defines an interface for teeing accepted metrics to downstream systems.
+// Forward must not block and must not retain the slice.
+type Forwarder interface {
+	Forward(metrics []models.Metric)
 }
 
 // Handler provides HTTP handlers for metric processing operations.
 type Handler struct {
-	storage MemStorage
+	storage    MemStorage
+	history    HistoryReader
+	retention  RetentionReporter
+	limiter    Limiter
+	query      QueryEngine
+	alerts     AlertLister
+	pipeline   Pipeline
+	stream     Streamer
+	heartbeat  time.Duration
+	origins    []string
+	snapshots  Snapshotter
+	maxRestore int64
+	health     HealthChecker
+	values     ValueReader
+	flusher    Flusher
+	maxFuture  time.Duration
+	dedup      Deduplicator
+	forwarder  Forwarder
+	cluster    Cluster
+	replica    Replica
+	admin      SeriesAdmin
+	metrics    handlerMetrics
+}
+
+// handlerMetrics groups the self-instrumentation of the ingestion path.
+type handlerMetrics struct {
+	requests     *telemetry.Counter
+	accepted     *telemetry.Counter
+	rejected     *telemetry.Counter
+	payloadBytes *telemetry.Counter
+	latency      *telemetry.Histogram
+}
+
+// Option configures optional Handler dependencies.
+type Option func(*Handler)
+
+// WithMaxFuture rejects metrics timestamped more than d ahead of the server clock.
+func WithMaxFuture(d time.Duration) Option {
+	return func(h *Handler) {
+		h.maxFuture = d
+	}
+}
+
+// WithTelemetry registers the handler's self-instrumentation in the given registry.
+func WithTelemetry(reg *telemetry.Registry) Option {
+	return func(h *Handler) {
+		h.metrics = newHandlerMetrics(reg)
+	}
+}
+
+// WithPipeline processes ingested metrics with the given pipeline before they are validated and stored.
+func WithPipeline(pipeline Pipeline) Option {
+	return func(h *Handler) {
+		h.pipeline = pipeline
+	}
+}
+
+// WithForwarder forwards the metrics accepted by ingestion requests to downstream systems.
+func WithForwarder(f Forwarder) Option {
+	return func(h *Handler) {
+		h.forwarder = f
+	}
 }
 
 // New creates and returns a new Handler instance with the provided BufferService.
-func New(storage MemStorage) *Handler {
-	return &Handler{
+func New(storage MemStorage, opts ...Option) *Handler {
+	h := &Handler{
 		storage: storage,
+		metrics: newHandlerMetrics(nil),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+func newHandlerMetrics(reg *telemetry.Registry) handlerMetrics {
+	return handlerMetrics{
+		requests: reg.Counter("metric_server_ingest_requests_total",
+			"Total number of ingestion requests received."),
+		accepted: reg.Counter("metric_server_ingest_metrics_accepted_total",
+			"Total number of metrics accepted into storage."),
+		rejected: reg.Counter("metric_server_ingest_metrics_rejected_total",
+			"Total number of metrics rejected during ingestion."),
+		payloadBytes: reg.Counter("metric_server_ingest_payload_bytes_total",
+			"Total number of decoded payload bytes received."),
+		latency: reg.Histogram("metric_server_ingest_request_duration_seconds",
+			"Latency of ingestion requests.", nil),
 	}
 }
 
 // HandleMetrics processes incoming HTTP requests containing metric data.
-// It expects a JSON array of metrics in the request body and pushes them
-// to the configured BufferService.
+// It expects a batch of metrics in the request body, as a JSON array or batch
+// object, a protobuf Batch or MessagePack according to the Content-Type, and
+// pushes them to the configured BufferService. When cardinality limits refuse
+// some new series, the rest of the batch is stored and 429 is returned with details.
 func (h *Handler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	var metrics []models.Metric
+	start := time.Now()
+	h.metrics.requests.Inc()
+	defer func() {
+		h.metrics.latency.Observe(time.Since(start).Seconds())
+	}()
+
+	body := &countingReader{r: r.Body}
+	payload, err := codec.ForContentType(r.Header.Get("Content-Type")).DecodeBatch(body)
+	h.metrics.payloadBytes.Add(float64(body.n))
 
-	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+	if err != nil {
+		logger.FromContext(r.Context()).Debug("invalid metrics payload", logger.Err(err))
 		http.Error(w, "invalid payload", http.StatusBadRequest)
 		return
 	}
 
+	h.store(w, r, payload.ID, payload.Metrics)
+}
+
+// store runs decoded metrics through the pipeline, validation and cardinality
+// limits and stores the accepted ones, sending those of series owned by other
+// cluster nodes to their owners. It is shared by all ingestion formats.
+// A request whose idempotency key, or else batchID, was already applied is
+// only acknowledged. A read-only replica refuses the request.
+func (h *Handler) store(w http.ResponseWriter, r *http.Request, batchID string, metrics []models.Metric) {
+	if h.readOnly(w) {
+		return
+	}
+
+	key, ok := h.idempotencyKey(r, batchID)
+	if !ok {
+		http.Error(w, "invalid idempotency key", http.StatusBadRequest)
+		return
+	}
+	if key != "" {
+		if status, seen := h.dedup.Begin(key); seen {
+			replay(w, status)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { h.dedup.Complete(key, sw.status) }()
+		w = sw
+	}
+
+	// Metrics owned by other nodes are processed there, like their own. They
+	// are sent first: an unavailable node is answered with 503 before anything
+	// is stored locally, so that the client can retry the whole request. A
+	// node refusing metrics is answered with its status once the local ones
+	// are stored.
+	var refused error
+	if h.cluster != nil {
+		var remote map[string][]models.Metric
+		metrics, remote = h.cluster.Split(r.Header, metrics)
+		if len(remote) > 0 {
+			refused = h.sendToOwners(r, remote)
+			if _, ok := refusedStatus(refused); refused != nil && !ok {
+				http.Error(w, "cluster nodes unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+
+	if h.pipeline != nil {
+		metrics = h.pipeline.Process(metrics)
+	}
+
+	now := time.Now()
+	accepted := metrics[:0]
 	for _, value := range metrics {
-		h.storage.Set(value.Name, value.Value)
+		if !valid(value) || h.tooNew(value, now) {
+			h.metrics.rejected.Inc()
+			continue
+		}
+		accepted = append(accepted, value)
+	}
+
+	var rejected []limits.Rejection
+	if h.limiter != nil {
+		info := middleware.RequestInfoFromContext(r.Context())
+		accepted, rejected = h.limiter.Admit(info.Client, info.Tenant, accepted)
+		h.metrics.rejected.Add(float64(len(rejected)))
+	}
+
+	if len(accepted) > 0 {
+		h.storage.SetBatch(accepted)
+		h.metrics.accepted.Add(float64(len(accepted)))
+		if h.forwarder != nil {
+			h.forwarder.Forward(accepted)
+		}
+	}
+
+	if refused != nil {
+		status, _ := refusedStatus(refused)
+		http.Error(w, refused.Error(), status)
+		return
+	}
+
+	if len(rejected) > 0 {
+		writeLimitExceeded(w, r, len(accepted), rejected)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// tooNew reports whether a metric is timestamped further in the future than allowed.
+func (h *Handler) tooNew(m models.Metric, now time.Time) bool {
+	return h.maxFuture > 0 && m.Timestamp != 0 && m.Time().Sub(now) > h.maxFuture
+}
+
+// valid reports whether a metric may be stored. Its name must be valid for
+// clients, see models.ValidName, label names must be identifiers not starting
+// with the reserved "__" prefix and timestamps may not be negative.
+func valid(m models.Metric) bool {
+	if m.Timestamp < 0 || !models.ValidName(m.Name) {
+		return false
+	}
+
+	for label := range m.Labels {
+		if !validLabelName(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validLabelName reports whether name matches [a-zA-Z_][a-zA-Z0-9_]* without a leading "__".
+func validLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,17 +1,36 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
 
+	"github.com/sanchey92/metric-server/internal/admin"
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/dedup"
 	"github.com/sanchey92/metric-server/internal/http-server/handler/mocks"
+	"github.com/sanchey92/metric-server/internal/http-server/middleware"
+	"github.com/sanchey92/metric-server/internal/limits"
 	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/snapshot"
+	"github.com/sanchey92/metric-server/internal/stream"
 )
 
 func TestHandler_HandleMetrics(t *testing.T) {
@@ -29,8 +48,10 @@ func TestHandler_HandleMetrics(t *testing.T) {
 			},
 			expectedStatus: http.StatusOK,
 			setupMock: func(m *mocks.MockMemStorage) {
-				m.EXPECT().Set("cpu", 42.5).Times(1)
-				m.EXPECT().Set("memory", 75.0).Times(1)
+				m.EXPECT().SetBatch([]models.Metric{
+					{Name: "cpu", Value: 42.5},
+					{Name: "memory", Value: 75.0},
+				}).Times(1)
 			},
 		},
 		{
@@ -52,7 +73,32 @@ func TestHandler_HandleMetrics(t *testing.T) {
 			},
 			expectedStatus: http.StatusOK,
 			setupMock: func(m *mocks.MockMemStorage) {
-				m.EXPECT().Set("null_metric", 0.0).Times(1)
+				m.EXPECT().SetBatch([]models.Metric{{Name: "null_metric", Value: 0}}).Times(1)
+			},
+		},
+		{
+			name: "empty and reserved names rejected",
+			requestBody: []models.Metric{
+				{Name: "", Value: 1},
+				{Name: "_self_metric_server_ingest_requests_total", Value: 2},
+				{Name: "cpu", Value: 3},
+			},
+			expectedStatus: http.StatusOK,
+			setupMock: func(m *mocks.MockMemStorage) {
+				m.EXPECT().SetBatch([]models.Metric{{Name: "cpu", Value: 3}}).Times(1)
+			},
+		},
+		{
+			name: "invalid labels rejected",
+			requestBody: []models.Metric{
+				{Name: "cpu", Value: 1, Labels: map[string]string{"__name__": "x"}},
+				{Name: "cpu", Value: 2, Labels: map[string]string{"1core": "x"}},
+				{Name: `cpu{core="0"}`, Value: 3},
+				{Name: "cpu", Value: 4, Labels: map[string]string{"core": "0"}},
+			},
+			expectedStatus: http.StatusOK,
+			setupMock: func(m *mocks.MockMemStorage) {
+				m.EXPECT().SetBatch([]models.Metric{{Name: "cpu", Value: 4, Labels: map[string]string{"core": "0"}}}).Times(1)
 			},
 		},
 	}
@@ -87,3 +133,615 @@ func TestHandler_HandleMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_HandleMetrics_CardinalityLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockMemStorage(ctrl)
+	mockStorage.EXPECT().SetBatch([]models.Metric{{Name: "cpu", Value: 1}}).Times(1)
+
+	h := New(mockStorage, WithLimiter(limits.New(config.Cardinality{MaxSeries: 1}, nil)))
+
+	body, err := json.Marshal([]models.Metric{{Name: "cpu", Value: 1}, {Name: "req_123", Value: 2}})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	h.HandleMetrics(w, r)
+
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	var resp struct {
+		Accepted   int                `json:"accepted"`
+		Rejections []limits.Rejection `json:"rejections"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, 1, resp.Accepted)
+	require.Equal(t, []limits.Rejection{{Series: "req_123", Reason: limits.ReasonGlobal, Limit: 1}}, resp.Rejections)
+}
+
+func TestHandler_HandleMetrics_Timestamps(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Now()
+	past := now.Add(-time.Hour).UnixMilli()
+	soon := now.Add(30 * time.Second).UnixMilli()
+
+	mockStorage := mocks.NewMockMemStorage(ctrl)
+	mockStorage.EXPECT().SetBatch([]models.Metric{
+		{Name: "past", Value: 1, Timestamp: past},
+		{Name: "soon", Value: 2, Timestamp: soon},
+	}).Times(1)
+
+	h := New(mockStorage, WithMaxFuture(time.Minute))
+
+	body, err := json.Marshal([]models.Metric{
+		{Name: "past", Value: 1, Timestamp: past},
+		{Name: "soon", Value: 2, Timestamp: soon},
+		{Name: "future", Value: 3, Timestamp: now.Add(time.Hour).UnixMilli()},
+		{Name: "negative", Value: 4, Timestamp: -1},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	h.HandleMetrics(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHandler_HandleMetrics_Formats(t *testing.T) {
+	metrics := []models.Metric{
+		{Name: "cpu", MType: "gauge", Value: 0.5, Labels: map[string]string{"host": "a"}},
+		{Name: "requests", MType: "counter", Value: 10, Timestamp: time.Now().UnixMilli()},
+	}
+
+	for _, c := range []codec.Codec{codec.JSON{}, codec.Protobuf{}, codec.Msgpack{}} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockStorage := mocks.NewMockMemStorage(ctrl)
+			mockStorage.EXPECT().SetBatch(metrics).Times(1)
+
+			var body bytes.Buffer
+			require.NoError(t, c.Encode(&body, metrics))
+
+			r := httptest.NewRequest(http.MethodPost, "/update", &body)
+			r.Header.Set("Content-Type", c.ContentType())
+			w := httptest.NewRecorder()
+
+			New(mockStorage).HandleMetrics(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+// latestValues is a ValueReader over a fixed set of samples.
+type latestValues []models.Sample
+
+func (v latestValues) Latest() []models.Sample { return v }
+
+func TestHandler_HandleValues_Negotiation(t *testing.T) {
+	samples := latestValues{{Key: "cpu", Value: 0.5, Timestamp: time.UnixMilli(1718000000000).UTC()}}
+	h := New(nil, WithValues(samples))
+
+	tests := []struct {
+		accept              string
+		expectedContentType string
+		decode              func([]byte) ([]models.Sample, error)
+	}{
+		{
+			accept:              "",
+			expectedContentType: codec.ContentTypeJSON,
+			decode: func(data []byte) ([]models.Sample, error) {
+				var out []models.Sample
+				return out, json.Unmarshal(data, &out)
+			},
+		},
+		{
+			accept:              "application/x-protobuf",
+			expectedContentType: codec.ContentTypeProtobuf,
+			decode:              codec.UnmarshalSamples,
+		},
+		{
+			accept:              "application/msgpack, application/json;q=0.5",
+			expectedContentType: codec.ContentTypeMsgpack,
+			decode: func(data []byte) ([]models.Sample, error) {
+				var out []models.Sample
+				dec := msgpack.NewDecoder(bytes.NewReader(data))
+				dec.SetCustomStructTag("json")
+				return out, dec.Decode(&out)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expectedContentType, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/values", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+
+			h.HandleValues(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.expectedContentType, w.Header().Get("Content-Type"))
+			got, err := tt.decode(w.Body.Bytes())
+			require.NoError(t, err)
+			require.Len(t, got, 1)
+			require.Equal(t, "cpu", got[0].Key)
+			require.Equal(t, 0.5, got[0].Value)
+			require.True(t, samples[0].Timestamp.Equal(got[0].Timestamp))
+		})
+	}
+}
+
+func TestHandler_HandleMetrics_Idempotency(t *testing.T) {
+	type request struct {
+		body             string
+		key              string
+		client           string
+		expectedStatus   int
+		expectedReplayed bool
+	}
+
+	tests := []struct {
+		name            string
+		requests        []request
+		expectedApplied int
+	}{
+		{
+			name: "retry with header is acknowledged once",
+			requests: []request{
+				{body: `[{"name":"cpu","value":1}]`, key: "k1", expectedStatus: http.StatusOK},
+				{body: `[{"name":"cpu","value":1}]`, key: "k1", expectedStatus: http.StatusOK, expectedReplayed: true},
+				{body: `[{"name":"cpu","value":1}]`, key: "k2", expectedStatus: http.StatusOK},
+			},
+			expectedApplied: 2,
+		},
+		{
+			name: "batch id in payload",
+			requests: []request{
+				{body: `{"id":"b1","metrics":[{"name":"cpu","value":1}]}`, expectedStatus: http.StatusOK},
+				{body: ` {"id":"b1","metrics":[{"name":"cpu","value":1}]}`, expectedStatus: http.StatusOK, expectedReplayed: true},
+			},
+			expectedApplied: 1,
+		},
+		{
+			name: "keys are scoped to the client",
+			requests: []request{
+				{body: `[{"name":"cpu","value":1}]`, key: "k1", client: "a", expectedStatus: http.StatusOK},
+				{body: `[{"name":"cpu","value":1}]`, key: "k1", client: "b", expectedStatus: http.StatusOK},
+			},
+			expectedApplied: 2,
+		},
+		{
+			name: "requests without key are always applied",
+			requests: []request{
+				{body: `[{"name":"cpu","value":1}]`, expectedStatus: http.StatusOK},
+				{body: `{"metrics":[{"name":"cpu","value":1}]}`, expectedStatus: http.StatusOK},
+			},
+			expectedApplied: 2,
+		},
+		{
+			name: "invalid key",
+			requests: []request{
+				{body: `[{"name":"cpu","value":1}]`, key: "bad\tkey", expectedStatus: http.StatusBadRequest},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockStorage := mocks.NewMockMemStorage(ctrl)
+			mockStorage.EXPECT().SetBatch(gomock.Any()).Times(tt.expectedApplied)
+			// Replayed requests are not forwarded again either.
+			mockForwarder := mocks.NewMockForwarder(ctrl)
+			mockForwarder.EXPECT().Forward(gomock.Any()).Times(tt.expectedApplied)
+
+			h := New(mockStorage,
+				WithDeduplicator(dedup.New(config.Idempotency{}, nil)),
+				WithForwarder(mockForwarder),
+			)
+			next := middleware.RequestContext(slog.New(slog.DiscardHandler))(http.HandlerFunc(h.HandleMetrics))
+
+			for _, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBufferString(req.body))
+				if req.key != "" {
+					r.Header.Set(HeaderIdempotencyKey, req.key)
+				}
+				if req.client != "" {
+					r.Header.Set(middleware.HeaderClientID, req.client)
+				}
+				w := httptest.NewRecorder()
+
+				next.ServeHTTP(w, r)
+
+				require.Equal(t, req.expectedStatus, w.Code)
+				require.Equal(t, req.expectedReplayed, w.Header().Get(HeaderReplayed) == "true")
+			}
+		})
+	}
+}
+
+// peers owns the series named "remote" on behalf of another node, failing
+// the given number of sends to it.
+type peers struct {
+	failures int
+	sent     int
+}
+
+func (p *peers) Split(_ http.Header, metrics []models.Metric) ([]models.Metric, map[string][]models.Metric) {
+	local := metrics[:0]
+	remote := make(map[string][]models.Metric)
+	for _, m := range metrics {
+		if m.Name == "remote" {
+			remote["peer"] = append(remote["peer"], m)
+			continue
+		}
+		local = append(local, m)
+	}
+	return local, remote
+}
+
+func (p *peers) Send(context.Context, http.Header, map[string][]models.Metric) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("connection refused")
+	}
+	p.sent++
+	return nil
+}
+
+func TestHandler_HandleMetrics_IdempotencyUnavailablePeer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockMemStorage(ctrl)
+	mockStorage.EXPECT().SetBatch([]models.Metric{{Name: "cpu", Value: 1}}).Times(1)
+
+	p := &peers{failures: 1}
+	h := New(mockStorage, WithDeduplicator(dedup.New(config.Idempotency{}, nil)), WithCluster(p))
+
+	for _, expectedStatus := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		body := `[{"name":"cpu","value":1},{"name":"remote","value":2}]`
+		r := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBufferString(body))
+		r.Header.Set(HeaderIdempotencyKey, "k1")
+		w := httptest.NewRecorder()
+
+		h.HandleMetrics(w, r)
+
+		require.Equal(t, expectedStatus, w.Code)
+	}
+	require.Equal(t, 1, p.sent)
+}
+
+func TestHandler_HandleMetrics_IdempotencyInProgress(t *testing.T) {
+	d := dedup.New(config.Idempotency{}, nil)
+	h := New(nil, WithDeduplicator(d))
+
+	_, seen := d.Begin("\x1f\x1fk1")
+	require.False(t, seen)
+
+	r := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBufferString(`[{"name":"cpu","value":1}]`))
+	r.Header.Set(HeaderIdempotencyKey, "k1")
+	w := httptest.NewRecorder()
+
+	h.HandleMetrics(w, r)
+
+	require.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestHandler_HandleQuery(t *testing.T) {
+	h := New(nil, WithQueryEngine(promql.NewEngine(promql.NewStorage(nil, nil))))
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "scalar",
+			query:          "query=1%2B1&time=1700000000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"2"]}}`,
+		},
+		{
+			name:           "empty vector",
+			query:          "query=cpu&time=1700000000",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		},
+		{
+			name:           "parse error",
+			query:          "query=sum(",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing query",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			h.HandleQuery(w, r)
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				require.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_HandleStream(t *testing.T) {
+	hub := stream.NewHub(0, nil)
+	h := New(nil, WithStream(hub, time.Hour))
+
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleStream))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?name=cpu&match[]=" + `mem{host="a"}`)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	ts := time.Unix(1_700_000_000, 0).UTC()
+	hub.Publish([]models.Sample{
+		{Key: `mem{host="b"}`, Value: 1, Timestamp: ts},
+		{Key: "cpu", Value: 2, Timestamp: ts},
+	})
+
+	scanner := bufio.NewScanner(resp.Body)
+	next := func() string {
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				return line
+			}
+		}
+		return ""
+	}
+
+	require.Equal(t, "event: update", next())
+	require.Equal(t, `data: {"key":"cpu","name":"cpu","value":2,"timestamp":"2023-11-14T22:13:20Z"}`, next())
+
+	hub.Close()
+	require.Equal(t, "event: error", next())
+	require.Equal(t, "data: stream closed", next())
+	require.Empty(t, next())
+}
+
+func TestHandler_HandleStream_Origin(t *testing.T) {
+	hub := stream.NewHub(0, nil)
+	defer hub.Close()
+	h := New(nil, WithStream(hub, time.Hour), WithStreamOrigins("https://dashboard.example.com/"))
+
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleStream))
+	defer srv.Close()
+
+	tests := []struct {
+		name           string
+		origin         string
+		expectedStatus int
+	}{
+		{name: "no origin", expectedStatus: http.StatusSwitchingProtocols},
+		{name: "same origin", origin: srv.URL, expectedStatus: http.StatusSwitchingProtocols},
+		{name: "allowed origin", origin: "https://Dashboard.example.com", expectedStatus: http.StatusSwitchingProtocols},
+		{name: "other origin", origin: "https://evil.example.com", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if tt.expectedStatus != http.StatusSwitchingProtocols {
+				require.Error(t, err)
+			}
+			require.NotNil(t, resp)
+			_ = resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_HandleStream_InvalidSelector(t *testing.T) {
+	h := New(nil, WithStream(stream.NewHub(0, nil), 0))
+
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/stream?match[]="+url.QueryEscape("cpu{"), nil)
+	rr := httptest.NewRecorder()
+	h.HandleStream(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+// seriesAdmin is a SeriesAdmin answering every operation with err.
+type seriesAdmin struct {
+	err error
+}
+
+func (a seriesAdmin) Delete(_ context.Context, sel admin.Selector) (admin.DeleteResult, error) {
+	return admin.DeleteResult{Series: []string{sel.Name}}, a.err
+}
+
+func (a seriesAdmin) Reset(_ context.Context, sel admin.Selector) ([]string, error) {
+	return []string{sel.Name}, a.err
+}
+
+func (a seriesAdmin) Rename(_ context.Context, from, to string) (map[string]string, error) {
+	return map[string]string{from: to}, a.err
+}
+
+func TestHandler_SeriesAdmin(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           []Option
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "delete",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{})},
+			path:           "/admin/series/delete",
+			body:           `{"name":"bad"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"series":["bad"],"rows":{"samples":0,"rollups":0,"series":0}}`,
+		},
+		{
+			name:           "reset",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{})},
+			path:           "/admin/series/reset",
+			body:           `{"name":"requests"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"series":["requests"]}`,
+		},
+		{
+			name:           "rename",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{})},
+			path:           "/admin/series/rename",
+			body:           `{"from":"load","to":"system_load"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"renamed":{"load":"system_load"}}`,
+		},
+		{
+			name:           "invalid selector",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{err: admin.ErrInvalidSelector})},
+			path:           "/admin/series/delete",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "rename conflict",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{err: admin.ErrConflict})},
+			path:           "/admin/series/rename",
+			body:           `{"from":"load","to":"system_load"}`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "not a single instance",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{err: admin.ErrUnavailable})},
+			path:           "/admin/series/delete",
+			body:           `{"name":"bad"}`,
+			expectedStatus: http.StatusNotImplemented,
+		},
+		{
+			name:           "storage failure",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{err: errors.New("db down")})},
+			path:           "/admin/series/reset",
+			body:           `{"name":"requests"}`,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "invalid body",
+			opts:           []Option{WithSeriesAdmin(seriesAdmin{})},
+			path:           "/admin/series/delete",
+			body:           `name=bad`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "not enabled",
+			path:           "/admin/series/delete",
+			body:           `{"name":"bad"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(nil, tt.opts...)
+			handlers := map[string]http.HandlerFunc{
+				"/admin/series/delete": h.HandleDeleteSeries,
+				"/admin/series/reset":  h.HandleResetSeries,
+				"/admin/series/rename": h.HandleRenameSeries,
+			}
+
+			var logs bytes.Buffer
+			r := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+			r.Header.Set(middleware.HeaderRequestID, "req-1")
+			w := httptest.NewRecorder()
+
+			// Audit records pass even the most restrictive log level.
+			log := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelError}))
+			middleware.RequestContext(log)(handlers[tt.path]).ServeHTTP(w, r)
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				require.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+
+			// Every attempted operation is audited with the identity of the request.
+			if tt.expectedStatus == http.StatusOK || tt.expectedStatus >= http.StatusConflict {
+				var entry struct {
+					Msg       string `json:"msg"`
+					RequestID string `json:"request_id"`
+					Op        string `json:"op"`
+					OK        bool   `json:"ok"`
+				}
+				require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+				require.Equal(t, "audit: series administration", entry.Msg)
+				require.Equal(t, "req-1", entry.RequestID)
+				require.NotEmpty(t, entry.Op)
+				require.Equal(t, tt.expectedStatus == http.StatusOK, entry.OK)
+			}
+		})
+	}
+}
+
+// snapshotter is a Snapshotter restoring every snapshot it is sent.
+type snapshotter struct{}
+
+func (snapshotter) Export(context.Context, io.Writer, snapshot.Filter) (snapshot.Stats, error) {
+	return snapshot.Stats{}, nil
+}
+
+func (snapshotter) Restore(_ context.Context, r io.ReadSeeker, _ snapshot.Filter) (snapshot.Stats, error) {
+	_, err := io.Copy(io.Discard, r)
+	return snapshot.Stats{}, err
+}
+
+func TestHandler_HandleRestore_MaxSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "within limit", body: "0123456789", expectedStatus: http.StatusOK},
+		{name: "too large", body: "0123456789a", expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(nil, WithSnapshots(snapshotter{}), WithMaxRestoreSize(10))
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			h.HandleRestore(w, r)
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
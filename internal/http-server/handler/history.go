@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/rollup"
+)
+
+// HistoryReader defines an interface for querying historical metric values.
+type HistoryReader interface {
+	Query(ctx context.Context, name string, start, end time.Time, step time.Duration) (rollup.Result, error)
+}
+
+// WithHistory enables the history endpoint backed by the given reader.
+func WithHistory(reader HistoryReader) Option {
+	return func(h *Handler) {
+		h.history = reader
+	}
+}
+
+// historyResponse is the JSON representation of a history query result.
+type historyResponse struct {
+	Name       string             `json:"name"`
+	Step       string             `json:"step"`
+	Resolution string             `json:"resolution"`
+	Points     []models.Aggregate `json:"points"`
+}
+
+// HandleHistory returns the historical values of a single metric.
+// Query parameters:
+//   - name: metric name (required)
+//   - start, end: RFC3339 or Unix seconds (default: the last hour)
+//   - step: bucket size as a Go duration or seconds (default: 1m)
+//
+// The data is served from the coarsest rollup resolution that fits the step,
+// reported as "raw" when it had to be computed from raw samples. The response is
+// MessagePack when the Accept header prefers it and JSON otherwise.
+func (h *Handler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if h.history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "missing metric name", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	end, err := parseTime(q.Get("end"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start, err := parseTime(q.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	step, err := parseDuration(q.Get("step"), time.Minute)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.history.Query(r.Context(), name, start, end, step)
+	if errors.Is(err, rollup.ErrInvalidRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("history query failed", logger.Err(err))
+		http.Error(w, "history query failed", http.StatusInternalServerError)
+		return
+	}
+
+	resolution := "raw"
+	if result.Resolution > 0 {
+		resolution = result.Resolution.String()
+	}
+
+	points := result.Points
+	if points == nil {
+		points = []models.Aggregate{}
+	}
+
+	writeResponse(w, r, http.StatusOK, historyResponse{
+		Name:       name,
+		Step:       step.String(),
+		Resolution: resolution,
+		Points:     points,
+	})
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/http-server/middleware"
+)
+
+// Header names of idempotent ingestion. A request carrying an Idempotency-Key
+// that was already applied is answered with its original status and the
+// Idempotent-Replayed header set, without being applied again.
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	HeaderReplayed       = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLen bounds the length of a request key.
+const maxIdempotencyKeyLen = 255
+
+// Deduplicator defines an interface for remembering the keys of applied
+// ingestion requests. Begin reserves a key, reporting whether it is already
+// known and the status it was answered with (zero while still being applied);
+// Complete records the status of a reserved key.
+type Deduplicator interface {
+	Begin(key string) (status int, seen bool)
+	Complete(key string, status int)
+}
+
+// WithDeduplicator makes ingestion requests carrying an idempotency key safe to retry.
+func WithDeduplicator(d Deduplicator) Option {
+	return func(h *Handler) {
+		h.dedup = d
+	}
+}
+
+// idempotencyKey returns the key of an ingestion request scoped to its tenant
+// and client, taken from the Idempotency-Key header or else the batch ID, and
+// whether the key is valid. It is empty when deduplication is disabled or the
+// request has no key.
+func (h *Handler) idempotencyKey(r *http.Request, batchID string) (string, bool) {
+	if h.dedup == nil {
+		return "", true
+	}
+
+	key := r.Header.Get(HeaderIdempotencyKey)
+	if key == "" {
+		key = batchID
+	}
+	if key == "" {
+		return "", true
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return "", false
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return "", false
+		}
+	}
+
+	info := middleware.RequestInfoFromContext(r.Context())
+	return info.Tenant + "\x1f" + info.Client + "\x1f" + key, true
+}
+
+// replay answers a request whose key is already known with the status of the
+// original request, or 409 if that request is still being applied.
+func replay(w http.ResponseWriter, status int) {
+	if status == 0 {
+		http.Error(w, "request with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set(HeaderReplayed, "true")
+	w.WriteHeader(status)
+}
+
+// statusWriter records the status code written to the wrapped ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// HealthChecker defines an interface for checking a dependency of the server.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
+// ValueReader defines an interface for reading the current value of every series.
+type ValueReader interface {
+	Latest() []models.Sample
+}
+
+// Flusher defines an interface for persisting the in-memory metrics on demand.
+type Flusher interface {
+	Flush(ctx context.Context) (int, error)
+}
+
+// WithHealthCheck makes the health endpoint report the given dependency.
+func WithHealthCheck(checker HealthChecker) Option {
+	return func(h *Handler) {
+		h.health = checker
+	}
+}
+
+// WithValues enables the current values endpoint backed by the given reader.
+func WithValues(reader ValueReader) Option {
+	return func(h *Handler) {
+		h.values = reader
+	}
+}
+
+// WithFlusher enables the on-demand flush endpoint.
+func WithFlusher(flusher Flusher) Option {
+	return func(h *Handler) {
+		h.flusher = flusher
+	}
+}
+
+// healthResponse is the JSON representation of the server health.
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HandleHealth reports whether the server and its database are available,
+// with 503 if the database cannot be reached.
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if h.health != nil {
+		if err := h.health.Ping(r.Context()); err != nil {
+			logger.FromContext(r.Context()).Warn("health check failed", logger.Err(err))
+			writeJSON(w, r, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+			return
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// HandleValues returns the current value of the in-memory series, ordered by key,
+// as JSON, a protobuf Samples message or MessagePack according to the Accept header.
+// Query parameters:
+//   - name: metric name (repeatable; default: all)
+//   - prefix: series key prefix
+func (h *Handler) HandleValues(w http.ResponseWriter, r *http.Request) {
+	if h.values == nil {
+		http.Error(w, "values are not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	names, prefix := q["name"], q.Get("prefix")
+
+	samples := make([]models.Sample, 0)
+	for _, s := range h.values.Latest() {
+		if !strings.HasPrefix(s.Key, prefix) {
+			continue
+		}
+		if len(names) > 0 && !slices.Contains(names, seriesName(s.Key)) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	slices.SortFunc(samples, func(a, b models.Sample) int { return strings.Compare(a.Key, b.Key) })
+
+	writeResponse(w, r, http.StatusOK, samples)
+}
+
+// seriesName returns the metric name part of a series key.
+func seriesName(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// flushResponse is the JSON representation of an on-demand flush.
+type flushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// HandleFlush persists the in-memory metrics immediately and returns their number.
+func (h *Handler) HandleFlush(w http.ResponseWriter, r *http.Request) {
+	if h.flusher == nil {
+		http.Error(w, "flush is not enabled", http.StatusNotFound)
+		return
+	}
+	if h.readOnly(w) {
+		return
+	}
+
+	n, err := h.flusher.Flush(r.Context())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("on-demand flush failed", logger.Err(err))
+		http.Error(w, "flush failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, flushResponse{Flushed: n})
+}
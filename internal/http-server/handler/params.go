@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// parseTime parses a query parameter given either as RFC3339 or as (fractional)
+// Unix seconds. An empty value yields def.
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+
+	return t, nil
+}
+
+// parseDuration parses a query parameter given either as a Go duration ("5m")
+// or as (fractional) seconds. An empty value yields def.
+func parseDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	return d, nil
+}
+
+// writeResponse writes v with the given status code in the format preferred by
+// the request's Accept header, falling back to JSON for values the preferred
+// format cannot represent.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	c := codec.Negotiate(r.Header.Get("Accept"))
+	if c.ContentType() == codec.ContentTypeJSON {
+		writeJSON(w, r, status, v)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := c.Encode(&buf, v); err != nil {
+		if !errors.Is(err, codec.ErrUnsupported) {
+			logger.FromContext(r.Context()).Warn("failed to encode response", logger.Err(err))
+		}
+		writeJSON(w, r, status, v)
+		return
+	}
+
+	w.Header().Set("Content-Type", c.ContentType())
+	w.WriteHeader(status)
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.FromContext(r.Context()).Warn("failed to write response", logger.Err(err))
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.FromContext(r.Context()).Warn("failed to write response", logger.Err(err))
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/promql"
+)
+
+// QueryEngine defines an interface for evaluating PromQL queries.
+type QueryEngine interface {
+	Instant(ctx context.Context, query string, ts time.Time) (promql.Value, error)
+	Range(ctx context.Context, query string, start, end time.Time, step time.Duration) (promql.Matrix, error)
+	Series(ctx context.Context, selectors []string, start, end time.Time) ([]promql.Labels, error)
+}
+
+// WithQueryEngine enables the Prometheus-compatible query API backed by the given engine.
+func WithQueryEngine(engine QueryEngine) Option {
+	return func(h *Handler) {
+		h.query = engine
+	}
+}
+
+// Error types of the Prometheus HTTP API.
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+)
+
+// apiResponse is the envelope of every Prometheus HTTP API response.
+type apiResponse struct {
+	Status    string `json:"status"`
+	Data      any    `json:"data,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// queryData is the data of a query response.
+type queryData struct {
+	ResultType promql.ValueType `json:"resultType"`
+	Result     promql.Value     `json:"result"`
+}
+
+func writeAPIData(w http.ResponseWriter, r *http.Request, data any) {
+	writeJSON(w, r, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, errorType, msg string) {
+	writeJSON(w, r, status, apiResponse{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// writeQueryError reports invalid queries as bad data and anything else as an execution failure.
+func writeQueryError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, promql.ErrInvalidQuery) {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+
+	logger.FromContext(r.Context()).Error("query failed", logger.Err(err))
+	writeAPIError(w, r, http.StatusUnprocessableEntity, errorExecution, "query execution failed")
+}
+
+// queryEnabled reports whether the query API is configured, answering 404 otherwise.
+func (h *Handler) queryEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if h.query == nil {
+		writeAPIError(w, r, http.StatusNotFound, errorBadData, "query API is not enabled")
+		return false
+	}
+	return true
+}
+
+// HandleQuery evaluates an instant query.
+// Parameters (query string or form body):
+//   - query: PromQL expression (required)
+//   - time: RFC3339 or Unix seconds (default: now)
+func (h *Handler) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.queryEnabled(w, r) {
+		return
+	}
+
+	query := r.FormValue("query")
+	if query == "" {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, "missing query")
+		return
+	}
+
+	ts, err := parseTime(r.FormValue("time"), time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+
+	v, err := h.query.Instant(r.Context(), query, ts)
+	if err != nil {
+		writeQueryError(w, r, err)
+		return
+	}
+
+	writeAPIData(w, r, queryData{ResultType: v.Type(), Result: v})
+}
+
+// HandleQueryRange evaluates a query at every step of a time range.
+// Parameters (query string or form body):
+//   - query: PromQL expression (required)
+//   - start, end: RFC3339 or Unix seconds (required)
+//   - step: Go or PromQL duration, or seconds (required)
+func (h *Handler) HandleQueryRange(w http.ResponseWriter, r *http.Request) {
+	if !h.queryEnabled(w, r) {
+		return
+	}
+
+	query := r.FormValue("query")
+	if query == "" {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, "missing query")
+		return
+	}
+
+	var (
+		start, end time.Time
+		step       time.Duration
+		err        error
+	)
+	for _, p := range []string{"start", "end", "step"} {
+		if r.FormValue(p) == "" {
+			writeAPIError(w, r, http.StatusBadRequest, errorBadData, "missing "+p)
+			return
+		}
+	}
+	if start, err = parseTime(r.FormValue("start"), time.Time{}); err == nil {
+		if end, err = parseTime(r.FormValue("end"), time.Time{}); err == nil {
+			step, err = parseStep(r.FormValue("step"))
+		}
+	}
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+
+	m, err := h.query.Range(r.Context(), query, start, end, step)
+	if err != nil {
+		writeQueryError(w, r, err)
+		return
+	}
+
+	writeAPIData(w, r, queryData{ResultType: m.Type(), Result: m})
+}
+
+// parseStep accepts everything parseDuration does plus PromQL durations such as "1d".
+func parseStep(value string) (time.Duration, error) {
+	if d, err := promql.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	return parseDuration(value, 0)
+}
+
+// matchingSeries returns the label sets of the series selected by the match[]
+// parameters within the optional start and end (default: the last hour).
+func (h *Handler) matchingSeries(w http.ResponseWriter, r *http.Request) ([]promql.Labels, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return nil, false
+	}
+
+	end, err := parseTime(r.Form.Get("end"), time.Now().UTC())
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return nil, false
+	}
+
+	start, err := parseTime(r.Form.Get("start"), end.Add(-time.Hour))
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errorBadData, err.Error())
+		return nil, false
+	}
+
+	series, err := h.query.Series(r.Context(), r.Form["match[]"], start, end)
+	if err != nil {
+		writeQueryError(w, r, err)
+		return nil, false
+	}
+
+	return series, true
+}
+
+// HandleSeries lists the series matching the match[] selectors.
+func (h *Handler) HandleSeries(w http.ResponseWriter, r *http.Request) {
+	if !h.queryEnabled(w, r) {
+		return
+	}
+
+	series, ok := h.matchingSeries(w, r)
+	if !ok {
+		return
+	}
+
+	writeAPIData(w, r, series)
+}
+
+// HandleLabels lists the label names of the series matching the optional match[] selectors.
+func (h *Handler) HandleLabels(w http.ResponseWriter, r *http.Request) {
+	if !h.queryEnabled(w, r) {
+		return
+	}
+
+	series, ok := h.matchingSeries(w, r)
+	if !ok {
+		return
+	}
+
+	names := make(map[string]struct{})
+	for _, l := range series {
+		for name := range l {
+			names[name] = struct{}{}
+		}
+	}
+
+	writeAPIData(w, r, sortedKeys(names))
+}
+
+// HandleLabelValues lists the values of the label given in the path among the
+// series matching the optional match[] selectors.
+func (h *Handler) HandleLabelValues(w http.ResponseWriter, r *http.Request) {
+	if !h.queryEnabled(w, r) {
+		return
+	}
+
+	label := r.PathValue("name")
+
+	series, ok := h.matchingSeries(w, r)
+	if !ok {
+		return
+	}
+
+	values := make(map[string]struct{})
+	for _, l := range series {
+		if v, ok := l[label]; ok {
+			values[v] = struct{}{}
+		}
+	}
+
+	writeAPIData(w, r, sortedKeys(values))
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// Replica defines an interface for the read-only mode of a replica of another
+// instance. A replica refuses writes until promoted.
+type Replica interface {
+	ReadOnly() bool
+	Promote()
+}
+
+// WithReplica refuses writes while the instance is a read-only replica.
+func WithReplica(r Replica) Option {
+	return func(h *Handler) {
+		h.replica = r
+	}
+}
+
+// roleResponse is the response of the promote endpoint.
+type roleResponse struct {
+	Role string `json:"role"`
+}
+
+// readOnly reports whether the instance is a read-only replica, answering the
+// request with 503 if so, so that clients retry against the primary.
+func (h *Handler) readOnly(w http.ResponseWriter) bool {
+	if h.replica == nil || !h.replica.ReadOnly() {
+		return false
+	}
+
+	http.Error(w, "read-only replica", http.StatusServiceUnavailable)
+	return true
+}
+
+// HandlePromote promotes a replica to primary: it stops following its
+// primary, accepts writes and flushes. Promoting a primary changes nothing.
+func (h *Handler) HandlePromote(w http.ResponseWriter, r *http.Request) {
+	if h.replica != nil && h.replica.ReadOnly() {
+		h.replica.Promote()
+		logger.FromContext(r.Context()).Info("promoted to primary")
+	}
+
+	writeJSON(w, r, http.StatusOK, roleResponse{Role: "primary"})
+}
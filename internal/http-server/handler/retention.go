@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/retention"
+)
+
+// RetentionReporter defines an interface for running the retention policy.
+type RetentionReporter interface {
+	Apply(ctx context.Context, dryRun bool) (retention.Report, error)
+}
+
+// WithRetention enables the retention report endpoint backed by the given job.
+func WithRetention(reporter RetentionReporter) Option {
+	return func(h *Handler) {
+		h.retention = reporter
+	}
+}
+
+// HandleRetentionReport runs the retention policy in dry-run mode and returns
+// the series and history that would currently be deleted.
+func (h *Handler) HandleRetentionReport(w http.ResponseWriter, r *http.Request) {
+	if h.retention == nil {
+		http.Error(w, "retention is not enabled", http.StatusNotFound)
+		return
+	}
+
+	report, err := h.retention.Apply(r.Context(), true)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("retention report failed", logger.Err(err))
+		http.Error(w, "retention report failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/snapshot"
+)
+
+// defaultMaxRestoreSize bounds the size of a snapshot sent for restore, which
+// is spooled to a temporary file, unless configured otherwise.
+const defaultMaxRestoreSize = 1 << 30
+
+// Snapshotter defines an interface for exporting and restoring snapshots of the metric store.
+type Snapshotter interface {
+	Export(ctx context.Context, w io.Writer, f snapshot.Filter) (snapshot.Stats, error)
+	Restore(ctx context.Context, r io.ReadSeeker, f snapshot.Filter) (snapshot.Stats, error)
+}
+
+// WithSnapshots enables the snapshot export and restore endpoints.
+func WithSnapshots(snapshotter Snapshotter) Option {
+	return func(h *Handler) {
+		h.snapshots = snapshotter
+	}
+}
+
+// WithMaxRestoreSize bounds the size of a snapshot sent for restore (1 GiB by default).
+func WithMaxRestoreSize(n int64) Option {
+	return func(h *Handler) {
+		h.maxRestore = n
+	}
+}
+
+// parseFilter reads the snapshot filter from the query parameters:
+//   - prefix: series key prefix
+//   - start, end: RFC3339 or Unix seconds (default: unbounded)
+func parseFilter(q url.Values) (snapshot.Filter, error) {
+	f := snapshot.Filter{Prefix: q.Get("prefix")}
+
+	var err error
+	if f.Start, err = parseTime(q.Get("start"), time.Time{}); err != nil {
+		return f, err
+	}
+	if f.End, err = parseTime(q.Get("end"), time.Time{}); err != nil {
+		return f, err
+	}
+	if !f.Start.IsZero() && !f.End.IsZero() && f.End.Before(f.Start) {
+		return f, errors.New("end must not be before start")
+	}
+
+	return f, nil
+}
+
+// HandleSnapshot streams a snapshot of the metric store, restricted by the
+// prefix, start and end query parameters, as a file download.
+func (h *Handler) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if h.snapshots == nil {
+		http.Error(w, "snapshots are not enabled", http.StatusNotFound)
+		return
+	}
+
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log := logger.FromContext(r.Context())
+
+	// Large snapshots take longer than the server's write timeout.
+	if err = http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Warn("failed to clear write deadline", logger.Err(err))
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="metrics-%s.snap"`, time.Now().UTC().Format("20060102T150405Z")))
+
+	// Once streaming has started the status can no longer change; a failed
+	// export leaves a truncated file that fails verification on restore.
+	if _, err = h.snapshots.Export(r.Context(), w, f); err != nil {
+		log.Error("snapshot export failed", logger.Err(err))
+	}
+}
+
+// HandleRestore restores the snapshot sent as the request body, restricted by
+// the prefix, start and end query parameters. The snapshot is verified in full
+// before anything is written; a corrupt snapshot yields 400 and one larger
+// than the maximum restore size 413.
+func (h *Handler) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	if h.snapshots == nil {
+		http.Error(w, "snapshots are not enabled", http.StatusNotFound)
+		return
+	}
+	if h.readOnly(w) {
+		return
+	}
+
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log := logger.FromContext(r.Context())
+
+	// The snapshot is read twice, once to verify it and once to restore it.
+	tmp, err := os.CreateTemp("", "metric-server-restore-*")
+	if err != nil {
+		log.Error("failed to create temporary file", logger.Err(err))
+		http.Error(w, "restore failed", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	limit := h.maxRestore
+	if limit <= 0 {
+		limit = defaultMaxRestoreSize
+	}
+	if _, err = io.Copy(tmp, http.MaxBytesReader(w, r.Body, limit)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "snapshot too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read snapshot", http.StatusBadRequest)
+		return
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		log.Error("failed to rewind snapshot", logger.Err(err))
+		http.Error(w, "restore failed", http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := h.snapshots.Restore(r.Context(), tmp, f)
+	if errors.Is(err, snapshot.ErrCorrupt) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error("snapshot restore failed", logger.Err(err))
+		http.Error(w, "restore failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, stats)
+}
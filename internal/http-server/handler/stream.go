@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/stream"
+)
+
+// defaultHeartbeat is the keep-alive interval used when none is configured.
+const defaultHeartbeat = 15 * time.Second
+
+// Streamer defines an interface for subscribing to live metric updates.
+type Streamer interface {
+	Subscribe(selectors []string) (*stream.Subscriber, error)
+	Unsubscribe(sub *stream.Subscriber)
+}
+
+// WithStream enables the live update stream, sending keep-alive messages every
+// heartbeat on idle connections.
+func WithStream(streamer Streamer, heartbeat time.Duration) Option {
+	return func(h *Handler) {
+		if heartbeat <= 0 {
+			heartbeat = defaultHeartbeat
+		}
+		h.stream, h.heartbeat = streamer, heartbeat
+	}
+}
+
+// WithStreamOrigins allows WebSocket connections from browser pages of the
+// given origins, such as "https://dashboard.example.com", in addition to the
+// same origin.
+func WithStreamOrigins(origins ...string) Option {
+	return func(h *Handler) {
+		h.origins = append(h.origins, origins...)
+	}
+}
+
+// checkOrigin accepts WebSocket connections from clients sending no Origin
+// header, which are not browsers, from the origin of the server itself and
+// from the allowed origins.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range h.origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleStream pushes metric updates as they are written, over a WebSocket if
+// the request asks for an upgrade and as Server-Sent Events otherwise.
+// Query parameters:
+//   - match[]: series selectors, e.g. cpu{host=~"web-.*"} (repeatable)
+//   - name: metric name, a shorthand for a selector of the bare name (repeatable)
+//
+// Without filters every series is streamed. Rapid updates to the same series
+// are coalesced; clients that cannot keep up are disconnected.
+func (h *Handler) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if h.stream == nil {
+		http.Error(w, "stream is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	selectors := q["match[]"]
+	for _, name := range q["name"] {
+		selectors = append(selectors, fmt.Sprintf("{__name__=%q}", name))
+	}
+
+	sub, err := h.stream.Subscribe(selectors)
+	if errors.Is(err, stream.ErrHubClosed) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer h.stream.Unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.streamWebSocket(w, r, sub)
+		return
+	}
+	h.streamEvents(w, r, sub)
+}
+
+// streamEvents writes one "update" event per series update and an "error"
+// event before closing a subscription ended by the server.
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request, sub *stream.Subscriber) {
+	rc := http.NewResponseController(w)
+	log := logger.FromContext(r.Context())
+
+	// Streams outlive the server's write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Warn("failed to clear write deadline", logger.Err(err))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Warn("streaming is not supported by the connection", logger.Err(err))
+		return
+	}
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Done():
+			if err = sub.Err(); err != nil {
+				_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+				_ = rc.Flush()
+			}
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-sub.Ready():
+			for _, u := range sub.Drain() {
+				data, _ := json.Marshal(u)
+				if _, err = fmt.Fprintf(w, "event: update\ndata: %s\n\n", data); err != nil {
+					break
+				}
+			}
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			log.Debug("stream client gone", logger.Err(err))
+			return
+		}
+	}
+}
+
+// streamWebSocket sends every batch of pending updates as one JSON array
+// message and closes the connection with a reason when the server ends the subscription.
+func (h *Handler) streamWebSocket(w http.ResponseWriter, r *http.Request, sub *stream.Subscriber) {
+	log := logger.FromContext(r.Context())
+
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug("websocket upgrade failed", logger.Err(err))
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Incoming messages are ignored; reading processes control frames and
+	// detects the client going away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-gone:
+			return
+		case <-sub.Done():
+			code, reason := websocket.CloseNormalClosure, ""
+			if err = sub.Err(); err != nil {
+				code, reason = websocket.ClosePolicyViolation, err.Error()
+			}
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+				time.Now().Add(time.Second))
+			return
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.heartbeat))
+		case <-sub.Ready():
+			err = conn.WriteJSON(sub.Drain())
+		}
+
+		if err != nil {
+			log.Debug("stream client gone", logger.Err(err))
+			return
+		}
+	}
+}
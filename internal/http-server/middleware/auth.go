@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// BearerToken is an HTTP middleware letting through only the requests whose
+// Authorization header carries the given bearer token, compared in constant
+// time. Other requests are answered with 401; an empty token refuses all.
+func BearerToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !HasBearerToken(r.Header, token) {
+				logger.FromContext(r.Context()).Warn("unauthorized request", slog.String("path", r.URL.Path))
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasBearerToken reports whether the Authorization header carries the given
+// bearer token, compared in constant time. It is always false for an empty token.
+func HasBearerToken(header http.Header, token string) bool {
+	got, ok := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		header         string
+		expectedStatus int
+	}{
+		{name: "valid token", token: "secret", header: "Bearer secret", expectedStatus: http.StatusNoContent},
+		{name: "wrong token", token: "secret", header: "Bearer guess", expectedStatus: http.StatusUnauthorized},
+		{name: "missing header", token: "secret", expectedStatus: http.StatusUnauthorized},
+		{name: "other scheme", token: "secret", header: "Basic secret", expectedStatus: http.StatusUnauthorized},
+		{name: "no token configured", header: "Bearer ", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/series/delete", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			BearerToken(tt.token)(next).ServeHTTP(w, r)
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
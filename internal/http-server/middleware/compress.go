@@ -0,0 +1,517 @@
+// Package middleware provides HTTP middleware handlers for common web server functionality.
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// DefaultCompressMinSize is the response size below which compression is skipped.
+const DefaultCompressMinSize = 1024
+
+// Limits of compressed request bodies: the size of the body as sent, and the
+// size it decodes to.
+const (
+	maxEncodedRequestSize = 32 << 20
+	maxDecodedRequestSize = 64 << 20
+)
+
+// errTooLarge is returned for request bodies decoding to more than allowed.
+var errTooLarge = errors.New("decoded request body too large")
+
+// encoder compresses a response body; Reset points it at a new destination.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// decoder decompresses a request body; Reset points it at a new source.
+type decoder interface {
+	io.Reader
+	Reset(r io.Reader) error
+}
+
+// coding is a supported content coding with pools of its encoders and decoders.
+type coding struct {
+	name     string
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *coding) encoder(w io.Writer) encoder {
+	e := c.encoders.Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+func (c *coding) decoder(r io.Reader) (decoder, error) {
+	d := c.decoders.Get().(decoder)
+	if err := d.Reset(r); err != nil {
+		c.decoders.Put(d)
+		return nil, err
+	}
+	return d, nil
+}
+
+// codings lists the supported content codings in order of server preference,
+// used to break ties between equally weighted Accept-Encoding entries.
+var codings = []*coding{
+	{
+		name: "zstd",
+		encoders: sync.Pool{New: func() any {
+			e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+			return e
+		}},
+		decoders: sync.Pool{New: func() any {
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			return d
+		}},
+	},
+	{
+		name:     "gzip",
+		encoders: sync.Pool{New: func() any { return gzip.NewWriter(nil) }},
+		decoders: sync.Pool{New: func() any { return new(gzipDecoder) }},
+	},
+	{
+		name:     "br",
+		encoders: sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 4) }},
+		decoders: sync.Pool{New: func() any { return brotli.NewReader(nil) }},
+	},
+	{
+		name:     "deflate",
+		encoders: sync.Pool{New: func() any { return zlib.NewWriter(nil) }},
+		decoders: sync.Pool{New: func() any { return new(zlibDecoder) }},
+	},
+	{
+		name:     "snappy",
+		encoders: sync.Pool{New: func() any { return snappy.NewBufferedWriter(nil) }},
+		decoders: sync.Pool{New: func() any { return new(snappyDecoder) }},
+	},
+}
+
+func codingByName(name string) *coding {
+	for _, c := range codings {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Compress is an HTTP middleware decompressing request bodies sent with a
+// zstd, gzip, br, deflate or snappy Content-Encoding and compressing responses
+// with the coding preferred by the Accept-Encoding header. Compressed request
+// bodies over maxEncodedRequestSize bytes, or decoding to more than
+// maxDecodedRequestSize bytes, are refused with 413. Responses smaller
+// than minSize bytes, and responses that already set a Content-Encoding or
+// carry opaque binary data, are sent as is. Streaming requests (WebSocket
+// upgrades and Server-Sent Events) are passed through untouched, as
+// compression would buffer their messages and hide the connection from the upgrader.
+func Compress(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if streaming(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := next
+			if enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc != "" && enc != "identity" {
+				c := codingByName(enc)
+				if c == nil {
+					http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+					return
+				}
+				d, err := c.decoder(http.MaxBytesReader(w, r.Body, maxEncodedRequestSize))
+				var maxBytes *http.MaxBytesError
+				switch {
+				case errors.As(err, &maxBytes), errors.Is(err, errTooLarge):
+					http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+					return
+				case err != nil:
+					http.Error(w, "Failed to decompress request", http.StatusBadRequest)
+					return
+				}
+				defer c.decoders.Put(d)
+
+				body := &limitedBody{r: d, n: maxDecodedRequestSize}
+				r.Body = io.NopCloser(body)
+				r.Header.Del("Content-Encoding")
+				r.ContentLength = -1
+				h = refuseTooLarge(next, body)
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			c := negotiateCoding(r.Header.Get("Accept-Encoding"))
+			if c == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, coding: c, minSize: minSize}
+			defer func() {
+				if err := cw.close(); err != nil {
+					logger.FromContext(r.Context()).Warn("failed to finish compressed response", logger.Err(err))
+				}
+			}()
+
+			h.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// streaming reports whether the request asks for a WebSocket upgrade or an event stream.
+func streaming(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// negotiateCoding returns the coding preferred by an Accept-Encoding header,
+// honoring quality values, or nil if the response should not be compressed.
+// A wildcard selects the most preferred coding not listed otherwise.
+func negotiateCoding(accept string) *coding {
+	if accept == "" {
+		return nil
+	}
+
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		weights[name] = q
+	}
+
+	var (
+		best  *coding
+		bestQ float64
+	)
+	for _, c := range codings {
+		q, ok := weights[c.name]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// incompressible lists response content types that are already compressed.
+var incompressible = map[string]bool{
+	"application/octet-stream": true,
+	"application/gzip":         true,
+	"application/zstd":         true,
+	"application/zip":          true,
+}
+
+// compressWriter buffers the start of a response until minSize bytes were
+// written, then decides whether to compress it. Smaller responses are written
+// as is when the handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	coding  *coding
+	minSize int
+
+	status  int
+	buf     bytes.Buffer
+	enc     encoder
+	decided bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		if c.enc != nil {
+			return c.enc.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+
+	c.buf.Write(p)
+	if c.buf.Len() < c.minSize {
+		return len(p), nil
+	}
+
+	if err := c.start(c.compressible()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// compressible reports whether the response may be compressed.
+func (c *compressWriter) compressible() bool {
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if c.status < http.StatusOK || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return !incompressible[mediaType]
+}
+
+// start writes the header and the buffered data, compressed if requested.
+func (c *compressWriter) start(compress bool) error {
+	c.decided = true
+
+	if compress {
+		h := c.Header()
+		h.Set("Content-Encoding", c.coding.name)
+		h.Del("Content-Length")
+		c.enc = c.coding.encoder(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(c.buf.Bytes())
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf.Bytes())
+	}
+	c.buf.Reset()
+	return err
+}
+
+// close writes a response smaller than minSize as is, or finishes the compressed stream.
+func (c *compressWriter) close() error {
+	if !c.decided {
+		if c.status == 0 {
+			return nil
+		}
+		return c.start(false)
+	}
+	if c.enc == nil {
+		return nil
+	}
+
+	err := c.enc.Close()
+	c.coding.encoders.Put(c.enc)
+	c.enc = nil
+	return err
+}
+
+// Flush sends the buffered data, compressing it if it is not too small to decide yet.
+func (c *compressWriter) Flush() {
+	if !c.decided && c.status != 0 {
+		if err := c.start(c.buf.Len() >= c.minSize && c.compressible()); err != nil {
+			return
+		}
+	}
+	if c.enc != nil {
+		if err := c.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := c.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// limitedBody is a decoded request body failing with errTooLarge after n more
+// bytes. It records whether the body exceeded this or the encoded size limit.
+type limitedBody struct {
+	r        io.Reader
+	n        int64
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.tooLarge {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+
+	n, err := b.r.Read(p)
+	if int64(n) > b.n {
+		n = int(b.n)
+		b.n = 0
+		b.tooLarge = true
+		return n, errTooLarge
+	}
+	b.n -= int64(n)
+
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+// refuseTooLarge answers a request with 413 instead of the response of next
+// when its body turns out to be too large before next starts responding.
+func refuseTooLarge(next http.Handler, body *limitedBody) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &tooLargeWriter{ResponseWriter: w, body: body}
+		next.ServeHTTP(tw, r)
+		tw.refuse()
+	})
+}
+
+// tooLargeWriter drops the response of a handler whose request body was too large.
+type tooLargeWriter struct {
+	http.ResponseWriter
+	body    *limitedBody
+	started bool
+	refused bool
+}
+
+func (t *tooLargeWriter) WriteHeader(code int) {
+	if !t.refuse() {
+		t.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (t *tooLargeWriter) Write(p []byte) (int, error) {
+	if t.refuse() {
+		return len(p), nil
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *tooLargeWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// refuse answers with 413 if the body was too large when the response starts,
+// and reports whether the response is dropped.
+func (t *tooLargeWriter) refuse() bool {
+	if !t.started && t.body.tooLarge {
+		t.refused = true
+		http.Error(t.ResponseWriter, "request body too large", http.StatusRequestEntityTooLarge)
+	}
+	t.started = true
+	return t.refused
+}
+
+// gzipDecoder is a gzip.Reader created on first use, as creating one reads the header.
+type gzipDecoder struct{ r *gzip.Reader }
+
+func (g *gzipDecoder) Read(p []byte) (int, error) { return g.r.Read(p) }
+
+func (g *gzipDecoder) Reset(r io.Reader) error {
+	if g.r == nil {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		g.r = gr
+		return nil
+	}
+	return g.r.Reset(r)
+}
+
+// zlibDecoder is a zlib reader created on first use, as creating one reads the header.
+type zlibDecoder struct{ r io.ReadCloser }
+
+func (z *zlibDecoder) Read(p []byte) (int, error) { return z.r.Read(p) }
+
+func (z *zlibDecoder) Reset(r io.Reader) error {
+	if z.r == nil {
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return err
+		}
+		z.r = zr
+		return nil
+	}
+	return z.r.(zlib.Resetter).Reset(r, nil)
+}
+
+// snappyMagic starts a snappy framing format stream.
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// snappyDecoder reads snappy request bodies in the framing format, or in the
+// block format used by Prometheus remote write when the stream header is missing.
+type snappyDecoder struct {
+	framed *snappy.Reader
+	r      io.Reader
+}
+
+func (s *snappyDecoder) Read(p []byte) (int, error) { return s.r.Read(p) }
+
+func (s *snappyDecoder) Reset(r io.Reader) error {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(snappyMagic))
+	if err == nil && bytes.Equal(head, snappyMagic) {
+		if s.framed == nil {
+			s.framed = snappy.NewReader(br)
+		} else {
+			s.framed.Reset(br)
+		}
+		s.r = s.framed
+		return nil
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	if n, err := snappy.DecodedLen(data); err != nil {
+		return err
+	} else if n > maxDecodedRequestSize {
+		return errTooLarge
+	}
+	block, err := snappy.Decode(nil, data)
+	if err != nil {
+		return err
+	}
+	s.r = bytes.NewReader(block)
+	return nil
+}
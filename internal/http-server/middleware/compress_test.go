@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		w = zw
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "snappy":
+		w = snappy.NewBufferedWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "":
+		r = bytes.NewReader(data)
+	case "zstd":
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(bytes.NewReader(data))
+		r = zr
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case "snappy":
+		r = snappy.NewReader(bytes.NewReader(data))
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	require.NoError(t, err)
+
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return out
+}
+
+func TestCompress_Responses(t *testing.T) {
+	large := strings.Repeat("metric_value 42\n", 200)
+
+	tests := []struct {
+		name             string
+		acceptEncoding   string
+		body             string
+		contentType      string
+		expectedEncoding string
+	}{
+		{name: "plain for other clients", body: large},
+		{name: "gzip", acceptEncoding: "gzip, deflate", body: large, expectedEncoding: "gzip"},
+		{name: "server preference breaks ties", acceptEncoding: "gzip, zstd, br", body: large, expectedEncoding: "zstd"},
+		{name: "quality values", acceptEncoding: "zstd;q=0.5, br;q=0.9, gzip;q=0.1", body: large, expectedEncoding: "br"},
+		{name: "deflate", acceptEncoding: "deflate", body: large, expectedEncoding: "deflate"},
+		{name: "snappy", acceptEncoding: "snappy", body: large, expectedEncoding: "snappy"},
+		{name: "wildcard", acceptEncoding: "*", body: large, expectedEncoding: "zstd"},
+		{name: "wildcard with exclusion", acceptEncoding: "*, zstd;q=0", body: large, expectedEncoding: "gzip"},
+		{name: "refused codings", acceptEncoding: "gzip;q=0, identity", body: large},
+		{name: "unknown coding", acceptEncoding: "compress", body: large},
+		{name: "small response", acceptEncoding: "gzip", body: "ok"},
+		{name: "already compressed content", acceptEncoding: "gzip", body: large, contentType: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			h := Compress(DefaultCompressMinSize)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				calls++
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(http.StatusCreated)
+				// Written in parts, so the size threshold is crossed mid-response.
+				for part := range strings.SplitAfterSeq(tt.body, "\n") {
+					_, _ = io.WriteString(w, part)
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			require.Equal(t, 1, calls)
+			require.Equal(t, http.StatusCreated, rr.Code)
+			require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+			require.Equal(t, tt.expectedEncoding, rr.Header().Get("Content-Encoding"))
+			require.Equal(t, tt.body, string(decompress(t, tt.expectedEncoding, rr.Body.Bytes())))
+		})
+	}
+}
+
+func TestCompress_EmptyResponse(t *testing.T) {
+	h := Compress(DefaultCompressMinSize)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Empty(t, rr.Body.Bytes())
+}
+
+func TestCompress_Requests(t *testing.T) {
+	payload := []byte(`[{"name":"cpu","type":"gauge","value":0.5}]`)
+
+	tests := []struct {
+		name           string
+		encoding       string
+		body           []byte
+		expectedStatus int
+	}{
+		{name: "identity", body: payload, expectedStatus: http.StatusOK},
+		{name: "zstd", encoding: "zstd", body: compress(t, "zstd", payload), expectedStatus: http.StatusOK},
+		{name: "gzip", encoding: "gzip", body: compress(t, "gzip", payload), expectedStatus: http.StatusOK},
+		{name: "brotli", encoding: "br", body: compress(t, "br", payload), expectedStatus: http.StatusOK},
+		{name: "deflate", encoding: "deflate", body: compress(t, "deflate", payload), expectedStatus: http.StatusOK},
+		{name: "snappy framed", encoding: "snappy", body: compress(t, "snappy", payload), expectedStatus: http.StatusOK},
+		{name: "snappy block", encoding: "snappy", body: snappy.Encode(nil, payload), expectedStatus: http.StatusOK},
+		{name: "case insensitive", encoding: "GZIP", body: compress(t, "gzip", payload), expectedStatus: http.StatusOK},
+		{name: "invalid body", encoding: "gzip", body: payload, expectedStatus: http.StatusBadRequest},
+		{name: "unsupported", encoding: "compress", body: payload, expectedStatus: http.StatusUnsupportedMediaType},
+		{
+			name:           "snappy block too large",
+			encoding:       "snappy",
+			body:           append(binary.AppendUvarint(nil, maxDecodedRequestSize+1), payload...),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "body too large",
+			encoding:       "snappy",
+			body:           make([]byte, maxEncodedRequestSize+1),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "gzip bomb",
+			encoding:       "gzip",
+			body:           compress(t, "gzip", make([]byte, maxDecodedRequestSize+1)),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "zstd bomb",
+			encoding:       "zstd",
+			body:           compress(t, "zstd", make([]byte, maxDecodedRequestSize+1)),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each case runs twice to exercise pooled decoders.
+			for range 2 {
+				h := Compress(DefaultCompressMinSize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, err := io.ReadAll(r.Body)
+					if err != nil {
+						http.Error(w, "invalid payload", http.StatusBadRequest)
+						return
+					}
+					require.Equal(t, payload, body)
+					require.Empty(t, r.Header.Get("Content-Encoding"))
+				}))
+
+				req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(tt.body))
+				if tt.encoding != "" {
+					req.Header.Set("Content-Encoding", tt.encoding)
+				}
+				rr := httptest.NewRecorder()
+				h.ServeHTTP(rr, req)
+
+				require.Equal(t, tt.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestCompress_Streaming(t *testing.T) {
+	h := Compress(0)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, ok := w.(*compressWriter)
+		require.False(t, ok)
+		_, _ = io.WriteString(w, "data: x\n\n")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	require.Empty(t, rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "data: x\n\n", rr.Body.String())
+}
+
+func BenchmarkCompress(b *testing.B) {
+	body := []byte(strings.Repeat(`{"key":"http_requests_total{host=\"a\"}","value":42},`, 2000))
+
+	for _, c := range codings {
+		b.Run(c.name, func(b *testing.B) {
+			h := Compress(DefaultCompressMinSize)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write(body)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", c.name)
+
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
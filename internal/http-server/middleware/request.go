@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+// Request headers used to identify the caller.
+const (
+	HeaderRequestID = "X-Request-ID"
+	HeaderClientID  = "X-Client-ID"
+	HeaderTenantID  = "X-Tenant-ID"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo holds the request-scoped identity of a caller.
+type RequestInfo struct {
+	ID     string
+	Client string
+	Tenant string
+}
+
+// RequestInfoFromContext returns the RequestInfo stored by RequestContext, if any.
+func RequestInfoFromContext(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info
+}
+
+// RequestContext is an HTTP middleware that assigns every request an ID, resolves
+// the client and tenant identity, and stores both the RequestInfo and a logger
+// annotated with those fields in the request context.
+//
+// The request ID is taken from the X-Request-ID header or generated, the client
+// from X-Client-ID or the remote address, and the tenant from X-Tenant-ID.
+func RequestContext(log *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := RequestInfo{
+				ID:     r.Header.Get(HeaderRequestID),
+				Client: r.Header.Get(HeaderClientID),
+				Tenant: r.Header.Get(HeaderTenantID),
+			}
+			if info.ID == "" {
+				info.ID = newRequestID()
+			}
+			if info.Client == "" {
+				info.Client = remoteHost(r.RemoteAddr)
+			}
+
+			w.Header().Set(HeaderRequestID, info.ID)
+
+			reqLog := log.With(
+				slog.String("request_id", info.ID),
+				slog.String("client", info.Client),
+			)
+			if info.Tenant != "" {
+				reqLog = reqLog.With(slog.String("tenant", info.Tenant))
+			}
+
+			ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+			ctx = logger.WithContext(ctx, reqLog)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
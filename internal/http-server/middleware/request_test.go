@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+)
+
+func TestRequestContext_AccessLog(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedClient string
+		expectedTenant string
+	}{
+		{
+			name:           "identity from headers",
+			headers:        map[string]string{HeaderRequestID: "req-1", HeaderClientID: "agent-7", HeaderTenantID: "team-a"},
+			expectedClient: "agent-7",
+			expectedTenant: "team-a",
+		},
+		{
+			name:           "client falls back to remote address",
+			headers:        map[string]string{},
+			expectedClient: "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log := slog.New(slog.NewJSONHandler(&buf, nil))
+
+			var info RequestInfo
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info = RequestInfoFromContext(r.Context())
+				logger.FromContext(r.Context()).Info("inside")
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/update", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			RequestContext(log)(AccessLog(next)).ServeHTTP(w, r)
+
+			require.NotEmpty(t, info.ID)
+			require.Equal(t, info.ID, w.Header().Get(HeaderRequestID))
+			require.Equal(t, tt.expectedClient, info.Client)
+			require.Equal(t, tt.expectedTenant, info.Tenant)
+
+			dec := json.NewDecoder(&buf)
+			var entries []map[string]any
+			for dec.More() {
+				var e map[string]any
+				require.NoError(t, dec.Decode(&e))
+				entries = append(entries, e)
+			}
+
+			require.Len(t, entries, 2)
+			for _, e := range entries {
+				require.Equal(t, info.ID, e["request_id"])
+				require.Equal(t, tt.expectedClient, e["client"])
+			}
+			require.Equal(t, "http request", entries[1]["msg"])
+			require.EqualValues(t, http.StatusAccepted, entries[1]["status"])
+		})
+	}
+}
@@ -4,6 +4,7 @@
 package router
 
 import (
+	"log/slog"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -18,13 +19,231 @@ type MetricHandler interface {
 	HandleMetrics(w http.ResponseWriter, r *http.Request)
 }
 
+// Option mounts additional routes on the router.
+type Option func(r *routes)
+
+// routes collects the routes mounted by options: public ones, open to every
+// client, administrative ones, mounted under /admin, and internal ones, called
+// by other instances. Administrative and internal routes are restricted to the
+// requests carrying the admin token.
+type routes struct {
+	token    string
+	public   []func(r chi.Router)
+	admin    []func(r chi.Router)
+	internal []func(r chi.Router)
+}
+
+// public mounts routes open to every client.
+func public(mount func(r chi.Router)) Option {
+	return func(rt *routes) {
+		rt.public = append(rt.public, mount)
+	}
+}
+
+// admin mounts routes under /admin, restricted to the requests carrying the admin token.
+func admin(mount func(r chi.Router)) Option {
+	return func(rt *routes) {
+		rt.admin = append(rt.admin, mount)
+	}
+}
+
+// internal mounts routes called by other instances, restricted to the requests
+// carrying the admin token.
+func internal(mount func(r chi.Router)) Option {
+	return func(rt *routes) {
+		rt.internal = append(rt.internal, mount)
+	}
+}
+
+// WithAdminToken sets the bearer token required by the administrative and
+// internal routes. Without one, they refuse every request.
+func WithAdminToken(token string) Option {
+	return func(rt *routes) {
+		rt.token = token
+	}
+}
+
+// WithTelemetry mounts the self-instrumentation endpoint at the given path.
+func WithTelemetry(path string, handler http.Handler) Option {
+	return public(func(r chi.Router) {
+		r.Method(http.MethodGet, path, handler)
+	})
+}
+
+// WithHistory mounts the GET /history route for historical metric queries.
+func WithHistory(handler http.HandlerFunc) Option {
+	return public(func(r chi.Router) {
+		r.Get("/history", handler)
+	})
+}
+
+// WithRetentionReport mounts the GET /admin/retention/report route returning a dry-run retention report.
+func WithRetentionReport(handler http.HandlerFunc) Option {
+	return admin(func(r chi.Router) {
+		r.Get("/retention/report", handler)
+	})
+}
+
+// OpsHandler defines the handlers of the operational endpoints.
+type OpsHandler interface {
+	HandleHealth(w http.ResponseWriter, r *http.Request)
+	HandleValues(w http.ResponseWriter, r *http.Request)
+	HandleFlush(w http.ResponseWriter, r *http.Request)
+}
+
+// WithOps mounts the GET /health, GET /values and POST /admin/flush routes.
+func WithOps(handler OpsHandler) Option {
+	return func(rt *routes) {
+		public(func(r chi.Router) {
+			r.Get("/health", handler.HandleHealth)
+			r.Get("/values", handler.HandleValues)
+		})(rt)
+		admin(func(r chi.Router) {
+			r.Post("/flush", handler.HandleFlush)
+		})(rt)
+	}
+}
+
+// WithSnapshots mounts the GET /admin/snapshot and POST /admin/restore routes
+// exporting and restoring snapshots of the metric store.
+func WithSnapshots(export, restore http.HandlerFunc) Option {
+	return admin(func(r chi.Router) {
+		r.Get("/snapshot", export)
+		r.Post("/restore", restore)
+	})
+}
+
+// WithCardinality mounts the GET /api/v1/cardinality route reporting the top series prefixes.
+func WithCardinality(handler http.HandlerFunc) Option {
+	return public(func(r chi.Router) {
+		r.Get("/api/v1/cardinality", handler)
+	})
+}
+
+// WithAlerts mounts the GET /api/v1/alerts route listing active alerts.
+func WithAlerts(handler http.HandlerFunc) Option {
+	return public(func(r chi.Router) {
+		r.Get("/api/v1/alerts", handler)
+	})
+}
+
+// WithStream mounts the GET /stream route pushing live metric updates.
+func WithStream(handler http.HandlerFunc) Option {
+	return public(func(r chi.Router) {
+		r.Get("/stream", handler)
+	})
+}
+
+// WithCluster mounts the internal endpoint at the given path serving the
+// values of this node to the other cluster nodes.
+func WithCluster(path string, handler http.Handler) Option {
+	return internal(func(r chi.Router) {
+		r.Method(http.MethodGet, path, handler)
+	})
+}
+
+// WithReplication mounts the POST /admin/promote route promoting a replica and
+// the internal endpoint at the given path streaming changes to replicas.
+func WithReplication(promote http.HandlerFunc, path string, stream http.Handler) Option {
+	return func(rt *routes) {
+		admin(func(r chi.Router) {
+			r.Post("/promote", promote)
+		})(rt)
+		internal(func(r chi.Router) {
+			r.Method(http.MethodGet, path, stream)
+		})(rt)
+	}
+}
+
+// WithElection mounts the internal endpoint at the given path receiving the
+// flushes of followers on the leader.
+func WithElection(path string, handler http.Handler) Option {
+	return internal(func(r chi.Router) {
+		r.Method(http.MethodPost, path, handler)
+	})
+}
+
+// AdminHandler defines the handlers of the series administration endpoints.
+type AdminHandler interface {
+	HandleDeleteSeries(w http.ResponseWriter, r *http.Request)
+	HandleResetSeries(w http.ResponseWriter, r *http.Request)
+	HandleRenameSeries(w http.ResponseWriter, r *http.Request)
+}
+
+// WithSeriesAdmin mounts the POST /admin/series/delete, /admin/series/reset and
+// /admin/series/rename routes.
+func WithSeriesAdmin(handler AdminHandler) Option {
+	return admin(func(r chi.Router) {
+		r.Post("/series/delete", handler.HandleDeleteSeries)
+		r.Post("/series/reset", handler.HandleResetSeries)
+		r.Post("/series/rename", handler.HandleRenameSeries)
+	})
+}
+
+// QueryHandler defines the handlers of the Prometheus-compatible query API.
+type QueryHandler interface {
+	HandleQuery(w http.ResponseWriter, r *http.Request)
+	HandleQueryRange(w http.ResponseWriter, r *http.Request)
+	HandleSeries(w http.ResponseWriter, r *http.Request)
+	HandleLabels(w http.ResponseWriter, r *http.Request)
+	HandleLabelValues(w http.ResponseWriter, r *http.Request)
+}
+
+// WithQueryAPI mounts the Prometheus HTTP API query routes, accepting both GET
+// and form-encoded POST requests as Grafana sends either.
+func WithQueryAPI(handler QueryHandler) Option {
+	return public(func(r chi.Router) {
+		for path, fn := range map[string]http.HandlerFunc{
+			"/api/v1/query":               handler.HandleQuery,
+			"/api/v1/query_range":         handler.HandleQueryRange,
+			"/api/v1/series":              handler.HandleSeries,
+			"/api/v1/labels":              handler.HandleLabels,
+			"/api/v1/label/{name}/values": handler.HandleLabelValues,
+		} {
+			r.Get(path, fn)
+			r.Post(path, fn)
+		}
+	})
+}
+
 // New creates and configures a new chi router instance with:
-// - Gzip middleware for request/response compression
+// - Request context middleware attaching request ID, client, tenant and a scoped logger
+// - Access log middleware
+// - Compression middleware for request and response bodies
 // - POST /update route for metric submissions
-func New(handler MetricHandler) chi.Router {
+// - any additional routes mounted by the given options, the administrative
+// ones under /admin and the internal ones behind bearer token authentication
+func New(log *slog.Logger, handler MetricHandler, opts ...Option) chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.GzipMiddleware)
+	r.Use(middleware.RequestContext(log))
+	r.Use(middleware.AccessLog)
+	r.Use(middleware.Compress(middleware.DefaultCompressMinSize))
 	r.Post("/update", handler.HandleMetrics)
 
+	rt := &routes{}
+	for _, opt := range opts {
+		opt(rt)
+	}
+
+	for _, mount := range rt.public {
+		mount(r)
+	}
+	if len(rt.admin) > 0 {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(middleware.BearerToken(rt.token))
+			for _, mount := range rt.admin {
+				mount(r)
+			}
+		})
+	}
+	if len(rt.internal) > 0 {
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.BearerToken(rt.token))
+			for _, mount := range rt.internal {
+				mount(r)
+			}
+		})
+	}
+
 	return r
 }
@@ -6,12 +6,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 
 	"github.com/sanchey92/metric-server/internal/config"
-	"github.com/sanchey92/metric-server/internal/http-server/handler"
 	"github.com/sanchey92/metric-server/internal/http-server/router"
-	"github.com/sanchey92/metric-server/internal/storage"
 )
 
 // Server represents the HTTP server for the metric service.
@@ -21,10 +20,10 @@ type Server struct {
 }
 
 // New creates and configures a new Server instance with all required dependencies.
-// It initializes the storage, handlers, and router based on the provided configuration.
-func New(cfg *config.Config, memStorage *storage.MemStorage) (*Server, error) {
-	h := handler.New(memStorage)
-	r := router.New(h)
+// It initializes the router for the given handler and any additional routes, and
+// applies the HTTP server settings from the provided configuration.
+func New(cfg *config.Config, log *slog.Logger, h router.MetricHandler, opts ...router.Option) (*Server, error) {
+	r := router.New(log, h, opts...)
 
 	address := fmt.Sprintf("%s:%s", cfg.HTTPServer.Host, cfg.HTTPServer.Port)
 
@@ -34,11 +33,17 @@ func New(cfg *config.Config, memStorage *storage.MemStorage) (*Server, error) {
 		ReadTimeout:  cfg.HTTPServer.Timeout,
 		WriteTimeout: cfg.HTTPServer.Timeout,
 		IdleTimeout:  cfg.HTTPServer.IdleTimeout,
+		ErrorLog:     slog.NewLogLogger(log.Handler(), slog.LevelError),
 	}
 
 	return &Server{srv: srv}, nil
 }
 
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.srv.Addr
+}
+
 // Run starts the HTTP server and begins accepting connections.
 // It blocks until the server is shut down and returns any error encountered.
 // The method gracefully handles http.ErrServerClosed as a normal shutdown case.
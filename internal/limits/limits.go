@@ -0,0 +1,286 @@
+// Package limits provides protection against series explosions. A Limiter
+// tracks which client and tenant created every series and refuses new series
+// once a global, per-client, per-tenant or per-name-prefix cap is reached.
+// Existing series are always accepted, so a capped client can keep updating
+// what it already has. Series written to memory other than by clients, e.g.
+// restored, replicated, merged from followers or recorded by the server
+// itself, are tracked as well but never refused: they count towards the
+// global and prefix caps without being charged to any client or tenant.
+package limits
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Rejection reasons reported for refused series.
+const (
+	ReasonGlobal = "global"
+	ReasonClient = "client"
+	ReasonTenant = "tenant"
+	ReasonPrefix = "prefix"
+)
+
+// DefaultSeparators delimit the prefix of a metric name in cardinality reports.
+const DefaultSeparators = "._:"
+
+// Rejection describes a series refused because a limit was reached.
+type Rejection struct {
+	Series string `json:"series"`
+	Reason string `json:"reason"`
+	Limit  int    `json:"limit"`
+}
+
+// owner records who created a series, so the counts can be released on expiry.
+type owner struct {
+	client string
+	tenant string
+	prefix int // index into the configured prefix limits, -1 if none
+	// internal is set for series not created by a client, see Track.
+	internal bool
+}
+
+// Limiter enforces series cardinality limits. The zero limits disable the
+// corresponding check; series are tracked regardless so reports stay accurate.
+type Limiter struct {
+	cfg config.Cardinality
+
+	mu       sync.RWMutex
+	series   map[string]owner
+	byClient map[string]int
+	byTenant map[string]int
+	byPrefix []int
+
+	rejected *telemetry.CounterVec
+}
+
+// New creates a Limiter with the given limits, registering its drop counters in reg.
+func New(cfg config.Cardinality, reg *telemetry.Registry) *Limiter {
+	if cfg.Separators == "" {
+		cfg.Separators = DefaultSeparators
+	}
+
+	l := &Limiter{
+		cfg:      cfg,
+		series:   make(map[string]owner),
+		byClient: make(map[string]int),
+		byTenant: make(map[string]int),
+		byPrefix: make([]int, len(cfg.PrefixLimits)),
+		rejected: reg.CounterVec("metric_server_cardinality_rejected_total",
+			"Total number of new series rejected by cardinality limits.", "reason"),
+	}
+
+	reg.GaugeFunc("metric_server_cardinality_series", "Number of series tracked by the cardinality limiter.",
+		func() float64 { return float64(l.Len()) })
+
+	return l
+}
+
+// Admit splits metrics into those that may be stored and rejections for new
+// series that would exceed a limit. Accepted new series are charged to the
+// given client and tenant. Metrics of existing series only are returned as
+// given, checked under a shared lock; the exclusive one is only taken for new
+// series.
+func (l *Limiter) Admit(client, tenant string, metrics []models.Metric) ([]models.Metric, []Rejection) {
+	keys := make([]string, len(metrics))
+	for i := range metrics {
+		keys[i] = metrics[i].Key()
+	}
+
+	if l.known(keys) {
+		return metrics, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	accepted := make([]models.Metric, 0, len(metrics))
+	var rejected []Rejection
+
+	for i, m := range metrics {
+		key := keys[i]
+		if _, ok := l.series[key]; ok {
+			accepted = append(accepted, m)
+			continue
+		}
+
+		o := owner{client: client, tenant: tenant, prefix: l.prefixIndex(m.Name)}
+
+		if reason, limit := l.exceeded(o); reason != "" {
+			l.rejected.With(reason).Inc()
+			rejected = append(rejected, Rejection{Series: key, Reason: reason, Limit: limit})
+			continue
+		}
+
+		l.series[key] = o
+		l.byClient[o.client]++
+		l.byTenant[o.tenant]++
+		if o.prefix >= 0 {
+			l.byPrefix[o.prefix]++
+		}
+
+		accepted = append(accepted, m)
+	}
+
+	return accepted, rejected
+}
+
+// Track records the series of samples written to memory that are not tracked
+// yet, as internal series. It is meant to be registered as a listener of the
+// in-memory store before it is written, so that the limiter knows every series
+// in memory whichever way it was written.
+func (l *Limiter) Track(samples []models.Sample) {
+	if l.tracked(samples) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range samples {
+		key := samples[i].Key
+		if _, ok := l.series[key]; ok {
+			continue
+		}
+
+		name, _, _ := strings.Cut(key, "{")
+		o := owner{prefix: l.prefixIndex(name), internal: true}
+		l.series[key] = o
+		if o.prefix >= 0 {
+			l.byPrefix[o.prefix]++
+		}
+	}
+}
+
+// tracked reports whether the series of all the samples are tracked already.
+func (l *Limiter) tracked(samples []models.Sample) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for i := range samples {
+		if _, ok := l.series[samples[i].Key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// known reports whether all the series keys are tracked already.
+func (l *Limiter) known(keys []string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, key := range keys {
+		if _, ok := l.series[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// exceeded returns the first limit a new series of the given owner would exceed.
+func (l *Limiter) exceeded(o owner) (string, int) {
+	switch {
+	case l.cfg.MaxSeries > 0 && len(l.series) >= l.cfg.MaxSeries:
+		return ReasonGlobal, l.cfg.MaxSeries
+	case l.cfg.MaxSeriesPerClient > 0 && l.byClient[o.client] >= l.cfg.MaxSeriesPerClient:
+		return ReasonClient, l.cfg.MaxSeriesPerClient
+	case o.tenant != "" && l.cfg.MaxSeriesPerTenant > 0 && l.byTenant[o.tenant] >= l.cfg.MaxSeriesPerTenant:
+		return ReasonTenant, l.cfg.MaxSeriesPerTenant
+	case o.prefix >= 0 && l.byPrefix[o.prefix] >= l.cfg.PrefixLimits[o.prefix].MaxSeries:
+		return ReasonPrefix, l.cfg.PrefixLimits[o.prefix].MaxSeries
+	}
+	return "", 0
+}
+
+// prefixIndex returns the first configured prefix limit matching name, or -1.
+func (l *Limiter) prefixIndex(name string) int {
+	for i, p := range l.cfg.PrefixLimits {
+		if strings.HasPrefix(name, p.Prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Forget releases the given series keys, e.g. after they expired from storage.
+func (l *Limiter) Forget(names []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, name := range names {
+		o, ok := l.series[name]
+		if !ok {
+			continue
+		}
+
+		delete(l.series, name)
+		if !o.internal {
+			l.release(l.byClient, o.client)
+			l.release(l.byTenant, o.tenant)
+		}
+		if o.prefix >= 0 {
+			l.byPrefix[o.prefix]--
+		}
+	}
+}
+
+func (l *Limiter) release(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// Len returns the number of tracked series.
+func (l *Limiter) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.series)
+}
+
+// PrefixCount is the number of series sharing a metric name prefix.
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Series int    `json:"series"`
+}
+
+// TopPrefixes returns the n metric name prefixes with the most series, where a
+// prefix is the part of the name before the first separator character.
+func (l *Limiter) TopPrefixes(n int) []PrefixCount {
+	counts := make(map[string]int)
+
+	l.mu.RLock()
+	for name := range l.series {
+		prefix := name
+		if i := strings.IndexAny(name, l.cfg.Separators); i > 0 {
+			prefix = name[:i]
+		}
+		counts[prefix]++
+	}
+	l.mu.RUnlock()
+
+	top := make([]PrefixCount, 0, len(counts))
+	for prefix, c := range counts {
+		top = append(top, PrefixCount{Prefix: prefix, Series: c})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Series != top[j].Series {
+			return top[i].Series > top[j].Series
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+
+	return top
+}
@@ -0,0 +1,182 @@
+package limits
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+func metrics(names ...string) []models.Metric {
+	m := make([]models.Metric, len(names))
+	for i, name := range names {
+		m[i] = models.Metric{Name: name, Value: float64(i)}
+	}
+	return m
+}
+
+func names(m []models.Metric) []string {
+	out := make([]string, len(m))
+	for i := range m {
+		out[i] = m[i].Name
+	}
+	return out
+}
+
+func TestLimiter_Admit(t *testing.T) {
+	type call struct {
+		client, tenant   string
+		names            []string
+		expectedAccepted []string
+		expectedReasons  []string
+	}
+
+	tests := []struct {
+		name  string
+		cfg   config.Cardinality
+		calls []call
+	}{
+		{
+			name: "no limits",
+			calls: []call{
+				{client: "a", names: []string{"x", "y"}, expectedAccepted: []string{"x", "y"}},
+			},
+		},
+		{
+			name: "global limit keeps existing series",
+			cfg:  config.Cardinality{MaxSeries: 2},
+			calls: []call{
+				{client: "a", names: []string{"x", "y", "z"}, expectedAccepted: []string{"x", "y"},
+					expectedReasons: []string{ReasonGlobal}},
+				{client: "b", names: []string{"x", "w"}, expectedAccepted: []string{"x"},
+					expectedReasons: []string{ReasonGlobal}},
+				{client: "b", names: []string{"y", "x"}, expectedAccepted: []string{"y", "x"}},
+			},
+		},
+		{
+			name: "per client limit",
+			cfg:  config.Cardinality{MaxSeriesPerClient: 1},
+			calls: []call{
+				{client: "a", names: []string{"x", "y"}, expectedAccepted: []string{"x"},
+					expectedReasons: []string{ReasonClient}},
+				{client: "b", names: []string{"y"}, expectedAccepted: []string{"y"}},
+			},
+		},
+		{
+			name: "per tenant limit",
+			cfg:  config.Cardinality{MaxSeriesPerTenant: 1},
+			calls: []call{
+				{client: "a", tenant: "t1", names: []string{"x"}, expectedAccepted: []string{"x"}},
+				{client: "b", tenant: "t1", names: []string{"y"}, expectedAccepted: []string{},
+					expectedReasons: []string{ReasonTenant}},
+				{client: "b", names: []string{"y", "z"}, expectedAccepted: []string{"y", "z"}},
+			},
+		},
+		{
+			name: "prefix limit",
+			cfg:  config.Cardinality{PrefixLimits: []config.PrefixLimit{{Prefix: "req_", MaxSeries: 1}}},
+			calls: []call{
+				{client: "a", names: []string{"req_1", "req_2", "cpu"}, expectedAccepted: []string{"req_1", "cpu"},
+					expectedReasons: []string{ReasonPrefix}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.cfg, nil)
+
+			for _, c := range tt.calls {
+				accepted, rejected := l.Admit(c.client, c.tenant, metrics(c.names...))
+
+				require.Equal(t, c.expectedAccepted, names(accepted))
+
+				var reasons []string
+				for _, r := range rejected {
+					reasons = append(reasons, r.Reason)
+				}
+				require.Equal(t, c.expectedReasons, reasons)
+			}
+		})
+	}
+}
+
+func TestLimiter_AdmitConcurrent(t *testing.T) {
+	const maxSeries = 50
+	l := New(config.Cardinality{MaxSeries: maxSeries}, nil)
+
+	var (
+		wg       sync.WaitGroup
+		admitted atomic.Int64
+	)
+	for c := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				// Every series is sent by two clients.
+				accepted, _ := l.Admit(strconv.Itoa(c), "", metrics(fmt.Sprintf("s%d_%d", c/2, i)))
+				admitted.Add(int64(len(accepted)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, maxSeries, l.Len())
+	require.GreaterOrEqual(t, admitted.Load(), int64(maxSeries))
+}
+
+func TestLimiter_Forget(t *testing.T) {
+	l := New(config.Cardinality{MaxSeriesPerClient: 1}, nil)
+
+	accepted, _ := l.Admit("a", "", metrics("x"))
+	require.Len(t, accepted, 1)
+
+	_, rejected := l.Admit("a", "", metrics("y"))
+	require.Len(t, rejected, 1)
+
+	l.Forget([]string{"x", "unknown"})
+	require.Equal(t, 0, l.Len())
+
+	accepted, rejected = l.Admit("a", "", metrics("y"))
+	require.Len(t, accepted, 1)
+	require.Empty(t, rejected)
+}
+
+func TestLimiter_Track(t *testing.T) {
+	l := New(config.Cardinality{MaxSeries: 2, MaxSeriesPerClient: 1}, nil)
+
+	l.Track([]models.Sample{{Key: "x"}, {Key: `y{host="a"}`}, {Key: "x"}})
+	require.Equal(t, 2, l.Len())
+
+	// Tracked series count towards the global limit, but are not charged to
+	// any client and are accepted from any client.
+	accepted, rejected := l.Admit("", "", metrics("x", "z"))
+	require.Equal(t, []string{"x"}, names(accepted))
+	require.Equal(t, []Rejection{{Series: "z", Reason: ReasonGlobal, Limit: 2}}, rejected)
+
+	l.Forget([]string{"x"})
+	accepted, rejected = l.Admit("", "", metrics("z"))
+	require.Equal(t, []string{"z"}, names(accepted))
+	require.Empty(t, rejected)
+
+	// Tracking never refuses series.
+	l.Track([]models.Sample{{Key: "w"}})
+	require.Equal(t, 3, l.Len())
+}
+
+func TestLimiter_TopPrefixes(t *testing.T) {
+	l := New(config.Cardinality{}, nil)
+	l.Admit("a", "", metrics("http.requests", "http.errors", "db:queries", "cpu", "db.conns", "http_latency"))
+
+	require.Equal(t, []PrefixCount{
+		{Prefix: "http", Series: 3},
+		{Prefix: "db", Series: 2},
+	}, l.TopPrefixes(2))
+}
@@ -0,0 +1,87 @@
+// Package logger provides construction of the application's structured logger
+// and helpers for carrying request-scoped loggers through a context.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/config"
+)
+
+type ctxKey struct{}
+
+// LevelAudit is the level of audit records. It is above every level the
+// logger can be configured with, so that audit records are never filtered out.
+const LevelAudit = slog.Level(12)
+
+// New creates a slog.Logger writing to stdout according to the given configuration.
+// Format is either "json" (default) or "text"; Level is one of debug, info, warn, error.
+func New(cfg config.Log) (*slog.Logger, error) {
+	return newWithWriter(cfg, os.Stdout)
+}
+
+func newWithWriter(cfg config.Log, w io.Writer) (*slog.Logger, error) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+}
+
+// replaceLevel names LevelAudit in log records.
+func replaceLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == LevelAudit {
+			a.Value = slog.StringValue("AUDIT")
+		}
+	}
+	return a
+}
+
+func parseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// WithContext returns a copy of ctx carrying the given logger.
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx, or slog.Default() if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Err returns a slog attribute for an error under the conventional "error" key.
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
@@ -2,10 +2,156 @@
 // These structures represent the domain objects and their JSON representations for API communication.
 package models
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReservedPrefix starts the names of the server's self-instrumentation metrics
+// written into the metric store. Clients may not write or rename to them.
+const ReservedPrefix = "_self_"
+
 // Metric represents a single measurement or data point collected by the system.
 // It is used for both storage and API payloads, with JSON tags defining the serialization format.
+// Labels are optional and, together with the name, identify the series the value belongs to.
+// Timestamp is the optional time of the value in Unix milliseconds, set by the client;
+// zero means the time the server receives it.
 type Metric struct {
-	Name  string  `json:"name"`
-	MType string  `json:"type"`
-	Value float64 `json:"value"`
+	Name      string            `json:"name"`
+	MType     string            `json:"type"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+}
+
+// ValidName reports whether clients may write series of the metric name: it
+// must not be empty, start with ReservedPrefix or contain the characters
+// delimiting labels in series keys.
+func ValidName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ReservedPrefix) && !strings.ContainsAny(name, `{}"`)
+}
+
+// Key returns the series key of the metric, see SeriesKey.
+func (m Metric) Key() string {
+	return SeriesKey(m.Name, m.Labels)
+}
+
+// Time returns the client timestamp of the metric, or the zero time if it has none.
+func (m Metric) Time() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(m.Timestamp).UTC()
+}
+
+// Sample is the latest value of a series, identified by its series key.
+type Sample struct {
+	Key       string    `json:"key"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Aggregate summarizes the samples of a metric within one time bucket.
+// It is returned by history queries for both raw and rolled-up data.
+type Aggregate struct {
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Sum   float64   `json:"sum"`
+	Count int64     `json:"count"`
+	Last  float64   `json:"last"`
+}
+
+// Rollup is one bucket of a rollup resolution, given in seconds, of a series.
+type Rollup struct {
+	Resolution int64  `json:"resolution"`
+	Name       string `json:"name"`
+	Aggregate
+}
+
+// ExpireStats reports how much historical data a retention run deleted,
+// or would delete in dry-run mode.
+type ExpireStats struct {
+	Samples int64 `json:"samples"`
+	Rollups int64 `json:"rollups"`
+	Series  int64 `json:"series"`
+}
+
+// IdempotencyKey is the key of an applied ingestion request, scoped to its
+// sender, with the status it was answered with. Retries carrying the same key
+// until Expires are acknowledged with that status without being applied again.
+type IdempotencyKey struct {
+	Key     string
+	Status  int
+	Expires time.Time
+}
+
+// SeriesKey renders the canonical key of a series: the bare name when there are
+// no labels, otherwise name{label="value",...} with labels sorted by name and
+// values quoted. It is the identifier used by every storage backend.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[label]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// ParseSeriesKey splits a series key produced by SeriesKey back into its name and labels.
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "}") {
+		return "", nil, fmt.Errorf("invalid series key %q: missing closing brace", key)
+	}
+
+	name := key[:open]
+	rest := key[open+1 : len(key)-1]
+	labels := make(map[string]string)
+
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("invalid series key %q: expected label name", key)
+		}
+		label := rest[:eq]
+
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid series key %q: %w", key, err)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid series key %q: %w", key, err)
+		}
+		labels[label] = value
+
+		rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+	}
+
+	return name, labels, nil
 }
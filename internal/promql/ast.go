@@ -0,0 +1,133 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Expr is a node of a parsed query.
+type Expr interface {
+	expr()
+}
+
+// NumberLiteral is a scalar constant such as 0.99.
+type NumberLiteral struct {
+	Val float64
+}
+
+// VectorSelector selects the latest sample of every series matching all matchers.
+// The metric name, when given, is stored as a __name__ equality matcher.
+type VectorSelector struct {
+	Name     string
+	Matchers []*Matcher
+}
+
+// MatrixSelector selects the samples of a vector selector within a range
+// ending at the evaluation time.
+type MatrixSelector struct {
+	Vector *VectorSelector
+	Range  time.Duration
+}
+
+// Call is a function call such as rate(x[5m]).
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// AggregateExpr aggregates an instant vector, optionally grouped by or
+// without the given labels.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+// VectorMatching describes how the samples of two vectors are paired in a
+// binary operation: by all labels except the name (the default), only by the
+// listed labels (On) or by all labels except the listed ones.
+type VectorMatching struct {
+	On     bool
+	Labels []string
+}
+
+// BinaryExpr is an arithmetic or comparison operation.
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	Matching   *VectorMatching
+}
+
+// UnaryExpr negates its operand.
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (*NumberLiteral) expr()  {}
+func (*VectorSelector) expr() {}
+func (*MatrixSelector) expr() {}
+func (*Call) expr()           {}
+func (*AggregateExpr) expr()  {}
+func (*BinaryExpr) expr()     {}
+func (*UnaryExpr) expr()      {}
+func (*ParenExpr) expr()      {}
+
+// MatchType is the kind of a label matcher.
+type MatchType string
+
+// Supported label matchers.
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher matches the value of one label. A missing label has the empty value.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher creates a matcher, compiling the fully anchored regular expression
+// for the regexp match types.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		m.re = re
+	}
+
+	return m, nil
+}
+
+// Matches reports whether the label value v satisfies the matcher.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
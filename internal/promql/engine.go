@@ -0,0 +1,293 @@
+// Package promql implements a subset of the Prometheus query language on top
+// of the server's storages: vector and range selectors with label matchers,
+// arithmetic and comparison operators, the sum, avg, min, max and count
+// aggregations, and the functions listed in functions.go, evaluated either at
+// a single instant or over a range of evenly spaced steps.
+package promql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultLookback is how far back an instant vector selector looks for the
+// latest sample of a series.
+const DefaultLookback = 5 * time.Minute
+
+// maxPoints bounds the number of steps of a range query.
+const maxPoints = 11000
+
+// ErrInvalidQuery is returned for queries that cannot be parsed or evaluated
+// because of their own content rather than a storage failure.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Storage provides the samples of all series of a metric name within
+// [start, end], or of all series when name is empty. Points must be in time order.
+type Storage interface {
+	Select(ctx context.Context, name string, start, end time.Time) ([]Series, error)
+}
+
+// Engine evaluates queries against a storage.
+type Engine struct {
+	storage  Storage
+	lookback time.Duration
+}
+
+// NewEngine creates an Engine reading from the given storage.
+func NewEngine(storage Storage) *Engine {
+	return &Engine{storage: storage, lookback: DefaultLookback}
+}
+
+// Instant evaluates a query at a single point in time.
+func (e *Engine) Instant(ctx context.Context, query string, ts time.Time) (Value, error) {
+	expr, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	t := ts.UnixMilli()
+
+	ev, err := e.prepare(ctx, expr, t, t)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := ev.eval(expr, t)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := v.(Matrix); ok {
+		sortMatrix(m)
+	}
+
+	return v, nil
+}
+
+// Range evaluates a query at every step from start to end inclusive and
+// returns one series per distinct result label set.
+func (e *Engine) Range(ctx context.Context, query string, start, end time.Time, step time.Duration) (Matrix, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("%w: step must be positive", ErrInvalidQuery)
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("%w: end must not be before start", ErrInvalidQuery)
+	}
+	if end.Sub(start)/step >= maxPoints {
+		return nil, fmt.Errorf("%w: exceeded maximum resolution of %d points per series", ErrInvalidQuery, maxPoints)
+	}
+
+	expr, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typeOf(expr) {
+	case TypeScalar, TypeVector:
+	default:
+		return nil, fmt.Errorf("%w: range queries require an instant vector or scalar expression", ErrInvalidQuery)
+	}
+
+	from, to, stepMs := start.UnixMilli(), end.UnixMilli(), step.Milliseconds()
+
+	ev, err := e.prepare(ctx, expr, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	bySignature := make(map[string]*Series)
+	for t := from; t <= to; t += stepMs {
+		v, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := v.(type) {
+		case Scalar:
+			appendPoint(bySignature, Labels{}, Point(v))
+		case Vector:
+			for _, s := range v {
+				appendPoint(bySignature, s.Metric, Point{T: t, V: s.Point.V})
+			}
+		}
+	}
+
+	result := make(Matrix, 0, len(bySignature))
+	for _, s := range bySignature {
+		result = append(result, *s)
+	}
+	sortMatrix(result)
+
+	return result, nil
+}
+
+// Series returns the label sets of all series matching any of the given
+// selectors within [start, end], or of all series when none are given.
+func (e *Engine) Series(ctx context.Context, selectors []string, start, end time.Time) ([]Labels, error) {
+	var sels []*VectorSelector
+	for _, s := range selectors {
+		expr, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := expr.(*VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not a series selector", ErrInvalidQuery, s)
+		}
+		sels = append(sels, sel)
+	}
+
+	if len(sels) == 0 {
+		all, err := e.storage.Select(ctx, "", start, end)
+		if err != nil {
+			return nil, err
+		}
+		return labelsOf(all), nil
+	}
+
+	seen := make(map[string]bool)
+	var result []Series
+	for _, sel := range sels {
+		series, err := e.selectSeries(ctx, sel, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			sig := s.Metric.signature(nil, false)
+			if !seen[sig] {
+				seen[sig] = true
+				result = append(result, s)
+			}
+		}
+	}
+
+	return labelsOf(result), nil
+}
+
+func parse(query string) (Expr, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return expr, nil
+}
+
+// prepare loads the data of every selector in expr needed to evaluate it
+// between the given timestamps, so that storage is queried once per selector.
+func (e *Engine) prepare(ctx context.Context, expr Expr, from, to int64) (*evaluator, error) {
+	ev := &evaluator{lookback: e.lookback.Milliseconds(), data: make(map[*VectorSelector][]Series)}
+
+	var err error
+	walk(expr, func(n Expr) {
+		if err != nil {
+			return
+		}
+
+		var sel *VectorSelector
+		window := e.lookback
+		switch n := n.(type) {
+		case *VectorSelector:
+			sel = n
+		case *MatrixSelector:
+			sel, window = n.Vector, n.Range
+		default:
+			return
+		}
+
+		if _, ok := ev.data[sel]; ok {
+			return
+		}
+		ev.data[sel], err = e.selectSeries(ctx, sel, time.UnixMilli(from).Add(-window), time.UnixMilli(to))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+// selectSeries reads the series of the selector's metric name and keeps those matching all matchers.
+func (e *Engine) selectSeries(ctx context.Context, sel *VectorSelector, start, end time.Time) ([]Series, error) {
+	name := sel.Name
+	if name == "" {
+		for _, m := range sel.Matchers {
+			if m.Name == nameLabel && m.Type == MatchEqual {
+				name = m.Value
+			}
+		}
+	}
+
+	all, err := e.storage.Select(ctx, name, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select series: %w", err)
+	}
+
+	matched := all[:0]
+	for _, s := range all {
+		if matches(sel.Matchers, s.Metric) {
+			matched = append(matched, s)
+		}
+	}
+
+	return matched, nil
+}
+
+func matches(matchers []*Matcher, l Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(l[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// walk calls fn for every node of the expression tree.
+func walk(e Expr, fn func(Expr)) {
+	fn(e)
+
+	switch e := e.(type) {
+	case *MatrixSelector:
+		walk(e.Vector, fn)
+	case *Call:
+		for _, a := range e.Args {
+			walk(a, fn)
+		}
+	case *AggregateExpr:
+		walk(e.Expr, fn)
+	case *BinaryExpr:
+		walk(e.LHS, fn)
+		walk(e.RHS, fn)
+	case *UnaryExpr:
+		walk(e.Expr, fn)
+	case *ParenExpr:
+		walk(e.Expr, fn)
+	}
+}
+
+func appendPoint(bySignature map[string]*Series, l Labels, p Point) {
+	sig := l.signature(nil, false)
+	s, ok := bySignature[sig]
+	if !ok {
+		s = &Series{Metric: l}
+		bySignature[sig] = s
+	}
+	s.Points = append(s.Points, p)
+}
+
+func sortMatrix(m Matrix) {
+	sort.Slice(m, func(i, j int) bool {
+		return m[i].Metric.signature(nil, false) < m[j].Metric.signature(nil, false)
+	})
+}
+
+func labelsOf(series []Series) []Labels {
+	sortMatrix(series)
+
+	result := make([]Labels, len(series))
+	for i, s := range series {
+		result[i] = s.Metric
+	}
+	return result
+}
@@ -0,0 +1,207 @@
+package promql
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// fakeHistory serves samples from memory, filtering them like PostgresStorage.Samples.
+type fakeHistory []models.Sample
+
+func (f fakeHistory) Samples(_ context.Context, name string, start, end time.Time) ([]models.Sample, error) {
+	var out []models.Sample
+	for _, s := range f {
+		metric, _, _ := models.ParseSeriesKey(s.Key)
+		if (name == "" || metric == name) && !s.Timestamp.Before(start) && !s.Timestamp.After(end) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+var base = time.Unix(1_700_000_000, 0).UTC()
+
+// series records one sample per interval starting at base.
+func series(key string, interval time.Duration, values ...float64) []models.Sample {
+	samples := make([]models.Sample, len(values))
+	for i, v := range values {
+		samples[i] = models.Sample{Key: key, Value: v, Timestamp: base.Add(time.Duration(i) * interval)}
+	}
+	return samples
+}
+
+func newTestEngine(samples ...[]models.Sample) *Engine {
+	var history fakeHistory
+	for _, s := range samples {
+		history = append(history, s...)
+	}
+	return NewEngine(NewStorage(history, nil))
+}
+
+func TestEngine_Instant(t *testing.T) {
+	engine := newTestEngine(
+		series(models.SeriesKey("requests", map[string]string{"job": "api", "code": "200"}), 15*time.Second, 0, 15, 30, 45, 60),
+		series(models.SeriesKey("requests", map[string]string{"job": "api", "code": "500"}), 15*time.Second, 0, 3, 6, 9, 12),
+		series(models.SeriesKey("requests", map[string]string{"job": "web", "code": "200"}), 15*time.Second, 10, 20, 30, 40, 50),
+		series(models.SeriesKey("latency_bucket", map[string]string{"le": "0.1"}), time.Minute, 50),
+		series(models.SeriesKey("latency_bucket", map[string]string{"le": "0.5"}), time.Minute, 90),
+		series(models.SeriesKey("latency_bucket", map[string]string{"le": "+Inf"}), time.Minute, 100),
+		series("cpu", time.Minute, 0.5),
+	)
+	at := base.Add(time.Minute)
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]float64 // keyed by the series key of the result labels
+	}{
+		{
+			name:  "selector with matcher",
+			query: `requests{code="500"}`,
+			want:  map[string]float64{`requests{code="500",job="api"}`: 12},
+		},
+		{
+			name:  "regexp matcher",
+			query: `requests{job=~"a.*", code!="500"}`,
+			want:  map[string]float64{`requests{code="200",job="api"}`: 60},
+		},
+		{
+			name:  "sum by",
+			query: `sum by (job) (requests)`,
+			want:  map[string]float64{`{job="api"}`: 72, `{job="web"}`: 50},
+		},
+		{
+			name:  "aggregations without grouping",
+			query: `max(requests) - min(requests)`,
+			want:  map[string]float64{``: 48},
+		},
+		{
+			name:  "avg and count",
+			query: `avg(requests) + count(requests)`,
+			want:  map[string]float64{``: 122.0/3 + 3},
+		},
+		{
+			name:  "rate covering whole range",
+			query: `rate(requests{job="api",code="200"}[1m])`,
+			want:  map[string]float64{`{code="200",job="api"}`: 1},
+		},
+		{
+			name:  "increase",
+			query: `increase(requests{code="500"}[1m])`,
+			want:  map[string]float64{`{code="500",job="api"}`: 12},
+		},
+		{
+			name:  "comparison filters",
+			query: `requests > 55`,
+			want:  map[string]float64{`requests{code="200",job="api"}`: 60},
+		},
+		{
+			name:  "vector matching by labels",
+			query: `requests{code="500"} / ignoring (code) requests{code="200"}`,
+			want:  map[string]float64{`{job="api"}`: 0.2},
+		},
+		{
+			name:  "histogram quantile",
+			query: `histogram_quantile(0.7, latency_bucket)`,
+			want:  map[string]float64{``: 0.3},
+		},
+		{
+			name:  "latest sample within lookback",
+			query: `cpu`,
+			want:  map[string]float64{`cpu`: 0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := engine.Instant(context.Background(), tt.query, at)
+			require.NoError(t, err)
+
+			got := make(map[string]float64)
+			for _, s := range v.(Vector) {
+				got[keyOf(s.Metric)] = s.Point.V
+			}
+
+			require.Len(t, got, len(tt.want))
+			for k, want := range tt.want {
+				require.Contains(t, got, k)
+				require.InDelta(t, want, got[k], 1e-9, k)
+			}
+		})
+	}
+}
+
+func TestEngine_Instant_Scalar(t *testing.T) {
+	v, err := newTestEngine().Instant(context.Background(), `2 * 3 + 4 ^ 0.5`, base)
+	require.NoError(t, err)
+	require.Equal(t, Scalar{T: base.UnixMilli(), V: 8}, v)
+}
+
+func TestEngine_Instant_Lookback(t *testing.T) {
+	engine := newTestEngine(series("cpu", time.Minute, 0.5))
+
+	v, err := engine.Instant(context.Background(), `cpu`, base.Add(DefaultLookback))
+	require.NoError(t, err)
+	require.Empty(t, v)
+}
+
+func TestEngine_Instant_InvalidQuery(t *testing.T) {
+	_, err := newTestEngine().Instant(context.Background(), `sum(`, base)
+	require.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+func TestEngine_Range(t *testing.T) {
+	engine := newTestEngine(
+		series(models.SeriesKey("requests", map[string]string{"job": "api"}), 15*time.Second, 0, 15, 30, 45, 60, 75, 90),
+	)
+
+	m, err := engine.Range(context.Background(), `rate(requests[30s])`, base.Add(30*time.Second), base.Add(90*time.Second), 30*time.Second)
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	require.Equal(t, Labels{"job": "api"}, m[0].Metric)
+	require.Len(t, m[0].Points, 3)
+	for _, p := range m[0].Points {
+		require.InDelta(t, 1, p.V, 1e-9)
+	}
+
+	_, err = engine.Range(context.Background(), `requests[5m]`, base, base.Add(time.Minute), time.Second)
+	require.ErrorIs(t, err, ErrInvalidQuery)
+
+	_, err = engine.Range(context.Background(), `requests`, base, base.Add(time.Minute), 0)
+	require.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+func TestEngine_MergesLatestValues(t *testing.T) {
+	mem := latest{{Key: "cpu", Value: 0.9, Timestamp: base.Add(2 * time.Minute)}}
+	engine := NewEngine(NewStorage(fakeHistory(series("cpu", time.Minute, 0.5)), mem))
+
+	v, err := engine.Instant(context.Background(), `cpu`, base.Add(3*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 0.9, v.(Vector)[0].Point.V)
+}
+
+type latest []models.Sample
+
+func (l latest) Latest() []models.Sample { return l }
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := func() []bucket {
+		return []bucket{{upperBound: 1, count: 10}, {upperBound: 2, count: 20}, {upperBound: math.Inf(1), count: 20}}
+	}
+
+	require.InDelta(t, 1.5, bucketQuantile(0.75, buckets()), 1e-9)
+	require.InDelta(t, 0.5, bucketQuantile(0.25, buckets()), 1e-9)
+	require.Equal(t, math.Inf(1), bucketQuantile(1.5, buckets()))
+	require.True(t, math.IsNaN(bucketQuantile(0.5, []bucket{{upperBound: 1, count: 1}})))
+}
+
+func keyOf(l Labels) string {
+	name := l[nameLabel]
+	return models.SeriesKey(name, l.without(nameLabel))
+}
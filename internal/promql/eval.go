@@ -0,0 +1,327 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// evaluator evaluates an expression at single timestamps over preloaded selector data.
+type evaluator struct {
+	lookback int64
+	data     map[*VectorSelector][]Series
+}
+
+func (ev *evaluator) eval(e Expr, ts int64) (Value, error) {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+	case *ParenExpr:
+		return ev.eval(e.Expr, ts)
+	case *VectorSelector:
+		return ev.vector(e, ts), nil
+	case *MatrixSelector:
+		return ev.matrix(e, ts), nil
+	case *UnaryExpr:
+		return ev.negate(e, ts)
+	case *BinaryExpr:
+		return ev.binary(e, ts)
+	case *AggregateExpr:
+		return ev.aggregate(e, ts)
+	case *Call:
+		return functions[e.Func].eval(ev, e.Args, ts)
+	}
+	return nil, fmt.Errorf("%w: unsupported expression %T", ErrInvalidQuery, e)
+}
+
+// evalVector evaluates an expression known to yield an instant vector.
+func (ev *evaluator) evalVector(e Expr, ts int64) (Vector, error) {
+	v, err := ev.eval(e, ts)
+	if err != nil {
+		return nil, err
+	}
+	return v.(Vector), nil
+}
+
+// vector returns the latest sample of every selected series within the lookback window.
+func (ev *evaluator) vector(sel *VectorSelector, ts int64) Vector {
+	series := ev.data[sel]
+	vec := make(Vector, 0, len(series))
+
+	for _, s := range series {
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > ts }) - 1
+		if i < 0 || s.Points[i].T <= ts-ev.lookback {
+			continue
+		}
+		vec = append(vec, Sample{Metric: s.Metric, Point: Point{T: ts, V: s.Points[i].V}})
+	}
+
+	return vec
+}
+
+// matrix returns the points of every selected series within (ts-range, ts].
+func (ev *evaluator) matrix(sel *MatrixSelector, ts int64) Matrix {
+	series := ev.data[sel.Vector]
+	m := make(Matrix, 0, len(series))
+	from := ts - sel.Range.Milliseconds()
+
+	for _, s := range series {
+		lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > from })
+		hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > ts })
+		if lo < hi {
+			m = append(m, Series{Metric: s.Metric, Points: s.Points[lo:hi]})
+		}
+	}
+
+	return m
+}
+
+func (ev *evaluator) negate(e *UnaryExpr, ts int64) (Value, error) {
+	v, err := ev.eval(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case Scalar:
+		return Scalar{T: v.T, V: -v.V}, nil
+	case Vector:
+		out := make(Vector, len(v))
+		for i, s := range v {
+			out[i] = Sample{Metric: s.Metric.without(nameLabel), Point: Point{T: s.Point.T, V: -s.Point.V}}
+		}
+		return out, nil
+	}
+
+	return nil, fmt.Errorf("%w: unary minus requires a scalar or instant vector", ErrInvalidQuery)
+}
+
+// apply computes a binary operation. For comparisons it returns the left value
+// and whether the comparison holds.
+func apply(op string, l, r float64) (float64, bool) {
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	case "^":
+		return math.Pow(l, r), true
+	case "==":
+		return l, l == r
+	case "!=":
+		return l, l != r
+	case ">":
+		return l, l > r
+	case "<":
+		return l, l < r
+	case ">=":
+		return l, l >= r
+	case "<=":
+		return l, l <= r
+	}
+	return 0, false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (ev *evaluator) binary(e *BinaryExpr, ts int64) (Value, error) {
+	lv, err := ev.eval(e.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := ev.eval(e.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lv.(type) {
+	case Scalar:
+		switch r := rv.(type) {
+		case Scalar:
+			v, ok := apply(e.Op, l.V, r.V)
+			if isComparison(e.Op) {
+				v = boolValue(ok)
+			}
+			return Scalar{T: ts, V: v}, nil
+		case Vector:
+			return vectorScalar(e, r, l.V, true), nil
+		}
+	case Vector:
+		switch r := rv.(type) {
+		case Scalar:
+			return vectorScalar(e, l, r.V, false), nil
+		case Vector:
+			return vectorVector(e, l, r)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: invalid operands for %s", ErrInvalidQuery, e.Op)
+}
+
+// vectorScalar applies the operation to every sample of vec; swapped means the
+// scalar is the left operand. Comparisons without bool filter the vector.
+func vectorScalar(e *BinaryExpr, vec Vector, scalar float64, swapped bool) Vector {
+	out := make(Vector, 0, len(vec))
+
+	for _, s := range vec {
+		l, r := s.Point.V, scalar
+		if swapped {
+			l, r = r, l
+		}
+
+		v, ok := apply(e.Op, l, r)
+		metric := s.Metric
+
+		switch {
+		case !isComparison(e.Op):
+			metric = metric.without(nameLabel)
+		case e.ReturnBool:
+			v, metric = boolValue(ok), metric.without(nameLabel)
+		case !ok:
+			continue
+		default:
+			v = s.Point.V
+		}
+
+		out = append(out, Sample{Metric: metric, Point: Point{T: s.Point.T, V: v}})
+	}
+
+	return out
+}
+
+// vectorVector applies the operation to every pair of samples with matching
+// labels. Only one-to-one matching is supported.
+func vectorVector(e *BinaryExpr, lhs, rhs Vector) (Vector, error) {
+	matching := e.Matching
+	if matching == nil {
+		matching = &VectorMatching{}
+	}
+	signature := func(l Labels) string {
+		if matching.On {
+			return l.signature(matching.Labels, true)
+		}
+		return l.signature(append([]string{nameLabel}, matching.Labels...), false)
+	}
+
+	right := make(map[string]Sample, len(rhs))
+	for _, s := range rhs {
+		sig := signature(s.Metric)
+		if _, dup := right[sig]; dup {
+			return nil, fmt.Errorf("%w: many-to-many matching not allowed: found duplicate series on the right side of %s", ErrInvalidQuery, e.Op)
+		}
+		right[sig] = s
+	}
+
+	out := make(Vector, 0, len(lhs))
+	seen := make(map[string]bool, len(lhs))
+
+	for _, s := range lhs {
+		sig := signature(s.Metric)
+		r, ok := right[sig]
+		if !ok {
+			continue
+		}
+		if seen[sig] {
+			return nil, fmt.Errorf("%w: many-to-many matching not allowed: found duplicate series on the left side of %s", ErrInvalidQuery, e.Op)
+		}
+		seen[sig] = true
+
+		v, keep := apply(e.Op, s.Point.V, r.Point.V)
+		metric := s.Metric
+
+		switch {
+		case !isComparison(e.Op) || e.ReturnBool:
+			if e.ReturnBool {
+				v = boolValue(keep)
+			}
+			metric = metric.without(nameLabel)
+			if matching.On {
+				metric = metric.only(matching.Labels...)
+			} else {
+				metric = metric.without(matching.Labels...)
+			}
+		case !keep:
+			continue
+		}
+
+		out = append(out, Sample{Metric: metric, Point: Point{T: s.Point.T, V: v}})
+	}
+
+	return out, nil
+}
+
+// aggregate evaluates sum, avg, min, max and count over groups of samples.
+func (ev *evaluator) aggregate(e *AggregateExpr, ts int64) (Value, error) {
+	vec, err := ev.evalVector(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		metric Labels
+		value  float64
+		count  int
+	}
+
+	groups := make(map[string]*group)
+	var order []string
+
+	for _, s := range vec {
+		var metric Labels
+		if e.Without {
+			metric = s.Metric.without(append([]string{nameLabel}, e.Grouping...)...)
+		} else {
+			metric = s.Metric.only(e.Grouping...)
+		}
+
+		sig := metric.signature(nil, false)
+		g, ok := groups[sig]
+		if !ok {
+			groups[sig] = &group{metric: metric, value: s.Point.V, count: 1}
+			order = append(order, sig)
+			continue
+		}
+
+		g.count++
+		switch e.Op {
+		case "sum", "avg":
+			g.value += s.Point.V
+		case "max":
+			if g.value < s.Point.V || math.IsNaN(g.value) {
+				g.value = s.Point.V
+			}
+		case "min":
+			if g.value > s.Point.V || math.IsNaN(g.value) {
+				g.value = s.Point.V
+			}
+		}
+	}
+
+	out := make(Vector, 0, len(groups))
+	for _, sig := range order {
+		g := groups[sig]
+
+		v := g.value
+		switch e.Op {
+		case "avg":
+			v /= float64(g.count)
+		case "count":
+			v = float64(g.count)
+		}
+
+		out = append(out, Sample{Metric: g.metric, Point: Point{T: ts, V: v}})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,268 @@
+package promql
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// function describes a supported function: its argument and result types and
+// how it is evaluated.
+type function struct {
+	args []ValueType
+	ret  ValueType
+	eval func(ev *evaluator, args []Expr, ts int64) (Value, error)
+}
+
+// functions lists the supported functions by name.
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"rate":               overRange(func(s Series, r *MatrixSelector, ts int64) float64 { return extrapolatedRate(s, r, ts, true, true) }),
+		"increase":           overRange(func(s Series, r *MatrixSelector, ts int64) float64 { return extrapolatedRate(s, r, ts, true, false) }),
+		"delta":              overRange(func(s Series, r *MatrixSelector, ts int64) float64 { return extrapolatedRate(s, r, ts, false, false) }),
+		"avg_over_time":      overTime(func(s Series) float64 { return sumOf(s.Points) / float64(len(s.Points)) }),
+		"sum_over_time":      overTime(func(s Series) float64 { return sumOf(s.Points) }),
+		"count_over_time":    overTime(func(s Series) float64 { return float64(len(s.Points)) }),
+		"min_over_time":      overTime(func(s Series) float64 { return extremeOf(s.Points, math.Min) }),
+		"max_over_time":      overTime(func(s Series) float64 { return extremeOf(s.Points, math.Max) }),
+		"abs":                mapVector(math.Abs),
+		"histogram_quantile": {args: []ValueType{TypeScalar, TypeVector}, ret: TypeVector, eval: histogramQuantile},
+	}
+}
+
+// overRange builds a function of a range vector whose value depends on the range
+// window, such as rate. Series yielding NaN are dropped.
+func overRange(fn func(s Series, r *MatrixSelector, ts int64) float64) function {
+	return function{
+		args: []ValueType{TypeMatrix},
+		ret:  TypeVector,
+		eval: func(ev *evaluator, args []Expr, ts int64) (Value, error) {
+			sel := matrixArg(args[0])
+			m := ev.matrix(sel, ts)
+
+			out := make(Vector, 0, len(m))
+			for _, s := range m {
+				if v := fn(s, sel, ts); !math.IsNaN(v) {
+					out = append(out, Sample{Metric: s.Metric.without(nameLabel), Point: Point{T: ts, V: v}})
+				}
+			}
+			return out, nil
+		},
+	}
+}
+
+// overTime builds a function aggregating the points of each series of a range vector.
+func overTime(fn func(s Series) float64) function {
+	return overRange(func(s Series, _ *MatrixSelector, _ int64) float64 { return fn(s) })
+}
+
+// mapVector builds a function applying fn to every sample of an instant vector.
+func mapVector(fn func(float64) float64) function {
+	return function{
+		args: []ValueType{TypeVector},
+		ret:  TypeVector,
+		eval: func(ev *evaluator, args []Expr, ts int64) (Value, error) {
+			vec, err := ev.evalVector(args[0], ts)
+			if err != nil {
+				return nil, err
+			}
+
+			out := make(Vector, len(vec))
+			for i, s := range vec {
+				out[i] = Sample{Metric: s.Metric.without(nameLabel), Point: Point{T: ts, V: fn(s.Point.V)}}
+			}
+			return out, nil
+		},
+	}
+}
+
+// matrixArg unwraps parentheses around a range vector argument.
+func matrixArg(e Expr) *MatrixSelector {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			return e.(*MatrixSelector)
+		}
+		e = p.Expr
+	}
+}
+
+func sumOf(points []Point) float64 {
+	var sum float64
+	for _, p := range points {
+		sum += p.V
+	}
+	return sum
+}
+
+func extremeOf(points []Point, pick func(a, b float64) float64) float64 {
+	v := points[0].V
+	for _, p := range points[1:] {
+		v = pick(v, p.V)
+	}
+	return v
+}
+
+// extrapolatedRate computes rate, increase and delta the way Prometheus does:
+// the difference between the first and last point, corrected for counter resets,
+// is extrapolated to the edges of the range window unless a series apparently
+// starts or ends inside it. It returns NaN for fewer than two points.
+func extrapolatedRate(s Series, r *MatrixSelector, ts int64, isCounter, isRate bool) float64 {
+	points := s.Points
+	if len(points) < 2 {
+		return math.NaN()
+	}
+
+	first, last := points[0], points[len(points)-1]
+
+	result := last.V - first.V
+	if isCounter {
+		prev := first.V
+		for _, p := range points[1:] {
+			if p.V < prev {
+				result += prev
+			}
+			prev = p.V
+		}
+	}
+
+	rangeStart := ts - r.Range.Milliseconds()
+	durationToStart := float64(first.T-rangeStart) / 1000
+	durationToEnd := float64(ts-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageInterval := sampledInterval / float64(len(points)-1)
+
+	// A counter cannot go below zero, so do not extrapolate past the point it would have been zero.
+	if isCounter && result > 0 && first.V >= 0 {
+		if durationToZero := sampledInterval * (first.V / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	threshold := averageInterval * 1.1
+	extrapolated := sampledInterval
+
+	if durationToStart < threshold {
+		extrapolated += durationToStart
+	} else {
+		extrapolated += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		extrapolated += durationToEnd
+	} else {
+		extrapolated += averageInterval / 2
+	}
+
+	result *= extrapolated / sampledInterval
+	if isRate {
+		result /= r.Range.Seconds()
+	}
+
+	return result
+}
+
+// bucket is one cumulative histogram bucket.
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile estimates the φ-quantile from classic histogram buckets,
+// i.e. series sharing all labels but "le", the bucket's inclusive upper bound.
+func histogramQuantile(ev *evaluator, args []Expr, ts int64) (Value, error) {
+	phi, err := ev.eval(args[0], ts)
+	if err != nil {
+		return nil, err
+	}
+	vec, err := ev.evalVector(args[1], ts)
+	if err != nil {
+		return nil, err
+	}
+
+	type histogram struct {
+		metric  Labels
+		buckets []bucket
+	}
+
+	histograms := make(map[string]*histogram)
+	var order []string
+
+	for _, s := range vec {
+		upper, err := strconv.ParseFloat(s.Metric["le"], 64)
+		if err != nil {
+			continue
+		}
+
+		metric := s.Metric.without(nameLabel, "le")
+		sig := metric.signature(nil, false)
+
+		h, ok := histograms[sig]
+		if !ok {
+			h = &histogram{metric: metric}
+			histograms[sig] = h
+			order = append(order, sig)
+		}
+		h.buckets = append(h.buckets, bucket{upperBound: upper, count: s.Point.V})
+	}
+
+	out := make(Vector, 0, len(histograms))
+	for _, sig := range order {
+		h := histograms[sig]
+		out = append(out, Sample{Metric: h.metric, Point: Point{T: ts, V: bucketQuantile(phi.(Scalar).V, h.buckets)}})
+	}
+
+	return out, nil
+}
+
+// bucketQuantile interpolates the quantile q linearly within the bucket it falls
+// into. It follows Prometheus: the highest bucket must be +Inf, and a quantile
+// falling into it yields the upper bound of the second-highest bucket.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	// Scrapes are not atomic, so bucket counts may be slightly non-monotonic.
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	switch {
+	case b == len(buckets)-1:
+		return buckets[len(buckets)-2].upperBound
+	case b == 0 && buckets[0].upperBound <= 0:
+		return buckets[0].upperBound
+	}
+
+	start, end, count := 0.0, buckets[b].upperBound, buckets[b].count
+	if b > 0 {
+		start = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+
+	return start + (end-start)*(rank/count)
+}
@@ -0,0 +1,242 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// tokenKind classifies lexical tokens.
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokOperator // arithmetic and comparison operators
+	tokMatch    // label matchers "=", "=~" and "!~"; "!=" is lexed as tokOperator
+)
+
+// token is a lexical token with its byte offset in the input.
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.val)
+}
+
+// lex splits the input into tokens. The contents of square brackets are lexed
+// as a single duration token.
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(input); {
+		c := input[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentChar(input[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, val: input[start:i], pos: start})
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			start := i
+			i = scanNumber(input, i)
+			tokens = append(tokens, token{kind: tokNumber, val: input[start:i], pos: start})
+		case c == '"' || c == '\'' || c == '`':
+			val, n, err := scanString(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("at position %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokString, val: val, pos: i})
+			i += n
+		case c == '[':
+			end := strings.IndexByte(input[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("at position %d: unclosed '['", i)
+			}
+			tokens = append(tokens,
+				token{kind: tokLBracket, val: "[", pos: i},
+				token{kind: tokDuration, val: strings.TrimSpace(input[i+1 : i+end]), pos: i + 1},
+				token{kind: tokRBracket, val: "]", pos: i + end})
+			i += end + 1
+		default:
+			tok, n := scanPunct(input[i:])
+			if n == 0 {
+				return nil, fmt.Errorf("at position %d: unexpected character %q", i, c)
+			}
+			tok.pos = i
+			tokens = append(tokens, tok)
+			i += n
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// scanPunct lexes brackets, separators and operators, returning the token and its length.
+func scanPunct(s string) (token, int) {
+	if len(s) >= 2 {
+		switch s[:2] {
+		case "==", "!=", ">=", "<=":
+			return token{kind: tokOperator, val: s[:2]}, 2
+		case "=~", "!~":
+			return token{kind: tokMatch, val: s[:2]}, 2
+		}
+	}
+
+	switch s[0] {
+	case '(':
+		return token{kind: tokLParen, val: "("}, 1
+	case ')':
+		return token{kind: tokRParen, val: ")"}, 1
+	case '{':
+		return token{kind: tokLBrace, val: "{"}, 1
+	case '}':
+		return token{kind: tokRBrace, val: "}"}, 1
+	case ',':
+		return token{kind: tokComma, val: ","}, 1
+	case '=':
+		return token{kind: tokMatch, val: "="}, 1
+	case '+', '-', '*', '/', '%', '^', '>', '<':
+		return token{kind: tokOperator, val: s[:1]}, 1
+	}
+
+	return token{}, 0
+}
+
+func scanNumber(s string, i int) int {
+	for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+		i++
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			i = j
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+// scanString lexes a quoted string, returning its unquoted value and the number
+// of bytes consumed. Single-quoted strings follow the double-quoted escaping
+// rules; backquoted strings are raw.
+func scanString(s string) (string, int, error) {
+	quote := s[0]
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			body := s[1:i]
+			if quote == '`' {
+				return body, i + 1, nil
+			}
+			if quote == '\'' {
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			val, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+			}
+			return val, i + 1, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// durationUnits lists the supported duration units, longest first so that
+// "ms" is not read as minutes.
+var durationUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// ParseDuration parses a PromQL duration such as "5m", "1h30m" or "90s".
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	var total time.Duration
+	for rest := s; rest != ""; {
+		n := 0
+		for n < len(rest) && isDigit(rest[n]) {
+			n++
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		value, err := strconv.ParseInt(rest[:n], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		rest = rest[n:]
+
+		matched := false
+		for _, u := range durationUnits {
+			if strings.HasPrefix(rest, u.unit) {
+				total += time.Duration(value) * u.d
+				rest = rest[len(u.unit):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("invalid duration %q: missing or unknown unit", s)
+		}
+	}
+
+	return total, nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isIdentChar also accepts '.', which this server allows in metric names.
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) || c == '.' }
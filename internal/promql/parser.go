@@ -0,0 +1,430 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// aggregations lists the supported aggregation operators.
+var aggregations = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true,
+}
+
+// precedence returns the binding power of a binary operator; higher binds tighter.
+func precedence(op string) int {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return 1
+	case "+", "-":
+		return 2
+	case "*", "/", "%":
+		return 3
+	case "^":
+		return 4
+	}
+	return 0
+}
+
+func isComparison(op string) bool { return precedence(op) == 1 }
+
+// parser is a recursive descent parser over the token stream.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a query into its expression tree.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	e, err := p.parseExpr(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return e, nil
+}
+
+// ParseSelector parses a series selector such as cpu{host=~"a.*"} into its
+// matchers, the metric name being a __name__ matcher.
+func ParseSelector(input string) ([]*Matcher, error) {
+	e, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, ok := e.(*VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a series selector", input)
+	}
+
+	return sel.Matchers, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s, got %s", what, t)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("parse error at position %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// parseExpr parses a binary expression whose operators bind at least as tightly as minPrec.
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		prec := precedence(t.val)
+		if t.kind != tokOperator || prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		b := &BinaryExpr{Op: t.val, LHS: lhs}
+
+		if p.peek().kind == tokIdent && p.peek().val == "bool" {
+			if !isComparison(t.val) {
+				return nil, p.errorf(p.peek(), "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			b.ReturnBool = true
+		}
+
+		if b.Matching, err = p.parseVectorMatching(); err != nil {
+			return nil, err
+		}
+
+		// "^" is right-associative, all other operators are left-associative.
+		nextPrec := prec + 1
+		if t.val == "^" {
+			nextPrec = prec
+		}
+		if b.RHS, err = p.parseExpr(nextPrec); err != nil {
+			return nil, err
+		}
+
+		lt, rt := typeOf(b.LHS), typeOf(b.RHS)
+		if lt == TypeMatrix || rt == TypeMatrix {
+			return nil, p.errorf(t, "binary expressions must contain only scalar and instant vector types")
+		}
+		if lt == TypeScalar && rt == TypeScalar && isComparison(b.Op) && !b.ReturnBool {
+			return nil, p.errorf(t, "comparisons between scalars must use bool modifier")
+		}
+		if b.Matching != nil && (lt != TypeVector || rt != TypeVector) {
+			return nil, p.errorf(t, "vector matching only allowed between instant vectors")
+		}
+
+		lhs = b
+	}
+}
+
+// parseVectorMatching parses an optional on(...) or ignoring(...) clause.
+func (p *parser) parseVectorMatching() (*VectorMatching, error) {
+	t := p.peek()
+	if t.kind != tokIdent || (t.val != "on" && t.val != "ignoring") {
+		return nil, nil
+	}
+	p.next()
+
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return nil, err
+	}
+
+	return &VectorMatching{On: t.val == "on", Labels: labels}, nil
+}
+
+// parseUnary parses an optionally signed operand. Unary operators bind less
+// tightly than "^", so -2^2 is -(2^2).
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	if t.kind == tokOperator && (t.val == "-" || t.val == "+") {
+		p.next()
+
+		e, err := p.parseExpr(precedence("^"))
+		if err != nil {
+			return nil, err
+		}
+		if t.val == "+" {
+			return e, nil
+		}
+		if n, ok := e.(*NumberLiteral); ok {
+			return &NumberLiteral{Val: -n.Val}, nil
+		}
+		return &UnaryExpr{Op: "-", Expr: e}, nil
+	}
+
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == tokLBracket {
+		return p.parseMatrix(e)
+	}
+
+	return e, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t)
+		}
+		return &NumberLiteral{Val: v}, nil
+
+	case tokLParen:
+		e, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: e}, nil
+
+	case tokLBrace:
+		return p.parseSelector("")
+
+	case tokIdent:
+		next := p.peek()
+		if aggregations[t.val] && (next.kind == tokLParen || next.val == "by" || next.val == "without") {
+			return p.parseAggregate(t.val)
+		}
+		if next.kind == tokLParen {
+			return p.parseCall(t)
+		}
+		if t.val == "Inf" || t.val == "NaN" {
+			v, _ := strconv.ParseFloat(t.val, 64)
+			return &NumberLiteral{Val: v}, nil
+		}
+		if next.kind == tokLBrace {
+			p.next()
+		}
+		return p.parseSelector(t.val)
+	}
+
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// parseSelector parses a vector selector. The opening brace, if any, has been
+// consumed already; without it the selector consists of the name only.
+func (p *parser) parseSelector(name string) (Expr, error) {
+	sel := &VectorSelector{Name: name}
+
+	if name != "" {
+		m, _ := NewMatcher(MatchEqual, nameLabel, name)
+		sel.Matchers = append(sel.Matchers, m)
+		if p.tokens[p.pos-1].kind != tokLBrace {
+			return sel, nil
+		}
+	}
+
+	for p.peek().kind != tokRBrace {
+		label, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+
+		op := p.next()
+		if op.kind != tokMatch && op.val != "!=" {
+			return nil, p.errorf(op, "expected label matching operator, got %s", op)
+		}
+
+		value, err := p.expect(tokString, "label value")
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := NewMatcher(MatchType(op.val), label.val, value.val)
+		if err != nil {
+			return nil, p.errorf(value, "%v", err)
+		}
+		sel.Matchers = append(sel.Matchers, m)
+
+		if p.peek().kind == tokComma {
+			p.next()
+		} else if p.peek().kind != tokRBrace {
+			return nil, p.errorf(p.peek(), "expected ',' or '}', got %s", p.peek())
+		}
+	}
+	p.next()
+
+	if len(sel.Matchers) == 0 {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one matcher")
+	}
+
+	matchesEmpty := true
+	for _, m := range sel.Matchers {
+		if !m.Matches("") {
+			matchesEmpty = false
+			break
+		}
+	}
+	if matchesEmpty {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one non-empty matcher")
+	}
+
+	return sel, nil
+}
+
+func (p *parser) parseMatrix(e Expr) (Expr, error) {
+	open := p.next()
+
+	sel, ok := e.(*VectorSelector)
+	if !ok {
+		return nil, p.errorf(open, "ranges are only allowed for vector selectors")
+	}
+
+	t := p.next()
+	d, err := ParseDuration(t.val)
+	if err != nil {
+		return nil, p.errorf(t, "%v", err)
+	}
+	if d <= 0 {
+		return nil, p.errorf(t, "range must be positive")
+	}
+	p.next() // the closing bracket is always emitted by the lexer
+
+	return &MatrixSelector{Vector: sel, Range: d}, nil
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	fn, ok := functions[name.val]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %s", name)
+	}
+
+	p.next() // (
+
+	call := &Call{Func: name.val}
+	for p.peek().kind != tokRParen {
+		arg, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		if p.peek().kind == tokComma {
+			p.next()
+		} else if p.peek().kind != tokRParen {
+			return nil, p.errorf(p.peek(), "expected ',' or ')', got %s", p.peek())
+		}
+	}
+	p.next()
+
+	if len(call.Args) != len(fn.args) {
+		return nil, p.errorf(name, "function %s expects %d arguments, got %d", name.val, len(fn.args), len(call.Args))
+	}
+	for i, want := range fn.args {
+		if got := typeOf(call.Args[i]); got != want {
+			return nil, p.errorf(name, "argument %d of %s must be a %s, got %s", i+1, name.val, want, got)
+		}
+	}
+
+	return call, nil
+}
+
+// parseAggregate parses "op [by|without (labels)] (expr) [by|without (labels)]".
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+
+	grouped, err := p.parseGrouping(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+	if agg.Expr, err = p.parseExpr(1); err != nil {
+		return nil, err
+	}
+	if _, err = p.expect(tokRParen, "')'"); err != nil {
+		return nil, err
+	}
+
+	if !grouped {
+		if _, err = p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+
+	if typeOf(agg.Expr) != TypeVector {
+		return nil, fmt.Errorf("parse error: %s expects an instant vector", op)
+	}
+
+	return agg, nil
+}
+
+func (p *parser) parseGrouping(agg *AggregateExpr) (bool, error) {
+	t := p.peek()
+	if t.kind != tokIdent || (t.val != "by" && t.val != "without") {
+		return false, nil
+	}
+	p.next()
+
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return false, err
+	}
+
+	agg.Grouping = labels
+	agg.Without = t.val == "without"
+
+	return true, nil
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for p.peek().kind != tokRParen {
+		t, err := p.expect(tokIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, t.val)
+
+		if p.peek().kind == tokComma {
+			p.next()
+		} else if p.peek().kind != tokRParen {
+			return nil, p.errorf(p.peek(), "expected ',' or ')', got %s", p.peek())
+		}
+	}
+	p.next()
+
+	return labels, nil
+}
@@ -0,0 +1,156 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		check   func(t *testing.T, e Expr)
+		wantErr bool
+	}{
+		{
+			name:  "selector with matchers",
+			query: `http_requests_total{job="api", code=~"5..", path!="/health"}`,
+			check: func(t *testing.T, e Expr) {
+				sel, ok := e.(*VectorSelector)
+				require.True(t, ok)
+				require.Equal(t, "http_requests_total", sel.Name)
+				require.Len(t, sel.Matchers, 4)
+				require.Equal(t, MatchRegexp, sel.Matchers[2].Type)
+				require.True(t, sel.Matchers[2].Matches("503"))
+				require.False(t, sel.Matchers[2].Matches("404"))
+				require.Equal(t, MatchNotEqual, sel.Matchers[3].Type)
+			},
+		},
+		{
+			name:  "dotted metric name",
+			query: `cpu.load.avg`,
+			check: func(t *testing.T, e Expr) {
+				require.Equal(t, "cpu.load.avg", e.(*VectorSelector).Name)
+			},
+		},
+		{
+			name:  "rate over range",
+			query: `rate(requests[5m])`,
+			check: func(t *testing.T, e Expr) {
+				call := e.(*Call)
+				require.Equal(t, "rate", call.Func)
+				require.Equal(t, 5*time.Minute, call.Args[0].(*MatrixSelector).Range)
+			},
+		},
+		{
+			name:  "aggregation with trailing grouping",
+			query: `sum(rate(requests[1h30m])) by (job, instance)`,
+			check: func(t *testing.T, e Expr) {
+				agg := e.(*AggregateExpr)
+				require.Equal(t, "sum", agg.Op)
+				require.Equal(t, []string{"job", "instance"}, agg.Grouping)
+				require.False(t, agg.Without)
+				require.Equal(t, 90*time.Minute, agg.Expr.(*Call).Args[0].(*MatrixSelector).Range)
+			},
+		},
+		{
+			name:  "aggregation without",
+			query: `max without (instance) (cpu)`,
+			check: func(t *testing.T, e Expr) {
+				agg := e.(*AggregateExpr)
+				require.True(t, agg.Without)
+				require.Equal(t, []string{"instance"}, agg.Grouping)
+			},
+		},
+		{
+			name:  "operator precedence",
+			query: `1 + 2 * 3 > bool 6`,
+			check: func(t *testing.T, e Expr) {
+				cmp := e.(*BinaryExpr)
+				require.Equal(t, ">", cmp.Op)
+				require.True(t, cmp.ReturnBool)
+				sum := cmp.LHS.(*BinaryExpr)
+				require.Equal(t, "+", sum.Op)
+				require.Equal(t, "*", sum.RHS.(*BinaryExpr).Op)
+			},
+		},
+		{
+			name:  "unary minus binds looser than power",
+			query: `-2 ^ 2`,
+			check: func(t *testing.T, e Expr) {
+				require.Equal(t, "^", e.(*UnaryExpr).Expr.(*BinaryExpr).Op)
+			},
+		},
+		{
+			name:  "histogram quantile",
+			query: `histogram_quantile(0.9, sum by (le) (rate(latency_bucket[5m])))`,
+			check: func(t *testing.T, e Expr) {
+				call := e.(*Call)
+				require.Equal(t, 0.9, call.Args[0].(*NumberLiteral).Val)
+				require.Equal(t, []string{"le"}, call.Args[1].(*AggregateExpr).Grouping)
+			},
+		},
+		{
+			name:  "vector matching",
+			query: `errors / on (job) requests`,
+			check: func(t *testing.T, e Expr) {
+				b := e.(*BinaryExpr)
+				require.Equal(t, &VectorMatching{On: true, Labels: []string{"job"}}, b.Matching)
+			},
+		},
+		{name: "unknown function", query: `foo(cpu)`, wantErr: true},
+		{name: "wrong argument type", query: `rate(cpu)`, wantErr: true},
+		{name: "range on expression", query: `(cpu + 1)[5m]`, wantErr: true},
+		{name: "empty selector", query: `{job=""}`, wantErr: true},
+		{name: "invalid duration", query: `cpu[5x]`, wantErr: true},
+		{name: "scalar comparison without bool", query: `1 > 2`, wantErr: true},
+		{name: "binary on range vector", query: `cpu[5m] + 1`, wantErr: true},
+		{name: "trailing tokens", query: `cpu )`, wantErr: true},
+		{name: "invalid regexp", query: `cpu{job=~"("}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			tt.check(t, e)
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "30s", want: 30 * time.Second},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "250ms", want: 250 * time.Millisecond},
+		{in: "1d", want: 24 * time.Hour},
+		{in: "2w", want: 14 * 24 * time.Hour},
+		{in: "", wantErr: true},
+		{in: "5", wantErr: true},
+		{in: "m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDuration(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
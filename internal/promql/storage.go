@@ -0,0 +1,87 @@
+package promql
+
+import (
+	"context"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// HistoryStorage defines an interface for reading recorded samples.
+type HistoryStorage interface {
+	Samples(ctx context.Context, name string, start, end time.Time) ([]models.Sample, error)
+}
+
+// MemStorage defines an interface for reading the latest, not yet flushed values.
+type MemStorage interface {
+	Latest() []models.Sample
+}
+
+// storage merges recorded history with the latest in-memory values, so that
+// queries see data written since the last flush.
+type storage struct {
+	history HistoryStorage
+	mem     MemStorage
+}
+
+// NewStorage creates a Storage reading samples from history, extended by the
+// latest values held in memory. Either source may be nil.
+func NewStorage(history HistoryStorage, mem MemStorage) Storage {
+	return &storage{history: history, mem: mem}
+}
+
+// Select implements Storage.
+func (s *storage) Select(ctx context.Context, name string, start, end time.Time) ([]Series, error) {
+	bySeries := make(map[string]*Series)
+	var order []string
+
+	add := func(sample models.Sample) {
+		series, ok := bySeries[sample.Key]
+		if !ok {
+			metric, labels, err := models.ParseSeriesKey(sample.Key)
+			if err != nil || (name != "" && metric != name) {
+				return
+			}
+
+			series = &Series{Metric: make(Labels, len(labels)+1)}
+			for k, v := range labels {
+				series.Metric[k] = v
+			}
+			series.Metric[nameLabel] = metric
+
+			bySeries[sample.Key] = series
+			order = append(order, sample.Key)
+		}
+
+		p := Point{T: sample.Timestamp.UnixMilli(), V: sample.Value}
+		if n := len(series.Points); n > 0 && series.Points[n-1].T >= p.T {
+			return
+		}
+		series.Points = append(series.Points, p)
+	}
+
+	if s.history != nil {
+		samples, err := s.history.Samples(ctx, name, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range samples {
+			add(sample)
+		}
+	}
+
+	if s.mem != nil {
+		for _, sample := range s.mem.Latest() {
+			if !sample.Timestamp.Before(start) && !sample.Timestamp.After(end) {
+				add(sample)
+			}
+		}
+	}
+
+	result := make([]Series, len(order))
+	for i, key := range order {
+		result[i] = *bySeries[key]
+	}
+
+	return result, nil
+}
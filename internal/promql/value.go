@@ -0,0 +1,152 @@
+package promql
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nameLabel is the label holding the metric name.
+const nameLabel = "__name__"
+
+// ValueType is the type of an expression result.
+type ValueType string
+
+// Result types, named as in the Prometheus HTTP API.
+const (
+	TypeScalar ValueType = "scalar"
+	TypeVector ValueType = "vector"
+	TypeMatrix ValueType = "matrix"
+)
+
+// Labels is the label set of a series, including the metric name as __name__.
+type Labels map[string]string
+
+// signature returns a canonical string for the labels, restricted to the given
+// names (on) or excluding them (!on).
+func (l Labels) signature(names []string, on bool) string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		if contains(names, k) == on {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0xff)
+		b.WriteString(l[k])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// without returns a copy of the labels without the given names.
+func (l Labels) without(names ...string) Labels {
+	out := make(Labels, len(l))
+	for k, v := range l {
+		if !contains(names, k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// only returns a copy of the labels restricted to the given names.
+func (l Labels) only(names ...string) Labels {
+	out := make(Labels, len(names))
+	for _, k := range names {
+		if v, ok := l[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Point is a value at a timestamp in milliseconds since the Unix epoch.
+// It marshals to the Prometheus API form [<seconds>, "<value>"].
+type Point struct {
+	T int64
+	V float64
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Point) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{float64(p.T) / 1000, strconv.FormatFloat(p.V, 'f', -1, 64)})
+}
+
+// Series is a labelled list of points in time order.
+type Series struct {
+	Metric Labels  `json:"metric"`
+	Points []Point `json:"values"`
+}
+
+// Sample is a single labelled point of an instant vector.
+type Sample struct {
+	Metric Labels `json:"metric"`
+	Point  Point  `json:"value"`
+}
+
+// Vector is the result of an instant vector expression.
+type Vector []Sample
+
+// Matrix is the result of a range query or a range vector expression.
+type Matrix []Series
+
+// Scalar is the result of a scalar expression.
+type Scalar Point
+
+// MarshalJSON implements json.Marshaler.
+func (s Scalar) MarshalJSON() ([]byte, error) {
+	return Point(s).MarshalJSON()
+}
+
+// Value is a query result: a Scalar, Vector or Matrix.
+type Value interface {
+	Type() ValueType
+}
+
+// Type implements Value.
+func (Scalar) Type() ValueType { return TypeScalar }
+
+// Type implements Value.
+func (Vector) Type() ValueType { return TypeVector }
+
+// Type implements Value.
+func (Matrix) Type() ValueType { return TypeMatrix }
+
+// typeOf returns the static result type of an expression.
+func typeOf(e Expr) ValueType {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return TypeScalar
+	case *VectorSelector, *AggregateExpr:
+		return TypeVector
+	case *MatrixSelector:
+		return TypeMatrix
+	case *Call:
+		return functions[e.Func].ret
+	case *BinaryExpr:
+		if typeOf(e.LHS) == TypeScalar && typeOf(e.RHS) == TypeScalar {
+			return TypeScalar
+		}
+		return TypeVector
+	case *UnaryExpr:
+		return typeOf(e.Expr)
+	case *ParenExpr:
+		return typeOf(e.Expr)
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+// Package recording evaluates recording rules: PromQL expressions whose results
+// are written back into the in-memory storage as new series, so that they are
+// flushed and queryable like ingested metrics.
+package recording
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Querier defines an interface for evaluating instant queries.
+type Querier interface {
+	Instant(ctx context.Context, query string, ts time.Time) (promql.Value, error)
+}
+
+// MemStorage defines an interface for writing the recorded series.
+type MemStorage interface {
+	SetBatch(metrics []models.Metric)
+}
+
+// Recorder evaluates a set of recording rules.
+type Recorder struct {
+	rules   []config.RecordingRule
+	querier Querier
+	storage MemStorage
+	log     *slog.Logger
+
+	failures *telemetry.Counter
+	recorded *telemetry.Gauge
+}
+
+// New validates the rules and creates a Recorder writing their results to storage.
+func New(
+	rules []config.RecordingRule, querier Querier, storage MemStorage, reg *telemetry.Registry, log *slog.Logger,
+) (*Recorder, error) {
+	for _, rule := range rules {
+		if rule.Record == "" || strings.ContainsAny(rule.Record, "{}\"") {
+			return nil, fmt.Errorf("recording rule %q: invalid metric name", rule.Record)
+		}
+		if _, err := promql.Parse(rule.Expr); err != nil {
+			return nil, fmt.Errorf("recording rule %q: %w", rule.Record, err)
+		}
+	}
+
+	return &Recorder{
+		rules:   rules,
+		querier: querier,
+		storage: storage,
+		log:     log,
+		failures: reg.Counter("metric_server_recording_rule_failures_total",
+			"Total number of failed recording rule evaluations."),
+		recorded: reg.Gauge("metric_server_recording_rule_series",
+			"Number of series written by the most recent recording rule evaluation."),
+	}, nil
+}
+
+// Eval evaluates every rule at the given time and stores the results. Rules
+// are evaluated in order, so a rule may use the series recorded by earlier ones.
+// A failing rule is logged and skipped.
+func (r *Recorder) Eval(ctx context.Context, now time.Time) {
+	total := 0
+
+	for _, rule := range r.rules {
+		v, err := r.querier.Instant(ctx, rule.Expr, now)
+		if err != nil {
+			r.failures.Inc()
+			r.log.Warn("recording rule evaluation failed", slog.String("rule", rule.Record), logger.Err(err))
+			continue
+		}
+
+		metrics := record(rule, v)
+		r.storage.SetBatch(metrics)
+		total += len(metrics)
+	}
+
+	r.recorded.Set(float64(total))
+}
+
+// record converts a query result into metrics of the rule's name. The labels of
+// every result series are kept, with the rule's labels taking precedence.
+func record(rule config.RecordingRule, v promql.Value) []models.Metric {
+	switch v := v.(type) {
+	case promql.Scalar:
+		return []models.Metric{{Name: rule.Record, MType: "gauge", Value: v.V, Labels: labels(nil, rule.Labels)}}
+	case promql.Vector:
+		metrics := make([]models.Metric, len(v))
+		for i, s := range v {
+			metrics[i] = models.Metric{Name: rule.Record, MType: "gauge", Value: s.Point.V, Labels: labels(s.Metric, rule.Labels)}
+		}
+		return metrics
+	}
+	return nil
+}
+
+func labels(series promql.Labels, extra map[string]string) map[string]string {
+	out := make(map[string]string, len(series)+len(extra))
+	for k, v := range series {
+		if k != "__name__" {
+			out[k] = v
+		}
+	}
+	for k, v := range extra {
+		out[k] = v
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package recording
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+func TestRecorder_Eval(t *testing.T) {
+	mem := storage.NewMemStorage(1)
+	mem.Set(`requests{code="200",job="api"}`, 90)
+	mem.Set(`requests{code="500",job="api"}`, 10)
+	mem.Set(`requests{code="200",job="web"}`, 40)
+	mem.Set(`disk_used`, 30)
+	mem.Set(`disk_total`, 120)
+
+	rules := []config.RecordingRule{
+		{Record: "job:requests:sum", Expr: `sum by (job) (requests)`},
+		{Record: "job:errors:ratio", Expr: `sum by (job) (requests{code="500"}) / job:requests:sum`},
+		{Record: "disk:usage:ratio", Expr: `disk_used / on () disk_total`, Labels: map[string]string{"source": "rule"}},
+		{Record: "constant", Expr: `2 * 21`},
+	}
+
+	r, err := New(rules, promql.NewEngine(promql.NewStorage(nil, mem)), mem, nil, slog.Default())
+	require.NoError(t, err)
+
+	r.Eval(context.Background(), time.Now().Add(time.Second))
+
+	snapshot := mem.Snapshot()
+	require.Equal(t, 100.0, snapshot[`job:requests:sum{job="api"}`])
+	require.Equal(t, 40.0, snapshot[`job:requests:sum{job="web"}`])
+	require.Equal(t, 0.1, snapshot[`job:errors:ratio{job="api"}`])
+	require.NotContains(t, snapshot, `job:errors:ratio{job="web"}`)
+	require.Equal(t, 0.25, snapshot[`disk:usage:ratio{source="rule"}`])
+	require.Equal(t, 42.0, snapshot[`constant`])
+}
+
+func TestNew_InvalidRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RecordingRule
+	}{
+		{name: "missing name", rule: config.RecordingRule{Expr: "cpu"}},
+		{name: "name with labels", rule: config.RecordingRule{Record: `cpu{a="b"}`, Expr: "cpu"}},
+		{name: "invalid expression", rule: config.RecordingRule{Record: "cpu:sum", Expr: "sum("}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New([]config.RecordingRule{tt.rule}, nil, nil, nil, slog.Default())
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,283 @@
+// Package relabel implements the processing applied to ingested metrics before
+// they reach storage: name allow and deny lists followed by Prometheus-style
+// relabeling rules that can drop metrics, rename them and rewrite their labels.
+package relabel
+
+import (
+	"crypto/md5" //nolint:gosec // used for sharding, as in Prometheus, not for security
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// nameLabel is the label holding the metric name while rules are applied.
+const nameLabel = "__name__"
+
+// Supported relabeling actions.
+const (
+	ActionKeep      = "keep"
+	ActionDrop      = "drop"
+	ActionReplace   = "replace"
+	ActionLabelDrop = "labeldrop"
+	ActionLabelMap  = "labelmap"
+	ActionHashMod   = "hashmod"
+)
+
+// rule is a compiled relabeling rule with its counters.
+type rule struct {
+	config.RelabelRule
+	regex       *regexp.Regexp
+	replacement string
+
+	applied *telemetry.Counter
+	dropped *telemetry.Counter
+}
+
+// Pipeline filters and relabels metrics.
+type Pipeline struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+	rules []*rule
+
+	filtered *telemetry.CounterVec
+}
+
+// New compiles the configuration into a Pipeline, registering its counters in reg.
+// Every rule is counted under its position in the configuration.
+func New(cfg config.Relabel, reg *telemetry.Registry) (*Pipeline, error) {
+	p := &Pipeline{
+		filtered: reg.CounterVec("metric_server_relabel_filtered_total",
+			"Total number of metrics dropped by the name allow and deny lists.", "list"),
+	}
+
+	var err error
+	if p.allow, err = compileAll(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("invalid relabel allow list: %w", err)
+	}
+	if p.deny, err = compileAll(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("invalid relabel deny list: %w", err)
+	}
+
+	applied := reg.CounterVec("metric_server_relabel_rule_applied_total",
+		"Total number of metrics a relabel rule matched.", "rule", "action")
+	dropped := reg.CounterVec("metric_server_relabel_rule_dropped_total",
+		"Total number of metrics dropped by a relabel rule.", "rule", "action")
+
+	for i, rc := range cfg.Rules {
+		r, err := compileRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relabel rule %d: %w", i, err)
+		}
+		idx := strconv.Itoa(i)
+		r.applied = applied.With(idx, r.Action)
+		r.dropped = dropped.With(idx, r.Action)
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+// compileAll compiles fully anchored regular expressions.
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func compileRule(rc config.RelabelRule) (*rule, error) {
+	r := &rule{RelabelRule: rc, replacement: "$1"}
+
+	if r.Action == "" {
+		r.Action = ActionReplace
+	}
+	if r.Separator == "" {
+		r.Separator = ";"
+	}
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	if rc.Replacement != nil {
+		r.replacement = *rc.Replacement
+	}
+
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return nil, err
+	}
+	r.regex = re
+
+	switch r.Action {
+	case ActionKeep, ActionDrop, ActionLabelDrop, ActionLabelMap:
+	case ActionReplace:
+		if r.TargetLabel == "" {
+			return nil, fmt.Errorf("%s requires a target label", r.Action)
+		}
+	case ActionHashMod:
+		if r.TargetLabel == "" || r.Modulus == 0 {
+			return nil, fmt.Errorf("%s requires a target label and a positive modulus", r.Action)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return r, nil
+}
+
+// Process returns the metrics that pass the pipeline, relabeled. The input
+// slice is reused for the result.
+func (p *Pipeline) Process(metrics []models.Metric) []models.Metric {
+	if len(p.allow) == 0 && len(p.deny) == 0 && len(p.rules) == 0 {
+		return metrics
+	}
+
+	kept := metrics[:0]
+	for _, m := range metrics {
+		if !p.admitted(m.Name) {
+			continue
+		}
+
+		if len(p.rules) > 0 {
+			var ok bool
+			if m, ok = p.relabel(m); !ok {
+				continue
+			}
+		}
+
+		kept = append(kept, m)
+	}
+
+	return kept
+}
+
+func (p *Pipeline) admitted(name string) bool {
+	if len(p.allow) > 0 && !matchesAny(p.allow, name) {
+		p.filtered.With("allow").Inc()
+		return false
+	}
+	if matchesAny(p.deny, name) {
+		p.filtered.With("deny").Inc()
+		return false
+	}
+	return true
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// relabel applies the rules to a copy of the metric's labels. It reports false
+// if the metric was dropped or lost its name. Labels starting with "__" are
+// removed afterwards, so they can carry temporary values between rules.
+func (p *Pipeline) relabel(m models.Metric) (models.Metric, bool) {
+	labels := make(map[string]string, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	labels[nameLabel] = m.Name
+
+	for _, r := range p.rules {
+		if !r.apply(labels) {
+			r.dropped.Inc()
+			return m, false
+		}
+	}
+
+	m.Name = labels[nameLabel]
+	if m.Name == "" {
+		return m, false
+	}
+
+	m.Labels = nil
+	for k, v := range labels {
+		if strings.HasPrefix(k, "__") {
+			continue
+		}
+		if m.Labels == nil {
+			m.Labels = make(map[string]string, len(labels))
+		}
+		m.Labels[k] = v
+	}
+
+	return m, true
+}
+
+// apply runs the rule on labels in place and reports whether the metric is kept.
+func (r *rule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case ActionKeep:
+		if !r.regex.MatchString(value) {
+			return false
+		}
+		r.applied.Inc()
+
+	case ActionDrop:
+		if r.regex.MatchString(value) {
+			return false
+		}
+
+	case ActionReplace:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		r.applied.Inc()
+
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, value, match))
+		result := string(r.regex.ExpandString(nil, r.replacement, value, match))
+		if result == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = result
+		}
+
+	case ActionLabelDrop:
+		for name := range labels {
+			if name != nameLabel && r.regex.MatchString(name) {
+				delete(labels, name)
+				r.applied.Inc()
+			}
+		}
+
+	case ActionLabelMap:
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if match := r.regex.FindStringSubmatchIndex(name); match != nil {
+				labels[string(r.regex.ExpandString(nil, r.replacement, name, match))] = labels[name]
+				r.applied.Inc()
+			}
+		}
+
+	case ActionHashMod:
+		sum := md5.Sum([]byte(value)) //nolint:gosec
+		labels[r.TargetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%r.Modulus, 10)
+		r.applied.Inc()
+	}
+
+	return true
+}
@@ -0,0 +1,135 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+func ptr(s string) *string { return &s }
+
+func TestPipeline_Process(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Relabel
+		input    []models.Metric
+		expected []models.Metric
+	}{
+		{
+			name: "allow and deny lists",
+			cfg:  config.Relabel{Allow: []string{"http_.*", "cpu"}, Deny: []string{"http_debug_.*"}},
+			input: []models.Metric{
+				{Name: "http_requests", Value: 1},
+				{Name: "http_debug_allocs", Value: 2},
+				{Name: "cpu", Value: 3},
+				{Name: "memory", Value: 4},
+			},
+			expected: []models.Metric{{Name: "http_requests", Value: 1}, {Name: "cpu", Value: 3}},
+		},
+		{
+			name: "keep and drop",
+			cfg: config.Relabel{Rules: []config.RelabelRule{
+				{Action: ActionKeep, SourceLabels: []string{"env"}, Regex: "prod|staging"},
+				{Action: ActionDrop, SourceLabels: []string{"__name__", "env"}, Regex: "noisy;staging"},
+			}},
+			input: []models.Metric{
+				{Name: "cpu", Labels: map[string]string{"env": "prod"}},
+				{Name: "cpu", Labels: map[string]string{"env": "dev"}},
+				{Name: "noisy", Labels: map[string]string{"env": "staging"}},
+				{Name: "noisy", Labels: map[string]string{"env": "prod"}},
+			},
+			expected: []models.Metric{
+				{Name: "cpu", Labels: map[string]string{"env": "prod"}},
+				{Name: "noisy", Labels: map[string]string{"env": "prod"}},
+			},
+		},
+		{
+			name: "rename legacy metric",
+			cfg: config.Relabel{Rules: []config.RelabelRule{
+				{SourceLabels: []string{"__name__"}, Regex: "legacy_(.*)", TargetLabel: "__name__", Replacement: ptr("app_$1")},
+			}},
+			input:    []models.Metric{{Name: "legacy_requests", Value: 5}, {Name: "cpu", Value: 1}},
+			expected: []models.Metric{{Name: "app_requests", Value: 5}, {Name: "cpu", Value: 1}},
+		},
+		{
+			name: "replace with empty result deletes label",
+			cfg: config.Relabel{Rules: []config.RelabelRule{
+				{SourceLabels: []string{"path"}, Regex: "/users/.*", TargetLabel: "path", Replacement: ptr("")},
+			}},
+			input:    []models.Metric{{Name: "hits", Labels: map[string]string{"path": "/users/42", "code": "200"}}},
+			expected: []models.Metric{{Name: "hits", Labels: map[string]string{"code": "200"}}},
+		},
+		{
+			name: "labeldrop and labelmap",
+			cfg: config.Relabel{Rules: []config.RelabelRule{
+				{Action: ActionLabelDrop, Regex: "request_id|trace_.*"},
+				{Action: ActionLabelMap, Regex: "meta_(.+)"},
+			}},
+			input: []models.Metric{{Name: "hits", Labels: map[string]string{
+				"request_id": "abc", "trace_span": "1", "meta_team": "core",
+			}}},
+			expected: []models.Metric{{Name: "hits", Labels: map[string]string{"meta_team": "core", "team": "core"}}},
+		},
+		{
+			name: "hashmod with temporary label",
+			cfg: config.Relabel{Rules: []config.RelabelRule{
+				{Action: ActionHashMod, SourceLabels: []string{"instance"}, TargetLabel: "__shard", Modulus: 1},
+				{SourceLabels: []string{"__shard"}, TargetLabel: "shard"},
+			}},
+			input:    []models.Metric{{Name: "cpu", Labels: map[string]string{"instance": "a"}}},
+			expected: []models.Metric{{Name: "cpu", Labels: map[string]string{"instance": "a", "shard": "0"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.cfg, nil)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.expected, p.Process(tt.input))
+		})
+	}
+}
+
+func TestPipeline_Counters(t *testing.T) {
+	reg := telemetry.NewRegistry()
+
+	p, err := New(config.Relabel{
+		Deny:  []string{"debug_.*"},
+		Rules: []config.RelabelRule{{Action: ActionDrop, SourceLabels: []string{"env"}, Regex: "dev"}},
+	}, reg)
+	require.NoError(t, err)
+
+	p.Process([]models.Metric{
+		{Name: "debug_x"},
+		{Name: "cpu", Labels: map[string]string{"env": "dev"}},
+		{Name: "cpu", Labels: map[string]string{"env": "prod"}},
+	})
+
+	snapshot := reg.Snapshot()
+	require.Equal(t, 1.0, snapshot[`metric_server_relabel_filtered_total{list="deny"}`])
+	require.Equal(t, 1.0, snapshot[`metric_server_relabel_rule_dropped_total{rule="0",action="drop"}`])
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Relabel
+	}{
+		{name: "invalid allow regex", cfg: config.Relabel{Allow: []string{"("}}},
+		{name: "unknown action", cfg: config.Relabel{Rules: []config.RelabelRule{{Action: "explode"}}}},
+		{name: "replace without target", cfg: config.Relabel{Rules: []config.RelabelRule{{Action: ActionReplace}}}},
+		{name: "hashmod without modulus", cfg: config.Relabel{Rules: []config.RelabelRule{{Action: ActionHashMod, TargetLabel: "x"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg, nil)
+			require.Error(t, err)
+		})
+	}
+}
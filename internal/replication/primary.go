@@ -0,0 +1,257 @@
+// Package replication keeps hot standbys of the in-memory store. A primary
+// streams every change of its store to replicas over a long-lived HTTP
+// response; a replica catches up from a snapshot of the primary on every
+// (re)connection, then applies the changes as they come. Replicas refuse
+// writes and do not flush until promoted, after which they act as primary
+// with the unflushed window of the former primary still in memory.
+package replication
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// StreamPath is the internal endpoint streaming the changes of the primary.
+const StreamPath = "/internal/replication/stream"
+
+// Roles of an instance.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// Replication defaults applied to unset configuration values.
+const (
+	DefaultBufferSize = 1024
+	DefaultHeartbeat  = 5 * time.Second
+)
+
+// snapshotFrameSize is the number of mutations per frame of a snapshot.
+const snapshotFrameSize = 10000
+
+// errSlowReplica ends the stream of a replica whose buffer overflowed.
+var errSlowReplica = errors.New("replica fell behind")
+
+// MemStorage defines an interface for the in-memory store being replicated.
+type MemStorage interface {
+	Dump() []storage.Mutation
+	Apply(mutations []storage.Mutation)
+}
+
+// frame is a message of the replication stream, encoded as MessagePack.
+// Snapshot frames together make up the snapshot sent first; the frame
+// following them, possibly empty, ends it. Empty frames are heartbeats.
+type frame struct {
+	Mutations []storage.Mutation `json:"mutations,omitempty"`
+	Snapshot  bool               `json:"snapshot,omitempty"`
+}
+
+// Primary streams the changes of the store to connected replicas.
+type Primary struct {
+	mem        MemStorage
+	bufferSize int
+	heartbeat  time.Duration
+	log        *slog.Logger
+
+	mu       sync.RWMutex
+	replicas map[*subscription]struct{}
+	closed   bool
+
+	connected    *telemetry.Gauge
+	streamed     *telemetry.Counter
+	disconnected *telemetry.Counter
+}
+
+// subscription is the buffer of changes of a connected replica.
+type subscription struct {
+	changes chan []storage.Mutation
+	done    chan struct{}
+	err     error
+}
+
+// NewPrimary creates a Primary streaming the changes of mem, which are
+// published to it by Publish.
+func NewPrimary(cfg config.Replication, mem MemStorage, reg *telemetry.Registry, log *slog.Logger) *Primary {
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	return &Primary{
+		mem:        mem,
+		bufferSize: bufferSize,
+		heartbeat:  heartbeat(cfg),
+		log:        log,
+		replicas:   make(map[*subscription]struct{}),
+		connected: reg.Gauge("metric_server_replication_replicas",
+			"Number of replicas connected to this instance."),
+		streamed: reg.Counter("metric_server_replication_streamed_mutations_total",
+			"Total number of store changes queued for replicas."),
+		disconnected: reg.Counter("metric_server_replication_slow_replicas_total",
+			"Total number of replicas disconnected for falling behind."),
+	}
+}
+
+func heartbeat(cfg config.Replication) time.Duration {
+	if cfg.Heartbeat <= 0 {
+		return DefaultHeartbeat
+	}
+	return cfg.Heartbeat
+}
+
+// Publish queues changes for every connected replica. It is meant to be
+// registered as a storage mutation listener and never blocks on replicas: a
+// replica whose buffer is full is disconnected and catches up on reconnection.
+func (p *Primary) Publish(mutations []storage.Mutation) {
+	var slow []*subscription
+
+	p.mu.RLock()
+	for sub := range p.replicas {
+		select {
+		case sub.changes <- mutations:
+			p.streamed.Add(float64(len(mutations)))
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	p.mu.RUnlock()
+
+	for _, sub := range slow {
+		if p.remove(sub, errSlowReplica) {
+			p.disconnected.Inc()
+		}
+	}
+}
+
+// Close disconnects all replicas and refuses new ones.
+func (p *Primary) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for sub := range p.replicas {
+		close(sub.done)
+	}
+	clear(p.replicas)
+	p.closed = true
+	p.connected.Set(0)
+}
+
+func (p *Primary) subscribe() *subscription {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	sub := &subscription{
+		changes: make(chan []storage.Mutation, p.bufferSize),
+		done:    make(chan struct{}),
+	}
+	p.replicas[sub] = struct{}{}
+	p.connected.Set(float64(len(p.replicas)))
+
+	return sub
+}
+
+// remove unregisters sub, ending its stream with err, and reports whether it
+// was still registered.
+func (p *Primary) remove(sub *subscription, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.replicas[sub]; !ok {
+		return false
+	}
+	delete(p.replicas, sub)
+	p.connected.Set(float64(len(p.replicas)))
+	sub.err = err
+	close(sub.done)
+
+	return true
+}
+
+// ServeHTTP streams a snapshot of the store followed by its changes until the
+// replica disconnects, falls behind or the primary is closed.
+func (p *Primary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Changes are buffered from before the snapshot is taken, so none is
+	// missed; those already part of the snapshot are applied twice, harmlessly.
+	sub := p.subscribe()
+	if sub == nil {
+		http.Error(w, "replication closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer p.remove(sub, nil)
+
+	rc := http.NewResponseController(w)
+	log := logger.FromContext(r.Context())
+
+	// Streams outlive the server's write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Warn("failed to clear write deadline", logger.Err(err))
+	}
+
+	w.Header().Set("Content-Type", codec.ContentTypeMsgpack)
+	w.WriteHeader(http.StatusOK)
+
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+
+	send := func(f frame) error {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	dump := p.mem.Dump()
+	for start := 0; start < len(dump); start += snapshotFrameSize {
+		if err := send(frame{Mutations: dump[start:min(start+snapshotFrameSize, len(dump))], Snapshot: true}); err != nil {
+			log.Warn("failed to send snapshot to replica", logger.Err(err))
+			return
+		}
+	}
+	log.Info("replica connected", slog.Int("snapshot", len(dump)))
+
+	heartbeat := time.NewTicker(p.heartbeat)
+	defer heartbeat.Stop()
+
+	// The first frame after the snapshot ends it.
+	if err := send(frame{}); err != nil {
+		log.Warn("replica gone", logger.Err(err))
+		return
+	}
+
+	for {
+		var f frame
+
+		select {
+		case <-r.Context().Done():
+			log.Info("replica disconnected")
+			return
+		case <-sub.done:
+			if sub.err != nil {
+				log.Warn("disconnecting replica", logger.Err(sub.err))
+			}
+			return
+		case <-heartbeat.C:
+		case f.Mutations = <-sub.changes:
+		}
+
+		if err := send(f); err != nil {
+			log.Warn("replica gone", logger.Err(err))
+			return
+		}
+	}
+}
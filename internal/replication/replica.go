@@ -0,0 +1,212 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// Reconnection backoff bounds of a replica.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// missedHeartbeats is the number of heartbeats without any frame after which
+// a replica considers the connection dead.
+const missedHeartbeats = 3
+
+// Replica follows a primary, applying its changes to the local store until promoted.
+type Replica struct {
+	primary   string
+	token     string
+	heartbeat time.Duration
+	mem       MemStorage
+	http      *http.Client
+	log       *slog.Logger
+
+	promoted chan struct{}
+	promote  sync.Once
+
+	connected   *telemetry.Gauge
+	applied     *telemetry.Counter
+	reconnects  *telemetry.Counter
+	lastReceive *telemetry.Gauge
+}
+
+// ReplicaOption configures optional Replica behaviour.
+type ReplicaOption func(*Replica)
+
+// WithToken sets the bearer token authenticating the replica to its primary.
+func WithToken(token string) ReplicaOption {
+	return func(r *Replica) {
+		r.token = token
+	}
+}
+
+// NewReplica creates a Replica of the primary configured in cfg, applying its
+// changes to mem.
+func NewReplica(
+	cfg config.Replication, mem MemStorage, reg *telemetry.Registry, log *slog.Logger, opts ...ReplicaOption,
+) (*Replica, error) {
+	if cfg.Primary == "" {
+		return nil, errors.New("replication primary is required for a replica")
+	}
+
+	r := &Replica{
+		primary:   strings.TrimSuffix(cfg.Primary, "/"),
+		heartbeat: heartbeat(cfg),
+		mem:       mem,
+		http:      &http.Client{},
+		log:       log,
+		promoted:  make(chan struct{}),
+		connected: reg.Gauge("metric_server_replication_connected",
+			"Whether this replica is connected to its primary."),
+		applied: reg.Counter("metric_server_replication_applied_mutations_total",
+			"Total number of changes of the primary applied by this replica."),
+		reconnects: reg.Counter("metric_server_replication_reconnects_total",
+			"Total number of interrupted connections of this replica to its primary."),
+		lastReceive: reg.Gauge("metric_server_replication_last_receive_timestamp_seconds",
+			"Unix time of the last message received from the primary."),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// ReadOnly reports whether the replica still follows its primary.
+func (r *Replica) ReadOnly() bool {
+	select {
+	case <-r.promoted:
+		return false
+	default:
+		return true
+	}
+}
+
+// Promote stops following the primary, making this instance a primary. It is
+// idempotent.
+func (r *Replica) Promote() {
+	r.promote.Do(func() {
+		close(r.promoted)
+		r.log.Info("replica promoted to primary")
+	})
+}
+
+// Run follows the primary until the context is canceled or the replica is
+// promoted, reconnecting with exponential backoff whenever the stream breaks.
+func (r *Replica) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.promoted:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := minBackoff
+	for {
+		synced, err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if synced {
+			backoff = minBackoff
+		}
+		r.reconnects.Inc()
+		r.log.Warn("replication stream interrupted", slog.Duration("retry_in", backoff), logger.Err(err))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// follow applies the stream of the primary until it breaks and reports
+// whether the snapshot was applied before.
+func (r *Replica) follow(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.primary+StreamPath, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+
+	// Frames come at least every heartbeat; a silent connection is dead.
+	timeout := missedHeartbeats * r.heartbeat
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("primary returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	r.connected.Set(1)
+	defer r.connected.Set(0)
+
+	dec := msgpack.NewDecoder(resp.Body)
+	dec.SetCustomStructTag("json")
+
+	var (
+		snapshot []storage.Mutation
+		synced   bool
+	)
+	for {
+		var f frame
+		if err = dec.Decode(&f); err != nil {
+			return synced, err
+		}
+		watchdog.Reset(timeout)
+		r.lastReceive.Set(float64(time.Now().Unix()))
+
+		// The snapshot is applied at once rather than as it arrives, keeping the
+		// window in which reads see it partly short.
+		if f.Snapshot {
+			snapshot = append(snapshot, f.Mutations...)
+			continue
+		}
+		if !synced {
+			r.apply(snapshot)
+			r.log.Info("caught up with primary", slog.String("primary", r.primary), slog.Int("snapshot", len(snapshot)))
+			snapshot, synced = nil, true
+		}
+		r.apply(f.Mutations)
+	}
+}
+
+func (r *Replica) apply(mutations []storage.Mutation) {
+	if len(mutations) == 0 {
+		return
+	}
+	r.mem.Apply(mutations)
+	r.applied.Add(float64(len(mutations)))
+}
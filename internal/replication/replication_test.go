@@ -0,0 +1,205 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/http-server/handler"
+	"github.com/sanchey92/metric-server/internal/http-server/router"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/pkg/client"
+)
+
+// token authenticates replicas and administrative requests.
+const token = "secret"
+
+// instance is an in-process metric server serving the real router.
+type instance struct {
+	srv     *httptest.Server
+	mem     *storage.MemStorage
+	replica *Replica
+	client  *client.Client
+}
+
+// start runs an instance, following cfg.Primary if set.
+func start(t *testing.T, cfg config.Replication) *instance {
+	t.Helper()
+
+	log := slog.New(slog.DiscardHandler)
+	mem := storage.NewMemStorage(4)
+	primary := NewPrimary(cfg, mem, nil, log)
+	mem.AddMutationListener(primary.Publish)
+
+	opts := []handler.Option{handler.WithValues(mem)}
+	var replica *Replica
+	if cfg.Primary != "" {
+		var err error
+		replica, err = NewReplica(cfg, mem, nil, log, WithToken(token))
+		require.NoError(t, err)
+		opts = append(opts, handler.WithReplica(replica))
+	}
+	h := handler.New(mem, opts...)
+
+	srv := httptest.NewServer(router.New(log, h,
+		router.WithAdminToken(token),
+		router.WithOps(h),
+		router.WithReplication(h.HandlePromote, StreamPath, primary),
+	))
+	t.Cleanup(srv.Close)
+	t.Cleanup(primary.Close)
+
+	c, err := client.New(srv.URL)
+	require.NoError(t, err)
+
+	return &instance{srv: srv, mem: mem, replica: replica, client: c}
+}
+
+func metrics(from, to int) []models.Metric {
+	res := make([]models.Metric, 0, to-from)
+	for i := from; i < to; i++ {
+		res = append(res, models.Metric{
+			Name: "load", Value: float64(i), Labels: map[string]string{"host": strconv.Itoa(i)},
+			Timestamp: time.Now().UnixMilli(),
+		})
+	}
+	return res
+}
+
+func push(t *testing.T, in *instance, from, to int) {
+	t.Helper()
+	require.NoError(t, in.client.Push(context.Background(), metrics(from, to)))
+}
+
+// requireReplicated waits until the replica holds the same store as the primary.
+func requireReplicated(t *testing.T, primary, replica *instance) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		want, got := primary.mem.Dump(), replica.mem.Dump()
+		return len(want) == len(got) && sameMutations(want[1:], got[1:])
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// sameMutations reports whether both contain the same mutations in any order,
+// times being compared regardless of their location.
+func sameMutations(want, got []storage.Mutation) bool {
+	count := make(map[storage.Mutation]int, len(want))
+	for _, m := range want {
+		m.Sample.Timestamp = m.Sample.Timestamp.UTC()
+		count[m]++
+	}
+	for _, m := range got {
+		m.Sample.Timestamp = m.Sample.Timestamp.UTC()
+		if count[m] == 0 {
+			return false
+		}
+		count[m]--
+	}
+	return true
+}
+
+func TestReplication(t *testing.T) {
+	cfg := config.Replication{Heartbeat: 50 * time.Millisecond}
+	primary := start(t, cfg)
+	push(t, primary, 0, 10)
+
+	cfg.Primary = primary.srv.URL
+	replica := start(t, cfg)
+	replicator := replica.replica
+
+	done := make(chan error, 1)
+	go func() { done <- replicator.Run(context.Background()) }()
+
+	// Catch-up from the snapshot, then live changes.
+	requireReplicated(t, primary, replica)
+	push(t, primary, 10, 20)
+	requireReplicated(t, primary, replica)
+
+	// Flushes and expiry on the primary are replayed.
+	primary.mem.Pending()
+	primary.mem.DeleteStale(time.Now().Add(time.Hour), func(string) time.Duration { return time.Minute }, false)
+	requireReplicated(t, primary, replica)
+	require.Zero(t, replica.mem.Len())
+
+	// The replica refuses writes.
+	var apiErr *client.APIError
+	require.ErrorAs(t, replica.client.Push(context.Background(), []models.Metric{{Name: "x", Value: 1}}), &apiErr)
+	require.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+
+	// After a broken connection the replica catches up again.
+	primary.srv.CloseClientConnections()
+	primary.mem.SetBatch(metrics(20, 30))
+	requireReplicated(t, primary, replica)
+	require.Positive(t, replicator.reconnects.Value())
+
+	// Once promoted, the replica stops following and accepts writes.
+	req, err := http.NewRequest(http.MethodPost, replica.srv.URL+"/admin/promote", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var role struct {
+		Role string `json:"role"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&role))
+	require.Equal(t, RolePrimary, role.Role)
+
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica still following after promotion")
+	}
+	require.False(t, replicator.ReadOnly())
+
+	primary.mem.SetBatch(metrics(30, 40))
+	push(t, replica, 100, 101)
+	require.Equal(t, 11, replica.mem.Len())
+}
+
+func TestReplication_Unauthenticated(t *testing.T) {
+	primary := start(t, config.Replication{})
+
+	resp, err := http.Get(primary.srv.URL + StreamPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Post(primary.srv.URL+"/admin/promote", "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestPrimary_SlowReplica(t *testing.T) {
+	p := NewPrimary(config.Replication{BufferSize: 1}, storage.NewMemStorage(1), nil, slog.New(slog.DiscardHandler))
+	sub := p.subscribe()
+
+	p.Publish([]storage.Mutation{{Op: storage.OpFlush}})
+	p.Publish([]storage.Mutation{{Op: storage.OpFlush}})
+
+	<-sub.done
+	require.ErrorIs(t, sub.err, errSlowReplica)
+	require.Equal(t, float64(1), p.disconnected.Value())
+	require.Empty(t, p.replicas)
+
+	p.Close()
+	require.Nil(t, p.subscribe())
+}
+
+func TestNewReplica_PrimaryRequired(t *testing.T) {
+	_, err := NewReplica(config.Replication{Role: RoleReplica}, nil, nil, slog.Default())
+	require.Error(t, err)
+}
@@ -0,0 +1,302 @@
+// Package retention provides expiry of stale and historical metric data.
+// A Policy maps metric names to TTLs using a default and ordered glob/regex
+// overrides; a Job periodically applies it to the in-memory store and to the
+// history kept in PostgreSQL, optionally only reporting what it would delete.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// MemStorage defines the interface for in-memory storage whose stale series can be expired.
+type MemStorage interface {
+	DeleteStale(now time.Time, ttl func(name string) time.Duration, dryRun bool) []string
+}
+
+// HistoryStorage defines the interface for persistent storage whose history can be expired.
+// Names are selected by an include expression and a list of expressions to exclude.
+type HistoryStorage interface {
+	ExpireHistory(
+		ctx context.Context, include string, exclude []string, cutoff time.Time, dryRun bool,
+	) (models.ExpireStats, error)
+}
+
+// Rule is a single retention override.
+type Rule struct {
+	Pattern          string
+	re               *regexp.Regexp
+	MemoryTTL        time.Duration
+	HistoryTTL       time.Duration
+	OutOfOrderWindow time.Duration
+}
+
+// Policy resolves the retention TTLs for metric names.
+type Policy struct {
+	rules []Rule
+	def   config.RetentionTTL
+}
+
+// NewPolicy builds a Policy from configuration, compiling glob patterns into
+// anchored regular expressions.
+func NewPolicy(cfg config.Retention) (*Policy, error) {
+	p := &Policy{def: cfg.Default}
+
+	for i, r := range cfg.Rules {
+		var pattern string
+		switch {
+		case r.Match != "" && r.Regex != "":
+			return nil, fmt.Errorf("retention rule %d: match and regex are mutually exclusive", i)
+		case r.Match != "":
+			pattern = globToRegex(r.Match)
+		case r.Regex != "":
+			pattern = r.Regex
+		default:
+			return nil, fmt.Errorf("retention rule %d: match or regex is required", i)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %d: %w", i, err)
+		}
+
+		p.rules = append(p.rules, Rule{
+			Pattern:          pattern,
+			re:               re,
+			MemoryTTL:        r.MemoryTTL,
+			HistoryTTL:       r.HistoryTTL,
+			OutOfOrderWindow: r.OutOfOrderWindow,
+		})
+	}
+
+	return p, nil
+}
+
+// globToRegex converts a glob pattern ("*" and "?" wildcards) into an anchored regular expression.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
+
+// rule returns the first rule matching name, or nil if the default applies.
+func (p *Policy) rule(name string) *Rule {
+	for i := range p.rules {
+		if p.rules[i].re.MatchString(name) {
+			return &p.rules[i]
+		}
+	}
+	return nil
+}
+
+// MemoryTTL returns how long the named series is kept in memory without updates.
+func (p *Policy) MemoryTTL(name string) time.Duration {
+	if r := p.rule(name); r != nil {
+		return r.MemoryTTL
+	}
+	return p.def.MemoryTTL
+}
+
+// HistoryTTL returns how long the named series' history is kept.
+func (p *Policy) HistoryTTL(name string) time.Duration {
+	if r := p.rule(name); r != nil {
+		return r.HistoryTTL
+	}
+	return p.def.HistoryTTL
+}
+
+// OutOfOrderWindow returns how far behind the latest time of the named series
+// a timestamped sample may arrive and still be written to history.
+func (p *Policy) OutOfOrderWindow(name string) time.Duration {
+	if r := p.rule(name); r != nil {
+		return r.OutOfOrderWindow
+	}
+	return p.def.OutOfOrderWindow
+}
+
+// RuleReport describes the history expired (or expirable) by one rule.
+type RuleReport struct {
+	Rule   string             `json:"rule"`
+	Cutoff time.Time          `json:"cutoff"`
+	Stats  models.ExpireStats `json:"stats"`
+}
+
+// Report describes the outcome of a retention run.
+type Report struct {
+	DryRun         bool         `json:"dry_run"`
+	Time           time.Time    `json:"time"`
+	ExpiredSeries  []string     `json:"expired_series"`
+	ExpiredHistory []RuleReport `json:"expired_history"`
+}
+
+// Job periodically applies a Policy to memory and history storage.
+type Job struct {
+	interval time.Duration
+	dryRun   bool
+	policy   *Policy
+	mem      MemStorage
+	history  HistoryStorage
+	log      *slog.Logger
+	onExpire []func(names []string)
+	active   func() bool
+}
+
+// Option configures optional Job behavior.
+type Option func(*Job)
+
+// WithExpireHook registers fn to be called with the names of series removed
+// from memory, so that components tracking series can release them.
+func WithExpireHook(fn func(names []string)) Option {
+	return func(j *Job) {
+		j.onExpire = append(j.onExpire, fn)
+	}
+}
+
+// WithHistoryActive only expires history while active reports true, such as
+// on the leader of several instances sharing the database. Memory is expired
+// regardless, and dry runs report on history as well.
+func WithHistoryActive(active func() bool) Option {
+	return func(j *Job) {
+		j.active = active
+	}
+}
+
+// NewJob creates a new retention Job. A nil history storage limits it to memory.
+func NewJob(
+	interval time.Duration, dryRun bool, policy *Policy, mem MemStorage, history HistoryStorage, log *slog.Logger,
+	opts ...Option,
+) *Job {
+	j := &Job{
+		interval: interval,
+		dryRun:   dryRun,
+		policy:   policy,
+		mem:      mem,
+		history:  history,
+		log:      log,
+	}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+// Run applies the policy on every interval tick and blocks until the context is canceled.
+func (j *Job) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			report, err := j.Apply(ctx, j.dryRun)
+			if err != nil {
+				j.log.Error("retention run failed", logger.Err(err))
+				continue
+			}
+			j.logReport(report)
+		}
+	}
+}
+
+// Apply runs the policy once. With dryRun set, nothing is deleted and the report
+// lists what would have been.
+func (j *Job) Apply(ctx context.Context, dryRun bool) (Report, error) {
+	now := time.Now().UTC()
+
+	report := Report{
+		DryRun:        dryRun,
+		Time:          now,
+		ExpiredSeries: j.mem.DeleteStale(now, j.policy.MemoryTTL, dryRun),
+	}
+
+	if !dryRun && len(report.ExpiredSeries) > 0 {
+		for _, fn := range j.onExpire {
+			fn(report.ExpiredSeries)
+		}
+	}
+
+	if j.history == nil || (!dryRun && j.active != nil && !j.active()) {
+		return report, nil
+	}
+
+	// Each rule only covers names not claimed by an earlier rule, so that the
+	// first-match-wins semantics of the in-memory policy hold in SQL as well.
+	exclude := make([]string, 0, len(j.policy.rules))
+	for _, r := range j.policy.rules {
+		if r.HistoryTTL > 0 {
+			rr, err := j.expire(ctx, r.Pattern, exclude, now.Add(-r.HistoryTTL), dryRun)
+			if err != nil {
+				return report, err
+			}
+			report.ExpiredHistory = append(report.ExpiredHistory, rr)
+		}
+		exclude = append(exclude, r.Pattern)
+	}
+
+	if j.policy.def.HistoryTTL > 0 {
+		rr, err := j.expire(ctx, "", exclude, now.Add(-j.policy.def.HistoryTTL), dryRun)
+		if err != nil {
+			return report, err
+		}
+		report.ExpiredHistory = append(report.ExpiredHistory, rr)
+	}
+
+	return report, nil
+}
+
+func (j *Job) expire(
+	ctx context.Context, include string, exclude []string, cutoff time.Time, dryRun bool,
+) (RuleReport, error) {
+	stats, err := j.history.ExpireHistory(ctx, include, exclude, cutoff, dryRun)
+	if err != nil {
+		return RuleReport{}, err
+	}
+
+	rule := include
+	if rule == "" {
+		rule = "default"
+	}
+
+	return RuleReport{Rule: rule, Cutoff: cutoff, Stats: stats}, nil
+}
+
+func (j *Job) logReport(report Report) {
+	msg := "retention applied"
+	if report.DryRun {
+		msg = "retention dry run"
+	}
+
+	attrs := []any{slog.Int("expired_series", len(report.ExpiredSeries))}
+	for _, rr := range report.ExpiredHistory {
+		attrs = append(attrs, slog.Group(rr.Rule,
+			slog.Int64("samples", rr.Stats.Samples),
+			slog.Int64("rollups", rr.Stats.Rollups),
+			slog.Int64("series", rr.Stats.Series),
+		))
+	}
+
+	j.log.Info(msg, attrs...)
+}
@@ -0,0 +1,175 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/retention/mocks"
+)
+
+func TestPolicy_TTL(t *testing.T) {
+	policy, err := NewPolicy(config.Retention{
+		Default: config.RetentionTTL{MemoryTTL: time.Hour, HistoryTTL: 30 * 24 * time.Hour},
+		Rules: []config.RetentionRule{
+			{Match: "debug.*", RetentionTTL: config.RetentionTTL{MemoryTTL: time.Minute}},
+			{Regex: "^debug\\.keep", RetentionTTL: config.RetentionTTL{MemoryTTL: 0}},
+			{Regex: "^tmp_[0-9]+$", RetentionTTL: config.RetentionTTL{MemoryTTL: 5 * time.Minute}},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		expected time.Duration
+	}{
+		{name: "cpu", expected: time.Hour},
+		{name: "debug.requests", expected: time.Minute},
+		{name: "debug.keep", expected: time.Minute},
+		{name: "debugXrequests", expected: time.Hour},
+		{name: "tmp_42", expected: 5 * time.Minute},
+		{name: "tmp_x", expected: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, policy.MemoryTTL(tt.name))
+		})
+	}
+}
+
+func TestPolicy_OutOfOrderWindow(t *testing.T) {
+	policy, err := NewPolicy(config.Retention{
+		Default: config.RetentionTTL{OutOfOrderWindow: 10 * time.Minute},
+		Rules: []config.RetentionRule{
+			{Match: "batch_*", RetentionTTL: config.RetentionTTL{OutOfOrderWindow: 24 * time.Hour}},
+			{Match: "strict_*"},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 10*time.Minute, policy.OutOfOrderWindow("cpu"))
+	require.Equal(t, 24*time.Hour, policy.OutOfOrderWindow(`batch_jobs{job="etl"}`))
+	require.Zero(t, policy.OutOfOrderWindow("strict_clock"))
+}
+
+func TestNewPolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RetentionRule
+	}{
+		{name: "no pattern", rule: config.RetentionRule{}},
+		{name: "both patterns", rule: config.RetentionRule{Match: "a*", Regex: "^a"}},
+		{name: "bad regex", rule: config.RetentionRule{Regex: "("}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy(config.Retention{Rules: []config.RetentionRule{tt.rule}})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestJob_Apply(t *testing.T) {
+	cfg := config.Retention{
+		Default: config.RetentionTTL{HistoryTTL: 24 * time.Hour},
+		Rules: []config.RetentionRule{
+			{Match: "keep.*"},
+			{Match: "debug.*", RetentionTTL: config.RetentionTTL{HistoryTTL: time.Hour}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		inactive    bool
+		setupMocks  func(*mocks.MockMemStorage, *mocks.MockHistoryStorage)
+		expectError bool
+		expectRules []string
+	}{
+		{
+			name:   "rules exclude earlier matches",
+			dryRun: false,
+			setupMocks: func(mem *mocks.MockMemStorage, history *mocks.MockHistoryStorage) {
+				mem.EXPECT().DeleteStale(gomock.Any(), gomock.Any(), false).Return([]string{"old"})
+				gomock.InOrder(
+					history.EXPECT().
+						ExpireHistory(gomock.Any(), `^debug\..*$`, []string{`^keep\..*$`}, gomock.Any(), false).
+						Return(models.ExpireStats{Samples: 3}, nil),
+					history.EXPECT().
+						ExpireHistory(gomock.Any(), "", []string{`^keep\..*$`, `^debug\..*$`}, gomock.Any(), false).
+						Return(models.ExpireStats{Samples: 5}, nil),
+				)
+			},
+			expectRules: []string{`^debug\..*$`, "default"},
+		},
+		{
+			name:   "dry run is passed through",
+			dryRun: true,
+			setupMocks: func(mem *mocks.MockMemStorage, history *mocks.MockHistoryStorage) {
+				mem.EXPECT().DeleteStale(gomock.Any(), gomock.Any(), true).Return(nil)
+				history.EXPECT().
+					ExpireHistory(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), true).
+					Return(models.ExpireStats{}, nil).Times(2)
+			},
+			expectRules: []string{`^debug\..*$`, "default"},
+		},
+		{
+			name:     "history is left to the active instance",
+			inactive: true,
+			setupMocks: func(mem *mocks.MockMemStorage, _ *mocks.MockHistoryStorage) {
+				mem.EXPECT().DeleteStale(gomock.Any(), gomock.Any(), false).Return([]string{"old"})
+			},
+		},
+		{
+			name: "history error",
+			setupMocks: func(mem *mocks.MockMemStorage, history *mocks.MockHistoryStorage) {
+				mem.EXPECT().DeleteStale(gomock.Any(), gomock.Any(), false).Return(nil)
+				history.EXPECT().
+					ExpireHistory(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), false).
+					Return(models.ExpireStats{}, errors.New("db down"))
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mem := mocks.NewMockMemStorage(ctrl)
+			history := mocks.NewMockHistoryStorage(ctrl)
+			tt.setupMocks(mem, history)
+
+			policy, err := NewPolicy(cfg)
+			require.NoError(t, err)
+
+			job := NewJob(time.Minute, false, policy, mem, history, slog.Default(),
+				WithHistoryActive(func() bool { return !tt.inactive }))
+
+			report, err := job.Apply(context.Background(), tt.dryRun)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.dryRun, report.DryRun)
+
+			var rules []string
+			for _, rr := range report.ExpiredHistory {
+				rules = append(rules, rr.Rule)
+			}
+			require.Equal(t, tt.expectRules, rules)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Package rollup provides downsampling of historical metric data. A background
+// Job periodically aggregates raw samples into progressively coarser resolutions
+// (for example 1m, 1h and 1d) and a Reader answers history queries from the
+// coarsest resolution that still satisfies the requested step.
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Store defines the interface for persistent storage able to aggregate and
+// query historical data. A source of 0 denotes raw samples.
+type Store interface {
+	Rollup(ctx context.Context, step, source time.Duration, from, to time.Time) (int64, error)
+	QueryAggregates(
+		ctx context.Context, name string, source, step time.Duration, start, end time.Time,
+	) ([]models.Aggregate, error)
+}
+
+// Resolution describes one rollup level: the bucket size and how often it is recomputed.
+type Resolution struct {
+	Step     time.Duration
+	Interval time.Duration
+}
+
+// Resolutions converts and validates the configured rollup resolutions. They are
+// returned sorted by step; every step must be a whole number of seconds and a
+// multiple of the previous one, since each level is built from the one below it.
+func Resolutions(cfg []config.RollupResolution) ([]Resolution, error) {
+	resolutions := make([]Resolution, 0, len(cfg))
+	for _, r := range cfg {
+		if r.Step < time.Second || r.Step%time.Second != 0 {
+			return nil, fmt.Errorf("rollup step %s must be a positive whole number of seconds", r.Step)
+		}
+
+		interval := r.Interval
+		if interval <= 0 {
+			interval = r.Step
+		}
+
+		resolutions = append(resolutions, Resolution{Step: r.Step, Interval: interval})
+	}
+
+	sort.Slice(resolutions, func(i, j int) bool { return resolutions[i].Step < resolutions[j].Step })
+
+	for i := 1; i < len(resolutions); i++ {
+		if resolutions[i].Step%resolutions[i-1].Step != 0 {
+			return nil, fmt.Errorf("rollup step %s is not a multiple of %s", resolutions[i].Step, resolutions[i-1].Step)
+		}
+	}
+
+	return resolutions, nil
+}
+
+// Job periodically rolls up historical data into the configured resolutions.
+type Job struct {
+	store       Store
+	resolutions []Resolution
+	log         *slog.Logger
+	active      func() bool
+}
+
+// Option configures optional Job behavior.
+type Option func(*Job)
+
+// WithActive only rolls up while active reports true, such as on the leader
+// of several instances sharing the database.
+func WithActive(active func() bool) Option {
+	return func(j *Job) {
+		j.active = active
+	}
+}
+
+// NewJob creates a new Job for the given resolutions, which must be sorted as returned by Resolutions.
+func NewJob(store Store, resolutions []Resolution, log *slog.Logger, opts ...Option) *Job {
+	j := &Job{
+		store:       store,
+		resolutions: resolutions,
+		log:         log,
+	}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+// Run starts one rollup loop per resolution and blocks until the context is canceled.
+func (j *Job) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	for i, res := range j.resolutions {
+		var source time.Duration
+		if i > 0 {
+			source = j.resolutions[i-1].Step
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.loop(ctx, res, source)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (j *Job) loop(ctx context.Context, res Resolution, source time.Duration) {
+	ticker := time.NewTicker(res.Interval)
+	defer ticker.Stop()
+
+	// The first window reaches back one interval so that buckets completed
+	// while the server was down for less than that are still rolled up.
+	lastRun := time.Now().Add(-res.Interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Windows passed while inactive were rolled up by the active instance.
+			if j.active != nil && !j.active() {
+				lastRun = now
+				continue
+			}
+			from := lastRun.Add(-res.Step).Truncate(res.Step)
+			if err := j.rollup(ctx, res.Step, source, from, now); err != nil {
+				j.log.Error("rollup failed", slog.Duration("step", res.Step), logger.Err(err))
+				continue
+			}
+			lastRun = now
+		}
+	}
+}
+
+func (j *Job) rollup(ctx context.Context, step, source time.Duration, from, to time.Time) error {
+	start := time.Now()
+
+	n, err := j.store.Rollup(ctx, step, source, from, to)
+	if err != nil {
+		return err
+	}
+
+	j.log.Debug("rolled up metrics",
+		slog.Duration("step", step),
+		slog.Int64("buckets", n),
+		slog.Duration("duration", time.Since(start)),
+	)
+
+	return nil
+}
+
+// Result is the answer to a history query together with the resolution it was served from.
+// A zero Resolution means the points were computed from raw samples.
+type Result struct {
+	Resolution time.Duration
+	Points     []models.Aggregate
+}
+
+// ErrInvalidRange is returned for queries with an empty time range or non-positive step.
+var ErrInvalidRange = errors.New("invalid query range")
+
+// Reader answers history queries, choosing the data source automatically.
+type Reader struct {
+	store       Store
+	resolutions []Resolution
+}
+
+// NewReader creates a new Reader over the given sorted resolutions.
+func NewReader(store Store, resolutions []Resolution) *Reader {
+	return &Reader{
+		store:       store,
+		resolutions: resolutions,
+	}
+}
+
+// Query returns the metric's values within [start, end) in buckets of step,
+// read from the coarsest resolution whose step divides the requested one.
+func (r *Reader) Query(ctx context.Context, name string, start, end time.Time, step time.Duration) (Result, error) {
+	if !end.After(start) || step < time.Second {
+		return Result{}, ErrInvalidRange
+	}
+
+	source := Pick(r.resolutions, step)
+
+	points, err := r.store.QueryAggregates(ctx, name, source, step, start, end)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{Resolution: source, Points: points}, nil
+}
+
+// Pick returns the coarsest resolution step that evenly divides the requested
+// step, or 0 (raw samples) if no resolution is fine enough.
+func Pick(resolutions []Resolution, step time.Duration) time.Duration {
+	var picked time.Duration
+	for _, res := range resolutions {
+		if res.Step <= step && step%res.Step == 0 {
+			picked = res.Step
+		}
+	}
+	return picked
+}
@@ -0,0 +1,75 @@
+package rollup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+)
+
+func TestResolutions(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         []config.RollupResolution
+		expected    []Resolution
+		expectError bool
+	}{
+		{
+			name: "sorted with default interval",
+			cfg: []config.RollupResolution{
+				{Step: time.Hour, Interval: 10 * time.Minute},
+				{Step: time.Minute},
+			},
+			expected: []Resolution{
+				{Step: time.Minute, Interval: time.Minute},
+				{Step: time.Hour, Interval: 10 * time.Minute},
+			},
+		},
+		{
+			name:        "step not a multiple of the finer one",
+			cfg:         []config.RollupResolution{{Step: time.Minute}, {Step: 90 * time.Second}},
+			expectError: true,
+		},
+		{
+			name:        "sub-second step",
+			cfg:         []config.RollupResolution{{Step: 500 * time.Millisecond}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Resolutions(tt.cfg)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, res)
+		})
+	}
+}
+
+func TestPick(t *testing.T) {
+	resolutions := []Resolution{{Step: time.Minute}, {Step: time.Hour}, {Step: 24 * time.Hour}}
+
+	tests := []struct {
+		step     time.Duration
+		expected time.Duration
+	}{
+		{step: 15 * time.Second, expected: 0},
+		{step: time.Minute, expected: time.Minute},
+		{step: 5 * time.Minute, expected: time.Minute},
+		{step: 90 * time.Second, expected: 0},
+		{step: 2 * time.Hour, expected: time.Hour},
+		{step: 7 * 24 * time.Hour, expected: 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step.String(), func(t *testing.T) {
+			require.Equal(t, tt.expected, Pick(resolutions, tt.step))
+		})
+	}
+}
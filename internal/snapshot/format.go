@@ -0,0 +1,214 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Version is the snapshot format version written by this package.
+const Version = 1
+
+// magic identifies snapshot files.
+var magic = []byte("MSNP")
+
+// ErrCorrupt is returned when a snapshot is malformed, truncated or fails its checksum.
+var ErrCorrupt = errors.New("corrupt snapshot")
+
+// Header describes a snapshot and the filter it was exported with.
+type Header struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Filter
+}
+
+// Stats counts the records of a snapshot.
+type Stats struct {
+	Series  int64 `json:"series"`
+	Samples int64 `json:"samples"`
+	Rollups int64 `json:"rollups"`
+}
+
+// footer closes a snapshot with its record counts and the SHA-256 checksum of
+// every uncompressed line preceding it.
+type footer struct {
+	Stats
+	Checksum string `json:"sha256"`
+}
+
+// Record is one entry of a snapshot: either the latest value of a series, a raw
+// history sample or a rollup bucket.
+type Record struct {
+	Series *models.Sample `json:"series,omitempty"`
+	Sample *models.Sample `json:"sample,omitempty"`
+	Rollup *models.Rollup `json:"rollup,omitempty"`
+}
+
+// line is the JSON encoding of every line following the header.
+type line struct {
+	Record
+	Footer *footer `json:"footer,omitempty"`
+}
+
+// Writer writes a snapshot: the magic bytes and version, followed by a gzip
+// stream of JSON lines holding the header, the records and the footer.
+type Writer struct {
+	gz    *gzip.Writer
+	hash  hash.Hash
+	enc   *json.Encoder
+	stats Stats
+}
+
+// NewWriter writes the snapshot preamble and header to w.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if _, err := w.Write(append(append([]byte(nil), magic...), Version)); err != nil {
+		return nil, err
+	}
+
+	sw := &Writer{gz: gzip.NewWriter(w), hash: sha256.New()}
+	sw.enc = json.NewEncoder(io.MultiWriter(sw.gz, sw.hash))
+
+	h.Version = Version
+	if err := sw.enc.Encode(h); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// Write appends a record.
+func (w *Writer) Write(rec Record) error {
+	count(&w.stats, rec)
+	return w.enc.Encode(line{Record: rec})
+}
+
+// Close writes the footer and flushes the compressed stream. It does not close
+// the underlying writer.
+func (w *Writer) Close() (Stats, error) {
+	f := &footer{Stats: w.stats, Checksum: hex.EncodeToString(w.hash.Sum(nil))}
+	if err := json.NewEncoder(w.gz).Encode(line{Footer: f}); err != nil {
+		return w.stats, err
+	}
+
+	return w.stats, w.gz.Close()
+}
+
+// Reader reads a snapshot written by Writer, verifying its checksum and
+// record counts when the footer is reached.
+type Reader struct {
+	r      *bufio.Reader
+	hash   hash.Hash
+	header Header
+	stats  Stats
+	done   bool
+}
+
+// NewReader checks the snapshot preamble and reads the header.
+func NewReader(r io.Reader) (*Reader, error) {
+	preamble := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return nil, fmt.Errorf("%w: missing preamble", ErrCorrupt)
+	}
+	if !bytes.Equal(preamble[:len(magic)], magic) {
+		return nil, fmt.Errorf("%w: not a snapshot file", ErrCorrupt)
+	}
+	if v := int(preamble[len(magic)]); v != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorrupt, v)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	sr := &Reader{r: bufio.NewReader(gz), hash: sha256.New()}
+
+	data, err := sr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &sr.header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %w", ErrCorrupt, err)
+	}
+	sr.hash.Write(data)
+
+	return sr, nil
+}
+
+// Header returns the snapshot header.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next record. It returns io.EOF after the footer has been
+// verified and an error wrapping ErrCorrupt if verification fails.
+func (r *Reader) Next() (Record, error) {
+	if r.done {
+		return Record{}, io.EOF
+	}
+
+	data, err := r.readLine()
+	if err != nil {
+		return Record{}, err
+	}
+
+	var l line
+	if err = json.Unmarshal(data, &l); err != nil {
+		return Record{}, fmt.Errorf("%w: invalid record: %w", ErrCorrupt, err)
+	}
+
+	if l.Footer != nil {
+		r.done = true
+		if err = r.verify(l.Footer); err != nil {
+			return Record{}, err
+		}
+		return Record{}, io.EOF
+	}
+
+	if l.Series == nil && l.Sample == nil && l.Rollup == nil {
+		return Record{}, fmt.Errorf("%w: empty record", ErrCorrupt)
+	}
+	r.hash.Write(data)
+	count(&r.stats, l.Record)
+
+	return l.Record, nil
+}
+
+func (r *Reader) verify(f *footer) error {
+	if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != f.Checksum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	if r.stats != f.Stats {
+		return fmt.Errorf("%w: record count mismatch", ErrCorrupt)
+	}
+
+	// Reading to the end makes gzip verify its own checksum.
+	if _, err := io.Copy(io.Discard, r.r); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	return nil
+}
+
+// readLine reads one line, including its terminating newline.
+func (r *Reader) readLine() ([]byte, error) {
+	data, err := r.r.ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: truncated", ErrCorrupt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	return data, nil
+}
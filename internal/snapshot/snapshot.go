@@ -0,0 +1,278 @@
+// Package snapshot exports the metric store into portable snapshot files and
+// restores them, to move data between environments or recover from a bad
+// migration. A snapshot holds the latest value of every series, merged from
+// memory and PostgreSQL, together with the raw sample history and the rollups.
+// Snapshots are gzip-compressed JSON lines ending with a SHA-256 checksum, and
+// are fully verified before anything is restored.
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// importBatchSize is the number of records written to the database at once.
+const importBatchSize = 1000
+
+// MemStorage defines an interface for reading and writing the in-memory series.
+type MemStorage interface {
+	Latest() []models.Sample
+	SetBatch(metrics []models.Metric)
+}
+
+// Database defines an interface for reading and writing the persisted store.
+// Scans restrict series keys by prefix and times to [start, end], zero bounds being open.
+type Database interface {
+	ScanSeries(ctx context.Context, prefix string, start, end time.Time, fn func(models.Sample) error) error
+	ScanSamples(ctx context.Context, prefix string, start, end time.Time, fn func(models.Sample) error) error
+	ScanRollups(ctx context.Context, prefix string, start, end time.Time, fn func(models.Rollup) error) error
+	ImportSeries(ctx context.Context, series []models.Sample) error
+	ImportSamples(ctx context.Context, samples []models.Sample) error
+	ImportRollups(ctx context.Context, rollups []models.Rollup) error
+}
+
+// Filter restricts a snapshot to the series whose key starts with Prefix and to
+// the data points within [Start, End]. A zero bound is open.
+type Filter struct {
+	Prefix string    `json:"prefix,omitempty"`
+	Start  time.Time `json:"start,omitzero"`
+	End    time.Time `json:"end,omitzero"`
+}
+
+// Match reports whether the point of the given series at ts passes the filter.
+func (f Filter) Match(key string, ts time.Time) bool {
+	return strings.HasPrefix(key, f.Prefix) &&
+		(f.Start.IsZero() || !ts.Before(f.Start)) &&
+		(f.End.IsZero() || !ts.After(f.End))
+}
+
+// Service exports and restores snapshots.
+type Service struct {
+	mem MemStorage
+	db  Database
+	log *slog.Logger
+}
+
+// New creates a Service over the given stores. mem may be nil, in which case
+// only the persisted store is exported and restored.
+func New(mem MemStorage, db Database, log *slog.Logger) *Service {
+	return &Service{mem: mem, db: db, log: log}
+}
+
+// Export writes a snapshot of the data passing the filter to w.
+func (s *Service) Export(ctx context.Context, w io.Writer, f Filter) (Stats, error) {
+	sw, err := NewWriter(w, Header{CreatedAt: time.Now().UTC(), Filter: f})
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	series, err := s.latest(ctx, f)
+	if err != nil {
+		return Stats{}, err
+	}
+	for i := range series {
+		if err = sw.Write(Record{Series: &series[i]}); err != nil {
+			return Stats{}, fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+
+	err = s.db.ScanSamples(ctx, f.Prefix, f.Start, f.End, func(sample models.Sample) error {
+		return sw.Write(Record{Sample: &sample})
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	err = s.db.ScanRollups(ctx, f.Prefix, f.Start, f.End, func(r models.Rollup) error {
+		return sw.Write(Record{Rollup: &r})
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats, err := sw.Close()
+	if err != nil {
+		return stats, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	s.log.Info("snapshot exported",
+		slog.Int64("series", stats.Series), slog.Int64("samples", stats.Samples), slog.Int64("rollups", stats.Rollups))
+
+	return stats, nil
+}
+
+// latest merges the persisted latest values with the in-memory ones, which are
+// never older, ordered by series key.
+func (s *Service) latest(ctx context.Context, f Filter) ([]models.Sample, error) {
+	merged := make(map[string]models.Sample)
+
+	err := s.db.ScanSeries(ctx, f.Prefix, f.Start, f.End, func(sample models.Sample) error {
+		merged[sample.Key] = sample
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.mem != nil {
+		for _, sample := range s.mem.Latest() {
+			if f.Match(sample.Key, sample.Timestamp) {
+				sample.Timestamp = sample.Timestamp.UTC()
+				merged[sample.Key] = sample
+			}
+		}
+	}
+
+	series := make([]models.Sample, 0, len(merged))
+	for _, sample := range merged {
+		series = append(series, sample)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Key < series[j].Key })
+
+	return series, nil
+}
+
+// Verify reads the whole snapshot and checks its integrity.
+func Verify(r io.Reader) (Header, Stats, error) {
+	var stats Stats
+
+	sr, err := NewReader(r)
+	if err != nil {
+		return Header{}, stats, err
+	}
+
+	for {
+		rec, err := sr.Next()
+		if errors.Is(err, io.EOF) {
+			return sr.Header(), stats, nil
+		}
+		if err != nil {
+			return sr.Header(), stats, err
+		}
+		count(&stats, rec)
+	}
+}
+
+// Restore verifies the snapshot read from r and then writes the records passing
+// the filter into the stores. Restoring is idempotent: series keep a value
+// newer than the snapshot's, history records replace existing ones. Restored
+// series are not subject to cardinality limits, as they were admitted before.
+func (s *Service) Restore(ctx context.Context, r io.ReadSeeker, f Filter) (Stats, error) {
+	if _, _, err := Verify(r); err != nil {
+		return Stats{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Stats{}, fmt.Errorf("failed to rewind snapshot: %w", err)
+	}
+
+	sr, err := NewReader(r)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var (
+		stats   Stats
+		series  []models.Sample
+		samples []models.Sample
+		rollups []models.Rollup
+	)
+
+	for {
+		rec, err := sr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		switch {
+		case rec.Series != nil && f.Match(rec.Series.Key, rec.Series.Timestamp):
+			series = append(series, *rec.Series)
+		case rec.Sample != nil && f.Match(rec.Sample.Key, rec.Sample.Timestamp):
+			samples = append(samples, *rec.Sample)
+		case rec.Rollup != nil && f.Match(rec.Rollup.Name, rec.Rollup.Time):
+			rollups = append(rollups, *rec.Rollup)
+		default:
+			continue
+		}
+		count(&stats, rec)
+
+		if len(samples) >= importBatchSize {
+			if err = s.db.ImportSamples(ctx, samples); err != nil {
+				return stats, err
+			}
+			samples = samples[:0]
+		}
+		if len(rollups) >= importBatchSize {
+			if err = s.db.ImportRollups(ctx, rollups); err != nil {
+				return stats, err
+			}
+			rollups = rollups[:0]
+		}
+	}
+
+	if err = s.db.ImportSamples(ctx, samples); err != nil {
+		return stats, err
+	}
+	if err = s.db.ImportRollups(ctx, rollups); err != nil {
+		return stats, err
+	}
+	if err = s.restoreSeries(ctx, series); err != nil {
+		return stats, err
+	}
+
+	s.log.Info("snapshot restored",
+		slog.Int64("series", stats.Series), slog.Int64("samples", stats.Samples), slog.Int64("rollups", stats.Rollups))
+
+	return stats, nil
+}
+
+// restoreSeries persists the latest values and loads them into memory with
+// their snapshot timestamps, so that newer values in memory are kept.
+func (s *Service) restoreSeries(ctx context.Context, series []models.Sample) error {
+	for start := 0; start < len(series); start += importBatchSize {
+		if err := s.db.ImportSeries(ctx, series[start:min(start+importBatchSize, len(series))]); err != nil {
+			return err
+		}
+	}
+
+	if s.mem == nil {
+		return nil
+	}
+
+	metrics := make([]models.Metric, 0, len(series))
+	for _, sample := range series {
+		name, labels, err := models.ParseSeriesKey(sample.Key)
+		if err != nil {
+			s.log.Warn("skipping series with invalid key", slog.String("key", sample.Key))
+			continue
+		}
+		metrics = append(metrics, models.Metric{
+			Name: name, Value: sample.Value, Labels: labels, Timestamp: sample.Timestamp.UnixMilli(),
+		})
+	}
+	s.mem.SetBatch(metrics)
+
+	return nil
+}
+
+// count adds the record to the stats.
+func count(stats *Stats, rec Record) {
+	switch {
+	case rec.Series != nil:
+		stats.Series++
+	case rec.Sample != nil:
+		stats.Samples++
+	case rec.Rollup != nil:
+		stats.Rollups++
+	}
+}
@@ -0,0 +1,225 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/storage"
+)
+
+var t0 = time.Unix(1_700_000_000, 0).UTC()
+
+// fakeDB keeps the persisted store in slices and applies scan filters like PostgreSQL.
+type fakeDB struct {
+	series  []models.Sample
+	samples []models.Sample
+	rollups []models.Rollup
+}
+
+func (db *fakeDB) ScanSeries(_ context.Context, prefix string, start, end time.Time, fn func(models.Sample) error) error {
+	return scan(db.series, Filter{Prefix: prefix, Start: start, End: end}, fn)
+}
+
+func (db *fakeDB) ScanSamples(_ context.Context, prefix string, start, end time.Time, fn func(models.Sample) error) error {
+	return scan(db.samples, Filter{Prefix: prefix, Start: start, End: end}, fn)
+}
+
+func (db *fakeDB) ScanRollups(_ context.Context, prefix string, start, end time.Time, fn func(models.Rollup) error) error {
+	f := Filter{Prefix: prefix, Start: start, End: end}
+	for _, r := range db.rollups {
+		if f.Match(r.Name, r.Time) {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scan(samples []models.Sample, f Filter, fn func(models.Sample) error) error {
+	for _, s := range samples {
+		if f.Match(s.Key, s.Timestamp) {
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) ImportSeries(_ context.Context, series []models.Sample) error {
+	db.series = append(db.series, series...)
+	return nil
+}
+
+func (db *fakeDB) ImportSamples(_ context.Context, samples []models.Sample) error {
+	db.samples = append(db.samples, samples...)
+	return nil
+}
+
+func (db *fakeDB) ImportRollups(_ context.Context, rollups []models.Rollup) error {
+	db.rollups = append(db.rollups, rollups...)
+	return nil
+}
+
+// fakeMem is an in-memory store holding the latest values.
+type fakeMem struct {
+	latest []models.Sample
+	set    []models.Metric
+}
+
+func (m *fakeMem) Latest() []models.Sample { return m.latest }
+
+func (m *fakeMem) SetBatch(metrics []models.Metric) { m.set = append(m.set, metrics...) }
+
+func source() (*fakeMem, *fakeDB) {
+	mem := &fakeMem{latest: []models.Sample{
+		{Key: `cpu{host="a"}`, Value: 3, Timestamp: t0.Add(2 * time.Minute)},
+	}}
+	db := &fakeDB{
+		series: []models.Sample{
+			{Key: `cpu{host="a"}`, Value: 2, Timestamp: t0.Add(time.Minute)},
+			{Key: "mem", Value: 10, Timestamp: t0},
+		},
+		samples: []models.Sample{
+			{Key: `cpu{host="a"}`, Value: 1, Timestamp: t0},
+			{Key: `cpu{host="a"}`, Value: 2, Timestamp: t0.Add(time.Minute)},
+			{Key: "mem", Value: 10, Timestamp: t0},
+		},
+		rollups: []models.Rollup{
+			{Resolution: 60, Name: `cpu{host="a"}`, Aggregate: models.Aggregate{Time: t0, Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2}},
+		},
+	}
+	return mem, db
+}
+
+func TestService_ExportRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		export   Filter
+		restore  Filter
+		expected Stats
+	}{
+		{name: "everything", expected: Stats{Series: 2, Samples: 3, Rollups: 1}},
+		{name: "prefix on export", export: Filter{Prefix: "cpu"}, expected: Stats{Series: 1, Samples: 2, Rollups: 1}},
+		{name: "time range on restore", restore: Filter{Start: t0.Add(time.Minute)}, expected: Stats{Series: 1, Samples: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem, db := source()
+			log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			var buf bytes.Buffer
+			_, err := New(mem, db, log).Export(context.Background(), &buf, tt.export)
+			require.NoError(t, err)
+
+			dstMem, dstDB := &fakeMem{}, &fakeDB{}
+			stats, err := New(dstMem, dstDB, log).Restore(context.Background(), bytes.NewReader(buf.Bytes()), tt.restore)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, stats)
+			require.Len(t, dstDB.series, int(tt.expected.Series))
+			require.Len(t, dstDB.samples, int(tt.expected.Samples))
+			require.Len(t, dstDB.rollups, int(tt.expected.Rollups))
+			require.Len(t, dstMem.set, int(tt.expected.Series))
+		})
+	}
+}
+
+func TestService_RestoreKeepsNewerValues(t *testing.T) {
+	mem, db := source()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var buf bytes.Buffer
+	_, err := New(mem, db, log).Export(context.Background(), &buf, Filter{})
+	require.NoError(t, err)
+
+	dst := storage.NewMemStorage(0)
+	dst.SetBatch([]models.Metric{
+		{Name: "cpu", Value: 4, Labels: map[string]string{"host": "a"}, Timestamp: t0.Add(time.Hour).UnixMilli()},
+	})
+
+	_, err = New(dst, &fakeDB{}, log).Restore(context.Background(), bytes.NewReader(buf.Bytes()), Filter{})
+	require.NoError(t, err)
+
+	latest := make(map[string]models.Sample)
+	for _, sample := range dst.Latest() {
+		latest[sample.Key] = sample
+	}
+	require.Equal(t, models.Sample{Key: `cpu{host="a"}`, Value: 4, Timestamp: t0.Add(time.Hour)}, latest[`cpu{host="a"}`])
+	require.Equal(t, models.Sample{Key: "mem", Value: 10, Timestamp: t0}, latest["mem"])
+}
+
+func TestService_ExportPrefersMemory(t *testing.T) {
+	mem, db := source()
+
+	var buf bytes.Buffer
+	_, err := New(mem, db, slog.Default()).Export(context.Background(), &buf, Filter{})
+	require.NoError(t, err)
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+
+	rec, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, &models.Sample{Key: `cpu{host="a"}`, Value: 3, Timestamp: t0.Add(2 * time.Minute)}, rec.Series)
+}
+
+func TestVerify(t *testing.T) {
+	mem, db := source()
+
+	var buf bytes.Buffer
+	_, err := New(mem, db, slog.Default()).Export(context.Background(), &buf, Filter{Prefix: "cpu"})
+	require.NoError(t, err)
+	valid := buf.Bytes()
+
+	header, stats, err := Verify(bytes.NewReader(valid))
+	require.NoError(t, err)
+	require.Equal(t, Version, header.Version)
+	require.Equal(t, "cpu", header.Prefix)
+	require.Equal(t, Stats{Series: 1, Samples: 2, Rollups: 1}, stats)
+
+	t.Run("truncated", func(t *testing.T) {
+		_, _, err := Verify(bytes.NewReader(valid[:len(valid)/2]))
+		require.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("not a snapshot", func(t *testing.T) {
+		_, _, err := Verify(strings.NewReader("name,value\n"))
+		require.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		data := bytes.Clone(valid)
+		data[len(magic)] = Version + 1
+		_, _, err := Verify(bytes.NewReader(data))
+		require.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		// A snapshot whose footer does not match its records.
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, Header{})
+		require.NoError(t, err)
+		require.NoError(t, w.Write(Record{Sample: &models.Sample{Key: "cpu", Value: 1, Timestamp: t0}}))
+		w.hash.Write([]byte("tampered"))
+		_, err = w.Close()
+		require.NoError(t, err)
+
+		_, _, err = Verify(bytes.NewReader(buf.Bytes()))
+		require.ErrorContains(t, err, "checksum mismatch")
+
+		dst := &fakeDB{}
+		_, err = New(nil, dst, slog.Default()).Restore(context.Background(), bytes.NewReader(buf.Bytes()), Filter{})
+		require.ErrorIs(t, err, ErrCorrupt)
+		require.Empty(t, dst.samples)
+	})
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// IdempotencyKeys returns up to limit of the most recently persisted ingestion
+// request keys that have not expired, ordered by expiry, oldest first.
+func (s *PostgresStorage) IdempotencyKeys(ctx context.Context, limit int) ([]models.IdempotencyKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT key, status, expires_at FROM (
+			SELECT key, status, expires_at FROM idempotency_keys
+			WHERE expires_at > $1 ORDER BY expires_at DESC LIMIT $2
+		) recent ORDER BY expires_at`, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query idempotency keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []models.IdempotencyKey
+	for rows.Next() {
+		var key models.IdempotencyKey
+		if err = rows.Scan(&key.Key, &key.Status, &key.Expires); err != nil {
+			return nil, fmt.Errorf("failed to scan idempotency key row: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read idempotency keys: %w", err)
+	}
+
+	return keys, nil
+}
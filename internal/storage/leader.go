@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// ErrLockLost is returned when saving through a leader lock that is no longer held.
+var ErrLockLost = errors.New("leader lock lost")
+
+// LeaderLock is a PostgreSQL session advisory lock electing the leader among
+// instances sharing the database. It is held by a dedicated connection, so it
+// is released by the server as soon as that connection is lost.
+type LeaderLock struct {
+	db   *PostgresStorage
+	conn *pgxpool.Conn
+	id   int64
+	url  string
+}
+
+// TryLeaderLock takes the advisory lock id unless another session holds it,
+// returning nil then. Once taken, url is recorded as the address of the leader.
+func (s *PostgresStorage) TryLeaderLock(ctx context.Context, id int64, url string) (*LeaderLock, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+
+	var locked bool
+	if err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, id).Scan(&locked); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to take leader lock: %w", err)
+	}
+	if !locked {
+		conn.Release()
+		return nil, nil
+	}
+
+	l := &LeaderLock{db: s, conn: conn, id: id, url: url}
+	_, err = conn.Exec(ctx, `INSERT INTO leaders (lock_id, url, elected_at) VALUES ($1, $2, $3)
+			 ON CONFLICT (lock_id) DO UPDATE SET url = EXCLUDED.url, elected_at = EXCLUDED.elected_at`,
+		id, url, time.Now().UTC())
+	if err != nil {
+		_ = l.Release(ctx)
+		return nil, fmt.Errorf("failed to record leader: %w", err)
+	}
+
+	return l, nil
+}
+
+// Check verifies that the connection holding the lock is alive.
+func (l *LeaderLock) Check(ctx context.Context) error {
+	return l.conn.Ping(ctx)
+}
+
+// Save persists a flush like PostgresStorage.Save, but in the session holding
+// the lock after verifying that it still does, so that an instance that lost
+// leadership never writes. It fails with ErrLockLost if the lock is not held.
+func (l *LeaderLock) Save(ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey) error {
+	var held bool
+	err := l.conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_locks
+			 WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted AND objsubid = 1
+			   AND (classid::bigint << 32 | objid::bigint) = $1)`, l.id).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("failed to check leader lock: %w", err)
+	}
+	if !held {
+		return ErrLockLost
+	}
+
+	tx, err := l.conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to init transaction: %w", err)
+	}
+	return l.db.save(ctx, tx, current, history, keys)
+}
+
+// Release removes the leader record and releases the lock, handing leadership
+// over to the next instance trying to take it.
+func (l *LeaderLock) Release(ctx context.Context) error {
+	_, err := l.conn.Exec(ctx, `DELETE FROM leaders WHERE lock_id = $1 AND url = $2`, l.id, l.url)
+	if err == nil {
+		_, err = l.conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, l.id)
+	}
+	if err != nil {
+		// Closing the session releases the lock as well.
+		l.Close(ctx)
+		return fmt.Errorf("failed to release leader lock: %w", err)
+	}
+
+	l.conn.Release()
+	return nil
+}
+
+// Close closes the session holding the lock, which releases it, and returns
+// its connection to the pool, which discards it. It is used once the lock is
+// lost or cannot be released, so that it is not kept by a broken session.
+func (l *LeaderLock) Close(ctx context.Context) {
+	_ = l.conn.Conn().Close(ctx)
+	l.conn.Release()
+}
+
+// Leader returns the address recorded by the holder of the advisory lock id,
+// or an empty string if there is no leader.
+func (s *PostgresStorage) Leader(ctx context.Context, id int64) (string, error) {
+	var url string
+	err := s.pool.QueryRow(ctx, `SELECT url FROM leaders WHERE lock_id = $1`, id).Scan(&url)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query leader: %w", err)
+	}
+	return url, nil
+}
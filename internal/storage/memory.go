@@ -1,41 +1,409 @@
 // Package storage provides metric storage implementations.
 package storage
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// DefaultShards is the number of shards used when none is configured.
+const DefaultShards = 32
+
+// maxStackShards is the number of shards up to which batches are grouped by
+// shard without allocating.
+const maxStackShards = 256
 
 // MemStorage implements an in-memory thread-safe key-value store for metric data.
-// It uses a read-write mutex to allow multiple concurrent readers or a single writer.
+// Series are spread over a fixed number of shards by a hash of their name, each
+// guarded by its own read-write mutex, so writers to different shards never
+// contend and readers never stop the whole store.
+//
+// Every value has a time: the client timestamp of the metric or, without one,
+// the time it was written. The latest value by time wins; writes older than the
+// current value of their series are stale and do not change it. Timestamped
+// samples are also kept for history until the next flush, including stale ones
+// within the out-of-order window of their series.
 type MemStorage struct {
+	shards    []*shard
+	listeners []Listener
+	mutations []MutationListener
+	window    func(name string) time.Duration
+
+	stale      atomic.Uint64
+	outOfOrder atomic.Uint64
+}
+
+// MemOption configures optional MemStorage behaviour.
+type MemOption func(*MemStorage)
+
+// WithOutOfOrderWindow sets how far behind the latest time of a series, as
+// returned by window for the series key, a timestamped sample may be and still
+// be written to history. Without it, or with a zero window, only samples at or
+// after the latest time are.
+func WithOutOfOrderWindow(window func(name string) time.Duration) MemOption {
+	return func(s *MemStorage) {
+		s.window = window
+	}
+}
+
+// Listener is notified of the samples written by every Set or SetBatch call.
+// It is called synchronously after the write, so it must not block.
+type Listener func(samples []models.Sample)
+
+// shard is one partition of the store.
+type shard struct {
 	mu   sync.RWMutex
-	data map[string]float64
+	data map[string]entry
+	// history holds the timestamped samples written since the last flush.
+	history []models.Sample
+}
+
+// entry is a stored metric value together with its time and the time it was last written.
+type entry struct {
+	value   float64
+	ts      time.Time
+	updated time.Time
+	// stamped is set when the value came with a client timestamp.
+	stamped bool
+}
+
+// NewMemStorage creates and returns a new initialized MemStorage instance with
+// the given number of shards (DefaultShards if not positive).
+// The returned storage is ready to use with empty shards.
+func NewMemStorage(shardCount int, opts ...MemOption) *MemStorage {
+	if shardCount <= 0 {
+		shardCount = DefaultShards
+	}
+
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{data: make(map[string]entry)}
+	}
+
+	s := &MemStorage{
+		shards: shards,
+		window: func(string) time.Duration { return 0 },
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
-// NewMemStorage creates and returns a new initialized MemStorage instance.
-// The returned storage is ready to use with an empty data map.
-func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		data: make(map[string]float64),
+// shardIndex returns the shard responsible for name using the FNV-1a hash.
+func (s *MemStorage) shardIndex(name string) int {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	h := uint32(offset)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= prime
 	}
+
+	return int(h % uint32(len(s.shards))) //nolint:gosec
 }
 
-// Set stores a metric value with the given name in the storage.
-// The operation is thread-safe and will overwrite any existing value.
+// AddListener registers a listener for writes. Listeners must be registered
+// before the storage is used concurrently.
+func (s *MemStorage) AddListener(l Listener) {
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *MemStorage) notify(samples []models.Sample) {
+	for _, l := range s.listeners {
+		l(samples)
+	}
+}
+
+// Set stores a metric value with the given name in the storage, at the current time.
+// The operation is thread-safe and will overwrite any existing value not newer than now.
 func (s *MemStorage) Set(name string, value float64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data[name] = value
+	s.set(models.Metric{Name: name, Value: value})
 }
 
-// Snapshot creates and returns a thread-safe copy of all current metric values.
-// The snapshot is a new map containing all key-value pairs at the time of calling.
+// SetBatch stores a batch of metrics under their series keys, overwriting existing
+// values not newer than them. Metrics are grouped by shard first so that every
+// shard lock is taken at most once.
+func (s *MemStorage) SetBatch(metrics []models.Metric) {
+	switch len(metrics) {
+	case 0:
+		return
+	case 1:
+		s.set(metrics[0])
+		return
+	}
+
+	now := time.Now()
+
+	// Counting sort of the batch by shard: offsets[k]..offsets[k+1] delimits the
+	// positions in order of the metrics belonging to shard k. The offsets of up
+	// to maxStackShards shards stay on the stack.
+	var stack [maxStackShards + 1]int
+	offsets := stack[:]
+	if len(s.shards) > maxStackShards {
+		offsets = make([]int, len(s.shards)+1)
+	}
+	offsets = offsets[:len(s.shards)+1]
+
+	keys := make([]string, len(metrics))
+	shardOf := make([]int, len(metrics))
+	for i := range metrics {
+		keys[i] = metrics[i].Key()
+		shardOf[i] = s.shardIndex(keys[i])
+		offsets[shardOf[i]]++
+	}
+	for k := 1; k < len(offsets); k++ {
+		offsets[k] += offsets[k-1]
+	}
+	// Filling every shard from its end leaves offsets[k] at its start.
+	order := make([]int, len(metrics))
+	for i := len(metrics) - 1; i >= 0; i-- {
+		offsets[shardOf[i]]--
+		order[offsets[shardOf[i]]] = i
+	}
+
+	var (
+		written   []models.Sample
+		mutations []Mutation
+	)
+	if len(s.listeners) > 0 {
+		written = make([]models.Sample, 0, len(metrics))
+	}
+	if len(s.mutations) > 0 {
+		mutations = make([]Mutation, 0, len(metrics))
+	}
+
+	for k, sh := range s.shards {
+		group := order[offsets[k]:offsets[k+1]]
+		if len(group) == 0 {
+			continue
+		}
+
+		sh.mu.Lock()
+		for _, i := range group {
+			sample, current, history := s.write(sh, keys[i], metrics[i], now)
+			if current && written != nil {
+				written = append(written, sample)
+			}
+			if (current || history) && mutations != nil {
+				mutations = append(mutations, Mutation{
+					Op: OpWrite, Sample: sample, Stamped: metrics[i].Timestamp != 0, Current: current, History: history,
+				})
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	if len(written) > 0 {
+		s.notify(written)
+	}
+	if len(mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+}
+
+// set stores a single metric, locking its shard only, without the grouping
+// of batches.
+func (s *MemStorage) set(m models.Metric) {
+	key := m.Key()
+	sh := s.shards[s.shardIndex(key)]
+
+	sh.mu.Lock()
+	sample, current, history := s.write(sh, key, m, time.Now())
+	sh.mu.Unlock()
+
+	if current && len(s.listeners) > 0 {
+		s.notify([]models.Sample{sample})
+	}
+	if (current || history) && len(s.mutations) > 0 {
+		s.notifyMutations([]Mutation{{
+			Op: OpWrite, Sample: sample, Stamped: m.Timestamp != 0, Current: current, History: history,
+		}})
+	}
+}
+
+// write applies a single metric to its shard, which must be locked, and reports
+// whether it became the current value of its series and whether it was kept
+// for history.
+func (s *MemStorage) write(
+	sh *shard, key string, m models.Metric, now time.Time,
+) (sample models.Sample, current, history bool) {
+	ts, stamped := m.Time(), m.Timestamp != 0
+	if !stamped {
+		ts = now
+	}
+	sample = models.Sample{Key: key, Value: m.Value, Timestamp: ts}
+
+	existing, exists := sh.data[key]
+	if exists && ts.Before(existing.ts) {
+		s.stale.Add(1)
+		if stamped {
+			if existing.ts.Sub(ts) > s.window(key) {
+				s.outOfOrder.Add(1)
+			} else {
+				sh.history = append(sh.history, sample)
+				return sample, false, true
+			}
+		}
+		return sample, false, false
+	}
+
+	sh.data[key] = entry{value: m.Value, ts: ts, updated: now, stamped: stamped}
+	if stamped {
+		sh.history = append(sh.history, sample)
+	}
+
+	return sample, true, stamped
+}
+
+// DeleteStale removes every series that has not been written within its TTL,
+// as returned by ttl for the series name; a TTL of zero keeps the series forever.
+// It returns the names of the expired series. With dryRun set, nothing is removed.
+func (s *MemStorage) DeleteStale(now time.Time, ttl func(name string) time.Duration, dryRun bool) []string {
+	var (
+		expired   []string
+		mutations []Mutation
+	)
+	record := !dryRun && len(s.mutations) > 0
+
+	for _, sh := range s.shards {
+		names, deleted := sh.deleteStale(now, ttl, dryRun, record)
+		expired = append(expired, names...)
+		mutations = append(mutations, deleted...)
+	}
+
+	if len(mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+
+	return expired
+}
+
+// deleteStale returns the names of the expired series of the shard and, with
+// record set, their deletions.
+func (sh *shard) deleteStale(
+	now time.Time, ttl func(name string) time.Duration, dryRun, record bool,
+) (expired []string, deleted []Mutation) {
+	if dryRun {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	} else {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+	}
+
+	for name, e := range sh.data {
+		d := ttl(name)
+		if d <= 0 || now.Sub(e.updated) < d {
+			continue
+		}
+
+		expired = append(expired, name)
+		if !dryRun {
+			delete(sh.data, name)
+		}
+		if record {
+			deleted = append(deleted, Mutation{Op: OpDelete, Sample: models.Sample{Key: name, Timestamp: e.ts}})
+		}
+	}
+
+	return expired, deleted
+}
+
+// Snapshot creates and returns a copy of all current metric values.
+// Shards are copied one at a time, so writers are only blocked on the shard
+// being copied; the snapshot is consistent per series, not across shards.
 func (s *MemStorage) Snapshot() map[string]float64 {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	snapshot := make(map[string]float64, s.Len())
 
-	snapshot := make(map[string]float64, len(s.data))
-	for key, value := range s.data {
-		snapshot[key] = value
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, e := range sh.data {
+			snapshot[key] = e.value
+		}
+		sh.mu.RUnlock()
 	}
 
 	return snapshot
 }
+
+// Latest returns the current value of every series together with its time.
+func (s *MemStorage) Latest() []models.Sample {
+	samples := make([]models.Sample, 0, s.Len())
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, e := range sh.data {
+			samples = append(samples, models.Sample{Key: key, Value: e.value, Timestamp: e.ts})
+		}
+		sh.mu.RUnlock()
+	}
+
+	return samples
+}
+
+// Pending returns what a flush persists: the current value of every series with
+// its time, and the samples to append to history. The latter are the timestamped
+// samples written since the previous call, which are removed from the store, and
+// the current value of the series last written without a timestamp, with a zero
+// timestamp standing for the time of the flush.
+func (s *MemStorage) Pending() (current, history []models.Sample) {
+	current = make([]models.Sample, 0, s.Len())
+
+	var flushed []Mutation
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for key, e := range sh.data {
+			current = append(current, models.Sample{Key: key, Value: e.value, Timestamp: e.ts})
+			if !e.stamped {
+				history = append(history, models.Sample{Key: key, Value: e.value})
+			}
+		}
+		if len(s.mutations) > 0 {
+			for _, sample := range sh.history {
+				flushed = append(flushed, Mutation{Op: OpFlush, Sample: sample})
+			}
+		}
+		history = append(history, sh.history...)
+		sh.history = nil
+		sh.mu.Unlock()
+	}
+
+	if len(flushed) > 0 {
+		s.notifyMutations(flushed)
+	}
+
+	return current, history
+}
+
+// Len returns the number of series currently held in the storage.
+func (s *MemStorage) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.data)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// Instrument registers the storage's series count and write outcomes in the given registry.
+func (s *MemStorage) Instrument(reg *telemetry.Registry) {
+	reg.GaugeFunc("metric_server_memstorage_series", "Number of series held in memory.", func() float64 {
+		return float64(s.Len())
+	})
+	reg.CounterFunc("metric_server_memstorage_stale_writes_total",
+		"Total number of writes older than the current value of their series.",
+		func() float64 { return float64(s.stale.Load()) })
+	reg.CounterFunc("metric_server_memstorage_out_of_order_dropped_total",
+		"Total number of timestamped samples dropped as older than their out-of-order window.",
+		func() float64 { return float64(s.outOfOrder.Load()) })
+}
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+func TestMemStorage_DeleteStale(t *testing.T) {
+	ttl := func(name string) time.Duration {
+		if name == "forever" {
+			return 0
+		}
+		return time.Minute
+	}
+
+	tests := []struct {
+		name            string
+		dryRun          bool
+		expectedExpired []string
+		expectedLeft    map[string]float64
+	}{
+		{
+			name:            "expired series removed",
+			expectedExpired: []string{"cpu"},
+			expectedLeft:    map[string]float64{"forever": 2},
+		},
+		{
+			name:            "dry run keeps series",
+			dryRun:          true,
+			expectedExpired: []string{"cpu"},
+			expectedLeft:    map[string]float64{"cpu": 1, "forever": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStorage(4)
+			s.Set("cpu", 1)
+			s.Set("forever", 2)
+
+			expired := s.DeleteStale(time.Now().Add(2*time.Minute), ttl, tt.dryRun)
+
+			require.ElementsMatch(t, tt.expectedExpired, expired)
+			require.Equal(t, tt.expectedLeft, s.Snapshot())
+		})
+	}
+}
+
+func TestMemStorage_SetBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		shards   int
+		batches  [][]models.Metric
+		expected map[string]float64
+	}{
+		{
+			name:     "empty batch",
+			shards:   4,
+			batches:  [][]models.Metric{{}},
+			expected: map[string]float64{},
+		},
+		{
+			name:   "later values overwrite earlier ones",
+			shards: 4,
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 1}, {Name: "mem", Value: 2}},
+				{{Name: "cpu", Value: 3}, {Name: "disk", Value: 4}},
+			},
+			expected: map[string]float64{"cpu": 3, "mem": 2, "disk": 4},
+		},
+		{
+			name:     "default shard count",
+			shards:   0,
+			batches:  [][]models.Metric{{{Name: "cpu", Value: 1}, {Name: "cpu", Value: 2}}},
+			expected: map[string]float64{"cpu": 2},
+		},
+		{
+			name:     "single metrics",
+			shards:   4,
+			batches:  [][]models.Metric{{{Name: "cpu", Value: 1}}, {{Name: "cpu", Value: 2}}},
+			expected: map[string]float64{"cpu": 2},
+		},
+		{
+			name:   "more shards than grouped on the stack",
+			shards: maxStackShards + 1,
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 1}, {Name: "mem", Value: 2}, {Name: "cpu", Value: 3}},
+			},
+			expected: map[string]float64{"cpu": 3, "mem": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStorage(tt.shards)
+			for _, batch := range tt.batches {
+				s.SetBatch(batch)
+			}
+
+			require.Equal(t, tt.expected, s.Snapshot())
+			require.Equal(t, len(tt.expected), s.Len())
+		})
+	}
+}
+
+func TestMemStorage_SetAllocs(t *testing.T) {
+	s := NewMemStorage(DefaultShards)
+	s.Set("cpu", 1)
+
+	allocs := testing.AllocsPerRun(100, func() { s.Set("cpu", 2) })
+	require.Zero(t, allocs, "single writes do not allocate per shard")
+}
+
+func TestMemStorage_Concurrent(t *testing.T) {
+	s := NewMemStorage(8)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.SetBatch([]models.Metric{{Name: fmt.Sprintf("w%d_m%d", w, i%100), Value: float64(i)}})
+				if i%100 == 0 {
+					_ = s.Snapshot()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 800, s.Len())
+}
+
+// The benchmarks below compare a single shard (equivalent to the former
+// global-mutex store) with the default shard count. Run them with several
+// -cpu values to see how throughput scales with cores, e.g.
+//
+//	go test ./internal/storage -run '^$' -bench . -cpu 1,2,4,8
+func benchmarkNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric_%d", i)
+	}
+	return names
+}
+
+func BenchmarkMemStorage_SetParallel(b *testing.B) {
+	names := benchmarkNames(4096)
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewMemStorage(shards)
+			var seed atomic.Int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(1) * 7919)
+				for pb.Next() {
+					s.Set(names[i%len(names)], float64(i))
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorage_SetBatchParallel(b *testing.B) {
+	names := benchmarkNames(4096)
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewMemStorage(shards)
+			var seed atomic.Int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(1) * 7919)
+				batch := make([]models.Metric, 64)
+				for pb.Next() {
+					for j := range batch {
+						batch[j] = models.Metric{Name: names[(i+j)%len(names)], Value: float64(j)}
+					}
+					s.SetBatch(batch)
+					i += len(batch)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorage_SetWhileSnapshotting(b *testing.B) {
+	names := benchmarkNames(100_000)
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := NewMemStorage(shards)
+			for i, name := range names {
+				s.Set(name, float64(i))
+			}
+
+			done := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_ = s.Snapshot()
+					}
+				}
+			}()
+			defer close(done)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					s.Set(names[i%len(names)], float64(i))
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestMemStorage_Timestamps(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	at := func(d time.Duration) int64 { return base.Add(d).UnixMilli() }
+
+	window := func(name string) time.Duration {
+		if name == "late" {
+			return time.Minute
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name            string
+		batches         [][]models.Metric
+		expectedValue   float64
+		expectedTime    time.Time
+		expectedHistory []models.Sample
+	}{
+		{
+			name: "newer timestamp wins",
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 1, Timestamp: at(0)}},
+				{{Name: "cpu", Value: 2, Timestamp: at(time.Second)}},
+			},
+			expectedValue: 2,
+			expectedTime:  base.Add(time.Second),
+			expectedHistory: []models.Sample{
+				{Key: "cpu", Value: 1, Timestamp: base},
+				{Key: "cpu", Value: 2, Timestamp: base.Add(time.Second)},
+			},
+		},
+		{
+			name: "stale write ignored and dropped from history without a window",
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 2, Timestamp: at(time.Second)}},
+				{{Name: "cpu", Value: 1, Timestamp: at(0)}},
+			},
+			expectedValue:   2,
+			expectedTime:    base.Add(time.Second),
+			expectedHistory: []models.Sample{{Key: "cpu", Value: 2, Timestamp: base.Add(time.Second)}},
+		},
+		{
+			name: "out of order sample within window kept for history",
+			batches: [][]models.Metric{
+				{{Name: "late", Value: 3, Timestamp: at(2 * time.Minute)}},
+				{{Name: "late", Value: 2, Timestamp: at(90 * time.Second)}},
+				{{Name: "late", Value: 1, Timestamp: at(0)}},
+			},
+			expectedValue: 3,
+			expectedTime:  base.Add(2 * time.Minute),
+			expectedHistory: []models.Sample{
+				{Key: "late", Value: 3, Timestamp: base.Add(2 * time.Minute)},
+				{Key: "late", Value: 2, Timestamp: base.Add(90 * time.Second)},
+			},
+		},
+		{
+			name: "write without timestamp uses the current time",
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 1, Timestamp: at(0)}},
+				{{Name: "cpu", Value: 2}},
+			},
+			expectedValue: 2,
+			expectedHistory: []models.Sample{
+				{Key: "cpu", Value: 2},
+				{Key: "cpu", Value: 1, Timestamp: base},
+			},
+		},
+		{
+			name: "write without timestamp older than a future one is stale",
+			batches: [][]models.Metric{
+				{{Name: "cpu", Value: 1, Timestamp: time.Now().Add(time.Minute).UnixMilli()}},
+				{{Name: "cpu", Value: 2}},
+			},
+			expectedValue: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStorage(4, WithOutOfOrderWindow(window))
+			for _, batch := range tt.batches {
+				s.SetBatch(batch)
+			}
+
+			latest := s.Latest()
+			require.Len(t, latest, 1)
+			require.Equal(t, tt.expectedValue, latest[0].Value)
+			if !tt.expectedTime.IsZero() {
+				require.True(t, tt.expectedTime.Equal(latest[0].Timestamp))
+			}
+
+			current, history := s.Pending()
+			require.Equal(t, latest, current)
+			if tt.expectedHistory != nil {
+				require.Equal(t, tt.expectedHistory, history)
+			}
+
+			// Timestamped samples are handed over once.
+			_, history = s.Pending()
+			for _, sample := range history {
+				require.True(t, sample.Timestamp.IsZero())
+			}
+		})
+	}
+}
+
+func TestMemStorage_Replication(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	at := func(d time.Duration) int64 { return base.Add(d).UnixMilli() }
+	window := func(string) time.Duration { return time.Minute }
+
+	primary := NewMemStorage(4, WithOutOfOrderWindow(window))
+	replica := NewMemStorage(8)
+	primary.AddMutationListener(replica.Apply)
+
+	// Replicated before the replica caught up, overwritten by the snapshot.
+	replica.SetBatch([]models.Metric{{Name: "gone", Value: 1}})
+
+	primary.SetBatch([]models.Metric{
+		{Name: "cpu", Value: 1, Timestamp: at(time.Minute)},
+		{Name: "mem", Value: 2},
+		{Name: "old", Value: 3},
+	})
+	primary.SetBatch([]models.Metric{
+		{Name: "cpu", Value: 0.5, Timestamp: at(30 * time.Second)},
+		{Name: "cpu", Value: 0.1, Timestamp: at(-time.Hour)},
+	})
+
+	requireSame := func(t *testing.T) {
+		t.Helper()
+		require.ElementsMatch(t, primary.Latest(), replica.Latest())
+		primaryDump, replicaDump := primary.Dump(), replica.Dump()
+		require.Equal(t, primaryDump[0], replicaDump[0])
+		require.ElementsMatch(t, primaryDump[1:], replicaDump[1:])
+	}
+
+	replica.Apply(primary.Dump())
+	requireSame(t)
+	require.Len(t, replica.Dump(), 6, "reset, 3 series and 2 timestamped history samples")
+
+	primary.DeleteStale(time.Now().Add(time.Hour), func(name string) time.Duration {
+		if name == "old" {
+			return time.Minute
+		}
+		return 0
+	}, false)
+	requireSame(t)
+	require.Equal(t, 2, replica.Len())
+
+	primary.Pending()
+	requireSame(t)
+	_, history := replica.Pending()
+	require.Equal(t, []models.Sample{{Key: "mem", Value: 2}}, history)
+
+	// Changes notified out of order only drop what they describe.
+	late := NewMemStorage(2)
+	late.Apply([]Mutation{
+		{Op: OpWrite, Sample: models.Sample{Key: "cpu", Value: 2, Timestamp: base}, Stamped: true, Current: true},
+		{Op: OpWrite, Sample: models.Sample{Key: "cpu", Value: 2, Timestamp: base}, Stamped: true, History: true},
+		{Op: OpDelete, Sample: models.Sample{Key: "cpu", Timestamp: base.Add(-time.Second)}},
+		{Op: OpFlush, Sample: models.Sample{Key: "cpu", Value: 1, Timestamp: base}},
+	})
+	_, history = late.Pending()
+	require.Equal(t, []models.Sample{{Key: "cpu", Value: 2, Timestamp: base}}, history)
+	require.Equal(t, 1, late.Len())
+}
+
+func TestMemStorage_SeriesAdmin(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond).UTC()
+	at := func(d time.Duration) int64 { return base.Add(d).UnixMilli() }
+
+	mem := NewMemStorage(4)
+	replica := NewMemStorage(8)
+	mem.AddMutationListener(replica.Apply)
+
+	var written []models.Sample
+	mem.AddListener(func(samples []models.Sample) { written = append(written, samples...) })
+
+	mem.SetBatch([]models.Metric{
+		{Name: "cpu", Value: 1, Labels: map[string]string{"host": "a"}, Timestamp: at(0)},
+		{Name: "cpu", Value: 2, Labels: map[string]string{"host": "b"}, Timestamp: at(0)},
+		{Name: "requests", Value: 10},
+		{Name: "bad", Value: 3, Timestamp: at(0)},
+	})
+
+	requireSame := func(t *testing.T) {
+		t.Helper()
+		require.ElementsMatch(t, mem.Latest(), replica.Latest())
+		want, got := mem.Dump(), replica.Dump()
+		require.ElementsMatch(t, want[1:], got[1:])
+	}
+
+	// Deleted series are gone with their pending history.
+	require.Equal(t, 1, mem.DeleteSeries([]string{"bad", "missing"}))
+	requireSame(t)
+	require.Equal(t, 3, mem.Len())
+
+	// Reset series are zero as of the reset, their history is left alone.
+	reset := time.Now().UTC()
+	written = nil
+	require.Equal(t, 1, mem.ResetSeries([]string{"requests"}, reset))
+	requireSame(t)
+	require.Equal(t, []models.Sample{{Key: "requests", Timestamp: reset}}, written)
+
+	// Renamed series keep their value, time and pending history.
+	require.Equal(t, 2, mem.RenameSeries(map[string]string{
+		`cpu{host="a"}`: `cpu_usage{host="a"}`,
+		`cpu{host="b"}`: `cpu_usage{host="b"}`,
+	}))
+	requireSame(t)
+
+	current, history := mem.Pending()
+	require.ElementsMatch(t, []models.Sample{
+		{Key: `cpu_usage{host="a"}`, Value: 1, Timestamp: base},
+		{Key: `cpu_usage{host="b"}`, Value: 2, Timestamp: base},
+		{Key: "requests", Timestamp: reset},
+	}, current)
+	require.ElementsMatch(t, []models.Sample{
+		{Key: `cpu_usage{host="a"}`, Value: 1, Timestamp: base},
+		{Key: `cpu_usage{host="b"}`, Value: 2, Timestamp: base},
+	}, history)
+	requireSame(t)
+}
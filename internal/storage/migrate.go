@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+
+	"github.com/sanchey92/metric-server/migrations"
+)
+
+// Migration describes one of the embedded schema migrations.
+type Migration struct {
+	Version   int64     `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"applied_at,omitzero"`
+}
+
+// migrate runs fn with a goose provider over the embedded migrations. Migrations
+// hold a PostgreSQL advisory lock while they run, so that instances starting
+// together do not apply them concurrently.
+func (s *PostgresStorage) migrate(fn func(p *goose.Provider) error) error {
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return fmt.Errorf("failed to create migration lock: %w", err)
+	}
+
+	db := stdlib.OpenDBFromPool(s.pool)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	p, err := goose.NewProvider(goose.DialectPostgres, db, migrations.FS, goose.WithSessionLocker(locker))
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	return fn(p)
+}
+
+// MigrateUp applies all pending migrations and returns them.
+func (s *PostgresStorage) MigrateUp(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := s.migrate(func(p *goose.Provider) error {
+		results, err := p.Up(ctx)
+		for _, r := range results {
+			if r.Error == nil {
+				applied = append(applied, migration(r.Source, true, time.Time{}))
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return applied, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown rolls back the most recently applied migration and returns it.
+func (s *PostgresStorage) MigrateDown(ctx context.Context) (Migration, error) {
+	var rolledBack Migration
+
+	err := s.migrate(func(p *goose.Provider) error {
+		r, err := p.Down(ctx)
+		if err != nil {
+			return err
+		}
+		rolledBack = migration(r.Source, false, time.Time{})
+		return nil
+	})
+	if err != nil {
+		return rolledBack, fmt.Errorf("failed to roll back migration: %w", err)
+	}
+
+	return rolledBack, nil
+}
+
+// MigrationStatus returns every embedded migration, in order, with whether it is applied.
+func (s *PostgresStorage) MigrationStatus(ctx context.Context) ([]Migration, error) {
+	var status []Migration
+
+	err := s.migrate(func(p *goose.Provider) error {
+		results, err := p.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			status = append(status, migration(r.Source, r.State == goose.StateApplied, r.AppliedAt))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration status: %w", err)
+	}
+
+	return status, nil
+}
+
+func migration(src *goose.Source, applied bool, at time.Time) Migration {
+	return Migration{Version: src.Version, Name: path.Base(src.Path), Applied: applied, AppliedAt: at}
+}
@@ -3,10 +3,17 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/sanchey92/metric-server/internal/logger"
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/telemetry"
 )
 
 // PostgresStorage implements metric storage using PostgreSQL as the backend.
@@ -14,11 +21,34 @@ import (
 // transactional guarantees for metric updates.
 type PostgresStorage struct {
 	pool *pgxpool.Pool
+	log  *slog.Logger
+}
+
+// PostgresOption configures optional PostgresStorage behaviour.
+type PostgresOption func(*postgresOptions)
+
+type postgresOptions struct {
+	migrate bool
+}
+
+// WithMigrations applies the pending embedded schema migrations when connecting.
+func WithMigrations() PostgresOption {
+	return func(o *postgresOptions) {
+		o.migrate = true
+	}
 }
 
 // NewPostgresStorage creates and initializes a new PostgreSQL-backed storage.
-// It establishes a connection pool with the database and verifies connectivity.
-func NewPostgresStorage(ctx context.Context, dsn string) (*PostgresStorage, error) {
+// It establishes a connection pool with the database, verifies connectivity
+// and, if requested, brings the schema up to date.
+func NewPostgresStorage(
+	ctx context.Context, dsn string, log *slog.Logger, opts ...PostgresOption,
+) (*PostgresStorage, error) {
+	var options postgresOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	if err := ctx.Err(); err != nil {
 		return nil, fmt.Errorf("context canceled before connecting to postgres")
 	}
@@ -42,9 +72,23 @@ func NewPostgresStorage(ctx context.Context, dsn string) (*PostgresStorage, erro
 		return nil, fmt.Errorf("failed to ping postgres db")
 	}
 
-	return &PostgresStorage{
+	s := &PostgresStorage{
 		pool: pool,
-	}, nil
+		log:  log,
+	}
+
+	if options.migrate {
+		applied, err := s.MigrateUp(ctx)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		for _, m := range applied {
+			log.Info("applied migration", slog.String("migration", m.Name))
+		}
+	}
+
+	return s, nil
 }
 
 // Close gracefully shuts down the storage by closing all database connections.
@@ -52,36 +96,106 @@ func NewPostgresStorage(ctx context.Context, dsn string) (*PostgresStorage, erro
 func (s *PostgresStorage) Close() error {
 	if s.pool != nil {
 		s.pool.Close()
-		fmt.Println("close connection to postgres")
+		s.log.Info("closed connection to postgres")
 	}
 
 	return nil
 }
 
+// Ping checks that the database is reachable.
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// Instrument registers the connection pool statistics in the given registry.
+// Values are read from the pool on every collection.
+func (s *PostgresStorage) Instrument(reg *telemetry.Registry) {
+	reg.GaugeFunc("metric_server_pg_pool_acquired_conns", "Number of currently acquired connections.",
+		func() float64 { return float64(s.pool.Stat().AcquiredConns()) })
+	reg.GaugeFunc("metric_server_pg_pool_idle_conns", "Number of currently idle connections.",
+		func() float64 { return float64(s.pool.Stat().IdleConns()) })
+	reg.GaugeFunc("metric_server_pg_pool_total_conns", "Total number of connections in the pool.",
+		func() float64 { return float64(s.pool.Stat().TotalConns()) })
+	reg.GaugeFunc("metric_server_pg_pool_max_conns", "Maximum size of the pool.",
+		func() float64 { return float64(s.pool.Stat().MaxConns()) })
+	reg.CounterFunc("metric_server_pg_pool_acquires_total", "Total number of successful acquires.",
+		func() float64 { return float64(s.pool.Stat().AcquireCount()) })
+	reg.CounterFunc("metric_server_pg_pool_empty_acquires_total",
+		"Total number of acquires that had to wait for a connection.",
+		func() float64 { return float64(s.pool.Stat().EmptyAcquireCount()) })
+	reg.CounterFunc("metric_server_pg_pool_acquire_duration_seconds_total", "Total time spent acquiring connections.",
+		func() float64 { return s.pool.Stat().AcquireDuration().Seconds() })
+}
+
 // Save persists a batch of metrics to PostgreSQL using a transaction.
-// It performs atomic upsert operations (insert new or update existing metrics).
-func (s *PostgresStorage) Save(ctx context.Context, data map[string]float64) error {
+// It upserts the current value of every series unless the stored one is newer,
+// and appends the history samples to the raw sample history; samples without
+// a timestamp are recorded with the flush timestamp. The idempotency keys of
+// the requests that wrote the batch are stored in the same transaction, so a
+// key survives a restart only if its metrics do, and expired keys are removed.
+func (s *PostgresStorage) Save(ctx context.Context, current, history []models.Sample, keys []models.IdempotencyKey) error {
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to init transaction")
 	}
 
+	return s.save(ctx, tx, current, history, keys)
+}
+
+// save writes a flush in the transaction tx and commits it.
+func (s *PostgresStorage) save(
+	ctx context.Context, tx pgx.Tx, current, history []models.Sample, keys []models.IdempotencyKey,
+) error {
 	defer func() {
-		if err = tx.Rollback(ctx); err != nil {
-			fmt.Println("rollback error")
+		if rbErr := tx.Rollback(ctx); rbErr != nil && !errors.Is(rbErr, pgx.ErrTxClosed) {
+			s.log.Error("failed to roll back transaction", logger.Err(rbErr))
 		}
 	}()
 
-	query := `INSERT INTO metrics (name, value)
-			 VALUES ($1, $2)
-			 ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`
+	query := `INSERT INTO metrics (name, value, updated_at)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at
+			 WHERE metrics.updated_at <= EXCLUDED.updated_at`
+
+	sampleQuery := `INSERT INTO metric_samples (name, ts, value)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (name, ts) DO UPDATE SET value = EXCLUDED.value`
 
-	for name, value := range data {
-		_, err = tx.Exec(ctx, query, name, value)
+	ts := time.Now().UTC()
+
+	for _, sample := range current {
+		_, err := tx.Exec(ctx, query, sample.Key, sample.Value, sample.Timestamp.UTC())
 		if err != nil {
 			return fmt.Errorf("exec tx error")
 		}
 	}
 
+	for _, sample := range history {
+		at := sample.Timestamp.UTC()
+		if sample.Timestamp.IsZero() {
+			at = ts
+		}
+
+		_, err := tx.Exec(ctx, sampleQuery, sample.Key, at, sample.Value)
+		if err != nil {
+			return fmt.Errorf("exec tx error")
+		}
+	}
+
+	keyQuery := `INSERT INTO idempotency_keys (key, status, expires_at)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (key) DO UPDATE SET status = EXCLUDED.status, expires_at = EXCLUDED.expires_at`
+
+	for _, key := range keys {
+		_, err := tx.Exec(ctx, keyQuery, key.Key, key.Status, key.Expires.UTC())
+		if err != nil {
+			return fmt.Errorf("exec tx error")
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, ts); err != nil {
+		return fmt.Errorf("exec tx error")
+	}
+
 	return tx.Commit(ctx)
 }
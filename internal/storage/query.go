@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// likeEscaper escapes the LIKE wildcards of a literal pattern prefix.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Samples returns the raw samples recorded within [start, end], ordered by series
+// key and time. When name is set, only the series of that metric name are read,
+// i.e. the bare name and every labelled series name{...}; otherwise all series are.
+func (s *PostgresStorage) Samples(ctx context.Context, name string, start, end time.Time) ([]models.Sample, error) {
+	query := `SELECT name, ts, value FROM metric_samples WHERE ts >= $1 AND ts <= $2`
+	args := []any{start, end}
+
+	if name != "" {
+		query += ` AND (name = $3 OR name LIKE $4)`
+		args = append(args, name, likeEscaper.Replace(name)+"{%")
+	}
+
+	rows, err := s.pool.Query(ctx, query+` ORDER BY name, ts`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query samples: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []models.Sample
+	for rows.Next() {
+		var sample models.Sample
+		if err = rows.Scan(&sample.Key, &sample.Timestamp, &sample.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan sample row: %w", err)
+		}
+		samples = append(samples, sample)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read samples: %w", err)
+	}
+
+	return samples, nil
+}
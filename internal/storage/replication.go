@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"math"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// MutationOp is the kind of change described by a Mutation.
+type MutationOp uint8
+
+// Kinds of changes of the in-memory store.
+const (
+	// OpWrite writes Sample as the current value of its series, if Current is
+	// set, and keeps it for history, if History is set.
+	OpWrite MutationOp = iota + 1
+	// OpDelete removes the series Sample.Key, unless written after Sample.Timestamp.
+	OpDelete
+	// OpFlush drops Sample from the samples kept for history, as it was persisted.
+	OpFlush
+	// OpReset removes every series and history sample, starting a snapshot.
+	OpReset
+)
+
+// Mutation is a change of the in-memory store, such as streamed to replicas,
+// which replay it with Apply. Stamped tells whether a written value came with
+// a client timestamp.
+type Mutation struct {
+	Op      MutationOp    `json:"op"`
+	Sample  models.Sample `json:"sample"`
+	Stamped bool          `json:"stamped,omitempty"`
+	Current bool          `json:"current,omitempty"`
+	History bool          `json:"history,omitempty"`
+}
+
+// MutationListener is notified of every change of the store. It is called
+// synchronously after the change, so it must not block, and may retain the
+// slice. Changes of concurrent calls may be notified out of order, which Apply
+// tolerates: values only replace older ones, deletions spare newer ones and
+// flushes only drop the samples persisted. At worst a history sample is kept
+// although persisted, and persisting it again is harmless.
+type MutationListener func(mutations []Mutation)
+
+// AddMutationListener registers a listener for changes. Listeners must be
+// registered before the storage is used concurrently.
+func (s *MemStorage) AddMutationListener(l MutationListener) {
+	s.mutations = append(s.mutations, l)
+}
+
+func (s *MemStorage) notifyMutations(mutations []Mutation) {
+	for _, l := range s.mutations {
+		l(mutations)
+	}
+}
+
+// Dump returns the content of the store as mutations, starting with OpReset,
+// that recreate it when applied to another store.
+func (s *MemStorage) Dump() []Mutation {
+	mutations := make([]Mutation, 1, s.Len()+1)
+	mutations[0] = Mutation{Op: OpReset}
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, e := range sh.data {
+			mutations = append(mutations, Mutation{
+				Op:      OpWrite,
+				Sample:  models.Sample{Key: key, Value: e.value, Timestamp: e.ts},
+				Stamped: e.stamped,
+				Current: true,
+			})
+		}
+		for _, sample := range sh.history {
+			mutations = append(mutations, Mutation{Op: OpWrite, Sample: sample, Stamped: true, History: true})
+		}
+		sh.mu.RUnlock()
+	}
+
+	return mutations
+}
+
+// Apply replays mutations of another store. Listeners are notified as for
+// writes, so replicated changes are streamed and replicated further.
+func (s *MemStorage) Apply(mutations []Mutation) {
+	now := time.Now()
+
+	var (
+		written []models.Sample
+		flushed map[flushedSample]int
+	)
+	for _, m := range mutations {
+		switch m.Op {
+		case OpWrite:
+			sh := s.shards[s.shardIndex(m.Sample.Key)]
+			sh.mu.Lock()
+			if m.Current {
+				if e, ok := sh.data[m.Sample.Key]; !ok || !m.Sample.Timestamp.Before(e.ts) {
+					sh.data[m.Sample.Key] = entry{
+						value: m.Sample.Value, ts: m.Sample.Timestamp, updated: now, stamped: m.Stamped,
+					}
+					written = append(written, m.Sample)
+				}
+			}
+			if m.History {
+				sh.history = append(sh.history, m.Sample)
+			}
+			sh.mu.Unlock()
+
+		case OpDelete:
+			sh := s.shards[s.shardIndex(m.Sample.Key)]
+			sh.mu.Lock()
+			if e, ok := sh.data[m.Sample.Key]; ok && !e.ts.After(m.Sample.Timestamp) {
+				delete(sh.data, m.Sample.Key)
+			}
+			sh.mu.Unlock()
+
+		case OpFlush:
+			if flushed == nil {
+				flushed = make(map[flushedSample]int)
+			}
+			flushed[flushedKey(m.Sample)]++
+
+		case OpReset:
+			for _, sh := range s.shards {
+				sh.mu.Lock()
+				sh.data = make(map[string]entry)
+				sh.history = nil
+				sh.mu.Unlock()
+			}
+		}
+	}
+
+	if len(flushed) > 0 {
+		s.dropHistory(flushed)
+	}
+	if len(written) > 0 {
+		s.notify(written)
+	}
+	if len(s.mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+}
+
+// flushedSample identifies a history sample independently of the location of
+// its time, which is not preserved by encodings.
+type flushedSample struct {
+	key   string
+	ts    int64
+	value uint64
+}
+
+func flushedKey(sample models.Sample) flushedSample {
+	return flushedSample{key: sample.Key, ts: sample.Timestamp.UnixNano(), value: math.Float64bits(sample.Value)}
+}
+
+// dropHistory removes the given number of occurrences of every flushed sample
+// from history.
+func (s *MemStorage) dropHistory(flushed map[flushedSample]int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		kept := sh.history[:0]
+		for _, sample := range sh.history {
+			k := flushedKey(sample)
+			if flushed[k] > 0 {
+				flushed[k]--
+				continue
+			}
+			kept = append(kept, sample)
+		}
+		clear(sh.history[len(kept):])
+		sh.history = kept
+		sh.mu.Unlock()
+	}
+}
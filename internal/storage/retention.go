@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// ExpireHistory deletes raw samples, rollup buckets and latest values older than
+// cutoff for every metric whose name matches the include regular expression (all
+// names when empty) and none of the exclude expressions. Expressions are evaluated
+// by PostgreSQL, so they must stay within the syntax shared with Go's regexp.
+// With dryRun set, the rows are only counted.
+func (s *PostgresStorage) ExpireHistory(
+	ctx context.Context, include string, exclude []string, cutoff time.Time, dryRun bool,
+) (models.ExpireStats, error) {
+	var stats models.ExpireStats
+
+	if exclude == nil {
+		exclude = []string{}
+	}
+
+	match := `($1 = '' OR name ~ $1) AND NOT (name ~ ANY($2::text[]))`
+
+	targets := []struct {
+		table  string
+		column string
+		count  *int64
+	}{
+		{table: "metric_samples", column: "ts", count: &stats.Samples},
+		{table: "metric_rollups", column: "bucket", count: &stats.Rollups},
+		{table: "metrics", column: "updated_at", count: &stats.Series},
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("failed to init transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	for _, t := range targets {
+		where := fmt.Sprintf(`%s AND %s < $3`, match, t.column)
+
+		if dryRun {
+			query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s`, t.table, where)
+			if err = tx.QueryRow(ctx, query, include, exclude, cutoff).Scan(t.count); err != nil {
+				return stats, fmt.Errorf("failed to count expired rows in %s: %w", t.table, err)
+			}
+			continue
+		}
+
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s`, t.table, where), include, exclude, cutoff)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete expired rows from %s: %w", t.table, err)
+		}
+		*t.count = tag.RowsAffected()
+	}
+
+	return stats, tx.Commit(ctx)
+}
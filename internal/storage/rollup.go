@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// aggregateQuery builds a SELECT that groups either raw samples (source == 0) or
+// rollups of the given source resolution into buckets of $1 seconds within [$2, $3).
+// When byName is set, the rows are additionally restricted to a single metric name.
+//
+// Selected columns are: name, bucket, min, max, sum, count, last.
+func aggregateQuery(source time.Duration, byName bool) string {
+	if source == 0 {
+		query := `SELECT name,
+				to_timestamp(floor(extract(epoch FROM ts)::double precision / $1::bigint) * $1::bigint) AS b,
+				min(value), max(value), sum(value), count(*),
+				(array_agg(value ORDER BY ts DESC))[1]
+			FROM metric_samples
+			WHERE ts >= $2 AND ts < $3`
+		if byName {
+			query += ` AND name = $4`
+		}
+		return query + ` GROUP BY name, b`
+	}
+
+	query := fmt.Sprintf(`SELECT name,
+			to_timestamp(floor(extract(epoch FROM bucket)::double precision / $1::bigint) * $1::bigint) AS b,
+			min(min), max(max), sum(sum), sum(count)::bigint,
+			(array_agg(last ORDER BY bucket DESC))[1]
+		FROM metric_rollups
+		WHERE resolution = %d AND bucket >= $2 AND bucket < $3`, int64(source.Seconds()))
+	if byName {
+		query += ` AND name = $4`
+	}
+	return query + ` GROUP BY name, b`
+}
+
+// Rollup aggregates data from the source resolution (0 for raw samples) into
+// buckets of the given step for the window [from, to), replacing any existing
+// buckets in that window. Because whole buckets are recomputed, it is safe to
+// run repeatedly over overlapping windows. It returns the number of buckets written.
+func (s *PostgresStorage) Rollup(ctx context.Context, step, source time.Duration, from, to time.Time) (int64, error) {
+	query := `INSERT INTO metric_rollups (resolution, name, bucket, min, max, sum, count, last)
+		SELECT $1::integer, a.* FROM (` + aggregateQuery(source, false) + `) a
+		ON CONFLICT (resolution, name, bucket) DO UPDATE SET
+			min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum,
+			count = EXCLUDED.count, last = EXCLUDED.last`
+
+	tag, err := s.pool.Exec(ctx, query, int64(step.Seconds()), from, to)
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up %s buckets: %w", step, err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// QueryAggregates returns the values of a metric within [start, end) grouped into
+// buckets of the given step, reading raw samples (source == 0) or rollups of the
+// source resolution.
+func (s *PostgresStorage) QueryAggregates(
+	ctx context.Context, name string, source, step time.Duration, start, end time.Time,
+) ([]models.Aggregate, error) {
+	query := `SELECT b, min, max, sum, count, last FROM (` + aggregateQuery(source, true) + `) a
+		ORDER BY b`
+
+	rows, err := s.pool.Query(ctx, query, int64(step.Seconds()), start, end, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	var points []models.Aggregate
+	for rows.Next() {
+		var p models.Aggregate
+		if err = rows.Scan(&p.Time, &p.Min, &p.Max, &p.Sum, &p.Count, &p.Last); err != nil {
+			return nil, fmt.Errorf("failed to scan history row: %w", err)
+		}
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
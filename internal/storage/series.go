@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// lockAll takes the locks of every shard in order, so that administrative
+// changes spanning shards are applied at once.
+func (s *MemStorage) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *MemStorage) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// DeleteSeries removes the given series from the store together with their
+// pending history, and returns the number of series removed.
+func (s *MemStorage) DeleteSeries(keys []string) int {
+	drop := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		drop[key] = true
+	}
+
+	var mutations []Mutation
+	n := 0
+
+	s.lockAll()
+	for _, key := range keys {
+		sh := s.shards[s.shardIndex(key)]
+		e, ok := sh.data[key]
+		if !ok {
+			continue
+		}
+		delete(sh.data, key)
+		n++
+		mutations = append(mutations, Mutation{Op: OpDelete, Sample: models.Sample{Key: key, Timestamp: e.ts}})
+	}
+	for _, sh := range s.shards {
+		kept := sh.history[:0]
+		for _, sample := range sh.history {
+			if drop[sample.Key] {
+				mutations = append(mutations, Mutation{Op: OpFlush, Sample: sample})
+				continue
+			}
+			kept = append(kept, sample)
+		}
+		clear(sh.history[len(kept):])
+		sh.history = kept
+	}
+	s.unlockAll()
+
+	if len(mutations) > 0 && len(s.mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+
+	return n
+}
+
+// ResetSeries sets the given series held in the store to zero at time at, or
+// at their own time if later, and returns the number of series reset. The
+// reset is not kept for history, which is expected to be recorded already.
+func (s *MemStorage) ResetSeries(keys []string, at time.Time) int {
+	var (
+		written   []models.Sample
+		mutations []Mutation
+	)
+
+	s.lockAll()
+	for _, key := range keys {
+		sh := s.shards[s.shardIndex(key)]
+		e, ok := sh.data[key]
+		if !ok {
+			continue
+		}
+
+		ts := at
+		if e.ts.After(ts) {
+			ts = e.ts
+		}
+		sh.data[key] = entry{value: 0, ts: ts, updated: at, stamped: true}
+
+		sample := models.Sample{Key: key, Timestamp: ts}
+		written = append(written, sample)
+		mutations = append(mutations, Mutation{Op: OpWrite, Sample: sample, Stamped: true, Current: true})
+	}
+	s.unlockAll()
+
+	if len(written) > 0 {
+		s.notify(written)
+	}
+	if len(mutations) > 0 && len(s.mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+
+	return len(written)
+}
+
+// RenameSeries moves every series held in the store from a key of renames to
+// the key it maps to, together with its pending history, and returns the
+// number of series moved. Target keys are expected not to exist.
+func (s *MemStorage) RenameSeries(renames map[string]string) int {
+	var (
+		written   []models.Sample
+		mutations []Mutation
+		moved     []models.Sample
+	)
+
+	s.lockAll()
+	for from, to := range renames {
+		sh := s.shards[s.shardIndex(from)]
+		e, ok := sh.data[from]
+		if !ok {
+			continue
+		}
+		delete(sh.data, from)
+		s.shards[s.shardIndex(to)].data[to] = e
+
+		sample := models.Sample{Key: to, Value: e.value, Timestamp: e.ts}
+		written = append(written, sample)
+		mutations = append(mutations,
+			Mutation{Op: OpDelete, Sample: models.Sample{Key: from, Timestamp: e.ts}},
+			Mutation{Op: OpWrite, Sample: sample, Stamped: e.stamped, Current: true},
+		)
+	}
+	for _, sh := range s.shards {
+		kept := sh.history[:0]
+		for _, sample := range sh.history {
+			to, ok := renames[sample.Key]
+			if !ok {
+				kept = append(kept, sample)
+				continue
+			}
+			mutations = append(mutations, Mutation{Op: OpFlush, Sample: sample})
+			sample.Key = to
+			moved = append(moved, sample)
+		}
+		clear(sh.history[len(kept):])
+		sh.history = kept
+	}
+	for _, sample := range moved {
+		sh := s.shards[s.shardIndex(sample.Key)]
+		sh.history = append(sh.history, sample)
+		mutations = append(mutations, Mutation{Op: OpWrite, Sample: sample, Stamped: true, History: true})
+	}
+	s.unlockAll()
+
+	if len(written) > 0 {
+		s.notify(written)
+	}
+	if len(mutations) > 0 && len(s.mutations) > 0 {
+		s.notifyMutations(mutations)
+	}
+
+	return len(written)
+}
+
+// SeriesKeys returns the keys starting with prefix of every persisted series,
+// having a latest value, raw samples or rollups.
+func (s *PostgresStorage) SeriesKeys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := likeEscaper.Replace(prefix) + "%"
+	rows, err := s.pool.Query(ctx, `
+		SELECT name FROM metrics WHERE name LIKE $1
+		UNION SELECT DISTINCT name FROM metric_samples WHERE name LIKE $1
+		UNION SELECT DISTINCT name FROM metric_rollups WHERE name LIKE $1`, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query series keys: %w", err)
+	}
+
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read series keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// DeleteSeries deletes the latest values, raw samples and rollups of the given
+// series in a single transaction.
+func (s *PostgresStorage) DeleteSeries(ctx context.Context, keys []string) (models.ExpireStats, error) {
+	var stats models.ExpireStats
+
+	targets := []struct {
+		table string
+		count *int64
+	}{
+		{table: "metric_samples", count: &stats.Samples},
+		{table: "metric_rollups", count: &stats.Rollups},
+		{table: "metrics", count: &stats.Series},
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("failed to init transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	for _, t := range targets {
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE name = ANY($1)`, t.table), keys)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete series from %s: %w", t.table, err)
+		}
+		*t.count = tag.RowsAffected()
+	}
+
+	return stats, tx.Commit(ctx)
+}
+
+// ResetSeries sets the latest value of the given series to zero at time at
+// and records the reset in their raw samples, in a single transaction.
+// Series without a latest value are left alone.
+func (s *PostgresStorage) ResetSeries(ctx context.Context, keys []string, at time.Time) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to init transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO metric_samples (name, ts, value)
+		SELECT name, $2, 0 FROM metrics WHERE name = ANY($1)
+		ON CONFLICT (name, ts) DO UPDATE SET value = EXCLUDED.value`, keys, at); err != nil {
+		return fmt.Errorf("failed to record series reset: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE metrics SET value = 0, updated_at = $2 WHERE name = ANY($1)`, keys, at); err != nil {
+		return fmt.Errorf("failed to reset series: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RenameSeries moves the latest values, raw samples and rollups of every
+// series from a key of renames to the key it maps to, in a single
+// transaction. Target keys are expected not to exist.
+func (s *PostgresStorage) RenameSeries(ctx context.Context, renames map[string]string) error {
+	from := make([]string, 0, len(renames))
+	to := make([]string, 0, len(renames))
+	for old, key := range renames {
+		from = append(from, old)
+		to = append(to, key)
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to init transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	for _, table := range []string{"metrics", "metric_samples", "metric_rollups"} {
+		query := fmt.Sprintf(`UPDATE %s t SET name = r.new FROM unnest($1::text[], $2::text[]) AS r(old, new)
+			WHERE t.name = r.old`, table)
+		if _, err = tx.Exec(ctx, query, from, to); err != nil {
+			return fmt.Errorf("failed to rename series in %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
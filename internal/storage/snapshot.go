@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// rangeFilter renders the conditions restricting rows to series keys starting
+// with prefix and to column values within [start, end], a zero bound being open.
+func rangeFilter(column, prefix string, start, end time.Time) (string, []any) {
+	cond := `TRUE`
+	var args []any
+
+	if prefix != "" {
+		args = append(args, likeEscaper.Replace(prefix)+"%")
+		cond += fmt.Sprintf(` AND name LIKE $%d`, len(args))
+	}
+	if !start.IsZero() {
+		args = append(args, start)
+		cond += fmt.Sprintf(` AND %s >= $%d`, column, len(args))
+	}
+	if !end.IsZero() {
+		args = append(args, end)
+		cond += fmt.Sprintf(` AND %s <= $%d`, column, len(args))
+	}
+
+	return cond, args
+}
+
+// ScanSeries calls fn with the latest persisted value of every series whose key
+// starts with prefix and that was updated within [start, end]. Zero bounds are open.
+func (s *PostgresStorage) ScanSeries(
+	ctx context.Context, prefix string, start, end time.Time, fn func(models.Sample) error,
+) error {
+	cond, args := rangeFilter("updated_at", prefix, start, end)
+	rows, err := s.pool.Query(ctx, `SELECT name, value, updated_at FROM metrics WHERE `+cond+` ORDER BY name`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query series: %w", err)
+	}
+
+	var sample models.Sample
+	_, err = pgx.ForEachRow(rows, []any{&sample.Key, &sample.Value, &sample.Timestamp}, func() error {
+		return fn(sample)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read series: %w", err)
+	}
+
+	return nil
+}
+
+// ScanSamples calls fn with every raw sample of the series whose key starts
+// with prefix recorded within [start, end], ordered by key and time.
+func (s *PostgresStorage) ScanSamples(
+	ctx context.Context, prefix string, start, end time.Time, fn func(models.Sample) error,
+) error {
+	cond, args := rangeFilter("ts", prefix, start, end)
+	rows, err := s.pool.Query(ctx, `SELECT name, ts, value FROM metric_samples WHERE `+cond+` ORDER BY name, ts`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query samples: %w", err)
+	}
+
+	var sample models.Sample
+	_, err = pgx.ForEachRow(rows, []any{&sample.Key, &sample.Timestamp, &sample.Value}, func() error {
+		return fn(sample)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read samples: %w", err)
+	}
+
+	return nil
+}
+
+// ScanRollups calls fn with every rollup bucket of the series whose key starts
+// with prefix and that begins within [start, end], ordered by resolution, key and time.
+func (s *PostgresStorage) ScanRollups(
+	ctx context.Context, prefix string, start, end time.Time, fn func(models.Rollup) error,
+) error {
+	cond, args := rangeFilter("bucket", prefix, start, end)
+	rows, err := s.pool.Query(ctx, `SELECT resolution, name, bucket, min, max, sum, count, last
+		FROM metric_rollups WHERE `+cond+` ORDER BY resolution, name, bucket`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query rollups: %w", err)
+	}
+
+	var r models.Rollup
+	_, err = pgx.ForEachRow(rows, []any{&r.Resolution, &r.Name, &r.Time, &r.Min, &r.Max, &r.Sum, &r.Count, &r.Last},
+		func() error {
+			return fn(r)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to read rollups: %w", err)
+	}
+
+	return nil
+}
+
+// ImportSeries writes latest values, keeping those already persisted with a newer timestamp.
+func (s *PostgresStorage) ImportSeries(ctx context.Context, series []models.Sample) error {
+	batch := &pgx.Batch{}
+	for _, sample := range series {
+		batch.Queue(`INSERT INTO metrics (name, value, updated_at) VALUES ($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at
+			WHERE metrics.updated_at <= EXCLUDED.updated_at`, sample.Key, sample.Value, sample.Timestamp)
+	}
+
+	return s.sendBatch(ctx, batch, "series")
+}
+
+// ImportSamples writes raw samples, replacing existing samples at the same time.
+func (s *PostgresStorage) ImportSamples(ctx context.Context, samples []models.Sample) error {
+	batch := &pgx.Batch{}
+	for _, sample := range samples {
+		batch.Queue(`INSERT INTO metric_samples (name, ts, value) VALUES ($1, $2, $3)
+			ON CONFLICT (name, ts) DO UPDATE SET value = EXCLUDED.value`, sample.Key, sample.Timestamp, sample.Value)
+	}
+
+	return s.sendBatch(ctx, batch, "samples")
+}
+
+// ImportRollups writes rollup buckets, replacing existing buckets.
+func (s *PostgresStorage) ImportRollups(ctx context.Context, rollups []models.Rollup) error {
+	batch := &pgx.Batch{}
+	for _, r := range rollups {
+		batch.Queue(`INSERT INTO metric_rollups (resolution, name, bucket, min, max, sum, count, last)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (resolution, name, bucket) DO UPDATE SET
+				min = EXCLUDED.min, max = EXCLUDED.max, sum = EXCLUDED.sum,
+				count = EXCLUDED.count, last = EXCLUDED.last`,
+			r.Resolution, r.Name, r.Time, r.Min, r.Max, r.Sum, r.Count, r.Last)
+	}
+
+	return s.sendBatch(ctx, batch, "rollups")
+}
+
+// sendBatch runs the queued statements in a single transaction.
+func (s *PostgresStorage) sendBatch(ctx context.Context, batch *pgx.Batch, what string) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", what, err)
+	}
+
+	return nil
+}
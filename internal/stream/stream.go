@@ -0,0 +1,293 @@
+// Package stream fans out metric writes to live subscribers. Every subscriber
+// selects series with PromQL series selectors and receives the updates through
+// a bounded buffer in which rapid updates to the same series are coalesced,
+// so a subscriber only ever sees the latest value. A subscriber whose buffer
+// overflows with distinct series is disconnected as a slow consumer.
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/telemetry"
+)
+
+// DefaultBufferSize is the number of distinct pending series a subscriber may
+// hold when none is configured.
+const DefaultBufferSize = 1024
+
+// ErrSlowConsumer is reported to subscribers disconnected because their buffer overflowed.
+var ErrSlowConsumer = errors.New("slow consumer: update buffer overflowed")
+
+// ErrHubClosed is reported to subscribers when the hub shuts down.
+var ErrHubClosed = errors.New("stream closed")
+
+// Update is the latest value written to a series.
+type Update struct {
+	Key       string            `json:"key"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Hub distributes written samples to subscribers.
+type Hub struct {
+	bufferSize int
+
+	mu     sync.RWMutex
+	subs   map[*Subscriber]struct{}
+	closed bool
+
+	subscribers  *telemetry.Gauge
+	delivered    *telemetry.Counter
+	coalesced    *telemetry.Counter
+	disconnected *telemetry.Counter
+}
+
+// NewHub creates a Hub whose subscribers buffer up to bufferSize distinct series
+// (DefaultBufferSize if not positive), registering its metrics in reg.
+func NewHub(bufferSize int, reg *telemetry.Registry) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	return &Hub{
+		bufferSize: bufferSize,
+		subs:       make(map[*Subscriber]struct{}),
+		subscribers: reg.Gauge("metric_server_stream_subscribers",
+			"Number of connected stream subscribers."),
+		delivered: reg.Counter("metric_server_stream_updates_total",
+			"Total number of updates queued for stream subscribers."),
+		coalesced: reg.Counter("metric_server_stream_coalesced_total",
+			"Total number of updates replaced by a newer value before delivery."),
+		disconnected: reg.Counter("metric_server_stream_slow_consumers_total",
+			"Total number of stream subscribers disconnected as slow consumers."),
+	}
+}
+
+// Subscribe registers a subscriber for the series matching any of the given
+// selectors, or for all series when none are given.
+func (h *Hub) Subscribe(selectors []string) (*Subscriber, error) {
+	filters := make([][]*promql.Matcher, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := promql.ParseSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, matchers)
+	}
+
+	sub := &Subscriber{
+		hub:     h,
+		filters: filters,
+		limit:   h.bufferSize,
+		pending: make(map[string]int),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+	h.subs[sub] = struct{}{}
+	h.subscribers.Set(float64(len(h.subs)))
+
+	return sub, nil
+}
+
+// Unsubscribe removes the subscriber from the hub.
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.remove(sub, nil)
+}
+
+// remove unregisters sub and closes it with err.
+func (h *Hub) remove(sub *Subscriber, err error) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.subscribers.Set(float64(len(h.subs)))
+	h.mu.Unlock()
+
+	sub.close(err)
+}
+
+// Close disconnects all subscribers and refuses new ones.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	subs := h.subs
+	h.subs = make(map[*Subscriber]struct{})
+	h.closed = true
+	h.subscribers.Set(0)
+	h.mu.Unlock()
+
+	for sub := range subs {
+		sub.close(ErrHubClosed)
+	}
+}
+
+// Publish queues the samples for every interested subscriber. It is meant to
+// be registered as a storage write listener and never blocks on subscribers.
+func (h *Hub) Publish(samples []models.Sample) {
+	h.mu.RLock()
+	if len(h.subs) == 0 {
+		h.mu.RUnlock()
+		return
+	}
+	subs := make([]*Subscriber, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.RUnlock()
+
+	for _, sample := range samples {
+		name, labels, err := models.ParseSeriesKey(sample.Key)
+		if err != nil {
+			continue
+		}
+
+		u := Update{Key: sample.Key, Name: name, Labels: labels, Value: sample.Value, Timestamp: sample.Timestamp}
+
+		for _, sub := range subs {
+			if !sub.matches(name, labels) {
+				continue
+			}
+
+			switch sub.offer(u) {
+			case offerQueued:
+				h.delivered.Inc()
+			case offerCoalesced:
+				h.delivered.Inc()
+				h.coalesced.Inc()
+			case offerOverflow:
+				h.disconnected.Inc()
+				h.remove(sub, ErrSlowConsumer)
+			}
+		}
+	}
+}
+
+// offerResult is the outcome of queueing an update for a subscriber.
+type offerResult int
+
+const (
+	offerQueued offerResult = iota
+	offerCoalesced
+	offerOverflow
+	offerClosed
+)
+
+// Subscriber is a live subscription. Ready signals that updates are pending,
+// Done that the subscription ended.
+type Subscriber struct {
+	hub     *Hub
+	filters [][]*promql.Matcher
+	limit   int
+
+	mu      sync.Mutex
+	updates []Update       // pending updates in arrival order of their series
+	pending map[string]int // index into updates by series key
+	closed  bool
+	err     error
+
+	ready chan struct{}
+	done  chan struct{}
+}
+
+func (s *Subscriber) matches(name string, labels map[string]string) bool {
+	if len(s.filters) == 0 {
+		return true
+	}
+
+	for _, matchers := range s.filters {
+		ok := true
+		for _, m := range matchers {
+			v := labels[m.Name]
+			if m.Name == "__name__" {
+				v = name
+			}
+			if !m.Matches(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Subscriber) offer(u Update) offerResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return offerClosed
+	}
+
+	if i, ok := s.pending[u.Key]; ok {
+		s.updates[i] = u
+		return offerCoalesced
+	}
+
+	if len(s.updates) >= s.limit {
+		return offerOverflow
+	}
+
+	s.pending[u.Key] = len(s.updates)
+	s.updates = append(s.updates, u)
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+
+	return offerQueued
+}
+
+// Ready returns a channel that receives a value when updates are pending.
+func (s *Subscriber) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done returns a channel that is closed when the subscription ends.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscription ended: ErrSlowConsumer, ErrHubClosed or nil.
+func (s *Subscriber) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Drain returns and clears the pending updates.
+func (s *Subscriber) Drain() []Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updates := s.updates
+	s.updates = nil
+	clear(s.pending)
+
+	return updates
+}
+
+func (s *Subscriber) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed, s.err = true, err
+	close(s.done)
+}
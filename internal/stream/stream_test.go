@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+func sample(key string, v float64) models.Sample {
+	return models.Sample{Key: key, Value: v, Timestamp: time.Unix(1_700_000_000, 0).UTC()}
+}
+
+func TestHub_Publish(t *testing.T) {
+	tests := []struct {
+		name      string
+		selectors []string
+		samples   []models.Sample
+		expected  []string
+	}{
+		{
+			name:     "no selectors receive everything",
+			samples:  []models.Sample{sample("cpu", 1), sample(`mem{host="a"}`, 2)},
+			expected: []string{"cpu", `mem{host="a"}`},
+		},
+		{
+			name:      "filtered by name",
+			selectors: []string{"cpu"},
+			samples:   []models.Sample{sample("cpu", 1), sample(`mem{host="a"}`, 2)},
+			expected:  []string{"cpu"},
+		},
+		{
+			name:      "filtered by labels across selectors",
+			selectors: []string{`mem{host=~"b|c"}`, `{__name__="disk"}`},
+			samples: []models.Sample{
+				sample(`mem{host="a"}`, 1), sample(`mem{host="b"}`, 2), sample(`disk{host="a"}`, 3),
+			},
+			expected: []string{`mem{host="b"}`, `disk{host="a"}`},
+		},
+		{
+			name:     "rapid updates coalesced",
+			samples:  []models.Sample{sample("cpu", 1), sample("mem", 2), sample("cpu", 3)},
+			expected: []string{"cpu", "mem"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub(10, nil)
+			sub, err := hub.Subscribe(tt.selectors)
+			require.NoError(t, err)
+
+			hub.Publish(tt.samples)
+
+			if len(tt.expected) > 0 {
+				<-sub.Ready()
+			}
+			updates := sub.Drain()
+			keys := make([]string, len(updates))
+			for i, u := range updates {
+				keys[i] = u.Key
+			}
+			require.Equal(t, tt.expected, keys)
+		})
+	}
+}
+
+func TestHub_PublishKeepsLatestValue(t *testing.T) {
+	hub := NewHub(10, nil)
+	sub, err := hub.Subscribe(nil)
+	require.NoError(t, err)
+
+	hub.Publish([]models.Sample{sample(`cpu{host="a"}`, 1)})
+	hub.Publish([]models.Sample{sample(`cpu{host="a"}`, 2)})
+
+	updates := sub.Drain()
+	require.Len(t, updates, 1)
+	require.Equal(t, 2.0, updates[0].Value)
+	require.Equal(t, "cpu", updates[0].Name)
+	require.Equal(t, map[string]string{"host": "a"}, updates[0].Labels)
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	hub := NewHub(2, nil)
+	slow, err := hub.Subscribe(nil)
+	require.NoError(t, err)
+	other, err := hub.Subscribe([]string{"cpu"})
+	require.NoError(t, err)
+
+	hub.Publish([]models.Sample{sample("cpu", 1), sample("mem", 2), sample("disk", 3)})
+
+	<-slow.Done()
+	require.ErrorIs(t, slow.Err(), ErrSlowConsumer)
+
+	select {
+	case <-other.Done():
+		t.Fatal("subscriber within its buffer was disconnected")
+	default:
+	}
+	require.Len(t, other.Drain(), 1)
+}
+
+func TestHub_Close(t *testing.T) {
+	hub := NewHub(0, nil)
+	sub, err := hub.Subscribe(nil)
+	require.NoError(t, err)
+
+	hub.Close()
+	<-sub.Done()
+	require.ErrorIs(t, sub.Err(), ErrHubClosed)
+
+	_, err = hub.Subscribe(nil)
+	require.ErrorIs(t, err, ErrHubClosed)
+}
+
+func TestHub_SubscribeInvalidSelector(t *testing.T) {
+	_, err := NewHub(0, nil).Subscribe([]string{`cpu{host=}`})
+	require.Error(t, err)
+}
@@ -0,0 +1,142 @@
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sample is a single exported value, with labels already rendered into the name.
+type sample struct {
+	name  string
+	value float64
+}
+
+// collect renders every instrument of the family into flat samples.
+func (f *family) collect() []sample {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var samples []sample
+
+	for _, key := range f.order {
+		var values []string
+		if len(f.labelNames) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+
+		switch c := f.children[key].(type) {
+		case *Counter:
+			samples = append(samples, sample{seriesName(f.name, f.labelNames, values), c.Value()})
+		case *Gauge:
+			samples = append(samples, sample{seriesName(f.name, f.labelNames, values), c.Value()})
+		case func() float64:
+			samples = append(samples, sample{seriesName(f.name, f.labelNames, values), c()})
+		case *Histogram:
+			samples = append(samples, c.collect(f.name, f.labelNames, values)...)
+		}
+	}
+
+	return samples
+}
+
+func (h *Histogram) collect(name string, labelNames, values []string) []sample {
+	samples := make([]sample, 0, len(h.upperBounds)+3)
+	bucketLabels := append(append([]string{}, labelNames...), "le")
+
+	var cumulative uint64
+	for i, bound := range h.upperBounds {
+		cumulative += h.counts[i].Load()
+		bucketValues := append(append([]string{}, values...), formatFloat(bound))
+		samples = append(samples, sample{seriesName(name+"_bucket", bucketLabels, bucketValues), float64(cumulative)})
+	}
+
+	count := h.Count()
+	infValues := append(append([]string{}, values...), "+Inf")
+
+	return append(samples,
+		sample{seriesName(name+"_bucket", bucketLabels, infValues), float64(count)},
+		sample{seriesName(name+"_sum", labelNames, values), h.Sum()},
+		sample{seriesName(name+"_count", labelNames, values), float64(count)},
+	)
+}
+
+// seriesName renders name{label="value",...} for the given label names and values.
+func seriesName(name string, labelNames, values []string) string {
+	if len(labelNames) == 0 {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range labelNames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, "%s=%q", label, value)
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func (r *Registry) snapshotFamilies() []*family {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	families := make([]*family, 0, len(r.order))
+	for _, name := range r.order {
+		families = append(families, r.families[name])
+	}
+
+	return families
+}
+
+// WriteText writes all registered instruments to w in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for _, f := range r.snapshotFamilies() {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.collect() {
+			fmt.Fprintf(bw, "%s %s\n", s.name, formatFloat(s.value))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Snapshot returns the current value of every exported series keyed by its rendered name.
+func (r *Registry) Snapshot() map[string]float64 {
+	snapshot := make(map[string]float64)
+
+	for _, f := range r.snapshotFamilies() {
+		for _, s := range f.collect() {
+			snapshot[s.name] = s.value
+		}
+	}
+
+	return snapshot
+}
+
+// Handler returns an http.Handler serving the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, "failed to write metrics", http.StatusInternalServerError)
+		}
+	})
+}
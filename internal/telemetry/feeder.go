@@ -0,0 +1,50 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+)
+
+// Store defines the interface for the metric store that self-instrumentation
+// values are written back into.
+type Store interface {
+	Set(name string, value float64)
+}
+
+// Feeder periodically copies the registry's values into the metric store under
+// ReservedPrefix, so the server's own health is persisted like any other metric.
+type Feeder struct {
+	interval time.Duration
+	registry *Registry
+	store    Store
+}
+
+// NewFeeder creates a new Feeder writing registry values into store every interval.
+func NewFeeder(interval time.Duration, registry *Registry, store Store) *Feeder {
+	return &Feeder{
+		interval: interval,
+		registry: registry,
+		store:    store,
+	}
+}
+
+// Run feeds values on every tick and blocks until the context is canceled.
+func (f *Feeder) Run(ctx context.Context) error {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			f.feed()
+		}
+	}
+}
+
+func (f *Feeder) feed() {
+	for name, value := range f.registry.Snapshot() {
+		f.store.Set(ReservedPrefix+name, value)
+	}
+}
@@ -0,0 +1,256 @@
+// Package telemetry provides self-instrumentation for the metric server.
+// It implements a small set of lock-free instruments (counters, gauges and
+// histograms) grouped in a Registry that can be exposed in the Prometheus
+// text exposition format and fed back into the server's own metric store.
+package telemetry
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// ReservedPrefix is prepended to self-instrumentation metrics when they are
+// written back into the metric store. Client metrics using it are rejected.
+const ReservedPrefix = models.ReservedPrefix
+
+// DefaultBuckets are histogram buckets suited for request and flush latencies, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds the set of instrument families exposed by the server.
+// A nil *Registry is valid: instruments created from it work but are not exported.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	order    []string
+}
+
+// NewRegistry creates and returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// family is a named group of instruments sharing type, help text and label names.
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+
+	mu       sync.Mutex
+	children map[string]any
+	order    []string
+}
+
+func (r *Registry) family(name, help, typ string, labelNames []string, buckets []float64) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		children:   make(map[string]any),
+	}
+
+	if r == nil {
+		return f
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.families[name]; ok {
+		return existing
+	}
+
+	r.families[name] = f
+	r.order = append(r.order, name)
+
+	return f
+}
+
+// child returns the instrument for the given label values, creating it with newFn if needed.
+func (f *family) child(values []string, newFn func() any) any {
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c, ok := f.children[key]; ok {
+		return c
+	}
+
+	c := newFn()
+	f.children[key] = c
+	f.order = append(f.order, key)
+
+	return c
+}
+
+// Counter registers (or returns the existing) unlabeled counter with the given name.
+func (r *Registry) Counter(name, help string) *Counter {
+	return r.CounterVec(name, help).With()
+}
+
+// CounterVec registers a counter family partitioned by the given label names.
+func (r *Registry) CounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: r.family(name, help, typeCounter, labelNames, nil)}
+}
+
+// Gauge registers (or returns the existing) unlabeled gauge with the given name.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	f := r.family(name, help, typeGauge, nil, nil)
+	return f.child(nil, func() any { return &Gauge{} }).(*Gauge)
+}
+
+// GaugeFunc registers a gauge whose value is obtained by calling fn at collection time.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	f := r.family(name, help, typeGauge, nil, nil)
+	f.child(nil, func() any { return fn })
+}
+
+// CounterFunc registers a counter whose value is obtained by calling fn at collection time.
+// It is meant for monotonic values maintained elsewhere, such as connection pool statistics.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	f := r.family(name, help, typeCounter, nil, nil)
+	f.child(nil, func() any { return fn })
+}
+
+// Histogram registers (or returns the existing) unlabeled histogram with the given buckets.
+// Buckets must be sorted in increasing order; DefaultBuckets is used when none are given.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	f := r.family(name, help, typeHistogram, nil, buckets)
+
+	return f.child(nil, func() any { return newHistogram(f.buckets) }).(*Histogram)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by v. Negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current counter value.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the given label values, in the order of the family's label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.child(values, func() any { return &Counter{} }).(*Counter)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds v (which may be negative) to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram samples observations and counts them in configurable buckets.
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64
+	count       atomic.Uint64
+	sum         atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	addFloat(&h.sum, v)
+}
+
+// Count returns the total number of observations.
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sum.Load())
+}
+
+// addFloat atomically adds v to the float64 stored as bits in u.
+func addFloat(u *atomic.Uint64, v float64) {
+	for {
+		old := u.Load()
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if u.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// formatFloat renders v the way the Prometheus text format expects it.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
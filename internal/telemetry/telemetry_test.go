@@ -0,0 +1,92 @@
+package telemetry
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	reg := NewRegistry()
+
+	reg.Counter("requests_total", "Requests.").Add(3)
+	reg.Gauge("batch_size", "Batch size.").Set(7)
+	reg.CounterVec("drops_total", "Drops.", "rule").With("deny").Inc()
+	reg.GaugeFunc("series", "Series.", func() float64 { return 42 })
+
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, reg.WriteText(&buf))
+
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		"requests_total 3",
+		"batch_size 7",
+		`drops_total{rule="deny"} 1`,
+		"series 42",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{le="0.1"} 1`,
+		`latency_seconds_bucket{le="1"} 2`,
+		`latency_seconds_bucket{le="+Inf"} 3`,
+		"latency_seconds_sum 5.55",
+		"latency_seconds_count 3",
+	} {
+		require.Contains(t, out, line+"\n")
+	}
+}
+
+func TestRegistry_Snapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*Registry)
+		expected map[string]float64
+	}{
+		{
+			name:     "empty registry",
+			setup:    func(_ *Registry) {},
+			expected: map[string]float64{},
+		},
+		{
+			name: "same name returns same instrument",
+			setup: func(r *Registry) {
+				r.Counter("c", "").Inc()
+				r.Counter("c", "").Inc()
+			},
+			expected: map[string]float64{"c": 2},
+		},
+		{
+			name: "negative counter increments ignored",
+			setup: func(r *Registry) {
+				c := r.Counter("c", "")
+				c.Add(2)
+				c.Add(-1)
+				r.Gauge("g", "").Add(-1)
+			},
+			expected: map[string]float64{"c": 2, "g": -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry()
+			tt.setup(reg)
+			require.Equal(t, tt.expected, reg.Snapshot())
+		})
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var reg *Registry
+
+	c := reg.Counter("c", "")
+	c.Inc()
+
+	require.Equal(t, 1.0, c.Value())
+	require.Empty(t, reg.Snapshot())
+}
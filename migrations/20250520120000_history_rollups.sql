@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE metric_samples
+(
+    name  TEXT             NOT NULL,
+    ts    TIMESTAMPTZ      NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (name, ts)
+);
+
+CREATE INDEX metric_samples_ts_idx ON metric_samples (ts);
+
+CREATE TABLE metric_rollups
+(
+    resolution INTEGER          NOT NULL,
+    name       TEXT             NOT NULL,
+    bucket     TIMESTAMPTZ      NOT NULL,
+    min        DOUBLE PRECISION NOT NULL,
+    max        DOUBLE PRECISION NOT NULL,
+    sum        DOUBLE PRECISION NOT NULL,
+    count      BIGINT           NOT NULL,
+    last       DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (resolution, name, bucket)
+);
+
+CREATE INDEX metric_rollups_bucket_idx ON metric_rollups (resolution, bucket);
+
+-- +goose Down
+DROP TABLE metric_rollups;
+DROP TABLE metric_samples;
@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE idempotency_keys
+(
+    key        TEXT PRIMARY KEY,
+    status     INTEGER     NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+-- +goose Down
+DROP TABLE idempotency_keys;
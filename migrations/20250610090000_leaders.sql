@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE leaders
+(
+    lock_id    BIGINT PRIMARY KEY,
+    url        TEXT        NOT NULL,
+    elected_at TIMESTAMPTZ NOT NULL
+);
+
+-- +goose Down
+DROP TABLE leaders;
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL schema migrations into the binary. They
+// are written for goose and applied by the storage package.
+package migrations
+
+import "embed"
+
+// FS holds the migration files.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"database/sql"
+	"io/fs"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	files, err := fs.Glob(FS, "*.sql")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	// The database is opened lazily and never connected to.
+	cfg, err := pgx.ParseConfig("postgres://localhost/metrics")
+	require.NoError(t, err)
+	db := sql.OpenDB(stdlib.GetConnector(*cfg))
+	defer func() {
+		_ = db.Close()
+	}()
+
+	p, err := goose.NewProvider(goose.DialectPostgres, db, FS)
+	require.NoError(t, err)
+
+	sources := p.ListSources()
+	require.Len(t, sources, len(files))
+	for i := 1; i < len(sources); i++ {
+		require.Greater(t, sources[i].Version, sources[i-1].Version)
+	}
+}
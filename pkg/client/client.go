@@ -0,0 +1,416 @@
+// Package client is a Go client for the metric server HTTP API. It pushes
+// metrics, reads current values, runs PromQL queries, follows the live update
+// stream and drives the administrative endpoints.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/codec"
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// Metric is a single measurement pushed to the server.
+type Metric = models.Metric
+
+// Sample is the current value of a series, identified by its series key.
+type Sample = models.Sample
+
+// Header names identifying the sender and retried pushes, mirrored from the server.
+const (
+	HeaderClientID       = "X-Client-ID"
+	HeaderTenantID       = "X-Tenant-ID"
+	HeaderIdempotencyKey = "Idempotency-Key"
+)
+
+// APIError is returned when the server answers with an unexpected status code.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Format is the payload format of pushed metrics.
+type Format string
+
+// Supported push formats, see proto/metrics.proto for the protobuf schema.
+const (
+	FormatJSON     Format = codec.ContentTypeJSON
+	FormatProtobuf Format = codec.ContentTypeProtobuf
+	FormatMsgpack  Format = codec.ContentTypeMsgpack
+)
+
+// Client talks to a metric server. It is safe for concurrent use.
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+	gzip    bool
+	format  Format
+	header  http.Header
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests. Streaming requests
+// run until canceled, so it should not set an overall timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithGzip compresses pushed payloads with gzip.
+func WithGzip() Option {
+	return func(c *Client) {
+		c.gzip = true
+	}
+}
+
+// WithFormat sets the payload format of pushed metrics (JSON by default).
+func WithFormat(f Format) Option {
+	return func(c *Client) {
+		c.format = f
+	}
+}
+
+// WithClientID identifies the sender for per-client cardinality limits.
+func WithClientID(id string) Option {
+	return func(c *Client) {
+		c.header.Set(HeaderClientID, id)
+	}
+}
+
+// WithTenantID identifies the tenant for per-tenant cardinality limits.
+func WithTenantID(id string) Option {
+	return func(c *Client) {
+		c.header.Set(HeaderTenantID, id)
+	}
+}
+
+// WithToken authenticates requests to the administrative endpoints, such as
+// flushes and snapshots, with the admin token of the server.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// New creates a Client for the server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", baseURL)
+	}
+
+	c := &Client{baseURL: u, http: http.DefaultClient, format: FormatJSON, header: make(http.Header)}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	switch c.format {
+	case FormatJSON, FormatProtobuf, FormatMsgpack:
+	default:
+		return nil, fmt.Errorf("unsupported format %q", c.format)
+	}
+
+	return c, nil
+}
+
+// Push sends metrics to POST /update. A batch partially refused by cardinality
+// limits returns an *APIError with status 429; the other metrics were stored.
+func (c *Client) Push(ctx context.Context, metrics []Metric) error {
+	return c.PushWithKey(ctx, "", metrics)
+}
+
+// PushWithKey sends metrics like Push with an idempotency key, so that pushing
+// the same batch again with the same key after an error, such as a timeout, is
+// acknowledged by the server without being applied twice. An empty key sends
+// none. A retry racing the original request fails with status 409.
+func (c *Client) PushWithKey(ctx context.Context, key string, metrics []Metric) error {
+	var encoded bytes.Buffer
+	err := codec.ForContentType(string(c.format)).Encode(&encoded, metrics)
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %w", err)
+	}
+	body := encoded.Bytes()
+
+	header := make(http.Header)
+	header.Set("Content-Type", string(c.format))
+	if key != "" {
+		header.Set(HeaderIdempotencyKey, key)
+	}
+
+	if c.gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err = gz.Write(body); err != nil {
+			return err
+		}
+		if err = gz.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/update", nil, bytes.NewReader(body), header)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// NewIdempotencyKey returns a random key for PushWithKey.
+func NewIdempotencyKey() string {
+	return rand.Text()
+}
+
+// Values returns the current values of the series whose key starts with prefix,
+// restricted to the given metric names if any.
+func (c *Client) Values(ctx context.Context, prefix string, names ...string) ([]Sample, error) {
+	q := url.Values{"name": names}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+
+	var samples []Sample
+	if err := c.getJSON(ctx, "/values", q, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// apiResponse is the envelope of the Prometheus-compatible API.
+type apiResponse struct {
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  string          `json:"error"`
+}
+
+// Names returns the names of all known metrics.
+func (c *Client) Names(ctx context.Context) ([]string, error) {
+	var names []string
+	if err := c.api(ctx, "/api/v1/label/__name__/values", nil, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// QueryResult is the result of a PromQL query: its type ("scalar", "vector"
+// or "matrix") and the result in the Prometheus API JSON format.
+type QueryResult struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// Query evaluates a PromQL expression at ts, or at the server's current time if ts is zero.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (QueryResult, error) {
+	q := url.Values{"query": {query}}
+	if !ts.IsZero() {
+		q.Set("time", strconv.FormatFloat(float64(ts.UnixMilli())/1000, 'f', -1, 64))
+	}
+
+	var res QueryResult
+	err := c.api(ctx, "/api/v1/query", q, &res)
+	return res, err
+}
+
+// Update is a live update of a series received from the stream.
+type Update struct {
+	Key       string            `json:"key"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Stream follows GET /stream, calling fn for every update of the series
+// matching any of the selectors (all series if none), until ctx is canceled,
+// fn returns an error or the server ends the stream.
+func (c *Client) Stream(ctx context.Context, selectors []string, fn func(Update) error) error {
+	header := make(http.Header)
+	header.Set("Accept", "text/event-stream")
+
+	resp, err := c.do(ctx, http.MethodGet, "/stream", url.Values{"match[]": selectors}, nil, header)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && event != "":
+			switch event {
+			case "update":
+				var u Update
+				if err = json.Unmarshal([]byte(data), &u); err != nil {
+					return fmt.Errorf("invalid stream update: %w", err)
+				}
+				if err = fn(u); err != nil {
+					return err
+				}
+			case "error":
+				return fmt.Errorf("stream ended by server: %s", data)
+			}
+			event, data = "", ""
+		}
+	}
+
+	if err = scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Flush makes the server persist its in-memory metrics and returns their number.
+func (c *Client) Flush(ctx context.Context) (int, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/admin/flush", nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var res struct {
+		Flushed int `json:"flushed"`
+	}
+	return res.Flushed, decode(resp, &res)
+}
+
+// Snapshot downloads a snapshot of the store into w, restricted to the series
+// whose key starts with prefix and to the data within [start, end] (zero bounds are open).
+func (c *Client) Snapshot(ctx context.Context, w io.Writer, prefix string, start, end time.Time) error {
+	q := url.Values{}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if !start.IsZero() {
+		q.Set("start", start.Format(time.RFC3339Nano))
+	}
+	if !end.IsZero() {
+		q.Set("end", end.Format(time.RFC3339Nano))
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/admin/snapshot", q, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Health returns nil if the server and its database are available.
+func (c *Client) Health(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/health", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return drain(resp)
+}
+
+// do sends a request and returns the response if its status is 2xx, an *APIError otherwise.
+func (c *Client) do(
+	ctx context.Context, method, path string, q url.Values, body io.Reader, header http.Header,
+) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, q url.Values, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, q, nil, nil)
+	if err != nil {
+		return err
+	}
+	return decode(resp, v)
+}
+
+// api calls an endpoint of the Prometheus-compatible API and decodes its data into v.
+func (c *Client) api(ctx context.Context, path string, q url.Values, v any) error {
+	var res apiResponse
+
+	err := c.getJSON(ctx, path, q, &res)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Message), &res) == nil && res.Error != "" {
+		apiErr.Message = res.Error
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(res.Data, v)
+}
+
+func decode(resp *http.Response, v any) error {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
+
+func drain(resp *http.Response) error {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
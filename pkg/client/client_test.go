@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sanchey92/metric-server/internal/config"
+	"github.com/sanchey92/metric-server/internal/dedup"
+	"github.com/sanchey92/metric-server/internal/http-server/handler"
+	"github.com/sanchey92/metric-server/internal/http-server/router"
+	"github.com/sanchey92/metric-server/internal/promql"
+	"github.com/sanchey92/metric-server/internal/storage"
+	"github.com/sanchey92/metric-server/internal/stream"
+)
+
+// newRouter returns the real router over an in-memory store.
+// adminToken is the token of the administrative endpoints of the test servers.
+const adminToken = "secret"
+
+func newRouter(t *testing.T) (http.Handler, *storage.MemStorage) {
+	t.Helper()
+
+	mem := storage.NewMemStorage(4)
+	hub := stream.NewHub(0, nil)
+	mem.AddListener(hub.Publish)
+	t.Cleanup(hub.Close)
+
+	h := handler.New(mem,
+		handler.WithValues(mem),
+		handler.WithDeduplicator(dedup.New(config.Idempotency{}, nil)),
+		handler.WithQueryEngine(promql.NewEngine(promql.NewStorage(nil, mem))),
+		handler.WithStream(hub, time.Hour),
+	)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	return router.New(log, h, router.WithAdminToken(adminToken),
+		router.WithOps(h), router.WithQueryAPI(h), router.WithStream(h.HandleStream)), mem
+}
+
+// newServer runs the real router over an in-memory store.
+func newServer(t *testing.T) (*httptest.Server, *storage.MemStorage) {
+	t.Helper()
+
+	r, mem := newRouter(t)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return srv, mem
+}
+
+func TestClient_PushAndRead(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "plain"},
+		{name: "gzip", opts: []Option{WithGzip()}},
+		{name: "protobuf", opts: []Option{WithFormat(FormatProtobuf)}},
+		{name: "msgpack gzip", opts: []Option{WithFormat(FormatMsgpack), WithGzip()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newServer(t)
+
+			c, err := New(srv.URL, tt.opts...)
+			require.NoError(t, err)
+			ctx := context.Background()
+
+			require.NoError(t, c.Health(ctx))
+			require.NoError(t, c.Push(ctx, []Metric{
+				{Name: "cpu", MType: "gauge", Value: 0.5, Labels: map[string]string{"host": "a"}},
+				{Name: "mem", MType: "gauge", Value: 42},
+			}))
+
+			samples, err := c.Values(ctx, "", "cpu")
+			require.NoError(t, err)
+			require.Len(t, samples, 1)
+			require.Equal(t, `cpu{host="a"}`, samples[0].Key)
+			require.Equal(t, 0.5, samples[0].Value)
+
+			names, err := c.Names(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []string{"cpu", "mem"}, names)
+
+			res, err := c.Query(ctx, "sum(cpu) + mem", time.Time{})
+			require.NoError(t, err)
+			require.Equal(t, "vector", res.ResultType)
+		})
+	}
+}
+
+func TestClient_PushWithKey(t *testing.T) {
+	srv, mem := newServer(t)
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	key := NewIdempotencyKey()
+	require.NotEmpty(t, key)
+	require.NotEqual(t, key, NewIdempotencyKey())
+
+	require.NoError(t, c.PushWithKey(ctx, key, []Metric{{Name: "cpu", MType: "gauge", Value: 1}}))
+	// A retry of the same request is acknowledged without being applied.
+	require.NoError(t, c.PushWithKey(ctx, key, []Metric{{Name: "cpu", MType: "gauge", Value: 2}}))
+	require.Equal(t, 1.0, mem.Snapshot()["cpu"])
+
+	require.NoError(t, c.PushWithKey(ctx, NewIdempotencyKey(), []Metric{{Name: "cpu", MType: "gauge", Value: 3}}))
+	require.Equal(t, 3.0, mem.Snapshot()["cpu"])
+}
+
+func TestClient_Errors(t *testing.T) {
+	srv, _ := newServer(t)
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	_, err = c.Flush(context.Background())
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	admin, err := New(srv.URL, WithToken(adminToken))
+	require.NoError(t, err)
+	_, err = admin.Flush(context.Background())
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+
+	_, err = c.Query(context.Background(), "sum(", time.Time{})
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.Contains(t, apiErr.Message, "parse error")
+
+	_, err = New("localhost:8080")
+	require.Error(t, err)
+	_, err = New(srv.URL, WithFormat("text/csv"))
+	require.Error(t, err)
+}
+
+func TestClient_Stream(t *testing.T) {
+	srv, mem := newServer(t)
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errStop := errors.New("stop")
+	got := make(chan Update, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Stream(ctx, []string{"cpu"}, func(u Update) error {
+			got <- u
+			return errStop
+		})
+	}()
+
+	// Keep writing until the subscription is registered and the update arrives.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case u := <-got:
+			require.Equal(t, "cpu", u.Name)
+			require.Equal(t, 7.0, u.Value)
+			require.ErrorIs(t, <-done, errStop)
+			return
+		case <-ticker.C:
+			mem.Set("mem", 1)
+			mem.Set("cpu", 7)
+		case <-ctx.Done():
+			t.Fatal("no update received")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are histogram buckets suited for latencies, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric types sent by the instruments.
+const (
+	TypeGauge     = "gauge"
+	TypeCounter   = "counter"
+	TypeHistogram = "histogram"
+)
+
+// instrument is a handle aggregating values locally between flushes.
+type instrument interface {
+	// collect appends the current state of the instrument to metrics if it
+	// changed since the previous call.
+	collect(metrics []Metric) []Metric
+}
+
+// dirtyFlag tracks whether an instrument changed since it was last collected
+// and reports the first change after a collection to the reporter.
+type dirtyFlag struct {
+	dirty  atomic.Bool
+	notify func()
+}
+
+func (d *dirtyFlag) mark() {
+	if !d.dirty.Swap(true) {
+		d.notify()
+	}
+}
+
+// take clears the flag and reports whether it was set. It must be called
+// before reading the value so that concurrent updates are collected next time.
+func (d *dirtyFlag) take() bool {
+	return d.dirty.Swap(false)
+}
+
+// Gauge is a value that can go up and down. Only the latest value set
+// between two flushes is sent.
+type Gauge struct {
+	metric Metric
+	bits   atomic.Uint64
+	flag   dirtyFlag
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+	g.flag.mark()
+}
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+	g.flag.mark()
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) collect(metrics []Metric) []Metric {
+	if !g.flag.take() {
+		return metrics
+	}
+	m := g.metric
+	m.Value = g.Value()
+	return append(metrics, m)
+}
+
+// Counter is a monotonically increasing value. Its running total is sent, so
+// that rates are computed on the server as for any cumulative counter.
+type Counter struct {
+	metric Metric
+	bits   atomic.Uint64
+	flag   dirtyFlag
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by v. Negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.bits, v)
+	c.flag.mark()
+}
+
+// Value returns the running total of the counter.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (c *Counter) collect(metrics []Metric) []Metric {
+	if !c.flag.take() {
+		return metrics
+	}
+	m := c.metric
+	m.Value = c.Value()
+	return append(metrics, m)
+}
+
+// Histogram counts observations in cumulative buckets. It is sent as the
+// name_bucket{le="..."}, name_sum and name_count series that
+// histogram_quantile expects.
+type Histogram struct {
+	bounds  []float64 // sorted upper bounds, ending with +Inf
+	buckets []Metric  // one per upper bound
+	sum     Metric
+	count   Metric
+	flag    dirtyFlag
+
+	mu     sync.Mutex
+	counts []uint64
+	total  float64
+	n      uint64
+}
+
+func newHistogram(name string, buckets []float64, labels map[string]string, notify func()) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	bounds := slices.Clone(buckets)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	if !math.IsInf(bounds[len(bounds)-1], 1) {
+		bounds = append(bounds, math.Inf(1))
+	}
+
+	h := &Histogram{
+		bounds:  bounds,
+		buckets: make([]Metric, len(bounds)),
+		sum:     Metric{Name: name + "_sum", MType: TypeHistogram, Labels: labels},
+		count:   Metric{Name: name + "_count", MType: TypeHistogram, Labels: labels},
+		flag:    dirtyFlag{notify: notify},
+		counts:  make([]uint64, len(bounds)),
+	}
+	for i, bound := range bounds {
+		le := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			le[k] = v
+		}
+		le["le"] = formatBound(bound)
+		h.buckets[i] = Metric{Name: name + "_bucket", MType: TypeHistogram, Labels: le}
+	}
+
+	return h
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(v float64) {
+	// The first bucket whose upper bound is at least v.
+	i, _ := slices.BinarySearch(h.bounds, v)
+
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.total += v
+	h.n++
+	h.mu.Unlock()
+
+	h.flag.mark()
+}
+
+func (h *Histogram) collect(metrics []Metric) []Metric {
+	if !h.flag.take() {
+		return metrics
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, m := range h.buckets {
+		cumulative += h.counts[i]
+		m.Value = float64(cumulative)
+		metrics = append(metrics, m)
+	}
+
+	sum, count := h.sum, h.count
+	sum.Value, count.Value = h.total, float64(h.n)
+
+	return append(metrics, sum, count)
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// addFloat atomically adds v to the float64 stored in bits.
+func addFloat(bits *atomic.Uint64, v float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sanchey92/metric-server/internal/models"
+)
+
+// DropPolicy selects which metrics are discarded when the reporter's buffer is full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest buffered metrics to make room for new ones.
+	DropOldest DropPolicy = iota
+	// DropNewest discards the metrics that do not fit in the buffer.
+	DropNewest
+)
+
+// Reporter defaults.
+const (
+	DefaultFlushInterval = 10 * time.Second
+	DefaultBatchSize     = 500
+	DefaultBufferSize    = 10000
+	DefaultMaxRetries    = 3
+	DefaultMinBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff    = 5 * time.Second
+)
+
+// ErrReporterClosed is returned by Flush after Close.
+var ErrReporterClosed = errors.New("reporter is closed")
+
+// ReporterStats counts what a Reporter did with the collected metrics.
+type ReporterStats struct {
+	// Sent is the number of metrics accepted by the server.
+	Sent uint64
+	// Dropped is the number of metrics discarded because the buffer was full.
+	Dropped uint64
+	// Failed is the number of metrics refused by the server and not retried.
+	Failed uint64
+	// Buffered is the number of metrics waiting to be sent.
+	Buffered int
+}
+
+// Reporter aggregates values in Gauge, Counter and Histogram handles and pushes
+// them in the background. Every flush interval, or as soon as batch size series
+// have changed, the changed series are appended to a bounded buffer that is sent
+// in batches, retrying transient failures with exponential backoff. Metrics of
+// failed batches stay buffered for the next flush. It is safe for concurrent use.
+type Reporter struct {
+	client     *Client
+	interval   time.Duration
+	batchSize  int
+	bufferSize int
+	drop       DropPolicy
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	onError    func(error)
+
+	// mu guards the instrument registry.
+	mu          sync.Mutex
+	instruments []instrument
+	gauges      map[string]*Gauge
+	counters    map[string]*Counter
+	histograms  map[string]*Histogram
+
+	// bufMu guards the buffer of collected metrics.
+	bufMu  sync.Mutex
+	buffer []Metric
+
+	// sendMu serializes flushes.
+	sendMu sync.Mutex
+
+	changed atomic.Int64
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	kick    chan struct{}
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	closed  atomic.Bool
+	once    sync.Once
+}
+
+// ReporterOption configures a Reporter.
+type ReporterOption func(*Reporter)
+
+// WithFlushInterval sets how often changed series are pushed.
+func WithFlushInterval(d time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.interval = d
+	}
+}
+
+// WithBatchSize sets the maximum number of metrics per request. A flush is also
+// started early once that many series have changed.
+func WithBatchSize(n int) ReporterOption {
+	return func(r *Reporter) {
+		r.batchSize = n
+	}
+}
+
+// WithBufferSize bounds the number of metrics waiting to be sent and sets what
+// is discarded when the bound is reached.
+func WithBufferSize(n int, policy DropPolicy) ReporterOption {
+	return func(r *Reporter) {
+		r.bufferSize = n
+		r.drop = policy
+	}
+}
+
+// WithRetry sets how many times a failed batch is retried within a flush and
+// the bounds of the exponential backoff between attempts.
+func WithRetry(maxRetries int, minBackoff, maxBackoff time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.maxRetries = maxRetries
+		r.minBackoff = minBackoff
+		r.maxBackoff = maxBackoff
+	}
+}
+
+// WithErrorHandler sets a function called with the errors of background flushes.
+func WithErrorHandler(fn func(error)) ReporterOption {
+	return func(r *Reporter) {
+		r.onError = fn
+	}
+}
+
+// NewReporter creates a Reporter pushing through c and starts its background
+// flushes. Use WithGzip on c to compress the batches. Close must be called to
+// stop it and send the remaining metrics.
+func NewReporter(c *Client, opts ...ReporterOption) *Reporter {
+	r := &Reporter{
+		client:     c,
+		interval:   DefaultFlushInterval,
+		batchSize:  DefaultBatchSize,
+		bufferSize: DefaultBufferSize,
+		drop:       DropOldest,
+		maxRetries: DefaultMaxRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		onError:    func(error) {},
+		gauges:     make(map[string]*Gauge),
+		counters:   make(map[string]*Counter),
+		histograms: make(map[string]*Histogram),
+		kick:       make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.batchSize = max(r.batchSize, 1)
+	r.bufferSize = max(r.bufferSize, 1)
+	r.minBackoff = max(r.minBackoff, time.Millisecond)
+	r.maxBackoff = max(r.maxBackoff, r.minBackoff)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.run(ctx)
+
+	return r
+}
+
+// Gauge returns the gauge with the given name and labels, creating it if needed.
+func (r *Reporter) Gauge(name string, labels map[string]string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := models.SeriesKey(name, labels)
+	if g, ok := r.gauges[key]; ok {
+		return g
+	}
+
+	g := &Gauge{metric: Metric{Name: name, MType: TypeGauge, Labels: labels}}
+	g.flag.notify = r.notifyChange
+	r.gauges[key] = g
+	r.instruments = append(r.instruments, g)
+
+	return g
+}
+
+// Counter returns the counter with the given name and labels, creating it if needed.
+func (r *Reporter) Counter(name string, labels map[string]string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := models.SeriesKey(name, labels)
+	if c, ok := r.counters[key]; ok {
+		return c
+	}
+
+	c := &Counter{metric: Metric{Name: name, MType: TypeCounter, Labels: labels}}
+	c.flag.notify = r.notifyChange
+	r.counters[key] = c
+	r.instruments = append(r.instruments, c)
+
+	return c
+}
+
+// Histogram returns the histogram with the given name and labels, creating it
+// with the given bucket upper bounds (DefaultBuckets if none) if needed.
+func (r *Reporter) Histogram(name string, buckets []float64, labels map[string]string) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := models.SeriesKey(name, labels)
+	if h, ok := r.histograms[key]; ok {
+		return h
+	}
+
+	h := newHistogram(name, buckets, labels, r.notifyChange)
+	r.histograms[key] = h
+	r.instruments = append(r.instruments, h)
+
+	return h
+}
+
+// notifyChange is called when an instrument changes for the first time since it
+// was collected, and starts a flush once batch size instruments have changed.
+func (r *Reporter) notifyChange() {
+	if r.changed.Add(1) >= int64(r.batchSize) {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush collects the changed series and sends everything buffered.
+func (r *Reporter) Flush(ctx context.Context) error {
+	if r.closed.Load() {
+		return ErrReporterClosed
+	}
+	return r.flush(ctx)
+}
+
+// Close stops the background flushes and sends the remaining metrics, giving
+// up when ctx is done. An interrupted background request may be repeated, which
+// is harmless as gauges and cumulative counters are idempotent.
+func (r *Reporter) Close(ctx context.Context) error {
+	err := ErrReporterClosed
+	r.once.Do(func() {
+		r.closed.Store(true)
+		r.cancel()
+		<-r.stopped
+		err = r.flush(ctx)
+	})
+	return err
+}
+
+// Stats returns the reporter's counts.
+func (r *Reporter) Stats() ReporterStats {
+	r.bufMu.Lock()
+	buffered := len(r.buffer)
+	r.bufMu.Unlock()
+
+	return ReporterStats{
+		Sent:     r.sent.Load(),
+		Dropped:  r.dropped.Load(),
+		Failed:   r.failed.Load(),
+		Buffered: buffered,
+	}
+}
+
+func (r *Reporter) run(ctx context.Context) {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.kick:
+		}
+
+		if err := r.flush(ctx); err != nil && ctx.Err() == nil {
+			r.onError(err)
+		}
+	}
+}
+
+func (r *Reporter) flush(ctx context.Context) error {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.collect()
+
+	var errs []error
+	for {
+		batch := r.next()
+		if len(batch) == 0 {
+			return errors.Join(errs...)
+		}
+
+		err := r.push(ctx, batch)
+		switch {
+		case err == nil:
+			r.sent.Add(uint64(len(batch)))
+		case retryable(err):
+			// Keep the batch for the next flush.
+			r.requeue(batch)
+			return errors.Join(append(errs, err)...)
+		default:
+			r.failed.Add(uint64(len(batch)))
+			errs = append(errs, err)
+		}
+	}
+}
+
+// collect appends the series changed since the previous collection to the buffer.
+func (r *Reporter) collect() {
+	r.mu.Lock()
+	instruments := r.instruments
+	r.mu.Unlock()
+
+	r.changed.Store(0)
+
+	var metrics []Metric
+	for _, inst := range instruments {
+		metrics = inst.collect(metrics)
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+
+	r.buffer = append(r.buffer, metrics...)
+	r.trim()
+}
+
+// next removes and returns the oldest batch of buffered metrics.
+func (r *Reporter) next() []Metric {
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+
+	n := min(len(r.buffer), r.batchSize)
+	batch := slices.Clone(r.buffer[:n])
+	r.buffer = slices.Delete(r.buffer, 0, n)
+
+	return batch
+}
+
+// requeue puts a batch that could not be sent back at the head of the buffer.
+func (r *Reporter) requeue(batch []Metric) {
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+
+	r.buffer = append(batch, r.buffer...)
+	r.trim()
+}
+
+// trim enforces the buffer bound according to the drop policy.
+func (r *Reporter) trim() {
+	excess := len(r.buffer) - r.bufferSize
+	if excess <= 0 {
+		return
+	}
+
+	r.dropped.Add(uint64(excess))
+	if r.drop == DropNewest {
+		r.buffer = r.buffer[:r.bufferSize]
+		return
+	}
+	r.buffer = slices.Delete(r.buffer, 0, excess)
+}
+
+// push sends a batch, retrying transient failures with exponential backoff and
+// jitter. Every attempt carries the same idempotency key, so a batch applied by
+// an attempt whose answer was lost is not applied again.
+func (r *Reporter) push(ctx context.Context, batch []Metric) error {
+	key := NewIdempotencyKey()
+	backoff := r.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := r.client.PushWithKey(ctx, key, batch)
+		if err == nil || attempt >= r.maxRetries || !retryable(err) {
+			return err
+		}
+
+		wait := backoff/2 + rand.N(backoff/2+1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, r.maxBackoff)
+	}
+}
+
+// retryable reports whether a push error is transient: a transport error, a
+// server-side failure or a retry racing the original attempt. Other client
+// errors, such as a batch partially refused by cardinality limits, would fail again.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError ||
+			apiErr.StatusCode == http.StatusRequestTimeout || apiErr.StatusCode == http.StatusConflict
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer runs the real router behind a handler failing the first pushes
+// with the given status, counting gzip-encoded requests and recording the
+// idempotency keys of the pushes.
+type flakyServer struct {
+	failures atomic.Int64
+	status   int
+	gzipped  atomic.Int64
+	pushes   atomic.Int64
+
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func newFlakyServer(t *testing.T, status int, failures int64) (*flakyServer, *httptest.Server) {
+	t.Helper()
+
+	r, _ := newRouter(t)
+	fs := &flakyServer{status: status, keys: make(map[string]bool)}
+	fs.failures.Store(failures)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/update" {
+			fs.pushes.Add(1)
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				fs.gzipped.Add(1)
+			}
+			fs.mu.Lock()
+			fs.keys[req.Header.Get(HeaderIdempotencyKey)] = true
+			fs.mu.Unlock()
+			if fs.failures.Add(-1) >= 0 {
+				http.Error(w, http.StatusText(fs.status), fs.status)
+				return
+			}
+		}
+		r.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	return fs, srv
+}
+
+func TestReporter_Instruments(t *testing.T) {
+	srv, _ := newServer(t)
+	c, err := New(srv.URL, WithGzip())
+	require.NoError(t, err)
+
+	r := NewReporter(c, WithFlushInterval(time.Hour))
+
+	labels := map[string]string{"host": "a"}
+	r.Gauge("temperature", labels).Set(10)
+	r.Gauge("temperature", labels).Add(2.5)
+	r.Counter("requests", labels).Inc()
+	r.Counter("requests", labels).Add(2)
+	r.Counter("requests", labels).Add(-5)
+
+	latency := r.Histogram("latency", []float64{0.1, 1}, nil)
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.Observe(v)
+	}
+
+	require.NoError(t, r.Close(context.Background()))
+	require.ErrorIs(t, r.Flush(context.Background()), ErrReporterClosed)
+
+	samples, err := c.Values(context.Background(), "")
+	require.NoError(t, err)
+
+	values := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		values[s.Key] = s.Value
+	}
+	require.InDelta(t, 3.65, values["latency_sum"], 1e-9)
+	delete(values, "latency_sum")
+	require.Equal(t, map[string]float64{
+		`temperature{host="a"}`:     12.5,
+		`requests{host="a"}`:        3,
+		`latency_bucket{le="0.1"}`:  2,
+		`latency_bucket{le="1"}`:    3,
+		`latency_bucket{le="+Inf"}`: 4,
+		`latency_count`:             4,
+	}, values)
+
+	stats := r.Stats()
+	require.Equal(t, uint64(len(samples)), stats.Sent)
+	require.Zero(t, stats.Buffered)
+}
+
+func TestReporter_SendsOnlyChangedSeries(t *testing.T) {
+	fs, srv := newFlakyServer(t, http.StatusServiceUnavailable, 0)
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	r := NewReporter(c, WithFlushInterval(time.Hour))
+	defer func() {
+		_ = r.Close(context.Background())
+	}()
+
+	ctx := context.Background()
+	r.Gauge("a", nil).Set(1)
+	r.Gauge("b", nil).Set(1)
+	require.NoError(t, r.Flush(ctx))
+	require.Equal(t, uint64(2), r.Stats().Sent)
+
+	require.NoError(t, r.Flush(ctx))
+	require.Equal(t, int64(1), fs.pushes.Load())
+
+	r.Gauge("b", nil).Set(2)
+	require.NoError(t, r.Flush(ctx))
+	require.Equal(t, uint64(3), r.Stats().Sent)
+}
+
+func TestReporter_BatchSize(t *testing.T) {
+	fs, srv := newFlakyServer(t, http.StatusServiceUnavailable, 0)
+	c, err := New(srv.URL, WithGzip())
+	require.NoError(t, err)
+
+	r := NewReporter(c, WithFlushInterval(time.Hour), WithBatchSize(2))
+	defer func() {
+		_ = r.Close(context.Background())
+	}()
+
+	r.Gauge("a", nil).Set(1)
+	r.Gauge("b", nil).Set(1)
+
+	require.Eventually(t, func() bool {
+		return r.Stats().Sent == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), fs.gzipped.Load())
+
+	// A histogram flushed on its own is split into requests of batch size.
+	r.Histogram("latency", []float64{1, 2}, nil).Observe(1)
+	require.NoError(t, r.Flush(context.Background()))
+	require.Equal(t, int64(4), fs.pushes.Load())
+}
+
+func TestReporter_Retry(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		failures   int64
+		maxRetries int
+		wantErr    bool
+		pushes     int64
+		expected   ReporterStats
+	}{
+		{
+			name:       "recovers within retries",
+			status:     http.StatusServiceUnavailable,
+			failures:   2,
+			maxRetries: 2,
+			pushes:     3,
+			expected:   ReporterStats{Sent: 1},
+		},
+		{
+			name:       "retries exhausted keeps the batch",
+			status:     http.StatusBadGateway,
+			failures:   3,
+			maxRetries: 1,
+			wantErr:    true,
+			pushes:     2,
+			expected:   ReporterStats{Buffered: 1},
+		},
+		{
+			name:       "client error is not retried",
+			status:     http.StatusBadRequest,
+			failures:   1,
+			maxRetries: 3,
+			wantErr:    true,
+			pushes:     1,
+			expected:   ReporterStats{Failed: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, srv := newFlakyServer(t, tt.status, tt.failures)
+			c, err := New(srv.URL)
+			require.NoError(t, err)
+
+			r := NewReporter(c, WithFlushInterval(time.Hour), WithRetry(tt.maxRetries, time.Millisecond, 2*time.Millisecond))
+			defer func() {
+				_ = r.Close(context.Background())
+			}()
+
+			r.Gauge("cpu", nil).Set(1)
+			err = r.Flush(context.Background())
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expected, r.Stats())
+			require.Equal(t, tt.pushes, fs.pushes.Load())
+			require.Len(t, fs.keys, 1, "attempts of a batch share its idempotency key")
+			require.NotContains(t, fs.keys, "")
+		})
+	}
+}
+
+func TestReporter_DropPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   DropPolicy
+		expected []string
+	}{
+		{name: "drop oldest", policy: DropOldest, expected: []string{"c", "d"}},
+		{name: "drop newest", policy: DropNewest, expected: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFlakyServer(t, http.StatusServiceUnavailable, 100)
+			c, err := New(srv.URL)
+			require.NoError(t, err)
+
+			r := NewReporter(c,
+				WithFlushInterval(time.Hour),
+				WithBatchSize(10),
+				WithBufferSize(2, tt.policy),
+				WithRetry(0, time.Millisecond, time.Millisecond),
+			)
+			defer func() {
+				_ = r.Close(context.Background())
+			}()
+
+			for _, name := range []string{"a", "b", "c", "d"} {
+				r.Gauge(name, nil).Set(1)
+			}
+			require.Error(t, r.Flush(context.Background()))
+
+			stats := r.Stats()
+			require.Equal(t, uint64(2), stats.Dropped)
+			require.Equal(t, 2, stats.Buffered)
+
+			names := make([]string, 0, len(r.buffer))
+			for _, m := range r.buffer {
+				names = append(names, m.Name)
+			}
+			require.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestReporter_CloseSendsBufferedMetrics(t *testing.T) {
+	fs, srv := newFlakyServer(t, http.StatusServiceUnavailable, 1)
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	r := NewReporter(c, WithFlushInterval(time.Hour), WithRetry(0, time.Millisecond, time.Millisecond))
+
+	r.Counter("requests", nil).Inc()
+	require.Error(t, r.Flush(context.Background()))
+	require.Equal(t, 1, r.Stats().Buffered)
+
+	r.Counter("requests", nil).Inc()
+	require.NoError(t, r.Close(context.Background()))
+	require.Equal(t, ReporterStats{Sent: 2}, r.Stats())
+	require.Equal(t, int64(2), fs.pushes.Load())
+}